@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessCacheTTL is how long the access resolved for a personal access
+// token or share link is reused before the user is looked up again.
+const accessCacheTTL = 30 * time.Second
+
+// accessCache remembers how a user resolved when they act without a
+// session, so scripts pulling many layers do not ask the directory for
+// every request.
+type accessCache struct {
+	mu      sync.Mutex
+	entries map[string]accessCacheEntry
+}
+
+type accessCacheEntry struct {
+	lookup    sessionLookup
+	expiresAt time.Time
+}
+
+var accessLookups = &accessCache{entries: make(map[string]accessCacheEntry)}
+
+// resolveLogin looks the user up again the way they logged in: password
+// logins ask the AUTH_BACKENDS chain, single sign-on maps the groups the
+// identity provider sent with the current mapping and grants.
+func resolveLogin(source, username string, groups []string) (*User, []Access, error) {
+	switch source {
+	case loginSourceOIDC:
+		return oidcGroupAccess(username, groups)
+	case loginSourceSAML:
+		return samlGroupAccess(username, groups)
+	case loginSourcePassword:
+		return lookupAccess(username)
+	default:
+		return nil, nil, errLookupUnsupported
+	}
+}
+
+func (c *accessCache) key(source, username string, groups []string) string {
+	// The prefix is lowercased so flush finds every spelling.
+	return strings.ToLower(username) + "\x00" + source + "\x00" + strings.Join(groups, "\n")
+}
+
+// resolve returns what resolveLogin answers, reusing an answer younger
+// than accessCacheTTL. Failures to ask are not cached.
+func (c *accessCache) resolve(source, username string, groups []string, now time.Time) (*User, []Access, error) {
+	key := c.key(source, username, groups)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || !now.Before(entry.expiresAt) {
+		entry = accessCacheEntry{expiresAt: now.Add(accessCacheTTL)}
+		entry.lookup.user, entry.lookup.access, entry.lookup.err = resolveLogin(source, username, groups)
+		if entry.lookup.err != nil && !accountGone(entry.lookup.err) {
+			return nil, nil, entry.lookup.err
+		}
+		c.mu.Lock()
+		for k, e := range c.entries {
+			if !now.Before(e.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		c.entries[key] = entry
+		c.mu.Unlock()
+	}
+	if entry.lookup.err != nil {
+		return nil, nil, entry.lookup.err
+	}
+	u := *entry.lookup.user
+	access, _ := activeAccess(append([]Access(nil), entry.lookup.access...), now)
+	return &u, access, nil
+}
+
+// flush drops cached answers for username, or every answer when username
+// is empty.
+func (c *accessCache) flush(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := strings.ToLower(username) + "\x00"
+	for k := range c.entries {
+		if username == "" || strings.HasPrefix(k, prefix) {
+			delete(c.entries, k)
+		}
+	}
+}
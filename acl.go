@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	aclActionPush   = "push"
+	aclActionDelete = "delete"
+
+	aclEffectAllow = "allow"
+	aclEffectDeny  = "deny"
+)
+
+// aclRuleFile is the on-disk format of ACL_RULES_FILE.
+type aclRuleFile struct {
+	Rules []aclRule `json:"rules"`
+}
+
+// aclRule narrows namespace access for manifest pushes and deletes. Rules
+// are checked in order and the first one that matches decides. Rules can
+// only take access away: allow stops evaluation, but the namespace still
+// has to grant the capability.
+type aclRule struct {
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags"`
+	Actions    []string `json:"actions"`
+	Groups     []string `json:"groups"`
+	Effect     string   `json:"effect"`
+
+	repo *regexp.Regexp
+	tags []*regexp.Regexp
+}
+
+var repoACL []aclRule
+
+func loadACLRules(path string) ([]aclRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		return nil, fmt.Errorf("acl rules: %w", err)
+	}
+	var file aclRuleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("acl rules %s: %w", path, err)
+	}
+	rules, err := compileACLRules(file.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("acl rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func compileACLRules(rules []aclRule) ([]aclRule, error) {
+	compiled := make([]aclRule, 0, len(rules))
+	for i, rule := range rules {
+		if strings.TrimSpace(rule.Repository) == "" {
+			return nil, fmt.Errorf("rule %d needs a repository", i)
+		}
+		rule.Effect = strings.ToLower(strings.TrimSpace(rule.Effect))
+		if rule.Effect != aclEffectAllow && rule.Effect != aclEffectDeny {
+			return nil, fmt.Errorf("rule %d: unknown effect %q", i, rule.Effect)
+		}
+		for _, action := range rule.Actions {
+			if action != aclActionPush && action != aclActionDelete {
+				return nil, fmt.Errorf("rule %d: unknown action %q", i, action)
+			}
+		}
+		rule.repo = globRegexp(rule.Repository)
+		rule.tags = nil
+		for _, tag := range rule.Tags {
+			rule.tags = append(rule.tags, globRegexp(tag))
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// globRegexp compiles a glob where * matches within one path segment and
+// ** matches across segments.
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func isDigestReference(ref string) bool {
+	return strings.Contains(ref, ":")
+}
+
+func (rule aclRule) matches(groups []string, repo, ref, action string) bool {
+	if len(rule.Actions) > 0 && !containsString(rule.Actions, action) {
+		return false
+	}
+	if !rule.repo.MatchString(repo) {
+		return false
+	}
+	if len(rule.Groups) > 0 && !anyGroupMatches(rule.Groups, groups) {
+		return false
+	}
+	if len(rule.tags) == 0 {
+		return true
+	}
+	if isDigestReference(ref) {
+		// A delete by digest removes every tag pointing at it, and we
+		// cannot tell which those are, so tag-scoped rules still apply.
+		// Pushes by digest create no tag and are left alone.
+		return action == aclActionDelete
+	}
+	for _, tag := range rule.tags {
+		if tag.MatchString(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyGroupMatches(want, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if strings.EqualFold(w, h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aclAllows applies the first matching rule. Without a match the namespace
+// decision stands.
+func aclAllows(rules []aclRule, groups []string, repo, ref, action string) bool {
+	for _, rule := range rules {
+		if rule.matches(groups, repo, ref, action) {
+			return rule.Effect == aclEffectAllow
+		}
+	}
+	return true
+}
+
+// manifestACLRequest reports the repository, reference and ACL action of a
+// manifest PUT or DELETE. Other requests are not subject to ACL rules.
+func manifestACLRequest(r *http.Request) (repo, ref, action string, ok bool) {
+	switch r.Method {
+	case http.MethodPut:
+		action = aclActionPush
+	case http.MethodDelete:
+		action = aclActionDelete
+	default:
+		return "", "", "", false
+	}
+	rest, found := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !found {
+		return "", "", "", false
+	}
+	idx := strings.LastIndex(rest, "/manifests/")
+	if idx <= 0 {
+		return "", "", "", false
+	}
+	repo = rest[:idx]
+	ref = rest[idx+len("/manifests/"):]
+	if ref == "" || strings.Contains(ref, "/") {
+		return "", "", "", false
+	}
+	return repo, ref, action, true
+}
+
+func accessGroups(access []Access) []string {
+	var groups []string
+	seen := map[string]bool{}
+	for _, entry := range access {
+		if entry.Group == "" || seen[entry.Group] {
+			continue
+		}
+		seen[entry.Group] = true
+		groups = append(groups, entry.Group)
+	}
+	return groups
+}
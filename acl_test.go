@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		value string
+		want  bool
+	}{
+		{"team1/prod/*", "team1/prod/app", true},
+		{"team1/prod/*", "team1/prod/app/worker", false},
+		{"team1/prod/**", "team1/prod/app/worker", true},
+		{"team1/app", "team1/app", true},
+		{"team1/app", "team1/apps", false},
+		{"v*", "v1.2.3", true},
+		{"release-*", "release-2024.1", true},
+		{"release-*", "v1", false},
+		{"v?", "v1", true},
+	}
+	for _, tt := range tests {
+		if got := globRegexp(tt.glob).MatchString(tt.value); got != tt.want {
+			t.Fatalf("glob %q on %q: expected %v, got %v", tt.glob, tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestManifestACLRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "/v2/team1/prod/app/manifests/v1", nil)
+	repo, ref, action, ok := manifestACLRequest(req)
+	if !ok || repo != "team1/prod/app" || ref != "v1" || action != aclActionPush {
+		t.Fatalf("unexpected result: %q %q %q %v", repo, ref, action, ok)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/v2/team1/app/manifests/v1", nil)
+	if _, _, _, ok := manifestACLRequest(req); ok {
+		t.Fatalf("expected GET to be ignored")
+	}
+	req = httptest.NewRequest(http.MethodPut, "/v2/team1/app/blobs/uploads/abc", nil)
+	if _, _, _, ok := manifestACLRequest(req); ok {
+		t.Fatalf("expected blob upload to be ignored")
+	}
+}
+
+func TestAuthorizeAppliesACLRules(t *testing.T) {
+	withACLRules(t, []aclRule{
+		{Repository: "team1/app", Tags: []string{"v*"}, Actions: []string{"push", "delete"}, Groups: []string{"team1-release"}, Effect: "allow"},
+		{Repository: "team1/app", Tags: []string{"v*"}, Effect: "deny"},
+		{Repository: "team1/prod/**", Actions: []string{"delete"}, Effect: "deny"},
+	})
+
+	developer := []Access{{Group: "team1_rwd", Namespace: "team1", DeleteAllowed: true}}
+	release := append([]Access{{Group: "team1-release", Namespace: "team1", PullOnly: true}}, developer...)
+
+	tests := []struct {
+		name   string
+		access []Access
+		method string
+		path   string
+		want   bool
+	}{
+		{"developer pushes dev tag", developer, http.MethodPut, "/v2/team1/app/manifests/dev-42", true},
+		{"developer pushes release tag", developer, http.MethodPut, "/v2/team1/app/manifests/v1.0", false},
+		{"release group pushes release tag", release, http.MethodPut, "/v2/team1/app/manifests/v1.0", true},
+		{"developer pushes by digest", developer, http.MethodPut, "/v2/team1/app/manifests/sha256:abc", true},
+		{"developer deletes by digest", developer, http.MethodDelete, "/v2/team1/app/manifests/sha256:abc", false},
+		{"release group deletes by digest", release, http.MethodDelete, "/v2/team1/app/manifests/sha256:abc", true},
+		{"pull is unaffected", developer, http.MethodGet, "/v2/team1/app/manifests/v1.0", true},
+		{"prod delete denied", release, http.MethodDelete, "/v2/team1/prod/api/manifests/sha256:abc", false},
+		{"prod push allowed", developer, http.MethodPut, "/v2/team1/prod/api/manifests/v2", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := authorize(tt.access, req); got != tt.want {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestACLAllowDoesNotWidenNamespaceAccess(t *testing.T) {
+	withACLRules(t, []aclRule{{Repository: "team1/**", Effect: "allow"}})
+	access := []Access{{Group: "team1_r", Namespace: "team1", PullOnly: true}}
+	req := httptest.NewRequest(http.MethodPut, "/v2/team1/app/manifests/v1", nil)
+	if authorize(access, req) {
+		t.Fatalf("expected allow rule not to grant push")
+	}
+}
+
+func TestAuthorizeTokenAppliesACLRules(t *testing.T) {
+	withACLRules(t, []aclRule{
+		{Repository: "team1/app", Tags: []string{"v*"}, Groups: []string{"team1-release"}, Effect: "allow"},
+		{Repository: "team1/app", Tags: []string{"v*"}, Effect: "deny"},
+	})
+	scopes := []tokenAccess{{Type: "repository", Name: "team1/app", Actions: []string{"pull", "push"}}}
+	req := httptest.NewRequest(http.MethodPut, "/v2/team1/app/manifests/v1", nil)
+
+	if authorizeToken(&tokenClaims{Access: scopes, Groups: []string{"team1_rw"}}, req) {
+		t.Fatalf("expected release tag push to be denied without the release group")
+	}
+	if !authorizeToken(&tokenClaims{Access: scopes, Groups: []string{"team1-release"}}, req) {
+		t.Fatalf("expected release group to push release tags")
+	}
+}
+
+func TestHandleTagDeleteProtectedByACL(t *testing.T) {
+	withACLRules(t, []aclRule{{Repository: "team1/*", Tags: []string{"v*"}, Actions: []string{"delete"}, Effect: "deny"}})
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("unexpected upstream request %s %s", r.Method, r.URL.Path)
+	})
+	defer cleanup()
+
+	router := cvRouter()
+	access := []Access{{Group: "team1_rwd", Namespace: "team1", DeleteAllowed: true}}
+	token := seedSessionWithAccess(t, "alice", access)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/api/tag?repo=team1/app&tag=v1", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestLoadACLRules(t *testing.T) {
+	if rules, err := loadACLRules(""); err != nil || rules != nil {
+		t.Fatalf("expected no rules without a path, got %v %v", rules, err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "acl.json")
+	data := `{"rules":[{"repository":"team1/app","tags":["v*"],"effect":"deny"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	rules, err := loadACLRules(path)
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("unexpected result: %v %v", rules, err)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"rules":[{"repository":"team1/app","effect":"maybe"}]}`), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if _, err := loadACLRules(bad); err == nil {
+		t.Fatalf("expected error for unknown effect")
+	}
+}
+
+func withACLRules(t *testing.T, rules []aclRule) {
+	t.Helper()
+	compiled, err := compileACLRules(rules)
+	if err != nil {
+		t.Fatalf("compile rules: %v", err)
+	}
+	prev := repoACL
+	repoACL = compiled
+	t.Cleanup(func() {
+		repoACL = prev
+	})
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/adapters/humachi"
@@ -22,6 +25,24 @@ func registerAPI(api huma.API) {
 	huma.Get(group, "/taginfo", handleTagInfo)
 	huma.Get(group, "/taglayers", handleTagLayers)
 	huma.Delete(group, "/tag", handleTagDelete)
+	huma.Delete(group, "/admin/auth-cache", handleAuthCacheFlush)
+	huma.Delete(group, "/admin/mfa/{username}", handleMFAReset)
+	huma.Delete(group, "/admin/sessions/{username}", handleSessionLogoutUser)
+	huma.Get(group, "/sessions", handleSessionList)
+	huma.Delete(group, "/sessions/{id}", handleSessionRevoke)
+	huma.Get(group, "/grants", handleGrantList)
+	huma.Post(group, "/grants", handleGrantCreate)
+	huma.Delete(group, "/grants/{id}", handleGrantRevoke)
+	huma.Get(group, "/shares", handleShareList)
+	huma.Post(group, "/shares", handleShareCreate)
+	huma.Delete(group, "/shares/{id}", handleShareRevoke)
+	huma.Get(group, "/tokens", handleTokenList)
+	huma.Post(group, "/tokens", handleTokenCreate)
+	huma.Delete(group, "/tokens/{id}", handleTokenRevoke)
+	huma.Get(group, "/robots", handleRobotList)
+	huma.Post(group, "/robots", handleRobotCreate)
+	huma.Post(group, "/robots/{id}/secret", handleRobotRotate)
+	huma.Delete(group, "/robots/{id}", handleRobotDelete)
 }
 
 func mustSession(ctx context.Context) sessionData {
@@ -32,13 +53,33 @@ func sessionMiddleware(api huma.API) func(huma.Context, func(huma.Context)) {
 	return func(ctx huma.Context, next func(huma.Context)) {
 		req, _ := humachi.Unwrap(ctx)
 
-		sess, ok := getSession(req)
+		var sess sessionData
+		var ok bool
+		if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+			// Scripts authenticate with a personal access token instead of
+			// the session cookie.
+			if sess, ok = personalTokenSession(req); !ok {
+				_ = huma.WriteErr(api, ctx, http.StatusUnauthorized, "invalid or insufficient token")
+				return
+			}
+		} else {
+			sess, ok = getSession(req)
+		}
 		if !ok || sess.User == nil {
-			_ = huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized")
-			return
+			// Public namespaces can be browsed read-only without a login.
+			if len(publicNamespaces) == 0 || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+				_ = huma.WriteErr(api, ctx, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			sess = anonymousSession()
+		}
+		// Drop temporary grants that expired or were revoked since login.
+		if access, pruned := activeAccess(sess.Access, time.Now()); pruned {
+			sess.Access = access
+			sess.Namespaces = namespacesFromAccess(access)
 		}
 
-		next(huma.WithValue(ctx, sessionContextKey{}, sess))
+		next(huma.WithValue(ctx, sessionContextKey{}, withPublicNamespaces(sess)))
 	}
 }
 
@@ -75,33 +116,35 @@ func requireNamespace(sess sessionData, namespace string) (string, error) {
 	return ns, nil
 }
 
-func namespaceFromRepo(repo string) (string, error) {
-	parts := strings.SplitN(repo, "/", 2)
-	if len(parts) < 2 {
+// namespaceFromRepo returns the most specific of namespaces that contains
+// repo, or "" when none does.
+func namespaceFromRepo(namespaces []string, repo string) (string, error) {
+	if !strings.Contains(repo, "/") {
 		return "", huma.Error400BadRequest("invalid repo")
 	}
-	return parts[0], nil
+	namespace, _ := mostSpecificNamespace(namespaces, repo)
+	return namespace, nil
 }
 
-func repoNamespace(repoInput string) (string, string, error) {
+func repoNamespace(namespaces []string, repoInput string) (string, string, error) {
 	repo := strings.TrimSpace(repoInput)
 	if repo == "" {
 		return "", "", huma.Error400BadRequest("missing repo")
 	}
-	namespace, err := namespaceFromRepo(repo)
+	namespace, err := namespaceFromRepo(namespaces, repo)
 	if err != nil {
 		return "", "", err
 	}
 	return repo, namespace, nil
 }
 
-func repoTagNamespace(repoInput, tagInput string) (string, string, string, error) {
+func repoTagNamespace(namespaces []string, repoInput, tagInput string) (string, string, string, error) {
 	repo := strings.TrimSpace(repoInput)
 	tag := strings.TrimSpace(tagInput)
 	if repo == "" || tag == "" {
 		return "", "", "", huma.Error400BadRequest("missing repo or tag")
 	}
-	namespace, err := namespaceFromRepo(repo)
+	namespace, err := namespaceFromRepo(namespaces, repo)
 	if err != nil {
 		return "", "", "", err
 	}
@@ -130,7 +173,7 @@ func handleCatalog(ctx context.Context, input *catalogInput) (*catalogOutput, er
 		return nil, err
 	}
 
-	repos, err := fetchCatalog(ctx, namespace)
+	repos, err := fetchCatalog(ctx, namespace, sess.Namespaces)
 	if err != nil {
 		return nil, huma.Error502BadGateway("registry unavailable")
 	}
@@ -165,7 +208,7 @@ func handleRepos(ctx context.Context, input *reposInput) (*reposOutput, error) {
 		return nil, err
 	}
 
-	repos, err := fetchRepos(ctx, namespace)
+	repos, err := fetchRepos(ctx, namespace, sess.Namespaces)
 	if err != nil {
 		return nil, huma.Error502BadGateway("registry unavailable")
 	}
@@ -194,7 +237,7 @@ type tagsOutput struct {
 func handleTags(ctx context.Context, input *tagsInput) (*tagsOutput, error) {
 	sess := mustSession(ctx)
 
-	repo, namespace, err := repoNamespace(input.Repo)
+	repo, namespace, err := repoNamespace(sess.Namespaces, input.Repo)
 	if err != nil {
 		return nil, err
 	}
@@ -227,7 +270,7 @@ type tagInfoOutput struct {
 func handleTagInfo(ctx context.Context, input *tagInfoInput) (*tagInfoOutput, error) {
 	sess := mustSession(ctx)
 
-	repo, tag, namespace, err := repoTagNamespace(input.Repo, input.Tag)
+	repo, tag, namespace, err := repoTagNamespace(sess.Namespaces, input.Repo, input.Tag)
 	if err != nil {
 		return nil, err
 	}
@@ -255,7 +298,7 @@ type tagLayersOutput struct {
 func handleTagLayers(ctx context.Context, input *tagLayersInput) (*tagLayersOutput, error) {
 	sess := mustSession(ctx)
 
-	repo, tag, namespace, err := repoTagNamespace(input.Repo, input.Tag)
+	repo, tag, namespace, err := repoTagNamespace(sess.Namespaces, input.Repo, input.Tag)
 	if err != nil {
 		return nil, err
 	}
@@ -292,16 +335,19 @@ func ToHuma(code int, msg string) error {
 func handleTagDelete(ctx context.Context, input *tagDeleteInput) (*tagDeleteOutput, error) {
 	sess := mustSession(ctx)
 
-	repo, tag, namespace, err := repoTagNamespace(input.Repo, input.Tag)
+	repo, tag, namespace, err := repoTagNamespace(sess.Namespaces, input.Repo, input.Tag)
 	if err != nil {
 		return nil, err
 	}
 	if !namespaceAllowed(sess.Namespaces, namespace) {
 		return nil, huma.Error403Forbidden("namespace not allowed")
 	}
-	if !namespaceDeleteAllowed(sess.Access, namespace) {
+	if !namespaceCan(sess.Access, namespace, capDeleteTag) {
 		return nil, huma.Error403Forbidden("delete not allowed")
 	}
+	if !aclAllows(repoACL, accessGroups(sess.Access), repo, tag, aclActionDelete) {
+		return nil, huma.Error403Forbidden("tag protected by access rule")
+	}
 
 	digest, status, message, err := fetchTagDigest(ctx, repo, tag)
 	if err != nil {
@@ -329,3 +375,787 @@ func handleTagDelete(ctx context.Context, input *tagDeleteInput) (*tagDeleteOutp
 		},
 	}, nil
 }
+
+type authCacheFlushInput struct {
+	Username string `query:"username"`
+}
+
+type authCacheFlushPayload struct {
+	Flushed int `json:"flushed"`
+}
+
+type authCacheFlushOutput struct {
+	Body authCacheFlushPayload
+}
+
+func requireAdmin(sess sessionData) error {
+	if !isAdminUser(sess.User.Name) {
+		return huma.Error403Forbidden("admin required")
+	}
+	return nil
+}
+
+func handleAuthCacheFlush(ctx context.Context, input *authCacheFlushInput) (*authCacheFlushOutput, error) {
+	sess := mustSession(ctx)
+	if err := requireAdmin(sess); err != nil {
+		return nil, err
+	}
+
+	flushed := authCache.flush(strings.TrimSpace(input.Username))
+	accessLookups.flush(strings.TrimSpace(input.Username))
+	return &authCacheFlushOutput{
+		Body: authCacheFlushPayload{Flushed: flushed},
+	}, nil
+}
+
+type mfaResetInput struct {
+	Username string `path:"username"`
+}
+
+type mfaResetPayload struct {
+	Username string `json:"username"`
+}
+
+type mfaResetOutput struct {
+	Body mfaResetPayload
+}
+
+// handleMFAReset removes the second factor of a user who lost their
+// authenticator and recovery codes. They can enroll again afterwards.
+func handleMFAReset(ctx context.Context, input *mfaResetInput) (*mfaResetOutput, error) {
+	sess := mustSession(ctx)
+	if err := requireAdmin(sess); err != nil {
+		return nil, err
+	}
+	if err := mfaEnrollments.remove(input.Username, sess.User.Name, time.Now()); err != nil {
+		return nil, huma.Error404NotFound("two-factor authentication is not enabled for this user")
+	}
+	return &mfaResetOutput{Body: mfaResetPayload{Username: input.Username}}, nil
+}
+
+// canManageGrants reports whether the session may hand out or revoke
+// temporary grants on namespace. Admins always can; otherwise the session
+// needs manage-access from a permanent grant, so a temporary grant can
+// never be used to extend itself. A namespace without a grant of its own
+// inherits from the most specific granted parent, as repositories do.
+func canManageGrants(sess sessionData, namespace string) bool {
+	if sess.Anonymous || sess.User == nil {
+		return false
+	}
+	if isAdminUser(sess.User.Name) {
+		return true
+	}
+	var permanent []Access
+	for _, entry := range sess.Access {
+		if entry.GrantID == "" {
+			permanent = append(permanent, entry)
+		}
+	}
+	if _, ok := namespaceCapabilities(permanent, namespace); !ok {
+		parent, ok := mostSpecificNamespace(namespacesFromAccess(permanent), namespace)
+		if !ok {
+			return false
+		}
+		namespace = parent
+	}
+	return namespaceCan(permanent, namespace, capManageAccess)
+}
+
+type grantCreateBody struct {
+	User       string `json:"user,omitempty"`
+	Group      string `json:"group,omitempty"`
+	Namespace  string `json:"namespace"`
+	Permission string `json:"permission"`
+	Duration   string `json:"duration" doc:"How long the grant lasts, e.g. 48h"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+type grantCreateInput struct {
+	Body grantCreateBody
+}
+
+type grantOutput struct {
+	Status int
+	Body   accessGrant
+}
+
+func handleGrantCreate(ctx context.Context, input *grantCreateInput) (*grantOutput, error) {
+	sess := mustSession(ctx)
+	req := input.Body
+
+	namespace := strings.TrimSpace(req.Namespace)
+	user := strings.TrimSpace(req.User)
+	group := strings.TrimSpace(req.Group)
+	if namespace == "" {
+		return nil, huma.Error400BadRequest("missing namespace")
+	}
+	if (user == "") == (group == "") {
+		return nil, huma.Error400BadRequest("set exactly one of user or group")
+	}
+	if isPersonalNamespace(namespace) {
+		return nil, huma.Error400BadRequest("personal namespaces cannot be shared")
+	}
+	if !canManageGrants(sess, namespace) {
+		return nil, huma.Error403Forbidden("grant not allowed")
+	}
+	if _, err := grantFromPermission(namespace, req.Permission); err != nil {
+		return nil, huma.Error400BadRequest(err.Error())
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(req.Duration))
+	if err != nil || duration <= 0 {
+		return nil, huma.Error400BadRequest("invalid duration")
+	}
+	if duration > grantMaxDuration {
+		return nil, huma.Error400BadRequest("duration exceeds " + grantMaxDuration.String())
+	}
+
+	now := time.Now()
+	grant, err := accessGrants.add(accessGrant{
+		User:       user,
+		Group:      group,
+		Namespace:  namespace,
+		Permission: strings.ToLower(strings.TrimSpace(req.Permission)),
+		Reason:     strings.TrimSpace(req.Reason),
+		CreatedBy:  sess.User.Name,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(duration),
+	})
+	if err != nil {
+		return nil, huma.Error500InternalServerError("unable to create grant")
+	}
+	return &grantOutput{Status: http.StatusCreated, Body: grant}, nil
+}
+
+type grantListInput struct {
+	Namespace string `query:"namespace"`
+}
+
+type grantListPayload struct {
+	Grants []accessGrant `json:"grants"`
+}
+
+type grantListOutput struct {
+	Body grantListPayload
+}
+
+func handleGrantList(ctx context.Context, input *grantListInput) (*grantListOutput, error) {
+	sess := mustSession(ctx)
+	namespace := strings.TrimSpace(input.Namespace)
+	if namespace != "" && !canManageGrants(sess, namespace) {
+		return nil, huma.Error403Forbidden("namespace not allowed")
+	}
+
+	grants := []accessGrant{}
+	for _, g := range accessGrants.list(time.Now()) {
+		if namespace != "" && g.Namespace != namespace {
+			continue
+		}
+		if canManageGrants(sess, g.Namespace) {
+			grants = append(grants, g)
+		}
+	}
+	return &grantListOutput{Body: grantListPayload{Grants: grants}}, nil
+}
+
+type grantRevokeInput struct {
+	ID string `path:"id"`
+}
+
+func handleGrantRevoke(ctx context.Context, input *grantRevokeInput) (*grantOutput, error) {
+	sess := mustSession(ctx)
+	grant, ok := accessGrants.get(input.ID)
+	if !ok {
+		return nil, huma.Error404NotFound("grant not found")
+	}
+	if !canManageGrants(sess, grant.Namespace) {
+		return nil, huma.Error403Forbidden("revoke not allowed")
+	}
+	grant, err := accessGrants.revoke(grant.ID, sess.User.Name, time.Now())
+	if err != nil {
+		return nil, huma.Error404NotFound("grant not found")
+	}
+	return &grantOutput{Status: http.StatusOK, Body: grant}, nil
+}
+
+// canManageShare reports whether the session may see or revoke link: its
+// creator, admins and whoever manages access to its namespace.
+func canManageShare(sess sessionData, link shareLink) bool {
+	if sess.Anonymous || sess.User == nil {
+		return false
+	}
+	return strings.EqualFold(link.CreatedBy, sess.User.Name) || canManageGrants(sess, link.Namespace)
+}
+
+type shareCreateBody struct {
+	Repo     string `json:"repo"`
+	Digest   string `json:"digest,omitempty" doc:"Limit the link to one image"`
+	Duration string `json:"duration" doc:"How long the link works, e.g. 24h"`
+	Note     string `json:"note,omitempty"`
+}
+
+type shareCreateInput struct {
+	Body shareCreateBody
+}
+
+// shareCreatePayload spells out the link fields: huma does not
+// serialize fields promoted from an embedded unexported struct.
+type shareCreatePayload struct {
+	ID         string    `json:"id"`
+	Repo       string    `json:"repo"`
+	Namespace  string    `json:"namespace"`
+	Digest     string    `json:"digest,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Credential string    `json:"credential"`
+}
+
+type shareCreateOutput struct {
+	Status int
+	Body   shareCreatePayload
+}
+
+func handleShareCreate(ctx context.Context, input *shareCreateInput) (*shareCreateOutput, error) {
+	sess := mustSession(ctx)
+	if sess.Anonymous {
+		return nil, huma.Error403Forbidden("login required")
+	}
+	repo, namespace, err := repoNamespace(sess.Namespaces, input.Body.Repo)
+	if err != nil {
+		return nil, err
+	}
+	if !namespaceAllowed(sess.Namespaces, namespace) || !namespaceCan(sess.Access, namespace, capPull) {
+		return nil, huma.Error403Forbidden("namespace not allowed")
+	}
+	digest := strings.TrimSpace(input.Body.Digest)
+	if digest != "" && !digestPattern.MatchString(digest) {
+		return nil, huma.Error400BadRequest("invalid digest")
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(input.Body.Duration))
+	if err != nil || duration <= 0 {
+		return nil, huma.Error400BadRequest("invalid duration")
+	}
+	if duration > shareMaxDuration {
+		return nil, huma.Error400BadRequest("duration exceeds " + shareMaxDuration.String())
+	}
+
+	now := time.Now()
+	expires := now.Add(duration)
+	// A link must not outlive the temporary grant it was created through.
+	if limit := namespaceExpiry(sess.Access, namespace); limit != nil && expires.After(*limit) {
+		return nil, huma.Error400BadRequest("duration exceeds your access to " + namespace)
+	}
+
+	link, err := shareLinks.add(shareLink{
+		Repo:      repo,
+		Namespace: namespace,
+		Digest:    digest,
+		Note:      strings.TrimSpace(input.Body.Note),
+		CreatedBy: sess.User.Name,
+		CreatedAt: now,
+		ExpiresAt: expires,
+		Source:    sess.Source,
+		Groups:    sess.Groups,
+	})
+	if err != nil {
+		return nil, huma.Error500InternalServerError("unable to create share link")
+	}
+	return &shareCreateOutput{
+		Status: http.StatusCreated,
+		Body: shareCreatePayload{
+			ID:         link.ID,
+			Repo:       link.Repo,
+			Namespace:  link.Namespace,
+			Digest:     link.Digest,
+			Note:       link.Note,
+			CreatedBy:  link.CreatedBy,
+			CreatedAt:  link.CreatedAt,
+			ExpiresAt:  link.ExpiresAt,
+			Credential: link.credential(),
+		},
+	}, nil
+}
+
+type shareListPayload struct {
+	Links []shareLink `json:"links"`
+}
+
+type shareListOutput struct {
+	Body shareListPayload
+}
+
+func handleShareList(ctx context.Context, _ *struct{}) (*shareListOutput, error) {
+	sess := mustSession(ctx)
+	links := []shareLink{}
+	for _, link := range shareLinks.list(time.Now()) {
+		if canManageShare(sess, link) {
+			links = append(links, link.public())
+		}
+	}
+	return &shareListOutput{Body: shareListPayload{Links: links}}, nil
+}
+
+type shareRevokeInput struct {
+	ID string `path:"id"`
+}
+
+type shareRevokeOutput struct {
+	Body shareLink
+}
+
+func handleShareRevoke(ctx context.Context, input *shareRevokeInput) (*shareRevokeOutput, error) {
+	sess := mustSession(ctx)
+	link, ok := shareLinks.get(input.ID)
+	if !ok {
+		return nil, huma.Error404NotFound("share link not found")
+	}
+	if !canManageShare(sess, link) {
+		return nil, huma.Error403Forbidden("revoke not allowed")
+	}
+	link, err := shareLinks.revoke(link.ID, sess.User.Name, time.Now())
+	if err != nil {
+		return nil, huma.Error404NotFound("share link not found")
+	}
+	return &shareRevokeOutput{Body: link.public()}, nil
+}
+
+type robotCreateBody struct {
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Permission  string `json:"permission"`
+	Duration    string `json:"duration,omitempty" doc:"Optional lifetime, e.g. 2160h; leave empty for no expiry"`
+	Description string `json:"description,omitempty"`
+}
+
+type robotCreateInput struct {
+	Body robotCreateBody
+}
+
+type robotSecretPayload struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Namespace   string     `json:"namespace"`
+	Permission  string     `json:"permission"`
+	Description string     `json:"description,omitempty"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Username    string     `json:"username"`
+	Secret      string     `json:"secret"`
+}
+
+func newRobotSecretPayload(robot robotAccount, secret string) robotSecretPayload {
+	return robotSecretPayload{
+		ID:          robot.ID,
+		Name:        robot.Name,
+		Namespace:   robot.Namespace,
+		Permission:  robot.Permission,
+		Description: robot.Description,
+		CreatedBy:   robot.CreatedBy,
+		CreatedAt:   robot.CreatedAt,
+		ExpiresAt:   robot.ExpiresAt,
+		Username:    robot.Username(),
+		Secret:      secret,
+	}
+}
+
+type robotSecretOutput struct {
+	Status int
+	Body   robotSecretPayload
+}
+
+func handleRobotCreate(ctx context.Context, input *robotCreateInput) (*robotSecretOutput, error) {
+	sess := mustSession(ctx)
+	req := input.Body
+
+	namespace := strings.TrimSpace(req.Namespace)
+	name := strings.ToLower(strings.TrimSpace(req.Name))
+	if namespace == "" {
+		return nil, huma.Error400BadRequest("missing namespace")
+	}
+	if !robotNamePattern.MatchString(name) {
+		return nil, huma.Error400BadRequest("invalid robot name")
+	}
+	if isPersonalNamespace(namespace) {
+		return nil, huma.Error400BadRequest("personal namespaces cannot have robot accounts")
+	}
+	if !canManageGrants(sess, namespace) {
+		return nil, huma.Error403Forbidden("robot account not allowed")
+	}
+	if _, err := grantFromPermission(namespace, req.Permission); err != nil {
+		return nil, huma.Error400BadRequest(err.Error())
+	}
+
+	now := time.Now()
+	robot := robotAccount{
+		Name:        name,
+		Namespace:   namespace,
+		Permission:  strings.ToLower(strings.TrimSpace(req.Permission)),
+		Description: strings.TrimSpace(req.Description),
+		CreatedBy:   sess.User.Name,
+		CreatedAt:   now,
+	}
+	if raw := strings.TrimSpace(req.Duration); raw != "" {
+		duration, err := time.ParseDuration(raw)
+		if err != nil || duration <= 0 {
+			return nil, huma.Error400BadRequest("invalid duration")
+		}
+		expires := now.Add(duration)
+		robot.ExpiresAt = &expires
+	}
+
+	robot, secret, err := robotAccounts.add(robot)
+	if errors.Is(err, errRobotExists) {
+		return nil, huma.Error409Conflict("robot account already exists")
+	}
+	if err != nil {
+		return nil, huma.Error500InternalServerError("unable to create robot account")
+	}
+	return &robotSecretOutput{
+		Status: http.StatusCreated,
+		Body:   newRobotSecretPayload(robot, secret),
+	}, nil
+}
+
+type robotListInput struct {
+	Namespace string `query:"namespace"`
+}
+
+type robotInfo struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Namespace   string     `json:"namespace"`
+	Permission  string     `json:"permission"`
+	Description string     `json:"description,omitempty"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+	Username    string     `json:"username"`
+	Expired     bool       `json:"expired"`
+}
+
+func newRobotInfo(robot robotAccount, now time.Time) robotInfo {
+	return robotInfo{
+		ID:          robot.ID,
+		Name:        robot.Name,
+		Namespace:   robot.Namespace,
+		Permission:  robot.Permission,
+		Description: robot.Description,
+		CreatedBy:   robot.CreatedBy,
+		CreatedAt:   robot.CreatedAt,
+		ExpiresAt:   robot.ExpiresAt,
+		LastUsed:    robot.LastUsed,
+		Username:    robot.Username(),
+		Expired:     robot.expired(now),
+	}
+}
+
+type robotListPayload struct {
+	Robots []robotInfo `json:"robots"`
+}
+
+type robotListOutput struct {
+	Body robotListPayload
+}
+
+func handleRobotList(ctx context.Context, input *robotListInput) (*robotListOutput, error) {
+	sess := mustSession(ctx)
+	namespace := strings.TrimSpace(input.Namespace)
+	if namespace != "" && !canManageGrants(sess, namespace) {
+		return nil, huma.Error403Forbidden("namespace not allowed")
+	}
+
+	now := time.Now()
+	robots := []robotInfo{}
+	for _, robot := range robotAccounts.list() {
+		if namespace != "" && robot.Namespace != namespace {
+			continue
+		}
+		if canManageGrants(sess, robot.Namespace) {
+			robots = append(robots, newRobotInfo(robot, now))
+		}
+	}
+	return &robotListOutput{Body: robotListPayload{Robots: robots}}, nil
+}
+
+type robotIDInput struct {
+	ID string `path:"id"`
+}
+
+func handleRobotRotate(ctx context.Context, input *robotIDInput) (*robotSecretOutput, error) {
+	sess := mustSession(ctx)
+	robot, ok := robotAccounts.get(input.ID)
+	if !ok {
+		return nil, huma.Error404NotFound("robot account not found")
+	}
+	if !canManageGrants(sess, robot.Namespace) {
+		return nil, huma.Error403Forbidden("rotate not allowed")
+	}
+	robot, secret, err := robotAccounts.rotate(robot.ID, sess.User.Name, time.Now())
+	if err != nil {
+		return nil, huma.Error404NotFound("robot account not found")
+	}
+	return &robotSecretOutput{
+		Status: http.StatusOK,
+		Body:   newRobotSecretPayload(robot, secret),
+	}, nil
+}
+
+type robotDeleteOutput struct {
+	Body robotAccount
+}
+
+func handleRobotDelete(ctx context.Context, input *robotIDInput) (*robotDeleteOutput, error) {
+	sess := mustSession(ctx)
+	robot, ok := robotAccounts.get(input.ID)
+	if !ok {
+		return nil, huma.Error404NotFound("robot account not found")
+	}
+	if !canManageGrants(sess, robot.Namespace) {
+		return nil, huma.Error403Forbidden("delete not allowed")
+	}
+	robot, err := robotAccounts.remove(robot.ID, sess.User.Name, time.Now())
+	if err != nil {
+		return nil, huma.Error404NotFound("robot account not found")
+	}
+	return &robotDeleteOutput{Body: robot.public()}, nil
+}
+
+// requireTokenManager refuses anonymous sessions and sessions that come
+// from a personal access token, so a token can never mint or outlive
+// another.
+func requireTokenManager(sess sessionData) error {
+	if sess.Anonymous || sess.User == nil {
+		return huma.Error403Forbidden("login required")
+	}
+	if sess.TokenID != "" {
+		return huma.Error403Forbidden("personal access tokens cannot manage tokens")
+	}
+	return nil
+}
+
+// The fields are optional for huma so that handleTokenCreate answers a
+// missing value with its own 400.
+type tokenCreateBody struct {
+	Name     string   `json:"name,omitempty"`
+	Duration string   `json:"duration,omitempty" doc:"How long the token works, e.g. 720h"`
+	Scopes   []string `json:"scopes,omitempty" doc:"api-read, api-write, registry-pull and/or registry-push"`
+}
+
+type tokenCreateInput struct {
+	Body tokenCreateBody
+}
+
+type tokenCreatePayload struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Token     string    `json:"token"`
+}
+
+type tokenCreateOutput struct {
+	Status int
+	Body   tokenCreatePayload
+}
+
+func handleTokenCreate(ctx context.Context, input *tokenCreateInput) (*tokenCreateOutput, error) {
+	sess := mustSession(ctx)
+	if err := requireTokenManager(sess); err != nil {
+		return nil, err
+	}
+	req := input.Body
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, huma.Error400BadRequest("missing name")
+	}
+	var scopes []string
+	for _, scope := range req.Scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !containsString(allTokenScopes, scope) {
+			return nil, huma.Error400BadRequest("unknown scope " + scope)
+		}
+		if !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, huma.Error400BadRequest("missing scopes")
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(req.Duration))
+	if err != nil || duration <= 0 {
+		return nil, huma.Error400BadRequest("invalid duration")
+	}
+	if duration > personalTokenMaxDuration {
+		return nil, huma.Error400BadRequest("duration exceeds " + personalTokenMaxDuration.String())
+	}
+
+	now := time.Now()
+	account := *sess.User
+	token, value, err := personalTokens.add(personalToken{
+		Name:      name,
+		Username:  sess.User.Name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+		Account:   &account,
+		Access:    sess.Access,
+		Source:    sess.Source,
+		Groups:    sess.Groups,
+	})
+	if err != nil {
+		return nil, huma.Error500InternalServerError("unable to create token")
+	}
+	return &tokenCreateOutput{
+		Status: http.StatusCreated,
+		Body: tokenCreatePayload{
+			ID:        token.ID,
+			Name:      token.Name,
+			Username:  token.Username,
+			Scopes:    token.Scopes,
+			CreatedAt: token.CreatedAt,
+			ExpiresAt: token.ExpiresAt,
+			Token:     value,
+		},
+	}, nil
+}
+
+type tokenListPayload struct {
+	Tokens []personalToken `json:"tokens"`
+}
+
+type tokenListOutput struct {
+	Body tokenListPayload
+}
+
+func handleTokenList(ctx context.Context, _ *struct{}) (*tokenListOutput, error) {
+	sess := mustSession(ctx)
+	tokens := []personalToken{}
+	if !sess.Anonymous {
+		for _, token := range personalTokens.list(sess.User.Name, time.Now()) {
+			tokens = append(tokens, token.public())
+		}
+	}
+	return &tokenListOutput{Body: tokenListPayload{Tokens: tokens}}, nil
+}
+
+type tokenRevokeInput struct {
+	ID string `path:"id"`
+}
+
+type tokenRevokeOutput struct {
+	Body personalToken
+}
+
+func handleTokenRevoke(ctx context.Context, input *tokenRevokeInput) (*tokenRevokeOutput, error) {
+	sess := mustSession(ctx)
+	if sess.Anonymous {
+		return nil, huma.Error403Forbidden("login required")
+	}
+	token, ok := personalTokens.get(input.ID)
+	if !ok {
+		return nil, huma.Error404NotFound("token not found")
+	}
+	if !strings.EqualFold(token.Username, sess.User.Name) && !isAdminUser(sess.User.Name) {
+		return nil, huma.Error403Forbidden("revoke not allowed")
+	}
+	token, err := personalTokens.revoke(token.ID, sess.User.Name, time.Now())
+	if err != nil {
+		return nil, huma.Error404NotFound("token not found")
+	}
+	return &tokenRevokeOutput{Body: token.public()}, nil
+}
+
+type sessionListPayload struct {
+	Sessions []sessionInfo `json:"sessions"`
+}
+
+type sessionListOutput struct {
+	Body sessionListPayload
+}
+
+func handleSessionList(ctx context.Context, _ *struct{}) (*sessionListOutput, error) {
+	sess := mustSession(ctx)
+	if sess.Anonymous {
+		return nil, huma.Error403Forbidden("login required")
+	}
+	sessions, err := userSessions(sess.User.Name)
+	if err != nil {
+		return nil, huma.Error500InternalServerError("unable to list sessions")
+	}
+	for i := range sessions {
+		sessions[i].Current = sess.ID != "" && sessions[i].ID == sess.ID
+	}
+	return &sessionListOutput{Body: sessionListPayload{Sessions: sessions}}, nil
+}
+
+type sessionRevokeInput struct {
+	ID string `path:"id"`
+}
+
+type sessionRevokePayload struct {
+	ID string `json:"id"`
+}
+
+type sessionRevokeOutput struct {
+	Body sessionRevokePayload
+}
+
+// handleSessionRevoke ends one of the caller's own sessions, for example
+// one left open on another machine.
+func handleSessionRevoke(ctx context.Context, input *sessionRevokeInput) (*sessionRevokeOutput, error) {
+	sess := mustSession(ctx)
+	if sess.Anonymous {
+		return nil, huma.Error403Forbidden("login required")
+	}
+	found, err := destroySessionByID(sess.User.Name, input.ID)
+	if err != nil {
+		return nil, huma.Error500InternalServerError("unable to revoke session")
+	}
+	if !found {
+		return nil, huma.Error404NotFound("session not found")
+	}
+	recordAudit(auditEvent{
+		Actor:   sess.User.Name,
+		Action:  "session.revoke",
+		Subject: "user:" + sess.User.Name,
+		Detail:  "session " + input.ID,
+	})
+	return &sessionRevokeOutput{Body: sessionRevokePayload{ID: input.ID}}, nil
+}
+
+type sessionLogoutInput struct {
+	Username string `path:"username"`
+}
+
+type sessionLogoutPayload struct {
+	Username string `json:"username"`
+	Ended    int    `json:"ended"`
+}
+
+type sessionLogoutOutput struct {
+	Body sessionLogoutPayload
+}
+
+// handleSessionLogoutUser ends every session of a user. With a shared
+// session store this covers all replicas.
+func handleSessionLogoutUser(ctx context.Context, input *sessionLogoutInput) (*sessionLogoutOutput, error) {
+	sess := mustSession(ctx)
+	if err := requireAdmin(sess); err != nil {
+		return nil, err
+	}
+	username := strings.TrimSpace(input.Username)
+	ended := destroyUserSessions(username)
+	recordAudit(auditEvent{
+		Actor:   sess.User.Name,
+		Action:  "session.logout",
+		Subject: "user:" + username,
+		Detail:  fmt.Sprintf("%d sessions ended", ended),
+	})
+	return &sessionLogoutOutput{Body: sessionLogoutPayload{Username: username, Ended: ended}}, nil
+}
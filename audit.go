@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvent is one line of the audit log.
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor,omitempty"`
+	Action    string    `json:"action"`
+	Namespace string    `json:"namespace,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// recordAudit writes event to the server log and, when AUDIT_LOG_FILE is
+// set, appends it to that file as a JSON line.
+func recordAudit(event auditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("audit: encode %s: %v", event.Action, err)
+		return
+	}
+	log.Printf("audit: %s", data)
+	if auditLogPath == "" {
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		log.Printf("audit: open %s: %v", auditLogPath, err)
+		return
+	}
+	defer f.Close() //nolint:errcheck
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("audit: write %s: %v", auditLogPath, err)
+	}
+}
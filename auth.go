@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 )
 
-var ldapAuth = ldapAuthenticateAccess
+// ldapAuth is the directory password check. It runs the AUTH_BACKENDS
+// chain, LDAP by default.
+var ldapAuth = func(username, password string) (*User, []Access, error) {
+	return authenticators.Authenticate(username, password)
+}
 
 func authenticate(w http.ResponseWriter, r *http.Request) (*User, []Access, bool) {
 	username, password, ok := r.BasicAuth()
@@ -15,7 +20,7 @@ func authenticate(w http.ResponseWriter, r *http.Request) (*User, []Access, bool
 		return nil, nil, false
 	}
 
-	u, access, err := ldapAuth(username, password)
+	u, access, err := registryAuth(username, password)
 	if err != nil {
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return nil, nil, false
@@ -24,6 +29,39 @@ func authenticate(w http.ResponseWriter, r *http.Request) (*User, []Access, bool
 	return u, access, true
 }
 
+// registryAuth checks registry credentials. Personal access tokens, robot
+// accounts and CI job tokens are verified locally; everything else goes to
+// the directory. A directory password cannot carry a second factor, so it
+// is refused for users who need one.
+func registryAuth(username, password string) (*User, []Access, error) {
+	if isPersonalTokenCredential(password) {
+		return personalTokenAuth(username, password)
+	}
+	if isWorkloadCredential(password) {
+		return workloadAuth(context.Background(), password)
+	}
+	if isRobotUsername(username) {
+		return robotAuth(username, password)
+	}
+	user, access, err := cachedLDAPAuth(username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mfaRequiredFor(user.Name) {
+		return nil, nil, errMFAPassword
+	}
+	return user, access, nil
+}
+
+func isAdminUser(name string) bool {
+	for _, admin := range adminUsers {
+		if strings.EqualFold(admin, name) {
+			return true
+		}
+	}
+	return false
+}
+
 func authorize(access []Access, r *http.Request) bool {
 	if !isSafeRequestPath(r) {
 		return false
@@ -33,58 +71,33 @@ func authorize(access []Access, r *http.Request) bool {
 	if r.URL.Path == "/v2/" {
 		return true
 	}
+	if publicPull(r) {
+		return true
+	}
 
-	// Path must be /v2/<namespace>/...
-	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+	// Path must be /v2/<namespace>/...; the most specific granted
+	// namespace covering the repository decides.
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
 		return false
 	}
-	rest := strings.TrimPrefix(r.URL.Path, "/v2/")
-	parts := strings.SplitN(rest, "/", 2)
-	if len(parts) < 2 || parts[0] == "" {
-		return false
+	repo, ok := repositoryFromPath(r.URL.Path)
+	if !ok {
+		repo = rest
 	}
-	namespace := parts[0]
-	pullOnly, deleteAllowed, ok := namespacePermissions(access, namespace)
+	namespace, ok := mostSpecificNamespace(namespacesFromAccess(access), repo)
 	if !ok {
 		return false
 	}
-
-	// Pull-only enforcement
-	if pullOnly {
-		switch r.Method {
-		case http.MethodGet, http.MethodHead:
-			return true
-		case http.MethodDelete:
-			return deleteAllowed
-		default:
-			return false
-		}
+	if !namespaceCan(access, namespace, registryCapability(r)) {
+		return false
 	}
-
-	if r.Method == http.MethodDelete {
-		return deleteAllowed
+	if repo, ref, action, ok := manifestACLRequest(r); ok {
+		return aclAllows(repoACL, accessGroups(access), repo, ref, action)
 	}
-
 	return true
 }
 
-func namespacePermissions(access []Access, namespace string) (pullOnly bool, deleteAllowed bool, ok bool) {
-	pullOnly = true
-	for _, entry := range access {
-		if entry.Namespace == "" || entry.Namespace != namespace {
-			continue
-		}
-		ok = true
-		if !entry.PullOnly {
-			pullOnly = false
-		}
-		if entry.DeleteAllowed {
-			deleteAllowed = true
-		}
-	}
-	return pullOnly, deleteAllowed, ok
-}
-
 func isSafeRequestPath(r *http.Request) bool {
 	raw := r.URL.RawPath
 	if raw == "" {
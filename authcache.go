@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialCache remembers successful directory lookups for registry Basic
+// Auth. Passwords are never stored; entries are keyed by the username and a
+// keyed hash of the password using a per-process random salt.
+type credentialCache struct {
+	mu      sync.Mutex
+	salt    []byte
+	entries map[string]credentialCacheEntry
+}
+
+type credentialCacheEntry struct {
+	user      *User
+	access    []Access
+	expiresAt time.Time
+}
+
+var authCache = newCredentialCache()
+
+func newCredentialCache() *credentialCache {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return &credentialCache{
+		salt:    salt,
+		entries: make(map[string]credentialCacheEntry),
+	}
+}
+
+func (c *credentialCache) key(username, password string) string {
+	mac := hmac.New(sha256.New, c.salt)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	// The prefix is lowercased so flush finds every spelling the
+	// directory accepted.
+	return strings.ToLower(username) + "\x00" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *credentialCache) get(username, password string, now time.Time) (*User, []Access, bool) {
+	key := c.key(username, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, nil, false
+	}
+	u := *entry.user
+	return &u, append([]Access(nil), entry.access...), true
+}
+
+func (c *credentialCache) put(username, password string, u *User, access []Access, expiresAt time.Time) {
+	key := c.key(username, password)
+	stored := *u
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = credentialCacheEntry{
+		user:      &stored,
+		access:    append([]Access(nil), access...),
+		expiresAt: expiresAt,
+	}
+}
+
+// flush drops cached entries for username, or every entry when username is
+// empty, and reports how many were removed.
+func (c *credentialCache) flush(username string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := strings.ToLower(username) + "\x00"
+	removed := 0
+	for k := range c.entries {
+		if username != "" && !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		delete(c.entries, k)
+		removed++
+	}
+	return removed
+}
+
+// cachedLDAPAuth consults the credential cache before asking the directory.
+// Only successful online lookups are cached; failures and offline fallbacks
+// always go back to LDAP.
+func cachedLDAPAuth(username, password string) (*User, []Access, error) {
+	now := time.Now()
+	if authCacheTTL > 0 {
+		if u, access, ok := authCache.get(username, password, now); ok {
+			access, _ = activeAccess(access, now)
+			return u, access, nil
+		}
+	}
+	u, access, degraded, err := directoryAuth(username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if authCacheTTL > 0 && !degraded {
+		authCache.put(username, password, u, access, now.Add(authCacheTTL))
+	}
+	if degraded {
+		access, _ = activeAccess(access, now)
+	}
+	return u, access, nil
+}
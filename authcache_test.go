@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCachedLDAPAuthReusesSuccess(t *testing.T) {
+	calls := withCachedAuth(t, time.Minute, nil)
+
+	for i := 0; i < 3; i++ {
+		u, access, err := cachedLDAPAuth("alice", "secret")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if u.Name != "alice" || len(access) != 1 || access[0].Namespace != "team1" {
+			t.Fatalf("unexpected result: %+v %+v", u, access)
+		}
+	}
+	if *calls != 1 {
+		t.Fatalf("expected 1 directory lookup, got %d", *calls)
+	}
+
+	if _, _, err := cachedLDAPAuth("alice", "other"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *calls != 2 {
+		t.Fatalf("expected different password to miss the cache, got %d lookups", *calls)
+	}
+}
+
+func TestCachedLDAPAuthDoesNotCacheFailures(t *testing.T) {
+	calls := withCachedAuth(t, time.Minute, errors.New("ldap bind failed"))
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := cachedLDAPAuth("alice", "wrong"); err == nil {
+			t.Fatalf("expected failure")
+		}
+	}
+	if *calls != 2 {
+		t.Fatalf("expected failures to reach the directory, got %d lookups", *calls)
+	}
+}
+
+func TestCredentialCacheExpiry(t *testing.T) {
+	cache := newCredentialCache()
+	now := time.Now()
+	cache.put("alice", "secret", &User{Name: "alice"}, nil, now.Add(time.Second))
+	if _, _, ok := cache.get("alice", "secret", now); !ok {
+		t.Fatalf("expected cache hit before expiry")
+	}
+	if _, _, ok := cache.get("alice", "secret", now.Add(2*time.Second)); ok {
+		t.Fatalf("expected cache miss after expiry")
+	}
+}
+
+func TestCredentialCacheFlush(t *testing.T) {
+	cache := newCredentialCache()
+	expires := time.Now().Add(time.Minute)
+	cache.put("alice", "a", &User{Name: "alice"}, nil, expires)
+	cache.put("Alice", "b", &User{Name: "Alice"}, nil, expires)
+	cache.put("bob", "c", &User{Name: "bob"}, nil, expires)
+
+	if n := cache.flush("ALICE"); n != 2 {
+		t.Fatalf("expected every spelling of alice to be flushed, got %d", n)
+	}
+	if _, _, ok := cache.get("bob", "c", time.Now()); !ok {
+		t.Fatalf("expected other users to stay cached")
+	}
+	if n := cache.flush(""); n != 1 {
+		t.Fatalf("expected 1 entry flushed, got %d", n)
+	}
+}
+
+func TestHandleAuthCacheFlushRequiresAdmin(t *testing.T) {
+	withCachedAuth(t, time.Minute, nil)
+	router := cvRouter()
+
+	token := seedSession(t, "alice", []string{"team1"})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/api/admin/auth-cache", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+
+	prevAdmins := adminUsers
+	adminUsers = []string{"alice"}
+	t.Cleanup(func() {
+		adminUsers = prevAdmins
+	})
+	if _, _, err := cachedLDAPAuth("bob", "secret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/admin/auth-cache?username=bob", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if _, _, ok := authCache.get("bob", "secret", time.Now()); ok {
+		t.Fatalf("expected bob to be flushed")
+	}
+}
+
+func withCachedAuth(t *testing.T, ttl time.Duration, authErr error) *int {
+	t.Helper()
+	calls := 0
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		calls++
+		if authErr != nil {
+			return nil, nil, authErr
+		}
+		return &User{Name: username}, []Access{{Namespace: "team1"}}, nil
+	}
+	prevTTL := authCacheTTL
+	prevCache := authCache
+	authCacheTTL = ttl
+	authCache = newCredentialCache()
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+		authCacheTTL = prevTTL
+		authCache = prevCache
+	})
+	return &calls
+}
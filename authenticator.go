@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// authenticator checks a username and password against one user
+// directory and resolves the user's namespace access.
+type authenticator interface {
+	Authenticate(username, password string) (*User, []Access, error)
+}
+
+// authChain tries its authenticators in order; the first one that accepts
+// the credentials wins.
+type authChain []authenticator
+
+// accessResolver is implemented by authenticators that can resolve a
+// user's access again without the password, for session revalidation.
+// canLookup reports whether the backend is configured to do so.
+type accessResolver interface {
+	Lookup(username string) (*User, []Access, error)
+	canLookup() bool
+}
+
+var (
+	errUnknownUser       = errors.New("unknown user")
+	errNoAccess          = errors.New("no authorized groups")
+	errLookupUnsupported = errors.New("backend cannot look users up without a password")
+)
+
+// accountGone reports whether a lookup found that the user no longer
+// exists or has no authorized groups, as opposed to failing to ask.
+func accountGone(err error) bool {
+	return errors.Is(err, errUnknownUser) || errors.Is(err, errNoAccess)
+}
+
+// lookupError combines the errors of looking a user up in several places.
+// The account only counts as gone when every place said so.
+func lookupError(errs []error) error {
+	if len(errs) == 0 {
+		return errLookupUnsupported
+	}
+	for _, err := range errs {
+		if !accountGone(err) {
+			return err
+		}
+	}
+	return errs[0]
+}
+
+func (c authChain) Authenticate(username, password string) (*User, []Access, error) {
+	if len(c) == 0 {
+		return nil, nil, errors.New("no authentication backend configured")
+	}
+	if len(c) == 1 {
+		return c[0].Authenticate(username, password)
+	}
+	var errs []error
+	for _, a := range c {
+		user, access, err := a.Authenticate(username, password)
+		if err == nil {
+			return user, access, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// Lookup resolves username in the backends in order; the first one that
+// knows the user wins.
+func (c authChain) Lookup(username string) (*User, []Access, error) {
+	var errs []error
+	for _, a := range c {
+		r, ok := a.(accessResolver)
+		if !ok {
+			errs = append(errs, errLookupUnsupported)
+			continue
+		}
+		user, access, err := r.Lookup(username)
+		if err == nil {
+			return user, access, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, nil, lookupError(errs)
+}
+
+// canLookup reports whether any backend in the chain can look users up.
+func (c authChain) canLookup() bool {
+	for _, a := range c {
+		if r, ok := a.(accessResolver); ok && r.canLookup() {
+			return true
+		}
+	}
+	return false
+}
+
+type ldapAuthenticator struct{}
+
+func (ldapAuthenticator) Authenticate(username, password string) (*User, []Access, error) {
+	return ldapAuthenticateAccess(username, password)
+}
+
+func (ldapAuthenticator) Lookup(username string) (*User, []Access, error) {
+	return ldapLookupAccess(username)
+}
+
+// canLookup needs LDAP_BIND_DN on at least one directory.
+func (ldapAuthenticator) canLookup() bool {
+	for _, cfg := range ldapDirectories() {
+		if cfg.BindDN != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var authenticators authChain = authChain{ldapAuthenticator{}}
+
+// newAuthChain builds the chain named in AUTH_BACKENDS.
+func newAuthChain(names []string, fileCfg FileAuthConfig) (authChain, error) {
+	var chain authChain
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if seen[name] {
+			return nil, fmt.Errorf("auth backend %s is listed twice", name)
+		}
+		seen[name] = true
+		switch name {
+		case "ldap":
+			chain = append(chain, ldapAuthenticator{})
+		case "file":
+			a, err := newFileAuthenticator(fileCfg)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, a)
+		default:
+			return nil, fmt.Errorf("unknown auth backend %q", name)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("AUTH_BACKENDS lists no backend")
+	}
+	return chain, nil
+}
@@ -16,7 +16,10 @@ const manifestAcceptHeader = "application/vnd.docker.distribution.manifest.v2+js
 	"application/vnd.oci.image.manifest.v1+json," +
 	"application/vnd.oci.image.index.v1+json"
 
-func fetchCatalog(ctx context.Context, namespace string) ([]repoInfo, error) {
+// fetchCatalog lists the repositories under namespace with their tags.
+// Repositories that belong to a more specific namespace in namespaces are
+// left out; they are listed under that namespace instead.
+func fetchCatalog(ctx context.Context, namespace string, namespaces []string) ([]repoInfo, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
 
 	catalogURL := upstream.ResolveReference(&url.URL{Path: "/v2/_catalog"})
@@ -42,9 +45,8 @@ func fetchCatalog(ctx context.Context, namespace string) ([]repoInfo, error) {
 	}
 
 	var repos []repoInfo
-	prefix := namespace + "/"
 	for _, repo := range cat.Repositories {
-		if !strings.HasPrefix(repo, prefix) {
+		if !repoOwnedBy(namespaces, namespace, repo) {
 			continue
 		}
 		tagsURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/tags/list"})
@@ -74,7 +76,7 @@ func fetchCatalog(ctx context.Context, namespace string) ([]repoInfo, error) {
 	return repos, nil
 }
 
-func fetchRepos(ctx context.Context, namespace string) ([]string, error) {
+func fetchRepos(ctx context.Context, namespace string, namespaces []string) ([]string, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
 
 	catalogURL := upstream.ResolveReference(&url.URL{Path: "/v2/_catalog"})
@@ -100,9 +102,8 @@ func fetchRepos(ctx context.Context, namespace string) ([]string, error) {
 	}
 
 	var repos []string
-	prefix := namespace + "/"
 	for _, repo := range cat.Repositories {
-		if strings.HasPrefix(repo, prefix) {
+		if repoOwnedBy(namespaces, namespace, repo) {
 			repos = append(repos, repo)
 		}
 	}
@@ -28,7 +28,7 @@ func TestFetchCatalogFiltersAndTags(t *testing.T) {
 	})
 	defer cleanup()
 
-	repos, err := fetchCatalog(context.Background(), "team1")
+	repos, err := fetchCatalog(context.Background(), "team1", nil)
 	if err != nil {
 		t.Fatalf("fetchCatalog: %v", err)
 	}
@@ -53,7 +53,7 @@ func TestFetchCatalogStatusError(t *testing.T) {
 	})
 	defer cleanup()
 
-	_, err := fetchCatalog(context.Background(), "team1")
+	_, err := fetchCatalog(context.Background(), "team1", nil)
 	if err == nil || !strings.Contains(err.Error(), "catalog status") {
 		t.Fatalf("expected catalog status error, got %v", err)
 	}
@@ -70,7 +70,7 @@ func TestFetchReposFilters(t *testing.T) {
 	})
 	defer cleanup()
 
-	repos, err := fetchRepos(context.Background(), "team1")
+	repos, err := fetchRepos(context.Background(), "team1", nil)
 	if err != nil {
 		t.Fatalf("fetchRepos: %v", err)
 	}
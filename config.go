@@ -3,12 +3,54 @@ package main
 import (
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	upstream = mustParse("http://registry:5000")
-	ldapCfg  = loadLDAPConfig()
+	upstream   = mustParse("http://registry:5000")
+	ldapCfg    = loadLDAPConfig()
+	ldapDirs   = loadLDAPDirectories(ldapCfg)
+	tokenCfg   = loadTokenConfig()
+	offlineCfg = loadOfflineConfig()
+	oidcCfg    = loadOIDCConfig()
+	samlCfg    = loadSAMLConfig()
+	fileCfg    = loadFileAuthConfig()
+	sessionCfg = loadSessionConfig()
+
+	authCacheTTL = getEnvDuration("AUTH_CACHE_TTL", 0)
+	authBackends = splitCommaList(getEnv("AUTH_BACKENDS", "ldap"))
+	aclRulesPath = getEnv("ACL_RULES_FILE", "")
+	adminUsers   = splitCommaList(getEnv("ADMIN_USERS", ""))
+
+	personalNamespaces      = getEnvBool("PERSONAL_NAMESPACES", false)
+	personalNamespacePrefix = getEnv("PERSONAL_NAMESPACE_PREFIX", "u-")
+
+	publicNamespaces = splitCommaList(getEnv("PUBLIC_NAMESPACES", ""))
+
+	auditLogPath       = getEnv("AUDIT_LOG_FILE", "")
+	grantStorePath     = getEnv("GRANT_STORE_PATH", "")
+	grantMaxDuration   = getEnvDuration("GRANT_MAX_DURATION", 7*24*time.Hour)
+	grantSweepInterval = getEnvDuration("GRANT_SWEEP_INTERVAL", time.Minute)
+
+	shareLinkKey     = getEnv("SHARE_LINK_KEY", "")
+	shareStorePath   = getEnv("SHARE_LINK_STORE_PATH", "")
+	shareMaxDuration = getEnvDuration("SHARE_LINK_MAX_DURATION", 7*24*time.Hour)
+
+	robotStorePath = getEnv("ROBOT_STORE_PATH", "")
+
+	workloadIdentityPath = getEnv("WORKLOAD_IDENTITY_FILE", "")
+
+	scimToken     = getEnv("SCIM_TOKEN", "")
+	scimStorePath = getEnv("SCIM_STORE_PATH", "")
+
+	mfaMode      = strings.ToLower(getEnv("MFA_MODE", mfaModeOptional))
+	mfaStorePath = getEnv("MFA_STORE_PATH", "")
+	mfaIssuer    = getEnv("MFA_ISSUER", "ContainerVault")
+
+	personalTokenStorePath   = getEnv("PERSONAL_TOKEN_STORE_PATH", "")
+	personalTokenMaxDuration = getEnvDuration("PERSONAL_TOKEN_MAX_DURATION", 90*24*time.Hour)
 )
 
 func mustParse(s string) *url.URL {
@@ -20,8 +62,14 @@ func mustParse(s string) *url.URL {
 }
 
 func loadLDAPConfig() LDAPConfig {
+	urls := splitCommaList(getEnv("LDAP_URL", "ldaps://ldap:389"))
+	primary := ""
+	if len(urls) > 0 {
+		primary = urls[0]
+	}
 	return LDAPConfig{
-		URL:             getEnv("LDAP_URL", "ldaps://ldap:389"),
+		URL:             primary,
+		URLs:            urls,
 		BaseDN:          getEnv("LDAP_BASE_DN", "dc=glauth,dc=com"),
 		UserFilter:      getEnv("LDAP_USER_FILTER", "(mail=%s)"),
 		GroupAttribute:  getEnv("LDAP_GROUP_ATTRIBUTE", "memberOf"),
@@ -29,6 +77,133 @@ func loadLDAPConfig() LDAPConfig {
 		UserMailDomain:  getEnv("LDAP_USER_DOMAIN", "@example.com"),
 		StartTLS:        getEnvBool("LDAP_STARTTLS", false),
 		SkipTLSVerify:   getEnvBool("LDAP_SKIP_TLS_VERIFY", true),
+		BindDN:          getEnv("LDAP_BIND_DN", ""),
+		BindPassword:    getEnv("LDAP_BIND_PASSWORD", ""),
+		UserAttribute:   getEnv("LDAP_USER_ATTRIBUTE", ""),
+
+		GroupResolution:       splitCommaList(getEnv("LDAP_GROUP_RESOLUTION", "memberof")),
+		GroupBaseDN:           getEnv("LDAP_GROUP_BASE_DN", ""),
+		GroupMemberAttributes: splitCommaList(getEnv("LDAP_GROUP_MEMBER_ATTRIBUTES", "member,uniqueMember")),
+		GroupMappingFile:      getEnv("LDAP_GROUP_MAPPING_FILE", ""),
+
+		ServerSelection: getEnv("LDAP_SERVER_SELECTION", "ordered"),
+		ServerBackoff:   getEnvDuration("LDAP_SERVER_BACKOFF", 30*time.Second),
+		DialTimeout:     getEnvDuration("LDAP_DIAL_TIMEOUT", 5*time.Second),
+		PoolSize:        getEnvInt("LDAP_POOL_SIZE", 4),
+		PoolIdleTimeout: getEnvDuration("LDAP_POOL_IDLE_TIMEOUT", time.Minute),
+	}
+}
+
+// loadLDAPDirectories returns the directories named in LDAP_DIRECTORIES.
+// Each one reads LDAP_<NAME>_* variables and falls back to the global
+// LDAP_* settings in base for anything it does not override. Without
+// LDAP_DIRECTORIES it returns nil and ldapCfg is used on its own.
+func loadLDAPDirectories(base LDAPConfig) []LDAPConfig {
+	names := splitCommaList(getEnv("LDAP_DIRECTORIES", ""))
+	if len(names) == 0 {
+		return nil
+	}
+	dirs := make([]LDAPConfig, 0, len(names))
+	for _, name := range names {
+		dirs = append(dirs, loadLDAPDirectory(name, base))
+	}
+	return dirs
+}
+
+func loadLDAPDirectory(name string, base LDAPConfig) LDAPConfig {
+	prefix := "LDAP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	cfg := base
+	cfg.Name = name
+	cfg.Domains = splitCommaList(getEnv(prefix+"DOMAINS", ""))
+	cfg.URLs = splitCommaList(getEnv(prefix+"URL", strings.Join(base.URLs, ",")))
+	cfg.URL = ""
+	if len(cfg.URLs) > 0 {
+		cfg.URL = cfg.URLs[0]
+	}
+	cfg.BaseDN = getEnv(prefix+"BASE_DN", base.BaseDN)
+	cfg.UserFilter = getEnv(prefix+"USER_FILTER", base.UserFilter)
+	cfg.GroupAttribute = getEnv(prefix+"GROUP_ATTRIBUTE", base.GroupAttribute)
+	cfg.GroupNamePrefix = getEnv(prefix+"GROUP_PREFIX", base.GroupNamePrefix)
+	cfg.UserMailDomain = getEnv(prefix+"USER_DOMAIN", base.UserMailDomain)
+	cfg.StartTLS = getEnvBool(prefix+"STARTTLS", base.StartTLS)
+	cfg.SkipTLSVerify = getEnvBool(prefix+"SKIP_TLS_VERIFY", base.SkipTLSVerify)
+	cfg.BindDN = getEnv(prefix+"BIND_DN", base.BindDN)
+	cfg.BindPassword = getEnv(prefix+"BIND_PASSWORD", base.BindPassword)
+	cfg.UserAttribute = getEnv(prefix+"USER_ATTRIBUTE", base.UserAttribute)
+	cfg.GroupResolution = splitCommaList(getEnv(prefix+"GROUP_RESOLUTION", strings.Join(base.GroupResolution, ",")))
+	cfg.GroupBaseDN = getEnv(prefix+"GROUP_BASE_DN", base.GroupBaseDN)
+	cfg.GroupMappingFile = getEnv(prefix+"GROUP_MAPPING_FILE", base.GroupMappingFile)
+	return cfg
+}
+
+func loadTokenConfig() TokenConfig {
+	return TokenConfig{
+		Enabled:        getEnvBool("TOKEN_AUTH_ENABLE", false),
+		Realm:          getEnv("TOKEN_REALM", "https://localhost/token"),
+		Service:        getEnv("TOKEN_SERVICE", "container-vault"),
+		Issuer:         getEnv("TOKEN_ISSUER", "container-vault"),
+		TTL:            getEnvDuration("TOKEN_TTL", 5*time.Minute),
+		SigningKeyPath: getEnv("TOKEN_SIGNING_KEY", ""),
+	}
+}
+
+func loadOIDCConfig() OIDCConfig {
+	return OIDCConfig{
+		Issuer:           strings.TrimSuffix(getEnv("OIDC_ISSUER", ""), "/"),
+		ClientID:         getEnv("OIDC_CLIENT_ID", ""),
+		ClientSecret:     getEnv("OIDC_CLIENT_SECRET", ""),
+		RedirectURL:      getEnv("OIDC_REDIRECT_URL", "https://localhost/oidc/callback"),
+		Scopes:           splitCommaList(getEnv("OIDC_SCOPES", "openid,profile,email")),
+		UsernameClaim:    getEnv("OIDC_USERNAME_CLAIM", "preferred_username"),
+		GroupsClaim:      getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		GroupPrefix:      getEnv("OIDC_GROUP_PREFIX", ldapCfg.GroupNamePrefix),
+		GroupMappingFile: getEnv("OIDC_GROUP_MAPPING_FILE", ldapCfg.GroupMappingFile),
+		ProviderName:     getEnv("OIDC_PROVIDER_NAME", "single sign-on"),
+	}
+}
+
+func loadSAMLConfig() SAMLConfig {
+	return SAMLConfig{
+		RootURL:           strings.TrimSuffix(getEnv("SAML_ROOT_URL", ""), "/"),
+		EntityID:          getEnv("SAML_ENTITY_ID", ""),
+		IDPMetadataURL:    getEnv("SAML_IDP_METADATA_URL", ""),
+		IDPMetadataFile:   getEnv("SAML_IDP_METADATA_FILE", ""),
+		CertFile:          getEnv("SAML_CERT_FILE", ""),
+		KeyFile:           getEnv("SAML_KEY_FILE", ""),
+		UsernameAttribute: getEnv("SAML_USERNAME_ATTRIBUTE", ""),
+		GroupsAttribute:   getEnv("SAML_GROUPS_ATTRIBUTE", "groups"),
+		GroupPrefix:       getEnv("SAML_GROUP_PREFIX", ldapCfg.GroupNamePrefix),
+		GroupMappingFile:  getEnv("SAML_GROUP_MAPPING_FILE", ldapCfg.GroupMappingFile),
+		ProviderName:      getEnv("SAML_PROVIDER_NAME", "SAML"),
+	}
+}
+
+func loadSessionConfig() SessionConfig {
+	return SessionConfig{
+		Store:              strings.ToLower(getEnv("SESSION_STORE", sessionStoreMemory)),
+		Path:               getEnv("SESSION_STORE_PATH", "sessions.db"),
+		RedisURL:           getEnv("SESSION_REDIS_URL", "redis://localhost:6379/0"),
+		RedisPrefix:        getEnv("SESSION_REDIS_PREFIX", "cv:session:"),
+		Lifetime:           getEnvDuration("SESSION_LIFETIME", 30*time.Minute),
+		IdleTimeout:        getEnvDuration("SESSION_IDLE_TIMEOUT", 0),
+		RevalidateInterval: getEnvDuration("SESSION_REVALIDATE_INTERVAL", 5*time.Minute),
+	}
+}
+
+func loadFileAuthConfig() FileAuthConfig {
+	return FileAuthConfig{
+		HtpasswdFile:     getEnv("FILE_AUTH_HTPASSWD", ""),
+		GroupsFile:       getEnv("FILE_AUTH_GROUPS", ""),
+		GroupPrefix:      getEnv("FILE_AUTH_GROUP_PREFIX", ldapCfg.GroupNamePrefix),
+		GroupMappingFile: getEnv("FILE_AUTH_GROUP_MAPPING_FILE", ldapCfg.GroupMappingFile),
+	}
+}
+
+func loadOfflineConfig() OfflineConfig {
+	return OfflineConfig{
+		GracePeriod: getEnvDuration("OFFLINE_GRACE_PERIOD", 0),
+		Mode:        getEnv("OFFLINE_MODE", offlineModeReadOnly),
+		StorePath:   getEnv("OFFLINE_STORE_PATH", ""),
 	}
 }
 
@@ -46,3 +221,23 @@ func getEnvBool(key string, def bool) bool {
 	}
 	return def
 }
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err == nil && d > 0 {
+			return d
+		}
+	}
+	return def
+}
+
+func getEnvInt(key string, def int) int {
+	if v, ok := os.LookupEnv(key); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err == nil && n >= 0 {
+			return n
+		}
+	}
+	return def
+}
@@ -65,3 +65,31 @@ func unsetEnv(t *testing.T, key string) {
 		_ = os.Unsetenv(key)
 	})
 }
+
+func TestLoadLDAPDirectories(t *testing.T) {
+	base := LDAPConfig{URLs: []string{"ldaps://ldap:389"}, BaseDN: "dc=glauth,dc=com", GroupNamePrefix: "team"}
+
+	unsetEnv(t, "LDAP_DIRECTORIES")
+	if dirs := loadLDAPDirectories(base); dirs != nil {
+		t.Fatalf("expected no directories without LDAP_DIRECTORIES, got %+v", dirs)
+	}
+
+	t.Setenv("LDAP_DIRECTORIES", "corp, acme-ad")
+	t.Setenv("LDAP_ACME_AD_URL", "ldaps://dc1.acme,ldaps://dc2.acme")
+	t.Setenv("LDAP_ACME_AD_BASE_DN", "dc=acme,dc=com")
+	t.Setenv("LDAP_ACME_AD_DOMAINS", "acme.com")
+	dirs := loadLDAPDirectories(base)
+	if len(dirs) != 2 {
+		t.Fatalf("expected 2 directories, got %d", len(dirs))
+	}
+	if dirs[0].Name != "corp" || dirs[0].BaseDN != base.BaseDN || dirs[0].URL != "ldaps://ldap:389" {
+		t.Fatalf("expected corp to inherit global settings, got %+v", dirs[0])
+	}
+	acme := dirs[1]
+	if acme.Name != "acme-ad" || acme.BaseDN != "dc=acme,dc=com" || acme.URL != "ldaps://dc1.acme" || len(acme.URLs) != 2 {
+		t.Fatalf("unexpected acme directory: %+v", acme)
+	}
+	if len(acme.Domains) != 1 || acme.Domains[0] != "acme.com" || acme.GroupNamePrefix != "team" {
+		t.Fatalf("unexpected acme directory: %+v", acme)
+	}
+}
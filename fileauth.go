@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// fileGroupsFile is the on-disk format of FILE_AUTH_GROUPS: group names
+// with their member usernames.
+type fileGroupsFile struct {
+	Groups map[string][]string `yaml:"groups"`
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// fileAuthenticator checks passwords against an htpasswd file and takes
+// group membership from a YAML file. Both files are read again when they
+// change on disk.
+type fileAuthenticator struct {
+	cfg FileAuthConfig
+
+	mu            sync.Mutex
+	htpasswdStamp fileStamp
+	groupsStamp   fileStamp
+	hashes        map[string]string
+	groups        map[string][]string
+}
+
+var errFileAuth = errors.New("invalid credentials")
+
+func newFileAuthenticator(cfg FileAuthConfig) (*fileAuthenticator, error) {
+	if cfg.HtpasswdFile == "" || cfg.GroupsFile == "" {
+		return nil, errors.New("file auth needs FILE_AUTH_HTPASSWD and FILE_AUTH_GROUPS")
+	}
+	if _, err := groupMapperFor(cfg.GroupMappingFile); err != nil {
+		return nil, err
+	}
+	a := &fileAuthenticator{cfg: cfg}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// reloadLocked reads both files if either changed since the last load. A
+// broken edit keeps the previous contents in use.
+func (a *fileAuthenticator) reloadLocked() error {
+	htpasswdStamp, err := statFile(a.cfg.HtpasswdFile)
+	if err != nil {
+		return fmt.Errorf("htpasswd: %w", err)
+	}
+	groupsStamp, err := statFile(a.cfg.GroupsFile)
+	if err != nil {
+		return fmt.Errorf("groups file: %w", err)
+	}
+	if a.hashes != nil && htpasswdStamp == a.htpasswdStamp && groupsStamp == a.groupsStamp {
+		return nil
+	}
+	// Remember the stamps even on failure so a broken file is reported
+	// once, not on every login.
+	a.htpasswdStamp, a.groupsStamp = htpasswdStamp, groupsStamp
+
+	hashes, err := loadHtpasswd(a.cfg.HtpasswdFile)
+	if err != nil {
+		return err
+	}
+	groups, err := loadFileGroups(a.cfg.GroupsFile)
+	if err != nil {
+		return err
+	}
+	a.hashes, a.groups = hashes, groups
+	return nil
+}
+
+func (a *fileAuthenticator) Authenticate(username, password string) (*User, []Access, error) {
+	if password == "" {
+		return nil, nil, fmt.Errorf("empty password for %s", username)
+	}
+	a.mu.Lock()
+	if err := a.reloadLocked(); err != nil {
+		log.Printf("file auth: keeping previous users: %v", err)
+	}
+	hash, ok := a.hashes[username]
+	groups := a.groups[username]
+	a.mu.Unlock()
+
+	if !ok {
+		// Spend the same time on unknown users as on wrong passwords.
+		_ = bcrypt.CompareHashAndPassword(dummyBcryptHash(), []byte(password))
+		return nil, nil, errFileAuth
+	}
+	if !checkPasswordHash(hash, password) {
+		return nil, nil, errFileAuth
+	}
+	return a.access(username, groups)
+}
+
+func (a *fileAuthenticator) canLookup() bool {
+	return true
+}
+
+// Lookup resolves the groups of username from the files without checking
+// a password.
+func (a *fileAuthenticator) Lookup(username string) (*User, []Access, error) {
+	a.mu.Lock()
+	if err := a.reloadLocked(); err != nil {
+		log.Printf("file auth: keeping previous users: %v", err)
+	}
+	_, ok := a.hashes[username]
+	groups := a.groups[username]
+	a.mu.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w %s", errUnknownUser, username)
+	}
+	return a.access(username, groups)
+}
+
+func (a *fileAuthenticator) access(username string, groups []string) (*User, []Access, error) {
+	mapper, err := groupMapperFor(a.cfg.GroupMappingFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, user := accessFromGroups(username, groups, a.cfg.GroupPrefix, mapper)
+	if user == nil {
+		return nil, nil, fmt.Errorf("%w for %s", errNoAccess, username)
+	}
+	return user, access, nil
+}
+
+// loadHtpasswd reads user:hash lines. Only bcrypt and argon2id hashes are
+// accepted; the weaker htpasswd formats are refused.
+func loadHtpasswd(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		return nil, fmt.Errorf("htpasswd: %w", err)
+	}
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("htpasswd %s line %d: expected user:hash", path, line)
+		}
+		if _, dup := hashes[username]; dup {
+			return nil, fmt.Errorf("htpasswd %s line %d: user %s is listed twice", path, line, username)
+		}
+		if err := validatePasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("htpasswd %s line %d: %w", path, line, err)
+		}
+		hashes[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("htpasswd %s: %w", path, err)
+	}
+	return hashes, nil
+}
+
+// loadFileGroups returns the groups of every user, sorted by name.
+func loadFileGroups(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		return nil, fmt.Errorf("groups file: %w", err)
+	}
+	var file fileGroupsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("groups file %s: %w", path, err)
+	}
+	groups := make(map[string][]string)
+	for group, members := range file.Groups {
+		if strings.TrimSpace(group) == "" {
+			return nil, fmt.Errorf("groups file %s: empty group name", path)
+		}
+		for _, member := range members {
+			if !containsString(groups[member], group) {
+				groups[member] = append(groups[member], group)
+			}
+		}
+	}
+	for member := range groups {
+		sort.Strings(groups[member])
+	}
+	return groups, nil
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func validatePasswordHash(hash string) error {
+	switch {
+	case isBcryptHash(hash):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash: %w", err)
+		}
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2idHash(hash)
+		return err
+	default:
+		return errors.New("unsupported hash; use bcrypt or argon2id")
+	}
+}
+
+func checkPasswordHash(hash, password string) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	params, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key))) // #nosec G115 -- key length comes from a decoded hash
+	return subtle.ConstantTimeCompare(key, params.key) == 1
+}
+
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2idHash reads the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>, with unpadded base64.
+func parseArgon2idHash(hash string) (argon2idParams, error) {
+	var p argon2idParams
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, errors.New("invalid argon2id parameters")
+	}
+	if p.memory == 0 || p.time == 0 || p.threads == 0 {
+		return p, errors.New("invalid argon2id parameters")
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, errors.New("invalid argon2id salt")
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return p, errors.New("invalid argon2id key")
+	}
+	return p, nil
+}
+
+var (
+	dummyBcryptOnce sync.Once
+	dummyBcrypt     []byte
+)
+
+func dummyBcryptHash() []byte {
+	dummyBcryptOnce.Do(func() {
+		dummyBcrypt, _ = bcrypt.GenerateFromPassword([]byte("container-vault"), bcrypt.DefaultCost)
+	})
+	return dummyBcrypt
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+	return string(hash)
+}
+
+func argon2idHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// writeFileAuth writes an htpasswd and a groups file and returns a config
+// pointing at them.
+func writeFileAuth(t *testing.T, htpasswd, groups string) FileAuthConfig {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := FileAuthConfig{
+		HtpasswdFile: filepath.Join(dir, "htpasswd"),
+		GroupsFile:   filepath.Join(dir, "groups.yaml"),
+		GroupPrefix:  "team",
+	}
+	if err := os.WriteFile(cfg.HtpasswdFile, []byte(htpasswd), 0o600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+	if err := os.WriteFile(cfg.GroupsFile, []byte(groups), 0o600); err != nil {
+		t.Fatalf("write groups: %v", err)
+	}
+	return cfg
+}
+
+// touch rewrites path with data and moves its modification time forward,
+// so the change is seen even on coarse file system clocks.
+func touch(t *testing.T, path, data string, at time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, at, at); err != nil {
+		t.Fatalf("chtimes %s: %v", path, err)
+	}
+}
+
+const testGroups = `groups:
+  team1_rw: [alice]
+  team2_r:
+    - alice
+    - bob
+`
+
+func TestFileAuthenticator(t *testing.T) {
+	htpasswd := "# users\nalice:" + bcryptHash(t, "secret") + "\nbob:" + argon2idHash("hunter2") + "\ncarol:" + bcryptHash(t, "pw") + "\n"
+	a, err := newFileAuthenticator(writeFileAuth(t, htpasswd, testGroups))
+	if err != nil {
+		t.Fatalf("new file authenticator: %v", err)
+	}
+
+	user, access, err := a.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatalf("alice: %v", err)
+	}
+	if user.Name != "alice" || !namespaceCan(access, "team1", capPush) || !namespaceCan(access, "team2", capPull) || namespaceCan(access, "team2", capPush) {
+		t.Fatalf("expected rw on team1 and r on team2, got %+v", access)
+	}
+	if _, access, err := a.Authenticate("bob", "hunter2"); err != nil || strings.Join(namespacesFromAccess(access), ",") != "team2" {
+		t.Fatalf("expected bob to log in with an argon2id hash, got %+v %v", access, err)
+	}
+
+	tests := map[string][2]string{
+		"wrong password": {"alice", "wrong"},
+		"unknown user":   {"mallory", "secret"},
+		"empty password": {"alice", ""},
+		"no groups":      {"carol", "pw"},
+		"argon2 wrong":   {"bob", "secret"},
+	}
+	for name, creds := range tests {
+		if _, _, err := a.Authenticate(creds[0], creds[1]); err == nil {
+			t.Fatalf("%s: expected the login to be refused", name)
+		}
+	}
+}
+
+func TestFileAuthenticatorReloads(t *testing.T) {
+	cfg := writeFileAuth(t, "alice:"+bcryptHash(t, "secret")+"\n", testGroups)
+	a, err := newFileAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("new file authenticator: %v", err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	touch(t, cfg.HtpasswdFile, "alice:"+bcryptHash(t, "changed")+"\n", later)
+	touch(t, cfg.GroupsFile, "groups:\n  team3_rw: [alice]\n", later)
+	if _, _, err := a.Authenticate("alice", "secret"); err == nil {
+		t.Fatalf("expected the old password to stop working")
+	}
+	_, access, err := a.Authenticate("alice", "changed")
+	if err != nil || strings.Join(namespacesFromAccess(access), ",") != "team3" {
+		t.Fatalf("expected the new password and groups, got %+v %v", access, err)
+	}
+
+	// A broken edit keeps the last good contents.
+	touch(t, cfg.HtpasswdFile, "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", later.Add(time.Minute))
+	if _, _, err := a.Authenticate("alice", "changed"); err != nil {
+		t.Fatalf("expected the previous users to stay in use: %v", err)
+	}
+}
+
+func TestLoadHtpasswdRejects(t *testing.T) {
+	tests := map[string]string{
+		"md5":       "alice:$apr1$abc$def\n",
+		"sha1":      "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n",
+		"plain":     "alice:secret\n",
+		"no hash":   "alice\n",
+		"duplicate": "alice:" + bcryptHash(t, "a") + "\nalice:" + bcryptHash(t, "b") + "\n",
+		"argon2i":   "alice:$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5\n",
+		"bad cost":  "alice:$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5\n",
+	}
+	for name, htpasswd := range tests {
+		if _, err := newFileAuthenticator(writeFileAuth(t, htpasswd, testGroups)); err == nil {
+			t.Fatalf("%s: expected the htpasswd file to be refused", name)
+		}
+	}
+	if _, err := newFileAuthenticator(writeFileAuth(t, "", "groups: [")); err == nil {
+		t.Fatalf("expected invalid YAML to be refused")
+	}
+	if _, err := newFileAuthenticator(FileAuthConfig{HtpasswdFile: "/does/not/exist"}); err == nil {
+		t.Fatalf("expected a missing groups file to be refused")
+	}
+}
+
+type fakeAuthenticator struct {
+	users map[string]string
+	calls int
+}
+
+func (f *fakeAuthenticator) Authenticate(username, password string) (*User, []Access, error) {
+	f.calls++
+	if ns, ok := f.users[username+":"+password]; ok {
+		return &User{Name: username, Namespace: ns}, []Access{{Namespace: ns}}, nil
+	}
+	return nil, nil, errors.New("rejected")
+}
+
+func TestAuthChainOrder(t *testing.T) {
+	first := &fakeAuthenticator{users: map[string]string{"alice:secret": "team1"}}
+	second := &fakeAuthenticator{users: map[string]string{"alice:secret": "team2", "bob:pw": "team3"}}
+	chain := authChain{first, second}
+
+	if user, _, err := chain.Authenticate("alice", "secret"); err != nil || user.Namespace != "team1" || second.calls != 0 {
+		t.Fatalf("expected the first backend to win, got %+v %v", user, err)
+	}
+	if user, _, err := chain.Authenticate("bob", "pw"); err != nil || user.Namespace != "team3" {
+		t.Fatalf("expected the second backend to be tried, got %+v %v", user, err)
+	}
+	if _, _, err := chain.Authenticate("bob", "wrong"); err == nil || strings.Count(err.Error(), "rejected") != 2 {
+		t.Fatalf("expected both rejections, got %v", err)
+	}
+}
+
+func TestNewAuthChain(t *testing.T) {
+	cfg := writeFileAuth(t, "alice:"+bcryptHash(t, "secret")+"\n", testGroups)
+	chain, err := newAuthChain([]string{"file", "LDAP"}, cfg)
+	if err != nil || len(chain) != 2 {
+		t.Fatalf("expected file then ldap, got %v %v", chain, err)
+	}
+	if _, ok := chain[0].(*fileAuthenticator); !ok {
+		t.Fatalf("expected the file backend first")
+	}
+	for _, names := range [][]string{nil, {"ldap", "ldap"}, {"kerberos"}} {
+		if _, err := newAuthChain(names, cfg); err == nil {
+			t.Fatalf("%v: expected the backend list to be refused", names)
+		}
+	}
+	if _, err := newAuthChain([]string{"file"}, FileAuthConfig{}); err == nil {
+		t.Fatalf("expected the file backend to need its files")
+	}
+}
+
+func TestLoginWithFileBackend(t *testing.T) {
+	cfg := writeFileAuth(t, "alice:"+bcryptHash(t, "secret")+"\n", testGroups)
+	chain, err := newAuthChain([]string{"file"}, cfg)
+	if err != nil {
+		t.Fatalf("new auth chain: %v", err)
+	}
+	prev := authenticators
+	authenticators = chain
+	t.Cleanup(func() {
+		authenticators = prev
+	})
+	withMFA(t, mfaModeOff)
+	withPersonalTokenStore(t)
+
+	form := url.Values{"username": {"alice"}, "password": {"secret"}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/api/dashboard" {
+		t.Fatalf("expected a login without LDAP, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if _, access, err := registryAuth("alice", "secret"); err != nil || !namespaceCan(access, "team1", capPush) {
+		t.Fatalf("expected registry access from the file backend, got %+v %v", access, err)
+	}
+}
+
+func TestAuthChainLookup(t *testing.T) {
+	cfg := writeFileAuth(t, "alice:"+bcryptHash(t, "secret")+"\ncarol:"+bcryptHash(t, "pw")+"\n", testGroups)
+	files, err := newFileAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("new file authenticator: %v", err)
+	}
+	if _, access, err := files.Lookup("alice"); err != nil || !namespaceCan(access, "team1", capPush) {
+		t.Fatalf("expected a lookup without the password, got %+v %v", access, err)
+	}
+	if _, _, err := files.Lookup("carol"); !accountGone(err) {
+		t.Fatalf("expected a user without groups to count as gone, got %v", err)
+	}
+	if _, _, err := files.Lookup("mallory"); !accountGone(err) {
+		t.Fatalf("expected an unknown user to count as gone, got %v", err)
+	}
+
+	// A backend that cannot answer keeps the account alive.
+	chain := authChain{files, &fakeAuthenticator{}}
+	if _, _, err := chain.Lookup("mallory"); err == nil || accountGone(err) {
+		t.Fatalf("expected an undecided lookup, got %v", err)
+	}
+	if _, _, err := (authChain{files}).Lookup("mallory"); !accountGone(err) {
+		t.Fatalf("expected the only backend to decide, got %v", err)
+	}
+
+	prevCfg, prevDirs := ldapCfg, ldapDirs
+	t.Cleanup(func() { ldapCfg, ldapDirs = prevCfg, prevDirs })
+	ldapCfg, ldapDirs = LDAPConfig{URL: "ldap://localhost"}, nil
+	if (authChain{ldapAuthenticator{}, &fakeAuthenticator{}}).canLookup() {
+		t.Fatalf("expected LDAP without a bind DN to be unable to look users up")
+	}
+	if !(authChain{ldapAuthenticator{}, files}).canLookup() {
+		t.Fatalf("expected the file backend to look users up")
+	}
+	ldapDirs = []LDAPConfig{{Name: "a"}, {Name: "b", BindDN: "cn=svc"}}
+	if !(authChain{ldapAuthenticator{}}).canLookup() {
+		t.Fatalf("expected a directory with a bind DN to look users up")
+	}
+}
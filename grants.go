@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// accessGrant gives a user or a group temporary access to a namespace on
+// top of what the directory grants.
+type accessGrant struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user,omitempty"`
+	Group      string    `json:"group,omitempty"`
+	Namespace  string    `json:"namespace"`
+	Permission string    `json:"permission"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+var errGrantNotFound = errors.New("grant not found")
+
+// matches reports whether the grant applies to username or one of groups.
+func (g accessGrant) matches(username string, groups []string) bool {
+	if g.User != "" {
+		return strings.EqualFold(g.User, username)
+	}
+	for _, group := range groups {
+		if strings.EqualFold(g.Group, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g accessGrant) access() Access {
+	// The permission was validated when the grant was created.
+	grant, _ := grantFromPermission(g.Namespace, g.Permission)
+	return Access{
+		Group:         g.Group,
+		Namespace:     g.Namespace,
+		PullOnly:      grant.pullOnly,
+		DeleteAllowed: grant.deleteAllowed,
+		Role:          grant.role,
+		GrantID:       g.ID,
+		ExpiresAt:     g.ExpiresAt,
+	}
+}
+
+// grantStore keeps the active grants. Expired and revoked grants are
+// removed from it; the audit log keeps their history.
+type grantStore struct {
+	jsonStore[accessGrant]
+}
+
+var accessGrants = newGrantStore(grantStorePath)
+
+func newGrantStore(path string) *grantStore {
+	store := &grantStore{}
+	store.load("grant store", path)
+	return store
+}
+
+func newGrantID() (string, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (s *grantStore) add(g accessGrant) (accessGrant, error) {
+	id, err := newGrantID()
+	if err != nil {
+		return accessGrant{}, err
+	}
+	g.ID = id
+
+	s.mu.Lock()
+	s.items[id] = g
+	s.saveLocked()
+	s.mu.Unlock()
+
+	recordAudit(auditEvent{
+		Time:      g.CreatedAt,
+		Actor:     g.CreatedBy,
+		Action:    "grant.create",
+		Namespace: g.Namespace,
+		Subject:   g.subject(),
+		Detail:    g.Permission + " until " + g.ExpiresAt.UTC().Format(time.RFC3339) + reasonSuffix(g.Reason),
+	})
+	return g, nil
+}
+
+func (s *grantStore) get(id string) (accessGrant, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.items[id]
+	return g, ok
+}
+
+func (s *grantStore) revoke(id, actor string, now time.Time) (accessGrant, error) {
+	s.mu.Lock()
+	g, ok := s.items[id]
+	if ok {
+		delete(s.items, id)
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return accessGrant{}, errGrantNotFound
+	}
+
+	recordAudit(auditEvent{
+		Time:      now,
+		Actor:     actor,
+		Action:    "grant.revoke",
+		Namespace: g.Namespace,
+		Subject:   g.subject(),
+		Detail:    g.ID,
+	})
+	return g, nil
+}
+
+// sweep drops grants that have expired and records each expiry.
+func (s *grantStore) sweep(now time.Time) int {
+	s.mu.Lock()
+	var expired []accessGrant
+	for id, g := range s.items {
+		if !now.Before(g.ExpiresAt) {
+			expired = append(expired, g)
+			delete(s.items, id)
+		}
+	}
+	if len(expired) > 0 {
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+
+	for _, g := range expired {
+		recordAudit(auditEvent{
+			Time:      now,
+			Action:    "grant.expire",
+			Namespace: g.Namespace,
+			Subject:   g.subject(),
+			Detail:    g.ID,
+		})
+	}
+	return len(expired)
+}
+
+// list returns the active grants, oldest first.
+func (s *grantStore) list(now time.Time) []accessGrant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]accessGrant, 0, len(s.items))
+	for _, g := range s.items {
+		if now.Before(g.ExpiresAt) {
+			out = append(out, g)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+func (s *grantStore) active(id string, now time.Time) bool {
+	g, ok := s.get(id)
+	return ok && now.Before(g.ExpiresAt)
+}
+
+// accessFor returns the access entries of every active grant for username
+// or one of groups.
+func (s *grantStore) accessFor(username string, groups []string, now time.Time) []Access {
+	var access []Access
+	for _, g := range s.list(now) {
+		if g.matches(username, groups) {
+			access = append(access, g.access())
+		}
+	}
+	return access
+}
+
+// activeAccess removes entries whose grant has expired or been revoked.
+// It returns access unchanged when nothing was removed.
+func activeAccess(access []Access, now time.Time) ([]Access, bool) {
+	kept := access
+	pruned := false
+	for i, entry := range access {
+		if entry.GrantID == "" || accessGrants.active(entry.GrantID, now) {
+			if pruned {
+				kept = append(kept, entry)
+			}
+			continue
+		}
+		if !pruned {
+			kept = append([]Access(nil), access[:i]...)
+			pruned = true
+		}
+	}
+	return kept, pruned
+}
+
+// namespaceExpiry returns when access to namespace ends, if it only comes
+// from temporary grants.
+func namespaceExpiry(access []Access, namespace string) *time.Time {
+	var latest time.Time
+	for _, entry := range access {
+		if entry.Namespace != namespace {
+			continue
+		}
+		if entry.GrantID == "" {
+			return nil
+		}
+		if entry.ExpiresAt.After(latest) {
+			latest = entry.ExpiresAt
+		}
+	}
+	if latest.IsZero() {
+		return nil
+	}
+	return &latest
+}
+
+// runGrantSweeper removes expired grants every interval until stop closes.
+func runGrantSweeper(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			accessGrants.sweep(now)
+		}
+	}
+}
+
+func (g accessGrant) subject() string {
+	if g.User != "" {
+		return "user:" + g.User
+	}
+	return "group:" + g.Group
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return " (" + reason + ")"
+}
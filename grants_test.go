@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessFromGroupsMergesGrants(t *testing.T) {
+	store := withGrantStore(t)
+	now := time.Now()
+	if _, err := store.add(accessGrant{User: "alice", Namespace: "team2", Permission: "rw", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+	if _, err := store.add(accessGrant{Group: "team1_r", Namespace: "team3", Permission: "r", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+	if _, err := store.add(accessGrant{User: "bob", Namespace: "team4", Permission: "rwd", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+
+	access, user := accessFromGroups("alice", []string{"cn=team1_r,dc=corp"}, "team", nil)
+	if user == nil || user.Namespace != "team2" {
+		t.Fatalf("expected the rw grant to be the primary namespace, got %+v", user)
+	}
+	got := namespacesFromAccess(access)
+	sort.Strings(got)
+	if strings.Join(got, ",") != "team1,team2,team3" {
+		t.Fatalf("unexpected namespaces: %v", got)
+	}
+	if !namespaceCan(access, "team2", capPush) || namespaceCan(access, "team3", capPush) {
+		t.Fatalf("unexpected grant capabilities: %+v", access)
+	}
+	for _, entry := range access[1:] {
+		if entry.GrantID == "" || entry.ExpiresAt.IsZero() {
+			t.Fatalf("expected grant entries to carry id and expiry: %+v", entry)
+		}
+	}
+
+	// A user with nothing but a grant can still log in.
+	if _, user := accessFromGroups("bob", nil, "team", nil); user == nil || user.Namespace != "team4" {
+		t.Fatalf("expected bob to log in through the grant, got %+v", user)
+	}
+}
+
+func TestActiveAccessDropsExpiredAndRevokedGrants(t *testing.T) {
+	store := withGrantStore(t)
+	now := time.Now()
+	short, _ := store.add(accessGrant{User: "alice", Namespace: "team2", Permission: "rw", CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+	long, _ := store.add(accessGrant{User: "alice", Namespace: "team3", Permission: "rw", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	access, _ := accessFromGroups("alice", []string{"team1_r"}, "team", nil)
+
+	if got, pruned := activeAccess(access, now); pruned || len(got) != 3 {
+		t.Fatalf("expected nothing pruned yet, got %+v", got)
+	}
+	got, pruned := activeAccess(access, now.Add(2*time.Minute))
+	if !pruned || strings.Join(namespacesFromAccess(got), ",") != "team1,team3" {
+		t.Fatalf("expected the short grant to expire, got %+v", got)
+	}
+	if _, err := store.revoke(long.ID, "root", now); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	got, _ = activeAccess(access, now)
+	if strings.Join(namespacesFromAccess(got), ",") != "team1,team2" {
+		t.Fatalf("expected the revoked grant to be dropped, got %+v", got)
+	}
+	if _, err := store.revoke(long.ID, "root", now); err != errGrantNotFound {
+		t.Fatalf("expected second revoke to fail, got %v", err)
+	}
+	if n := store.sweep(now.Add(2 * time.Minute)); n != 1 {
+		t.Fatalf("expected one expired grant, got %d", n)
+	}
+	if _, ok := store.get(short.ID); ok {
+		t.Fatalf("expected the expired grant to be swept")
+	}
+}
+
+func TestGrantStorePersistsAndAudits(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "grants.json")
+	logPath := filepath.Join(dir, "audit.log")
+	prevLog := auditLogPath
+	auditLogPath = logPath
+	t.Cleanup(func() {
+		auditLogPath = prevLog
+	})
+
+	now := time.Now()
+	store := newGrantStore(path)
+	g, err := store.add(accessGrant{Group: "oncall", Namespace: "team2", Permission: "rw", CreatedBy: "root", CreatedAt: now, ExpiresAt: now.Add(time.Minute), Reason: "INC-42"})
+	if err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+	if reloaded := newGrantStore(path); len(reloaded.list(now)) != 1 {
+		t.Fatalf("expected grant to survive a restart")
+	}
+	store.sweep(now.Add(time.Hour))
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected create and expire events, got %q", data)
+	}
+	var created, expired auditEvent
+	_ = json.Unmarshal([]byte(lines[0]), &created)
+	_ = json.Unmarshal([]byte(lines[1]), &expired)
+	if created.Action != "grant.create" || created.Actor != "root" || created.Subject != "group:oncall" || !strings.Contains(created.Detail, "INC-42") {
+		t.Fatalf("unexpected create event: %+v", created)
+	}
+	if expired.Action != "grant.expire" || expired.Detail != g.ID {
+		t.Fatalf("unexpected expire event: %+v", expired)
+	}
+}
+
+func TestGrantAPI(t *testing.T) {
+	withGrantStore(t)
+	prevAdmins := adminUsers
+	adminUsers = []string{"root"}
+	t.Cleanup(func() {
+		adminUsers = prevAdmins
+	})
+
+	router := cvRouter()
+	admin := seedSessionWithAccess(t, "root", nil)
+	nsAdmin := seedSessionWithAccess(t, "carol", []Access{{Namespace: "team2", Role: roleNamespaceAdmin}})
+	developer := seedSessionWithAccess(t, "dave", []Access{{Namespace: "team2", Role: roleDeveloper}})
+
+	call := func(token, method, path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		var buf bytes.Buffer
+		if body != nil {
+			_ = json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	grant := map[string]string{"user": "alice", "namespace": "team2", "permission": "rw", "duration": "48h", "reason": "incident"}
+	if rec := call(developer, http.MethodPost, "/api/grants", grant); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected developer to be refused, got %d", rec.Code)
+	}
+	rec := call(nsAdmin, http.MethodPost, "/api/grants", grant)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created accessGrant
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("decode grant: %v", err)
+	}
+	if created.ID == "" || created.CreatedBy != "carol" || created.ExpiresAt.Sub(created.CreatedAt) != 48*time.Hour {
+		t.Fatalf("unexpected grant: %+v", created)
+	}
+
+	for name, body := range map[string]map[string]string{
+		"too long":     {"user": "alice", "namespace": "team2", "permission": "rw", "duration": "720h"},
+		"bad duration": {"user": "alice", "namespace": "team2", "permission": "rw", "duration": "soon"},
+		"bad perm":     {"user": "alice", "namespace": "team2", "permission": "owner", "duration": "1h"},
+		"both":         {"user": "alice", "group": "ops", "namespace": "team2", "permission": "r", "duration": "1h"},
+	} {
+		if rec := call(admin, http.MethodPost, "/api/grants", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", name, rec.Code)
+		}
+	}
+	if rec := call(nsAdmin, http.MethodPost, "/api/grants", map[string]string{"group": "ops", "namespace": "team3", "permission": "r", "duration": "1h"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected namespace admin to be limited to their namespace, got %d", rec.Code)
+	}
+
+	rec = call(admin, http.MethodGet, "/api/grants", nil)
+	var listed grantListPayload
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil || len(listed.Grants) != 1 {
+		t.Fatalf("expected one grant, got %d %+v %v", rec.Code, listed, err)
+	}
+	rec = call(developer, http.MethodGet, "/api/grants", nil)
+	listed = grantListPayload{}
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil || len(listed.Grants) != 0 {
+		t.Fatalf("expected developer to see no grants, got %+v %v", listed, err)
+	}
+
+	if rec := call(developer, http.MethodDelete, "/api/grants/"+created.ID, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected developer revoke to be refused, got %d", rec.Code)
+	}
+	if rec := call(admin, http.MethodDelete, "/api/grants/"+created.ID, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected revoke to succeed, got %d", rec.Code)
+	}
+	if rec := call(admin, http.MethodDelete, "/api/grants/"+created.ID, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after revoke, got %d", rec.Code)
+	}
+}
+
+func TestCanManageGrantsInheritsFromParent(t *testing.T) {
+	sess := sessionData{
+		User: &User{Name: "alice"},
+		Access: []Access{
+			{Namespace: "org", Role: roleNamespaceAdmin},
+			{Namespace: "org/payments", Role: roleDeveloper, GrantID: "g1"},
+			{Namespace: "org/billing", PullOnly: true},
+		},
+	}
+	tests := map[string]bool{
+		"org":          true,
+		"org/payments": true,
+		"org/team/app": true,
+		"org/billing":  false,
+		"orgx":         false,
+	}
+	for namespace, want := range tests {
+		if got := canManageGrants(sess, namespace); got != want {
+			t.Fatalf("%s: expected %v, got %v", namespace, want, got)
+		}
+	}
+}
+
+func TestSessionDropsRevokedGrant(t *testing.T) {
+	store := withGrantStore(t)
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"repositories":["team2/app"]}`))
+	})
+	defer cleanup()
+
+	now := time.Now()
+	g, _ := store.add(accessGrant{User: "alice", Namespace: "team2", Permission: "r", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	access, _ := accessFromGroups("alice", []string{"team1_r"}, "team", nil)
+	token := seedSessionWithAccess(t, "alice", access)
+
+	router := cvRouter()
+	get := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/repos?namespace=team2", nil)
+		req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected grant to work, got %d", code)
+	}
+	if _, err := store.revoke(g.ID, "root", now); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if code := get(); code != http.StatusForbidden {
+		t.Fatalf("expected revoked grant to be dropped from the session, got %d", code)
+	}
+}
+
+func TestBuildNamespacePermissionsExpiry(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC()
+	access := []Access{
+		{Group: "team1_r", Namespace: "team1", PullOnly: true},
+		{Namespace: "team1", GrantID: "a", ExpiresAt: expires},
+		{Namespace: "team2", GrantID: "b", ExpiresAt: expires},
+	}
+	got := buildNamespacePermissions([]string{"team1", "team2"}, access)
+	if got[0].ExpiresAt != nil {
+		t.Fatalf("expected permanent access on team1, got %v", got[0].ExpiresAt)
+	}
+	if got[1].ExpiresAt == nil || !got[1].ExpiresAt.Equal(expires) {
+		t.Fatalf("expected team2 to expire at %v, got %v", expires, got[1].ExpiresAt)
+	}
+}
+
+func withGrantStore(t *testing.T) *grantStore {
+	return withStore(t, &accessGrants, newGrantStore(""))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// groupMappingFile is the on-disk format of LDAP_GROUP_MAPPING_FILE.
+type groupMappingFile struct {
+	Groups            []groupMappingEntry `json:"groups"`
+	Rules             []groupMappingRule  `json:"rules"`
+	DisableSuffixRule bool                `json:"disable_suffix_rule"`
+}
+
+// groupMappingEntry grants a namespace to one group, named either by its
+// CN or by its full DN.
+type groupMappingEntry struct {
+	Group      string `json:"group"`
+	Namespace  string `json:"namespace"`
+	Permission string `json:"permission"`
+}
+
+// groupMappingRule grants a namespace to every group whose name matches a
+// regular expression. Namespace may reference capture groups as $1 or
+// ${name}.
+type groupMappingRule struct {
+	Match      string `json:"match"`
+	Namespace  string `json:"namespace"`
+	Permission string `json:"permission"`
+}
+
+type groupGrant struct {
+	namespace     string
+	pullOnly      bool
+	deleteAllowed bool
+	role          string
+}
+
+type compiledGroupRule struct {
+	re        *regexp.Regexp
+	namespace string
+	grant     groupGrant
+}
+
+// groupMapper turns group DNs into namespace grants. Explicit entries are
+// checked first, then regex rules in file order, then the built-in
+// <prefix><namespace>_<r|rw|rd|rwd> suffix convention.
+type groupMapper struct {
+	exact  map[string][]groupGrant
+	rules  []compiledGroupRule
+	suffix bool
+}
+
+var defaultGroupMapper = &groupMapper{suffix: true}
+
+var (
+	groupMappersMu sync.Mutex
+	groupMappers   = make(map[string]*groupMapper)
+)
+
+// groupMapperFor returns the compiled mapping for path, loading it on first
+// use. An empty path selects the suffix convention only.
+func groupMapperFor(path string) (*groupMapper, error) {
+	if path == "" {
+		return defaultGroupMapper, nil
+	}
+	groupMappersMu.Lock()
+	defer groupMappersMu.Unlock()
+	if m, ok := groupMappers[path]; ok {
+		return m, nil
+	}
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		return nil, fmt.Errorf("group mapping: %w", err)
+	}
+	var file groupMappingFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("group mapping %s: %w", path, err)
+	}
+	m, err := newGroupMapper(file)
+	if err != nil {
+		return nil, fmt.Errorf("group mapping %s: %w", path, err)
+	}
+	groupMappers[path] = m
+	return m, nil
+}
+
+func newGroupMapper(file groupMappingFile) (*groupMapper, error) {
+	m := &groupMapper{
+		exact:  make(map[string][]groupGrant),
+		suffix: !file.DisableSuffixRule,
+	}
+	for _, entry := range file.Groups {
+		if strings.TrimSpace(entry.Group) == "" || strings.TrimSpace(entry.Namespace) == "" {
+			return nil, fmt.Errorf("group entry needs group and namespace: %+v", entry)
+		}
+		grant, err := grantFromPermission(entry.Namespace, entry.Permission)
+		if err != nil {
+			return nil, err
+		}
+		// Lowercase like rule results, so Team1 and team1 stay one namespace.
+		grant.namespace = strings.ToLower(grant.namespace)
+		if err := reservedNamespaceError(grant.namespace); err != nil {
+			return nil, fmt.Errorf("group %s: %w", entry.Group, err)
+		}
+		key := groupMappingKey(entry.Group)
+		m.exact[key] = append(m.exact[key], grant)
+	}
+	for _, rule := range file.Rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Match, err)
+		}
+		if strings.TrimSpace(rule.Namespace) == "" {
+			return nil, fmt.Errorf("rule %q needs a namespace", rule.Match)
+		}
+		// A capture can still expand into the personal space; such
+		// grants are dropped at login.
+		if err := reservedNamespaceError(strings.ToLower(strings.TrimSpace(rule.Namespace))); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Match, err)
+		}
+		grant, err := grantFromPermission(rule.Namespace, rule.Permission)
+		if err != nil {
+			return nil, err
+		}
+		m.rules = append(m.rules, compiledGroupRule{re: re, namespace: rule.Namespace, grant: grant})
+	}
+	return m, nil
+}
+
+func grantFromPermission(namespace, permission string) (groupGrant, error) {
+	grant := groupGrant{namespace: strings.TrimSpace(namespace)}
+	permission = strings.ToLower(strings.TrimSpace(permission))
+	if isRole(permission) {
+		grant.role = permission
+		grant.pullOnly, grant.deleteAllowed = legacyFlags(permission)
+		return grant, nil
+	}
+	switch permission {
+	case "r":
+		grant.pullOnly = true
+	case "rw":
+	case "rd":
+		grant.pullOnly = true
+		grant.deleteAllowed = true
+	case "rwd":
+		grant.deleteAllowed = true
+	default:
+		return groupGrant{}, fmt.Errorf("unknown permission %q for namespace %s", permission, namespace)
+	}
+	return grant, nil
+}
+
+// groupMappingKey normalises a configured group so that both a bare name
+// and a DN with different spacing or case match.
+func groupMappingKey(group string) string {
+	if strings.Contains(group, "=") {
+		return normalizeDN(group)
+	}
+	return strings.ToLower(strings.TrimSpace(group))
+}
+
+// grants returns the namespace grants for a group DN. prefix only limits
+// the suffix convention; explicit entries and rules ignore it.
+func (m *groupMapper) grants(dn, groupName, prefix string) []groupGrant {
+	if grants := m.exact[groupMappingKey(dn)]; len(grants) > 0 {
+		return grants
+	}
+	if grants := m.exact[groupMappingKey(groupName)]; len(grants) > 0 {
+		return grants
+	}
+	for _, rule := range m.rules {
+		match := rule.re.FindStringSubmatchIndex(groupName)
+		if match == nil {
+			continue
+		}
+		ns := string(rule.re.ExpandString(nil, rule.namespace, groupName, match))
+		ns = strings.ToLower(strings.TrimSpace(ns))
+		if ns == "" {
+			continue
+		}
+		grant := rule.grant
+		grant.namespace = ns
+		return []groupGrant{grant}
+	}
+	if !m.suffix || (prefix != "" && !strings.HasPrefix(groupName, prefix)) {
+		return nil
+	}
+	ns, pullOnly, deleteAllowed, ok := permissionsFromGroup(groupName)
+	if !ok {
+		return nil
+	}
+	return []groupGrant{{namespace: ns, pullOnly: pullOnly, deleteAllowed: deleteAllowed}}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGroupNameFromDN(t *testing.T) {
+	tests := []struct {
+		dn   string
+		want string
+	}{
+		{dn: "cn=team1_rw,ou=groups,dc=example,dc=com", want: "team1_rw"},
+		{dn: "OU=team2_r,dc=example,dc=com", want: "team2_r"},
+		{dn: `CN=Payments\, Writers,OU=Groups,DC=corp,DC=example`, want: "Payments, Writers"},
+		{dn: "uid=alice,dc=example,dc=com", want: "uid=alice,dc=example,dc=com"},
+		{dn: "team3_rwd", want: "team3_rwd"},
+	}
+	for _, tt := range tests {
+		if got := groupNameFromDN(tt.dn); got != tt.want {
+			t.Fatalf("groupNameFromDN(%q) = %q, want %q", tt.dn, got, tt.want)
+		}
+	}
+}
+
+func TestGroupMapperExplicitRulesAndSuffix(t *testing.T) {
+	mapper, err := newGroupMapper(groupMappingFile{
+		Groups: []groupMappingEntry{
+			{Group: "CN=Registry Admins,OU=Groups,DC=corp,DC=example", Namespace: "Platform", Permission: "rwd"},
+			{Group: "GG-Auditors", Namespace: "payments", Permission: "r"},
+			{Group: "GG-Auditors", Namespace: "billing", Permission: "r"},
+		},
+		Rules: []groupMappingRule{
+			{Match: `^GG-Registry-(?P<ns>[A-Za-z0-9]+)-Writers$`, Namespace: "${ns}", Permission: "rw"},
+			{Match: `^GG-Registry-([A-Za-z0-9]+)-Readers$`, Namespace: "$1", Permission: "r"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	groups := []string{
+		"cn=registry admins, ou=groups, dc=corp, dc=example",
+		"CN=GG-Registry-Payments-Writers,OU=Groups,DC=corp,DC=example",
+		"CN=GG-Registry-Billing-Readers,OU=Groups,DC=corp,DC=example",
+		"CN=GG-Auditors,OU=Groups,DC=corp,DC=example",
+		"CN=team9_rw,OU=Groups,DC=corp,DC=example",
+		"CN=Unrelated,OU=Groups,DC=corp,DC=example",
+	}
+	access, user := accessFromGroups("alice", groups, "team", mapper)
+	if user == nil || user.Namespace != "platform" || !user.DeleteAllowed {
+		t.Fatalf("expected platform rwd as primary access, got %+v", user)
+	}
+
+	got := make(map[string]Access)
+	for _, a := range access {
+		got[a.Group+"/"+a.Namespace] = a
+	}
+	want := map[string]Access{
+		"registry admins/platform":              {Group: "registry admins", Namespace: "platform", DeleteAllowed: true},
+		"GG-Registry-Payments-Writers/payments": {Group: "GG-Registry-Payments-Writers", Namespace: "payments"},
+		"GG-Registry-Billing-Readers/billing":   {Group: "GG-Registry-Billing-Readers", Namespace: "billing", PullOnly: true},
+		"GG-Auditors/payments":                  {Group: "GG-Auditors", Namespace: "payments", PullOnly: true},
+		"GG-Auditors/billing":                   {Group: "GG-Auditors", Namespace: "billing", PullOnly: true},
+		"team9_rw/team9":                        {Group: "team9_rw", Namespace: "team9"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d grants, got %+v", len(want), access)
+	}
+	for key, w := range want {
+		if got[key] != w {
+			t.Fatalf("grant %s: expected %+v, got %+v", key, w, got[key])
+		}
+	}
+}
+
+func TestGroupMapperDisableSuffixRule(t *testing.T) {
+	mapper, err := newGroupMapper(groupMappingFile{DisableSuffixRule: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	access, user := accessFromGroups("alice", []string{"cn=team1_rw,dc=example,dc=com"}, "team", mapper)
+	if user != nil || len(access) != 0 {
+		t.Fatalf("expected no access with the suffix rule disabled, got %+v", access)
+	}
+}
+
+func TestGroupMapperRejectsInvalidConfig(t *testing.T) {
+	tests := []groupMappingFile{
+		{Groups: []groupMappingEntry{{Group: "g", Namespace: "ns", Permission: "admin"}}},
+		{Groups: []groupMappingEntry{{Group: "g", Permission: "r"}}},
+		{Rules: []groupMappingRule{{Match: "(", Namespace: "ns", Permission: "r"}}},
+	}
+	for _, file := range tests {
+		if _, err := newGroupMapper(file); err == nil {
+			t.Fatalf("expected error for %+v", file)
+		}
+	}
+}
+
+func TestGroupMapperForLoadsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	data := `{"rules":[{"match":"^GG-(\\w+)-Writers$","namespace":"$1","permission":"rw"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write mapping: %v", err)
+	}
+	mapper, err := groupMapperFor(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	grants := mapper.grants("cn=GG-Payments-Writers,dc=corp", "GG-Payments-Writers", "team")
+	if len(grants) != 1 || grants[0].namespace != "payments" || grants[0].pullOnly {
+		t.Fatalf("unexpected grants: %+v", grants)
+	}
+
+	if _, err := groupMapperFor(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatalf("expected error for a missing mapping file")
+	}
+}
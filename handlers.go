@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 )
 
 func extractCredentials(r *http.Request) (string, string, bool, error) {
@@ -37,18 +38,23 @@ func handleLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, access, err := ldapAuthenticateAccess(username, password)
+	user, access, err := ldapAuth(username, password)
 	if err != nil {
-		log.Printf("ldap auth failed for %s: %v", username, err)
+		log.Printf("auth failed for %s: %v", username, err)
 		serveLogin(w, "Invalid credentials.")
 		return
 	}
+	if mfaRequiredFor(user.Name) {
+		startMFALogin(w, r, user, access)
+		return
+	}
 
-	if err := createSession(r.Context(), user, access); err != nil {
+	if err := createSession(r, loginSourcePassword, user, access, nil); err != nil {
 		log.Printf("session create failed for %s: %v", username, err)
 		serveLogin(w, "Login failed.")
 		return
 	}
+	personalTokens.refresh(loginSourcePassword, user, access, nil)
 	http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
 }
 
@@ -63,7 +69,25 @@ func serveLogin(w http.ResponseWriter, message string) {
 	if message != "" {
 		errorHTML = `<div class="error">` + html.EscapeString(message) + `</div>`
 	}
-	fmt.Fprint(w, strings.Replace(loginHTML, "{{ERROR}}", errorHTML, 1))
+	publicHTML := ""
+	if len(publicNamespaces) > 0 {
+		publicHTML = publicLinkHTML
+	}
+	ssoHTML := ""
+	if oidcCfg.Enabled() {
+		ssoHTML += ssoLink("/oidc/login", oidcCfg.ProviderName)
+	}
+	if samlCfg.Enabled() {
+		ssoHTML += ssoLink("/saml/login", samlCfg.ProviderName)
+	}
+	page := strings.Replace(loginHTML, "{{ERROR}}", errorHTML, 1)
+	page = strings.Replace(page, "{{PUBLIC}}", publicHTML, 1)
+	fmt.Fprint(w, strings.Replace(page, "{{SSO}}", ssoHTML, 1))
+}
+
+func ssoLink(href, provider string) string {
+	link := strings.Replace(ssoLinkHTML, "{{HREF}}", href, 1)
+	return strings.Replace(link, "{{PROVIDER}}", html.EscapeString(provider), 1)
 }
 
 func renderDashboardHTML(sess sessionData) ([]byte, error) {
@@ -76,43 +100,58 @@ func renderDashboardHTML(sess sessionData) ([]byte, error) {
 		return nil, err
 	}
 
-	page := strings.Replace(dashboardHTML, "{{USERNAME}}", html.EscapeString(sess.User.Name), 1)
+	username, action, tokens := sess.User.Name, logoutFormHTML, tokensPanelHTML
+	if mfaMode != mfaModeOff {
+		action = `<div class="top-actions">` + mfaLinkHTML + logoutFormHTML + `</div>`
+	}
+	if sess.Anonymous {
+		username, action, tokens = "guest", signInLinkHTML, ""
+	}
+	page := strings.Replace(dashboardHTML, "{{USERNAME}}", html.EscapeString(username), 1)
+	page = strings.Replace(page, "{{SESSION_ACTION}}", action, 1)
+	page = strings.Replace(page, "{{TOKENS}}", tokens, 1)
 	page = strings.Replace(page, "{{BOOTSTRAP}}", string(bootstrapJSON), 1)
 	return []byte(page), nil
 }
 
 type namespacePermission struct {
-	Namespace     string   `json:"namespace"`
-	PullOnly      bool     `json:"pull_only"`
-	DeleteAllowed bool     `json:"delete_allowed"`
-	Groups        []string `json:"groups,omitempty"`
-}
-
-func hasPermissionSuffix(group string) bool {
-	switch {
-	case strings.HasSuffix(group, "_rwd"):
-		return true
-	case strings.HasSuffix(group, "_rw"):
-		return true
-	case strings.HasSuffix(group, "_rd"):
-		return true
-	case strings.HasSuffix(group, "_r"):
-		return true
-	default:
-		return false
-	}
+	Namespace     string     `json:"namespace"`
+	PullOnly      bool       `json:"pull_only"`
+	DeleteAllowed bool       `json:"delete_allowed"`
+	Capabilities  []string   `json:"capabilities"`
+	Roles         []string   `json:"roles,omitempty"`
+	Groups        []string   `json:"groups,omitempty"`
+	Directories   []string   `json:"directories,omitempty"`
+	Parent        string     `json:"parent,omitempty"`
+	Personal      bool       `json:"personal,omitempty"`
+	Public        bool       `json:"public,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
 }
 
 func buildNamespacePermissions(namespaces []string, access []Access) []namespacePermission {
 	perms := make(map[string]*namespacePermission, len(namespaces))
 	groupSets := make(map[string]map[string]struct{}, len(namespaces))
+	directorySets := make(map[string]map[string]struct{}, len(namespaces))
 	seen := make(map[string]bool, len(namespaces))
 
 	for _, entry := range access {
 		mergeNamespaceAccess(perms, groupSets, seen, entry)
+		if entry.Namespace != "" && entry.Directory != "" {
+			addPermissionGroup(directorySets, entry.Namespace, entry.Directory)
+		}
 	}
 
 	applyPermissionGroups(perms, groupSets)
+	applyPermissionDirectories(perms, directorySets)
+	for ns, perm := range perms {
+		caps, _ := namespaceCapabilities(access, ns)
+		perm.Capabilities = caps.list()
+		perm.Roles = namespaceRoles(access, ns)
+		perm.Parent = namespaceParent(namespaces, ns)
+		perm.Personal = namespaceIsPersonal(access, ns)
+		perm.Public = namespaceAllowed(publicNamespaces, ns)
+		perm.ExpiresAt = namespaceExpiry(access, ns)
+	}
 	return orderedNamespacePermissions(namespaces, perms, seen)
 }
 
@@ -129,13 +168,14 @@ func mergeNamespaceAccess(perms map[string]*namespacePermission, groupSets map[s
 		}
 		perms[entry.Namespace] = perm
 	}
-	if !entry.PullOnly {
+	caps := entry.capabilities()
+	if caps.has(capPush) {
 		perm.PullOnly = false
 	}
-	if entry.DeleteAllowed {
+	if caps.has(capDeleteTag) {
 		perm.DeleteAllowed = true
 	}
-	if entry.Group != "" && hasPermissionSuffix(entry.Group) {
+	if entry.Group != "" && entry.Group != entry.Namespace {
 		addPermissionGroup(groupSets, entry.Namespace, entry.Group)
 	}
 }
@@ -163,6 +203,20 @@ func applyPermissionGroups(perms map[string]*namespacePermission, groupSets map[
 	}
 }
 
+func applyPermissionDirectories(perms map[string]*namespacePermission, directorySets map[string]map[string]struct{}) {
+	for ns, perm := range perms {
+		set := directorySets[ns]
+		if len(set) == 0 {
+			continue
+		}
+		perm.Directories = make([]string, 0, len(set))
+		for dir := range set {
+			perm.Directories = append(perm.Directories, dir)
+		}
+		sort.Strings(perm.Directories)
+	}
+}
+
 func orderedNamespacePermissions(namespaces []string, perms map[string]*namespacePermission, seen map[string]bool) []namespacePermission {
 	result := make([]namespacePermission, 0, len(namespaces))
 	for _, ns := range namespaces {
@@ -212,12 +266,3 @@ func namespaceAllowed(allowed []string, namespace string) bool {
 	}
 	return false
 }
-
-func namespaceDeleteAllowed(access []Access, namespace string) bool {
-	for _, entry := range access {
-		if entry.Namespace == namespace && entry.DeleteAllowed {
-			return true
-		}
-	}
-	return false
-}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -671,6 +672,24 @@ func TestBuildNamespacePermissions(t *testing.T) {
 	}
 }
 
+func TestBuildNamespacePermissionsDirectories(t *testing.T) {
+	access := []Access{
+		{Group: "team1_rw", Namespace: "team1", Directory: "corp"},
+		{Group: "team1_r", Namespace: "team1", PullOnly: true, Directory: "acme"},
+		{Group: "team2_r", Namespace: "team2", PullOnly: true},
+	}
+	got := buildNamespacePermissions([]string{"team1", "team2"}, access)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 permissions, got %d", len(got))
+	}
+	if want := []string{"acme", "corp"}; !reflect.DeepEqual(got[0].Directories, want) {
+		t.Fatalf("expected directories %v, got %v", want, got[0].Directories)
+	}
+	if got[1].Directories != nil {
+		t.Fatalf("expected no directories for team2, got %v", got[1].Directories)
+	}
+}
+
 func seedSession(t *testing.T, userName string, namespaces []string) string {
 	t.Helper()
 	return seedSessionData(t, userName, namespaces, nil)
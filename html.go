@@ -1,6 +1,6 @@
 package main
 
-const loginHTML = `<!doctype html>
+const cardHeadHTML = `<!doctype html>
 <html lang="en">
 <head>
   <meta charset="utf-8">
@@ -21,14 +21,23 @@ const loginHTML = `<!doctype html>
     label { display:block; margin-bottom:6px; font-size:13px; color:var(--muted); letter-spacing:0.3px; text-transform:uppercase; }
     input { display:block; width:100%; box-sizing:border-box; background:#0b1224; border:1px solid var(--line); color:#e2e8f0; border-radius:10px; padding:10px 12px; font-size:15px; }
     button { width:100%; box-sizing:border-box; border:0; border-radius:10px; padding:12px 14px; font-weight:600; background:var(--accent); color:#062238; cursor:pointer; }
+    .public { color:var(--accent); }
+    .sso { display:block; box-sizing:border-box; width:100%; margin-top:18px; padding:12px 14px; border-radius:10px; border:1px solid var(--accent); color:var(--accent); text-align:center; text-decoration:none; font-weight:600; }
+    .qr { display:block; width:220px; height:220px; margin:16px auto; padding:10px; border-radius:12px; background:#fff; image-rendering:pixelated; }
+    .secret { font-family:"IBM Plex Mono", "SFMono-Regular", Consolas, monospace; color:#e2e8f0; word-break:break-all; }
+    .codes { columns:2; margin:16px 0; padding:12px 16px 12px 32px; border:1px solid var(--line); border-radius:10px; font-family:"IBM Plex Mono", "SFMono-Regular", Consolas, monospace; color:#e2e8f0; }
     .error { margin-top:12px; padding:10px 12px; border-radius:10px; border:1px solid rgba(248,113,113,0.4); background:rgba(248,113,113,0.12); color:#fecaca; font-size:13px; }
   </style>
 </head>
-<body>
+`
+
+const loginHTML = cardHeadHTML + `<body>
   <div class="card">
     <h1>ContainerVault</h1>
     <p>Sign in to see your allowed namespaces and browse repository contents.</p>
     {{ERROR}}
+    {{PUBLIC}}
+    {{SSO}}
     <form method="post" action="/login">
       <div class="field">
         <label for="username">Username</label>
@@ -45,6 +54,73 @@ const loginHTML = `<!doctype html>
 </html>
 `
 
+const mfaHTML = cardHeadHTML + `<body>
+  <div class="card">
+    <h1>ContainerVault</h1>
+    {{CONTENT}}
+  </div>
+</body>
+</html>
+`
+
+const mfaCodeFormHTML = `<form method="post" action="{{ACTION}}">
+      <div class="field">
+        <label for="code">{{LABEL}}</label>
+        <input id="code" name="code" autocomplete="one-time-code" required autofocus>
+      </div>
+      <button type="submit">{{BUTTON}}</button>
+    </form>`
+
+const mfaPromptHTML = `<p>Enter the 6-digit code from your authenticator app, or one of your recovery codes.</p>
+    {{ERROR}}
+    {{FORM}}`
+
+const mfaSetupHTML = `<p>Scan this QR code with an authenticator app, then enter the 6-digit code it shows.</p>
+    <img class="qr" src="data:image/png;base64,{{QR}}" alt="QR code for your authenticator app">
+    <p>Or enter the key by hand: <span class="secret">{{SECRET}}</span></p>
+    {{ERROR}}
+    {{FORM}}`
+
+const mfaRecoveryHTML = `<p>Two-factor authentication is on. Keep these recovery codes somewhere safe. Each one works once, and they are not shown again.</p>
+    <ul class="codes">{{CODES}}</ul>
+    <a class="sso" href="/api/dashboard">Continue</a>`
+
+const mfaStatusHTML = `<p>Two-factor authentication is on for {{USERNAME}}. {{RECOVERY}} recovery codes left.</p>
+    {{ERROR}}
+    {{FORM}}
+    <a class="sso" href="/api/dashboard">Back</a>`
+
+const mfaLinkHTML = `<a class="logout" href="/mfa">Two-factor</a>`
+
+const logoutFormHTML = `<form method="post" action="/logout">
+      <button class="logout" type="submit">Logout</button>
+    </form>`
+
+const tokensPanelHTML = `<div class="panel tokens">
+    <div class="panel-title">Personal Access Tokens</div>
+    <form id="tokenForm" class="token-form">
+      <input name="name" placeholder="Token name" required>
+      <select name="duration">
+        <option value="168h">7 days</option>
+        <option value="720h" selected>30 days</option>
+        <option value="2160h">90 days</option>
+      </select>
+      <label><input type="checkbox" name="scope" value="api-read" checked> api-read</label>
+      <label><input type="checkbox" name="scope" value="api-write"> api-write</label>
+      <label><input type="checkbox" name="scope" value="registry-pull" checked> registry-pull</label>
+      <label><input type="checkbox" name="scope" value="registry-push"> registry-push</label>
+      <button class="refresh" type="submit">Create token</button>
+    </form>
+    <div id="tokenSecret"></div>
+    <div id="tokenList" class="mono"></div>
+  </div>`
+
+const signInLinkHTML = `<a class="signin" href="/login">Sign in</a>`
+
+const ssoLinkHTML = `<a class="sso" href="{{HREF}}">Sign in with {{PROVIDER}}</a>`
+
+const publicLinkHTML = `<p><a class="public" href="/api/dashboard">Browse public images</a> without signing in.</p>`
+
 const dashboardHTML = `<!doctype html>
 <html lang="en">
 <head>
@@ -70,7 +146,7 @@ const dashboardHTML = `<!doctype html>
     .top-actions { display:flex; align-items:center; gap:10px; }
     .refresh { border:1px solid rgba(56,189,248,0.6); background:rgba(56,189,248,0.12); color:#bae6fd; padding:8px 12px; border-radius:10px; cursor:pointer; }
     .refresh:hover { border-color:rgba(56,189,248,0.9); background:rgba(56,189,248,0.24); color:#e0f2fe; }
-    .logout { border:1px solid var(--line); background:#0b1224; color:#e2e8f0; padding:8px 12px; border-radius:10px; cursor:pointer; }
+    .logout { border:1px solid var(--line); background:#0b1224; color:#e2e8f0; padding:8px 12px; border-radius:10px; cursor:pointer; text-decoration:none; font-size:13px; }
     .tree { display:flex; flex-direction:column; gap:6px; }
     .node { width:100%; text-align:left; border:1px solid var(--line); background:var(--tree); color:#e2e8f0; padding:8px 10px; border-radius:10px; display:flex; align-items:center; gap:8px; cursor:pointer; font-size:14px; }
     .node:hover { border-color:rgba(56,189,248,0.6); }
@@ -83,6 +159,11 @@ const dashboardHTML = `<!doctype html>
     .perm-rd { background:rgba(248,113,113,0.18); color:#fca5a5; border-color:rgba(248,113,113,0.45); }
     .perm-rwd { background:rgba(74,222,128,0.18); color:#86efac; border-color:rgba(74,222,128,0.45); }
     .group-info { display:inline-flex; align-items:center; justify-content:center; width:18px; height:18px; border-radius:50%; border:1px solid rgba(148,163,184,0.45); color:#e2e8f0; font-size:11px; font-weight:700; background:rgba(148,163,184,0.12); cursor:help; }
+    .directory { display:inline-flex; align-items:center; padding:1px 8px; border-radius:999px; border:1px solid rgba(125,211,252,0.4); color:#7dd3fc; font-size:11px; background:rgba(125,211,252,0.08); }
+    .public { display:inline-flex; align-items:center; padding:1px 8px; border-radius:999px; border:1px solid rgba(250,204,21,0.4); color:#facc15; font-size:11px; background:rgba(250,204,21,0.08); }
+    .temporary { display:inline-flex; align-items:center; padding:1px 8px; border-radius:999px; border:1px solid rgba(251,146,60,0.4); color:#fb923c; font-size:11px; background:rgba(251,146,60,0.08); }
+    .signin { border:1px solid var(--line); background:#0b1224; color:#e2e8f0; padding:8px 12px; border-radius:10px; text-decoration:none; }
+    .personal { display:inline-flex; align-items:center; padding:1px 8px; border-radius:999px; border:1px solid rgba(134,239,172,0.4); color:#86efac; font-size:11px; background:rgba(134,239,172,0.08); }
     .node[data-type="folder"] { background:rgba(20,30,60,0.8); color:#e2e8f0; border-color:rgba(148,163,184,0.35); }
     .node[data-type="repo"] { background:rgba(15,23,42,0.8); color:#e2e8f0; }
     .node::before { content: ""; width:14px; height:14px; display:inline-flex; align-items:center; justify-content:center; font-size:12px; }
@@ -131,6 +212,12 @@ const dashboardHTML = `<!doctype html>
     .meta-row { display:flex; justify-content:space-between; gap:10px; font-size:12px; color:#cbd5e1; }
     .meta-key { color:var(--muted); }
     .meta-value { text-align:right; max-width:70%%; word-break:break-word; }
+    .tokens { margin-top:18px; }
+    .token-form { display:flex; flex-wrap:wrap; align-items:center; gap:10px; margin-bottom:12px; }
+    .token-form input, .token-form select { background:#0b1224; border:1px solid var(--line); color:#e2e8f0; border-radius:10px; padding:6px 10px; font-size:13px; }
+    .token-form label { display:inline-flex; align-items:center; gap:4px; font-size:12px; color:var(--muted); }
+    .token-secret { margin-bottom:12px; padding:10px 12px; border-radius:10px; border:1px solid rgba(74,222,128,0.45); background:rgba(74,222,128,0.08); color:#bbf7d0; font-size:12px; word-break:break-all; }
+    .token-row { display:flex; align-items:center; justify-content:space-between; gap:12px; padding:8px 10px; border:1px solid var(--line); border-radius:10px; margin-top:6px; font-size:13px; }
     @media (max-width: 900px) { .layout { grid-template-columns: 1fr; } }
   </style>
 </head>
@@ -140,9 +227,7 @@ const dashboardHTML = `<!doctype html>
       <h1>ContainerVault</h1>
       <p>Welcome, {{USERNAME}}. Expand a namespace to browse repositories and tags.</p>
     </div>
-    <form method="post" action="/logout">
-      <button class="logout" type="submit">Logout</button>
-    </form>
+    {{SESSION_ACTION}}
   </div>
   <div class="layout">
     <div class="panel">
@@ -157,6 +242,7 @@ const dashboardHTML = `<!doctype html>
       <div id="detailPanel" class="detail mono">Select a repository to view tags.</div>
     </div>
   </div>
+  {{TOKENS}}
   <script id="cv-bootstrap" type="application/json">{{BOOTSTRAP}}</script>
   <script type="module" src="/static/ui.js"></script>
 </body>
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval limits how often an unknown key ID triggers a new
+// fetch of the key set.
+const jwksRefreshInterval = 30 * time.Second
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// jwksCache keeps the signing keys published at a JWKS URL. Keys are
+// fetched again when a token names a key ID that is not known yet, which
+// follows key rotation at the issuer.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newJWKSCache(url string, client *http.Client) *jwksCache {
+	return &jwksCache{url: url, client: client}
+}
+
+// loadJWKSFile reads a key set from disk. The keys are fixed; the file is
+// not read again.
+func loadJWKSFile(path string) (*jwksCache, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		return nil, fmt.Errorf("jwks %s: %w", path, err)
+	}
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwks %s: %w", path, err)
+	}
+	keys := set.signingKeys()
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks %s: no usable signing keys", path)
+	}
+	return &jwksCache{keys: keys}, nil
+}
+
+// keyFor returns the key a token header refers to. It fits
+// verifySignedJWT.
+func (c *jwksCache) keyFor(ctx context.Context) func(jwtHeader) (crypto.PublicKey, error) {
+	return func(header jwtHeader) (crypto.PublicKey, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if key, ok := c.lookupLocked(header.KeyID); ok {
+			return key, nil
+		}
+		if c.url == "" || (c.keys != nil && time.Since(c.fetched) < jwksRefreshInterval) {
+			return nil, errInvalidToken
+		}
+		if err := c.fetchLocked(ctx); err != nil {
+			return nil, err
+		}
+		if key, ok := c.lookupLocked(header.KeyID); ok {
+			return key, nil
+		}
+		return nil, errInvalidToken
+	}
+}
+
+// lookupLocked finds key kid. A token without a key ID matches a set with
+// exactly one key.
+func (c *jwksCache) lookupLocked(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+func (c *jwksCache) fetchLocked(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("jwks %s: %w", c.url, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks %s: status %d", c.url, resp.StatusCode)
+	}
+	var set jsonWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("jwks %s: %w", c.url, err)
+	}
+	c.keys = set.signingKeys()
+	c.fetched = time.Now()
+	return nil
+}
+
+// signingKeys returns the usable signature keys of the set by key ID.
+// Keys of unsupported types are skipped.
+func (set jsonWebKeySet) signingKeys() map[string]crypto.PublicKey {
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("rsa exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, err
+		}
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
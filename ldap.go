@@ -1,9 +1,10 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
 )
@@ -14,119 +15,269 @@ func ldapAuthenticate(username, password string) (*User, error) {
 }
 
 func ldapAuthenticateAccess(username, password string) (*User, []Access, error) {
-	conn, err := dialLDAP(ldapCfg)
-	if err != nil {
-		return nil, nil, err
+	if password == "" {
+		return nil, nil, fmt.Errorf("empty password for %s", username)
 	}
-	defer conn.Close()
 
-	mail := username
-	if !strings.Contains(username, "@") && ldapCfg.UserMailDomain != "" {
-		domain := ldapCfg.UserMailDomain
-		if !strings.HasPrefix(domain, "@") {
-			domain = "@" + domain
+	var errs []error
+	for _, cfg := range ldapDirectoriesFor(ldapDirectories(), username) {
+		user, access, err := ldapAuthenticateDirectory(cfg, username, password)
+		if err == nil {
+			return user, access, nil
+		}
+		if cfg.Name != "" {
+			err = fmt.Errorf("directory %s: %w", cfg.Name, err)
 		}
-		mail = username + domain
+		errs = append(errs, err)
 	}
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("no ldap directory configured for %s", username)
+	}
+	return nil, nil, errors.Join(errs...)
+}
 
-	// Bind as the user using only the mail/UPN form.
-	bindIDs := []string{mail}
-
-	var bindErr error
-	for _, id := range bindIDs {
-		if id == "" {
-			continue
+// ldapLookupAccess resolves the access of username with the service
+// account of each directory, without the user's password. Directories
+// without LDAP_BIND_DN cannot be searched this way.
+func ldapLookupAccess(username string) (*User, []Access, error) {
+	var errs []error
+	for _, cfg := range ldapDirectoriesFor(ldapDirectories(), username) {
+		var user *User
+		var access []Access
+		err := errLookupUnsupported
+		if cfg.BindDN != "" {
+			err = ldapPoolFor(cfg).do(func(conn ldapClient) error {
+				var err error
+				user, access, err = ldapLookupConn(conn, cfg, username)
+				return err
+			})
 		}
-		if err := conn.Bind(id, password); err == nil {
-			bindErr = nil
-			break
-		} else {
-			bindErr = err
+		if err == nil {
+			return user, access, nil
 		}
+		if cfg.Name != "" {
+			err = fmt.Errorf("directory %s: %w", cfg.Name, err)
+		}
+		errs = append(errs, err)
 	}
-	if bindErr != nil {
-		return nil, nil, fmt.Errorf("ldap bind failed: %w", bindErr)
-	}
-
-	filter := fmt.Sprintf(ldapCfg.UserFilter, mail)
-	fmt.Println("filter", filter)
-	searchReq := ldap.NewSearchRequest(
-		ldapCfg.BaseDN,
-		ldap.ScopeWholeSubtree,
-		ldap.NeverDerefAliases, 1, 0, false,
-		filter,
-		nil,
-		nil,
-	)
+	return nil, nil, lookupError(errs)
+}
 
-	sr, err := conn.Search(searchReq)
+func ldapLookupConn(conn ldapClient, cfg LDAPConfig, username string) (*User, []Access, error) {
+	if err := conn.Bind(cfg.BindDN, cfg.BindPassword); err != nil {
+		return nil, nil, fmt.Errorf("ldap service bind failed: %w", err)
+	}
+	sr, err := conn.Search(userSearchRequest(cfg, userSearchFilter(cfg, username), 2))
 	if err != nil {
 		return nil, nil, fmt.Errorf("ldap search: %w", err)
 	}
-	if len(sr.Entries) == 0 {
-		return nil, nil, fmt.Errorf("user %s not found", mail)
+	switch len(sr.Entries) {
+	case 0:
+		return nil, nil, fmt.Errorf("%w %s", errUnknownUser, username)
+	case 1:
+		return ldapAccessForEntry(conn, cfg, username, sr.Entries[0])
+	default:
+		return nil, nil, fmt.Errorf("user %s is ambiguous (%d entries)", username, len(sr.Entries))
 	}
+}
 
-	entry := sr.Entries[0]
+func ldapAuthenticateDirectory(cfg LDAPConfig, username, password string) (*User, []Access, error) {
+	var user *User
+	var access []Access
+	err := ldapPoolFor(cfg).do(func(conn ldapClient) error {
+		var err error
+		user, access, err = ldapAuthenticateConn(conn, cfg, username, password)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, access, nil
+}
 
-	groups := entry.GetAttributeValues(ldapCfg.GroupAttribute)
+func ldapDirectories() []LDAPConfig {
+	if len(ldapDirs) > 0 {
+		return ldapDirs
+	}
+	return []LDAPConfig{ldapCfg}
+}
+
+// ldapDirectoriesFor picks the directories a login is tried against. A
+// username whose domain suffix is claimed by a directory goes only to that
+// directory; anything else is tried against every directory in order.
+func ldapDirectoriesFor(dirs []LDAPConfig, username string) []LDAPConfig {
+	at := strings.LastIndex(username, "@")
+	if at >= 0 {
+		domain := strings.ToLower(username[at+1:])
+		for _, cfg := range dirs {
+			for _, d := range cfg.Domains {
+				if strings.ToLower(strings.TrimPrefix(d, "@")) == domain {
+					return []LDAPConfig{cfg}
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+func ldapAuthenticateConn(conn ldapClient, cfg LDAPConfig, username, password string) (*User, []Access, error) {
+	var entry *ldap.Entry
+	var err error
+	if cfg.BindDN != "" {
+		entry, err = ldapSearchThenBind(conn, cfg, username, password)
+	} else {
+		entry, err = ldapBindThenSearch(conn, cfg, username, password)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return ldapAccessForEntry(conn, cfg, username, entry)
+}
+
+// ldapAccessForEntry resolves the groups of a user entry into access.
+func ldapAccessForEntry(conn ldapClient, cfg LDAPConfig, username string, entry *ldap.Entry) (*User, []Access, error) {
+	groups, err := resolveGroups(conn, cfg, entry)
+	if err != nil {
+		return nil, nil, err
+	}
 	fmt.Println("groups for", username, ":", groups)
 	fmt.Println(groups)
-	access, user := accessFromGroups(username, groups, ldapCfg.GroupNamePrefix)
+	mapper, err := groupMapperFor(cfg.GroupMappingFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, user := accessFromGroups(username, groups, cfg.GroupNamePrefix, mapper)
 	if user == nil {
-		return nil, nil, fmt.Errorf("no authorized groups for %s", username)
+		return nil, nil, fmt.Errorf("%w for %s", errNoAccess, username)
+	}
+	for i := range access {
+		access[i].Directory = cfg.Name
 	}
 
 	return user, access, nil
 }
 
-func dialLDAP(cfg LDAPConfig) (*ldap.Conn, error) {
+// ldapBindThenSearch binds as the user's mail/UPN and then looks up the
+// user's own entry.
+func ldapBindThenSearch(conn ldapClient, cfg LDAPConfig, username, password string) (*ldap.Entry, error) {
+	mail := userMail(cfg, username)
+	if err := conn.Bind(mail, password); err != nil {
+		return nil, fmt.Errorf("ldap bind failed: %w", err)
+	}
 
-	// #nosec G402 -- skip TLS verification if configured
-	conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: cfg.SkipTLSVerify}))
+	filter := userSearchFilter(cfg, username)
+	fmt.Println("filter", filter)
+	sr, err := conn.Search(userSearchRequest(cfg, filter, 1))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(sr.Entries) == 0 {
+		return nil, fmt.Errorf("user %s not found", mail)
 	}
+	return sr.Entries[0], nil
+}
 
-	if cfg.StartTLS && strings.HasPrefix(cfg.URL, "ldap://") {
-		// #nosec G402 -- skip TLS verification if configured
-		if err := conn.StartTLS(&tls.Config{InsecureSkipVerify: cfg.SkipTLSVerify}); err != nil {
-			_ = conn.Close()
-			return nil, err
-		}
+// ldapSearchThenBind looks the user up with the service account and then
+// verifies the password by binding as the DN that was found.
+func ldapSearchThenBind(conn ldapClient, cfg LDAPConfig, username, password string) (*ldap.Entry, error) {
+	if err := conn.Bind(cfg.BindDN, cfg.BindPassword); err != nil {
+		return nil, fmt.Errorf("ldap service bind failed: %w", err)
 	}
 
-	return conn, nil
+	filter := userSearchFilter(cfg, username)
+	sr, err := conn.Search(userSearchRequest(cfg, filter, 2))
+	if err != nil {
+		return nil, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(sr.Entries) != 1 {
+		return nil, fmt.Errorf("user %s not found or ambiguous (%d entries)", username, len(sr.Entries))
+	}
+	entry := sr.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return nil, fmt.Errorf("ldap bind failed: %w", err)
+	}
+	return entry, nil
 }
 
-func accessFromGroups(username string, groups []string, prefix string) ([]Access, *User) {
+func userSearchRequest(cfg LDAPConfig, filter string, sizeLimit int) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(
+		cfg.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, sizeLimit, 0, false,
+		filter,
+		nil,
+		nil,
+	)
+}
+
+// userMail appends the configured mail domain to bare usernames.
+func userMail(cfg LDAPConfig, username string) string {
+	if strings.Contains(username, "@") || cfg.UserMailDomain == "" {
+		return username
+	}
+	domain := cfg.UserMailDomain
+	if !strings.HasPrefix(domain, "@") {
+		domain = "@" + domain
+	}
+	return username + domain
+}
+
+// userSearchFilter builds the user lookup filter with the login value
+// escaped. When UserAttribute is set it takes precedence over the
+// UserFilter template. Mail-like attributes get the mail domain appended;
+// others (uid, sAMAccountName, cn) use the username as entered.
+func userSearchFilter(cfg LDAPConfig, username string) string {
+	attr := strings.TrimSpace(cfg.UserAttribute)
+	if attr == "" {
+		return fmt.Sprintf(cfg.UserFilter, ldap.EscapeFilter(userMail(cfg, username)))
+	}
+	value := username
+	switch strings.ToLower(attr) {
+	case "mail", "userprincipalname":
+		value = userMail(cfg, username)
+	}
+	return "(" + attr + "=" + ldap.EscapeFilter(value) + ")"
+}
+
+func accessFromGroups(username string, groups []string, prefix string, mapper *groupMapper) ([]Access, *User) {
 	var selected *User
 	var access []Access
 
+	// Groups pushed through SCIM count like directory groups, and a user
+	// the identity provider deactivated gets no access at all.
+	scimGroups, active := scimDirectory.loginGroups(username)
+	if !active {
+		return nil, nil
+	}
+	groups = append(groups[:len(groups):len(groups)], scimGroups...)
+
+	if mapper == nil {
+		mapper = defaultGroupMapper
+	}
+	groupNames := make([]string, 0, len(groups))
 	for _, g := range groups {
 		groupName := groupNameFromDN(g)
-		if prefix != "" && !strings.HasPrefix(groupName, prefix) {
-			continue
-		}
-
-		ns, pullOnly, deleteAllowed, ok := permissionsFromGroup(groupName)
-		if !ok {
-			continue
+		groupNames = append(groupNames, groupName)
+		for _, grant := range mapper.grants(g, groupName, prefix) {
+			access = append(access, Access{
+				Group:         groupName,
+				Namespace:     grant.namespace,
+				PullOnly:      grant.pullOnly,
+				DeleteAllowed: grant.deleteAllowed,
+				Role:          grant.role,
+			})
 		}
+	}
+	access = append(access, accessGrants.accessFor(username, groupNames, time.Now())...)
 
-		access = append(access, Access{
-			Group:         groupName,
-			Namespace:     ns,
-			PullOnly:      pullOnly,
-			DeleteAllowed: deleteAllowed,
-		})
-
+	for _, entry := range access {
 		candidate := &User{
 			Name:          username,
-			Group:         groupName,
-			Namespace:     ns,
-			PullOnly:      pullOnly,
-			DeleteAllowed: deleteAllowed,
+			Group:         entry.Group,
+			Namespace:     entry.Namespace,
+			PullOnly:      entry.PullOnly,
+			DeleteAllowed: entry.DeleteAllowed,
 		}
 
 		if selected == nil || morePermissive(candidate, selected) {
@@ -134,23 +285,21 @@ func accessFromGroups(username string, groups []string, prefix string) ([]Access
 		}
 	}
 
-	return access, selected
+	return withPersonalNamespace(username, access, selected)
 }
 
+// groupNameFromDN returns the value of the leading cn or ou RDN, with any
+// DN escaping removed. Values that are not DNs are returned unchanged.
 func groupNameFromDN(dn string) string {
-	parts := strings.SplitN(dn, ",", 2)
-	if len(parts) == 0 {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
 		return dn
 	}
 
-	first := strings.TrimSpace(parts[0])
-	firstLower := strings.ToLower(first)
-
-	switch {
-	case strings.HasPrefix(firstLower, "cn="):
-		return first[3:]
-	case strings.HasPrefix(firstLower, "ou="):
-		return first[3:]
+	first := parsed.RDNs[0].Attributes[0]
+	switch strings.ToLower(first.Type) {
+	case "cn", "ou":
+		return first.Value
 	default:
 		return dn
 	}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Group resolution strategies accepted in LDAP_GROUP_RESOLUTION.
+const (
+	groupResolveMemberOf     = "memberof"
+	groupResolveInChain      = "in-chain"
+	groupResolveRecursive    = "recursive"
+	groupResolvePrimaryGroup = "primary-group"
+
+	// ldapMatchingRuleInChain is the Active Directory LDAP_MATCHING_RULE_IN_CHAIN OID.
+	ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+	maxGroupNestingDepth = 16
+)
+
+type ldapSearcher interface {
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+}
+
+// resolveGroups returns the group DNs (or names) for a user entry using each
+// configured strategy in turn. Duplicates are removed case-insensitively.
+func resolveGroups(conn ldapSearcher, cfg LDAPConfig, entry *ldap.Entry) ([]string, error) {
+	strategies := cfg.GroupResolution
+	if len(strategies) == 0 {
+		strategies = []string{groupResolveMemberOf}
+	}
+
+	seen := make(map[string]struct{})
+	var groups []string
+	add := func(values []string) {
+		for _, v := range values {
+			key := strings.ToLower(v)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			groups = append(groups, v)
+		}
+	}
+
+	for _, strategy := range strategies {
+		switch strings.ToLower(strategy) {
+		case groupResolveMemberOf:
+			add(entry.GetAttributeValues(cfg.GroupAttribute))
+		case groupResolveInChain:
+			found, err := inChainGroups(conn, cfg, entry.DN)
+			if err != nil {
+				return nil, err
+			}
+			add(found)
+		case groupResolveRecursive:
+			found, err := recursiveGroups(conn, cfg, entry.DN)
+			if err != nil {
+				return nil, err
+			}
+			add(found)
+		case groupResolvePrimaryGroup:
+			found, err := primaryGroup(conn, cfg, entry)
+			if err != nil {
+				return nil, err
+			}
+			add(found)
+		default:
+			return nil, fmt.Errorf("unknown group resolution strategy %q", strategy)
+		}
+	}
+	return groups, nil
+}
+
+func groupBaseDN(cfg LDAPConfig) string {
+	if cfg.GroupBaseDN != "" {
+		return cfg.GroupBaseDN
+	}
+	return cfg.BaseDN
+}
+
+func searchGroupDNs(conn ldapSearcher, cfg LDAPConfig, filter string) ([]string, error) {
+	sr, err := conn.Search(ldap.NewSearchRequest(
+		groupBaseDN(cfg),
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap group search: %w", err)
+	}
+	dns := make([]string, 0, len(sr.Entries))
+	for _, e := range sr.Entries {
+		dns = append(dns, e.DN)
+	}
+	return dns, nil
+}
+
+// inChainGroups lets Active Directory expand nested membership server side.
+func inChainGroups(conn ldapSearcher, cfg LDAPConfig, userDN string) ([]string, error) {
+	filter := "(member:" + ldapMatchingRuleInChain + ":=" + ldap.EscapeFilter(userDN) + ")"
+	return searchGroupDNs(conn, cfg, filter)
+}
+
+// recursiveGroups walks member/uniqueMember links upwards from the user,
+// skipping DNs that were already visited so membership cycles terminate.
+func recursiveGroups(conn ldapSearcher, cfg LDAPConfig, userDN string) ([]string, error) {
+	memberAttrs := cfg.GroupMemberAttributes
+	if len(memberAttrs) == 0 {
+		memberAttrs = []string{"member", "uniqueMember"}
+	}
+
+	visited := map[string]struct{}{normalizeDN(userDN): {}}
+	frontier := []string{userDN}
+	var groups []string
+	for depth := 0; len(frontier) > 0 && depth < maxGroupNestingDepth; depth++ {
+		var next []string
+		for _, dn := range frontier {
+			var filter strings.Builder
+			filter.WriteString("(|")
+			for _, attr := range memberAttrs {
+				filter.WriteString("(" + attr + "=" + ldap.EscapeFilter(dn) + ")")
+			}
+			filter.WriteString(")")
+
+			parents, err := searchGroupDNs(conn, cfg, filter.String())
+			if err != nil {
+				return nil, err
+			}
+			for _, parent := range parents {
+				key := normalizeDN(parent)
+				if _, ok := visited[key]; ok {
+					continue
+				}
+				visited[key] = struct{}{}
+				groups = append(groups, parent)
+				next = append(next, parent)
+			}
+		}
+		frontier = next
+	}
+	return groups, nil
+}
+
+// primaryGroup resolves the Active Directory primary group, which is not
+// listed in memberOf. Its SID is the user's domain SID with the
+// primaryGroupID as the final RID.
+func primaryGroup(conn ldapSearcher, cfg LDAPConfig, entry *ldap.Entry) ([]string, error) {
+	rid := entry.GetAttributeValue("primaryGroupID")
+	userSID := entry.GetRawAttributeValue("objectSid")
+	if rid == "" || len(userSID) == 0 {
+		return nil, nil
+	}
+	groupSID, err := primaryGroupSID(userSID, rid)
+	if err != nil {
+		return nil, err
+	}
+	return searchGroupDNs(conn, cfg, "(objectSid="+escapeFilterBytes(groupSID)+")")
+}
+
+func primaryGroupSID(userSID []byte, primaryGroupID string) ([]byte, error) {
+	// Binary SID layout: revision(1), sub-authority count(1), authority(6),
+	// then count little-endian uint32 sub-authorities. The last one is the RID.
+	if len(userSID) < 12 || len(userSID) != 8+4*int(userSID[1]) {
+		return nil, fmt.Errorf("invalid objectSid")
+	}
+	rid, err := strconv.ParseUint(primaryGroupID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid primaryGroupID %q", primaryGroupID)
+	}
+	sid := append([]byte(nil), userSID...)
+	binary.LittleEndian.PutUint32(sid[len(sid)-4:], uint32(rid))
+	return sid, nil
+}
+
+func escapeFilterBytes(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		fmt.Fprintf(&sb, `\%02x`, c)
+	}
+	return sb.String()
+}
+
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	return strings.ToLower(parsed.String())
+}
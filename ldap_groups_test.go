@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+type fakeSearcher struct {
+	results  map[string][]string
+	searches []string
+}
+
+func (f *fakeSearcher) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	f.searches = append(f.searches, req.Filter)
+	sr := &ldap.SearchResult{}
+	for _, dn := range f.results[req.Filter] {
+		sr.Entries = append(sr.Entries, ldap.NewEntry(dn, nil))
+	}
+	return sr, nil
+}
+
+func TestResolveGroupsMemberOf(t *testing.T) {
+	entry := ldap.NewEntry("cn=alice,dc=example,dc=com", map[string][]string{
+		"memberOf": {"cn=team1_rw,dc=example,dc=com", "CN=team1_rw,dc=example,dc=com"},
+	})
+	cfg := LDAPConfig{GroupAttribute: "memberOf"}
+	groups, err := resolveGroups(&fakeSearcher{}, cfg, entry)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 1 || groups[0] != "cn=team1_rw,dc=example,dc=com" {
+		t.Fatalf("unexpected groups: %#v", groups)
+	}
+}
+
+func TestResolveGroupsInChain(t *testing.T) {
+	searcher := &fakeSearcher{results: map[string][]string{
+		"(member:1.2.840.113556.1.4.1941:=cn=alice,dc=example,dc=com)": {"cn=devs,dc=example,dc=com", "cn=team1_rw,dc=example,dc=com"},
+	}}
+	cfg := LDAPConfig{GroupResolution: []string{"in-chain"}}
+	groups, err := resolveGroups(searcher, cfg, ldap.NewEntry("cn=alice,dc=example,dc=com", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"cn=devs,dc=example,dc=com", "cn=team1_rw,dc=example,dc=com"}
+	if !reflect.DeepEqual(groups, want) {
+		t.Fatalf("unexpected groups: %#v", groups)
+	}
+}
+
+func TestResolveGroupsRecursiveStopsOnCycle(t *testing.T) {
+	filter := func(dn string) string {
+		return "(|(member=" + dn + ")(uniqueMember=" + dn + "))"
+	}
+	searcher := &fakeSearcher{results: map[string][]string{
+		filter("cn=alice,dc=example,dc=com"): {"cn=devs,dc=example,dc=com"},
+		filter("cn=devs,dc=example,dc=com"):  {"cn=team1_rw,dc=example,dc=com"},
+		// team1_rw is (mis)configured as a member of devs, forming a cycle.
+		filter("cn=team1_rw,dc=example,dc=com"): {"CN=devs,dc=example,dc=com"},
+	}}
+	cfg := LDAPConfig{GroupResolution: []string{"recursive"}}
+	groups, err := resolveGroups(searcher, cfg, ldap.NewEntry("cn=alice,dc=example,dc=com", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"cn=devs,dc=example,dc=com", "cn=team1_rw,dc=example,dc=com"}
+	if !reflect.DeepEqual(groups, want) {
+		t.Fatalf("unexpected groups: %#v", groups)
+	}
+	if len(searcher.searches) != 3 {
+		t.Fatalf("expected 3 searches, got %d", len(searcher.searches))
+	}
+
+	access, user := accessFromGroups("alice", groups, "team", nil)
+	if user == nil || len(access) != 1 || access[0].Namespace != "team1" {
+		t.Fatalf("expected nested group to grant team1, got %+v", access)
+	}
+}
+
+func TestResolveGroupsUnknownStrategy(t *testing.T) {
+	cfg := LDAPConfig{GroupResolution: []string{"bogus"}}
+	if _, err := resolveGroups(&fakeSearcher{}, cfg, ldap.NewEntry("cn=alice", nil)); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
+}
+
+func TestPrimaryGroupSID(t *testing.T) {
+	// S-1-5-21-1-2-3-1104
+	userSID := []byte{1, 5, 0, 0, 0, 0, 0, 5}
+	for _, sub := range []uint32{21, 1, 2, 3, 1104} {
+		userSID = binary.LittleEndian.AppendUint32(userSID, sub)
+	}
+	sid, err := primaryGroupSID(userSID, "513")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := binary.LittleEndian.Uint32(sid[len(sid)-4:]); got != 513 {
+		t.Fatalf("expected RID 513, got %d", got)
+	}
+	if binary.LittleEndian.Uint32(userSID[len(userSID)-4:]) != 1104 {
+		t.Fatalf("expected user SID to be left untouched")
+	}
+
+	searcher := &fakeSearcher{results: map[string][]string{
+		"(objectSid=" + escapeFilterBytes(sid) + ")": {"cn=Domain Users,dc=example,dc=com"},
+	}}
+	entry := ldap.NewEntry("cn=alice,dc=example,dc=com", map[string][]string{
+		"primaryGroupID": {"513"},
+		"objectSid":      {string(userSID)},
+	})
+	cfg := LDAPConfig{GroupResolution: []string{"primary-group"}}
+	groups, err := resolveGroups(searcher, cfg, entry)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 1 || groups[0] != "cn=Domain Users,dc=example,dc=com" {
+		t.Fatalf("unexpected groups: %#v", groups)
+	}
+
+	if _, err := primaryGroupSID([]byte{1, 2, 3}, "513"); err == nil {
+		t.Fatalf("expected invalid SID to fail")
+	}
+}
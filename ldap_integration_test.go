@@ -85,6 +85,39 @@ func TestLDAPAuthenticateJohndoeSingleNamespace(t *testing.T) {
 	}
 }
 
+func TestLDAPSearchThenBindWithServiceAccount(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	ldapURL, cleanup := startGlauth(ctx, t, "")
+	defer cleanup()
+
+	configureLDAPEnv(t, ldapURL)
+	t.Setenv("LDAP_BIND_DN", "cn=serviceuser,ou=svcaccts,ou=users,dc=glauth,dc=com")
+	t.Setenv("LDAP_BIND_PASSWORD", "mysecret")
+	t.Setenv("LDAP_USER_ATTRIBUTE", "cn")
+	prevCfg := ldapCfg
+	ldapCfg = loadLDAPConfig()
+	t.Cleanup(func() {
+		ldapCfg = prevCfg
+	})
+
+	u, _, err := ldapAuthenticateAccess("hackers", "dogood")
+	if err != nil {
+		t.Fatalf("unexpected auth failure: %v", err)
+	}
+	if u.Namespace != "team1" || !u.DeleteAllowed {
+		t.Fatalf("unexpected permissions: %+v", u)
+	}
+
+	if _, _, err := ldapAuthenticateAccess("hackers", "wrongpass"); err == nil {
+		t.Fatalf("expected wrong password to fail")
+	}
+	if _, _, err := ldapAuthenticateAccess("*", "dogood"); err == nil {
+		t.Fatalf("expected wildcard username to fail")
+	}
+}
+
 func TestProxyPushPullViaDocker(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
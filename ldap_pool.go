@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapClient is the subset of *ldap.Conn used for authentication, so pooled
+// connections can be substituted in tests.
+type ldapClient interface {
+	ldapSearcher
+	Bind(username, password string) error
+	Close() error
+	IsClosing() bool
+}
+
+var ldapDialURL = func(cfg LDAPConfig, url string) (ldapClient, error) {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	// #nosec G402 -- skip TLS verification if configured
+	conn, err := ldap.DialURL(url,
+		ldap.DialWithDialer(dialer),
+		ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: cfg.SkipTLSVerify}))
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.StartTLS && strings.HasPrefix(url, "ldap://") {
+		// #nosec G402 -- skip TLS verification if configured
+		if err := conn.StartTLS(&tls.Config{InsecureSkipVerify: cfg.SkipTLSVerify}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// ldapServerHealth remembers servers that recently failed to connect so they
+// are skipped until their backoff expires.
+type ldapServerHealth struct {
+	mu        sync.Mutex
+	downUntil map[string]time.Time
+	next      uint64
+}
+
+var ldapServers = &ldapServerHealth{downUntil: make(map[string]time.Time)}
+
+func (h *ldapServerHealth) markDown(url string, until time.Time) {
+	h.mu.Lock()
+	h.downUntil[url] = until
+	h.mu.Unlock()
+}
+
+func (h *ldapServerHealth) markUp(url string) {
+	h.mu.Lock()
+	delete(h.downUntil, url)
+	h.mu.Unlock()
+}
+
+// candidates orders the configured URLs for a dial attempt. Healthy servers
+// come first (rotated for round-robin), followed by servers still in backoff
+// as a last resort.
+func (h *ldapServerHealth) candidates(cfg LDAPConfig, now time.Time) []string {
+	urls := ldapURLs(cfg)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if strings.EqualFold(cfg.ServerSelection, "round-robin") && len(urls) > 1 {
+		start := int(h.next % uint64(len(urls)))
+		h.next++
+		urls = append(append([]string{}, urls[start:]...), urls[:start]...)
+	}
+
+	var healthy, down []string
+	for _, url := range urls {
+		if until, ok := h.downUntil[url]; ok && now.Before(until) {
+			down = append(down, url)
+			continue
+		}
+		healthy = append(healthy, url)
+	}
+	return append(healthy, down...)
+}
+
+func ldapURLs(cfg LDAPConfig) []string {
+	if len(cfg.URLs) > 0 {
+		return cfg.URLs
+	}
+	return []string{cfg.URL}
+}
+
+// dialLDAP connects to the first reachable configured server.
+func dialLDAP(cfg LDAPConfig) (ldapClient, error) {
+	var errs []error
+	for _, url := range ldapServers.candidates(cfg, time.Now()) {
+		conn, err := ldapDialURL(cfg, url)
+		if err == nil {
+			ldapServers.markUp(url)
+			return conn, nil
+		}
+		log.Printf("ldap server %s unavailable: %v", url, err)
+		ldapServers.markDown(url, time.Now().Add(cfg.ServerBackoff))
+		errs = append(errs, fmt.Errorf("%s: %w", url, err))
+	}
+	if len(errs) == 0 {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("no ldap servers configured"))
+	}
+	return nil, errors.Join(errs...)
+}
+
+type pooledLDAPConn struct {
+	conn     ldapClient
+	lastUsed time.Time
+}
+
+// ldapConnPool keeps up to size idle connections. Every user of a pooled
+// connection starts with a Bind, so no identity leaks between requests.
+type ldapConnPool struct {
+	mu          sync.Mutex
+	cfg         LDAPConfig
+	idle        []pooledLDAPConn
+	size        int
+	idleTimeout time.Duration
+}
+
+var (
+	ldapPoolsMu sync.Mutex
+	ldapPools   = make(map[string]*ldapConnPool)
+)
+
+func ldapPoolKey(cfg LDAPConfig) string {
+	return fmt.Sprintf("%s|%t|%t", strings.Join(ldapURLs(cfg), ","), cfg.StartTLS, cfg.SkipTLSVerify)
+}
+
+func ldapPoolFor(cfg LDAPConfig) *ldapConnPool {
+	key := ldapPoolKey(cfg)
+	ldapPoolsMu.Lock()
+	defer ldapPoolsMu.Unlock()
+	pool, ok := ldapPools[key]
+	if !ok {
+		pool = &ldapConnPool{
+			cfg:         cfg,
+			size:        cfg.PoolSize,
+			idleTimeout: cfg.PoolIdleTimeout,
+		}
+		ldapPools[key] = pool
+	}
+	return pool
+}
+
+// get returns an idle connection that still looks healthy, or dials a new
+// one. reused reports whether the connection came from the pool.
+func (p *ldapConnPool) get() (conn ldapClient, reused bool, err error) {
+	now := time.Now()
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		last := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if last.conn.IsClosing() || (p.idleTimeout > 0 && now.Sub(last.lastUsed) > p.idleTimeout) {
+			_ = last.conn.Close()
+			continue
+		}
+		p.mu.Unlock()
+		return last.conn, true, nil
+	}
+	p.mu.Unlock()
+
+	conn, err = dialLDAP(p.cfg)
+	return conn, false, err
+}
+
+func (p *ldapConnPool) put(conn ldapClient) {
+	if conn.IsClosing() {
+		_ = conn.Close()
+		return
+	}
+	p.mu.Lock()
+	if len(p.idle) >= p.size {
+		p.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pooledLDAPConn{conn: conn, lastUsed: time.Now()})
+	p.mu.Unlock()
+}
+
+// do runs fn on a pooled connection. Connections that hit a network error are
+// discarded; if the failing connection came from the pool, fn is retried
+// once on a freshly dialed connection.
+func (p *ldapConnPool) do(fn func(ldapClient) error) error {
+	conn, reused, err := p.get()
+	if err != nil {
+		return err
+	}
+	err = fn(conn)
+	if err != nil && isLDAPNetworkError(err) {
+		_ = conn.Close()
+		if !reused {
+			return err
+		}
+		if conn, err = dialLDAP(p.cfg); err != nil {
+			return err
+		}
+		err = fn(conn)
+		if err != nil && isLDAPNetworkError(err) {
+			_ = conn.Close()
+			return err
+		}
+	}
+	p.put(conn)
+	return err
+}
+
+func isLDAPNetworkError(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
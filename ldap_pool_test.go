@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+type fakeLDAPClient struct {
+	url     string
+	closed  bool
+	bindErr error
+	binds   int
+	entries []*ldap.Entry
+}
+
+func (f *fakeLDAPClient) Bind(username, password string) error {
+	f.binds++
+	return f.bindErr
+}
+
+func (f *fakeLDAPClient) Search(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return &ldap.SearchResult{Entries: f.entries}, nil
+}
+
+func (f *fakeLDAPClient) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeLDAPClient) IsClosing() bool {
+	return f.closed
+}
+
+func TestDialLDAPFailsOverAndBacksOff(t *testing.T) {
+	dialed := withFakeLDAPDial(t, map[string]bool{"ldaps://dc1": true})
+	cfg := LDAPConfig{URLs: []string{"ldaps://dc1", "ldaps://dc2"}, ServerBackoff: time.Minute}
+
+	conn, err := dialLDAP(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conn.(*fakeLDAPClient).url != "ldaps://dc2" {
+		t.Fatalf("expected failover to dc2")
+	}
+
+	if _, err := dialLDAP(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"ldaps://dc1", "ldaps://dc2", "ldaps://dc2"}
+	if !reflect.DeepEqual(*dialed, want) {
+		t.Fatalf("expected dc1 to be skipped during backoff, dialed %v", *dialed)
+	}
+}
+
+func TestDialLDAPAllServersDown(t *testing.T) {
+	withFakeLDAPDial(t, map[string]bool{"ldaps://dc1": true, "ldaps://dc2": true})
+	cfg := LDAPConfig{URLs: []string{"ldaps://dc1", "ldaps://dc2"}, ServerBackoff: time.Minute}
+
+	_, err := dialLDAP(cfg)
+	if err == nil {
+		t.Fatalf("expected error when all servers are down")
+	}
+	if !isLDAPNetworkError(err) {
+		t.Fatalf("expected network error, got %v", err)
+	}
+}
+
+func TestLDAPServerCandidatesRoundRobin(t *testing.T) {
+	health := &ldapServerHealth{downUntil: make(map[string]time.Time)}
+	cfg := LDAPConfig{URLs: []string{"a", "b", "c"}, ServerSelection: "round-robin"}
+	now := time.Now()
+
+	if got := health.candidates(cfg, now); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("unexpected order: %v", got)
+	}
+	if got := health.candidates(cfg, now); !reflect.DeepEqual(got, []string{"b", "c", "a"}) {
+		t.Fatalf("unexpected order: %v", got)
+	}
+	health.markDown("c", now.Add(time.Minute))
+	if got := health.candidates(cfg, now); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("expected unhealthy server last, got %v", got)
+	}
+}
+
+func TestLDAPConnPoolReusesConnections(t *testing.T) {
+	dialed := withFakeLDAPDial(t, nil)
+	pool := &ldapConnPool{cfg: LDAPConfig{URLs: []string{"ldaps://dc1"}}, size: 2}
+
+	for i := 0; i < 3; i++ {
+		err := pool.do(func(conn ldapClient) error {
+			return conn.Bind("user", "pass")
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(*dialed) != 1 {
+		t.Fatalf("expected a single dial, got %d", len(*dialed))
+	}
+}
+
+func TestLDAPConnPoolDiscardsBrokenConnection(t *testing.T) {
+	dialed := withFakeLDAPDial(t, nil)
+	pool := &ldapConnPool{cfg: LDAPConfig{URLs: []string{"ldaps://dc1"}}, size: 2}
+	stale := &fakeLDAPClient{url: "ldaps://dc1", bindErr: ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset"))}
+	pool.put(stale)
+
+	err := pool.do(func(conn ldapClient) error {
+		return conn.Bind("user", "pass")
+	})
+	if err != nil {
+		t.Fatalf("expected retry on a fresh connection, got %v", err)
+	}
+	if !stale.closed {
+		t.Fatalf("expected stale connection to be closed")
+	}
+	if len(*dialed) != 1 {
+		t.Fatalf("expected one fresh dial, got %d", len(*dialed))
+	}
+	if len(pool.idle) != 1 || pool.idle[0].conn == stale {
+		t.Fatalf("expected only the fresh connection to be pooled")
+	}
+}
+
+func TestLDAPConnPoolKeepsConnectionOnBadCredentials(t *testing.T) {
+	withFakeLDAPDial(t, nil)
+	pool := &ldapConnPool{cfg: LDAPConfig{URLs: []string{"ldaps://dc1"}}, size: 2}
+	badCreds := ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+
+	err := pool.do(func(conn ldapClient) error {
+		return badCreds
+	})
+	if !errors.Is(err, badCreds) {
+		t.Fatalf("expected credentials error, got %v", err)
+	}
+	if len(pool.idle) != 1 {
+		t.Fatalf("expected connection to be returned to the pool")
+	}
+}
+
+func withFakeLDAPDial(t *testing.T, down map[string]bool) *[]string {
+	t.Helper()
+	var dialed []string
+	originalDial := ldapDialURL
+	originalServers := ldapServers
+	ldapDialURL = func(cfg LDAPConfig, url string) (ldapClient, error) {
+		dialed = append(dialed, url)
+		if down[url] {
+			return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused"))
+		}
+		return &fakeLDAPClient{url: url}, nil
+	}
+	ldapServers = &ldapServerHealth{downUntil: make(map[string]time.Time)}
+	t.Cleanup(func() {
+		ldapDialURL = originalDial
+		ldapServers = originalServers
+	})
+	return &dialed
+}
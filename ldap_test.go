@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
 
 func TestPermissionsFromGroupSuffixes(t *testing.T) {
 	tests := []struct {
@@ -68,3 +74,131 @@ func TestMorePermissivePullOnly(t *testing.T) {
 		})
 	}
 }
+
+func TestUserSearchFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      LDAPConfig
+		username string
+		want     string
+	}{
+		{
+			name:     "template",
+			cfg:      LDAPConfig{UserFilter: "(mail=%s)", UserMailDomain: "example.com"},
+			username: "alice",
+			want:     "(mail=alice@example.com)",
+		},
+		{
+			name:     "template escapes input",
+			cfg:      LDAPConfig{UserFilter: "(mail=%s)"},
+			username: "alice)(|(mail=*",
+			want:     `(mail=alice\29\28|\28mail=\2a)`,
+		},
+		{
+			name:     "uid attribute",
+			cfg:      LDAPConfig{UserFilter: "(mail=%s)", UserAttribute: "uid", UserMailDomain: "@example.com"},
+			username: "alice",
+			want:     "(uid=alice)",
+		},
+		{
+			name:     "sAMAccountName escapes input",
+			cfg:      LDAPConfig{UserAttribute: "sAMAccountName"},
+			username: `bob*\`,
+			want:     `(sAMAccountName=bob\2a\5c)`,
+		},
+		{
+			name:     "userPrincipalName appends domain",
+			cfg:      LDAPConfig{UserAttribute: "userPrincipalName", UserMailDomain: "@corp.example"},
+			username: "carol",
+			want:     "(userPrincipalName=carol@corp.example)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := userSearchFilter(tt.cfg, tt.username); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticateAccessRejectsEmptyPassword(t *testing.T) {
+	if _, _, err := ldapAuthenticateAccess("alice", ""); err == nil {
+		t.Fatalf("expected empty password to be rejected")
+	}
+}
+
+func TestLDAPDirectoriesForRoutesByDomain(t *testing.T) {
+	dirs := []LDAPConfig{
+		{Name: "corp", Domains: []string{"corp.example"}},
+		{Name: "acme", Domains: []string{"@acme.example"}},
+	}
+
+	if got := ldapDirectoriesFor(dirs, "alice@ACME.example"); len(got) != 1 || got[0].Name != "acme" {
+		t.Fatalf("expected acme directory, got %+v", got)
+	}
+	if got := ldapDirectoriesFor(dirs, "bob"); len(got) != 2 {
+		t.Fatalf("expected every directory for a bare username, got %+v", got)
+	}
+	if got := ldapDirectoriesFor(dirs, "carol@other.example"); len(got) != 2 {
+		t.Fatalf("expected every directory for an unknown domain, got %+v", got)
+	}
+}
+
+func TestLDAPAuthenticateAccessTriesDirectoriesInOrder(t *testing.T) {
+	originalDial := ldapDialURL
+	originalServers := ldapServers
+	originalDirs := ldapDirs
+	ldapDialURL = func(cfg LDAPConfig, url string) (ldapClient, error) {
+		if url == "ldaps://corp" {
+			return &fakeLDAPClient{url: url, bindErr: errors.New("invalid credentials")}, nil
+		}
+		entry := ldap.NewEntry("cn=alice,dc=acme", map[string][]string{
+			"memberOf": {"cn=team1_rw,dc=acme"},
+		})
+		return &fakeLDAPClient{url: url, entries: []*ldap.Entry{entry}}, nil
+	}
+	ldapServers = &ldapServerHealth{downUntil: make(map[string]time.Time)}
+	ldapDirs = []LDAPConfig{
+		{Name: "corp", URLs: []string{"ldaps://corp"}, UserFilter: "(mail=%s)", GroupAttribute: "memberOf", GroupNamePrefix: "team"},
+		{Name: "acme", URLs: []string{"ldaps://acme"}, UserFilter: "(mail=%s)", GroupAttribute: "memberOf", GroupNamePrefix: "team"},
+	}
+	t.Cleanup(func() {
+		ldapDialURL = originalDial
+		ldapServers = originalServers
+		ldapDirs = originalDirs
+	})
+
+	user, access, err := ldapAuthenticateAccess("alice", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.Namespace != "team1" || len(access) != 1 || access[0].Directory != "acme" {
+		t.Fatalf("expected team1 access from acme, got %+v %+v", user, access)
+	}
+}
+
+func TestLDAPLookupConn(t *testing.T) {
+	cfg := LDAPConfig{Name: "corp", BindDN: "cn=svc", GroupAttribute: "memberOf", GroupNamePrefix: "team", UserFilter: "(mail=%s)"}
+	conn := &fakeLDAPClient{entries: []*ldap.Entry{ldap.NewEntry("cn=alice,dc=example,dc=com", map[string][]string{
+		"memberOf": {"cn=team1_rwd,ou=groups,dc=example,dc=com"},
+	})}}
+	user, access, err := ldapLookupConn(conn, cfg, "alice")
+	if err != nil || user.Name != "alice" || !namespaceCan(access, "team1", capDeleteTag) || access[0].Directory != "corp" {
+		t.Fatalf("expected access from the service account lookup, got %+v %v", access, err)
+	}
+
+	conn.entries = []*ldap.Entry{ldap.NewEntry("cn=alice,dc=example,dc=com", map[string][]string{"memberOf": {"cn=other,dc=example,dc=com"}})}
+	if _, _, err := ldapLookupConn(conn, cfg, "alice"); !accountGone(err) {
+		t.Fatalf("expected a user without groups to count as gone, got %v", err)
+	}
+	conn.entries = nil
+	if _, _, err := ldapLookupConn(conn, cfg, "alice"); !accountGone(err) {
+		t.Fatalf("expected a missing user to count as gone, got %v", err)
+	}
+	conn.bindErr = errors.New("invalid credentials")
+	if _, _, err := ldapLookupConn(conn, cfg, "alice"); err == nil || accountGone(err) {
+		t.Fatalf("expected a failed service bind to leave the session alone, got %v", err)
+	}
+}
@@ -41,6 +41,7 @@ func cvRouter() http.Handler {
 
 	router := chi.NewRouter()
 	router.Use(sessionManager.LoadAndSave)
+	router.Use(trackSessionActivity)
 	staticHandler := http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir)))
 	router.Handle("/static/*", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/static/")
@@ -57,6 +58,28 @@ func cvRouter() http.Handler {
 	router.Post("/login", handleLoginPost)
 	router.Get("/login", handleLoginGet)
 	router.HandleFunc("/logout", handleLogout)
+	if mfaMode != mfaModeOff {
+		router.Get("/login/mfa", handleMFALoginGet)
+		router.Post("/login/mfa", handleMFALoginPost)
+		router.Get("/mfa", handleMFASettings)
+		router.Post("/mfa", handleMFAEnroll)
+		router.Post("/mfa/disable", handleMFADisable)
+	}
+	if scimToken != "" {
+		router.Mount(scimBasePath, scimHandler())
+	}
+	if tokenCfg.Enabled {
+		router.Get("/token", handleToken)
+	}
+	if oidcCfg.Enabled() {
+		router.Get("/oidc/login", handleOIDCLogin)
+		router.Get("/oidc/callback", handleOIDCCallback)
+	}
+	if samlCfg.Enabled() {
+		router.Get("/saml/metadata", handleSAMLMetadata)
+		router.Get("/saml/login", handleSAMLLogin)
+		router.Post("/saml/acs", handleSAMLACS)
+	}
 
 	apiCfg := huma.DefaultConfig("ContainerVault", "1.0.0")
 	apiCfg.OpenAPIPath = ""
@@ -66,11 +89,44 @@ func cvRouter() http.Handler {
 	registerAPI(api)
 
 	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		// Public pulls go straight through; credentials that are sent
+		// anyway are still checked below. The /v2/ ping is not a public
+		// pull: in Basic mode it keeps answering 401, because Docker only
+		// sends stored credentials after a challenge there. Docker
+		// therefore cannot pull anonymously in Basic mode; that needs
+		// token mode and its anonymous tokens.
+		if r.Header.Get("Authorization") == "" && publicPull(r) {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		if _, password, ok := r.BasicAuth(); ok && isShareCredential(password) && !tokenCfg.Enabled {
+			serveShareRequest(w, r, proxy, password)
+			return
+		}
+
+		if tokenCfg.Enabled {
+			claims, ok := authenticateBearer(w, r)
+			if !ok {
+				return
+			}
+			if !authorizeToken(claims, r) {
+				writeBearerChallenge(w, r, "insufficient_scope")
+				http.Error(w, "insufficient scope", http.StatusUnauthorized)
+				return
+			}
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
 		user, access, ok := authenticate(w, r)
 		if !ok {
 			// http.Error already sent
 			return
 		}
+		if repo, ok := repositoryFromPath(r.URL.Path); ok {
+			access = adminPersonalAccess(user.Name, access, repo)
+		}
 
 		if !authorize(access, r) {
 			forbiddenMessage := "forbidden by user \"" + user.Name + "\" only allowed access to "
@@ -94,6 +150,61 @@ func cvRouter() http.Handler {
 }
 
 func main() {
+	for _, cfg := range ldapDirectories() {
+		if _, err := groupMapperFor(cfg.GroupMappingFile); err != nil {
+			log.Fatalf("invalid group mapping: %v", err)
+		}
+	}
+	if oidcCfg.Enabled() {
+		if _, err := groupMapperFor(oidcCfg.GroupMappingFile); err != nil {
+			log.Fatalf("invalid oidc group mapping: %v", err)
+		}
+	}
+	if samlCfg.Enabled() {
+		if _, err := groupMapperFor(samlCfg.GroupMappingFile); err != nil {
+			log.Fatalf("invalid saml group mapping: %v", err)
+		}
+		if _, _, err := loadSAMLKeyPair(samlCfg.CertFile, samlCfg.KeyFile); err != nil {
+			log.Fatalf("invalid saml configuration: %v", err)
+		}
+	}
+	switch mfaMode {
+	case mfaModeOff, mfaModeOptional, mfaModeRequired:
+	default:
+		log.Fatalf("invalid MFA_MODE %q: use off, optional or required", mfaMode)
+	}
+	store, err := newSessionStore(sessionCfg)
+	if err != nil {
+		log.Fatalf("invalid session store: %v", err)
+	}
+	sessionManager.Store = store
+	chain, err := newAuthChain(authBackends, fileCfg)
+	if err != nil {
+		log.Fatalf("invalid AUTH_BACKENDS: %v", err)
+	}
+	authenticators = chain
+	rules, err := loadACLRules(aclRulesPath)
+	if err != nil {
+		log.Fatalf("invalid acl rules: %v", err)
+	}
+	repoACL = rules
+	trust, err := loadWorkloadTrust(workloadIdentityPath)
+	if err != nil {
+		log.Fatalf("invalid workload identity configuration: %v", err)
+	}
+	workloadIdentity = trust
+	go runGrantSweeper(grantSweepInterval, nil)
+	if authenticators.canLookup() || oidcCfg.Enabled() || samlCfg.Enabled() {
+		go runSessionRevalidator(sessionCfg.RevalidateInterval, nil)
+	} else {
+		log.Printf("session revalidation is off: no auth backend can look users up without a password (set LDAP_BIND_DN or add the file backend)")
+	}
+	if len(publicNamespaces) > 0 && !tokenCfg.Enabled {
+		log.Printf("PUBLIC_NAMESPACES is set without TOKEN_AUTH_ENABLE; docker pull needs credentials in Basic mode, only plain HTTP clients can pull anonymously")
+	}
+	if shareStorePath != "" && shareLinkKey == "" {
+		log.Printf("SHARE_LINK_KEY is not set; stored share links stop working after a restart")
+	}
 
 	router := cvRouter()
 
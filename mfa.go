@@ -0,0 +1,604 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" // #nosec G505 -- RFC 6238 TOTP uses HMAC-SHA1, which authenticator apps expect
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"rsc.io/qr"
+)
+
+const (
+	mfaModeOff      = "off"
+	mfaModeOptional = "optional"
+	mfaModeRequired = "required"
+
+	totpPeriod   = 30 * time.Second
+	totpDigits   = 6
+	totpSkew     = 1
+	recoveryKeys = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code of secret for time step counter.
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter)) // #nosec G115 -- time steps are positive
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpStep returns the time step of code if it is valid at now, allowing
+// one step of clock drift either way.
+func totpStep(secret []byte, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// mfaEnrollment is the second factor of one user. Secret stays unconfirmed
+// until the user has proven it with a code.
+type mfaEnrollment struct {
+	Username       string     `json:"username"`
+	Secret         string     `json:"secret"`
+	Confirmed      bool       `json:"confirmed"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ConfirmedAt    *time.Time `json:"confirmed_at,omitempty"`
+	LastStep       int64      `json:"last_step,omitempty"`
+	RecoveryHashes []string   `json:"recovery_hashes,omitempty"`
+	Failures       int        `json:"failures,omitempty"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+}
+
+// provisioningURI is the otpauth:// URI authenticator apps read from the
+// QR code.
+func (e mfaEnrollment) provisioningURI() string {
+	label := url.PathEscape(mfaIssuer) + ":" + url.PathEscape(e.Username)
+	query := url.Values{
+		"secret":    {e.Secret},
+		"issuer":    {mfaIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod / time.Second))},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+type mfaStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]mfaEnrollment
+}
+
+var mfaEnrollments = newMFAStore(mfaStorePath)
+
+var (
+	errMFAEnrolled    = errors.New("two-factor authentication is already enabled")
+	errMFANotEnrolled = errors.New("two-factor authentication is not enabled")
+	errMFACode        = errors.New("invalid code")
+)
+
+func newMFAStore(path string) *mfaStore {
+	store := &mfaStore{path: path, users: make(map[string]mfaEnrollment)}
+	if path != "" {
+		if err := readJSONFile(path, &store.users); err != nil {
+			log.Printf("mfa store %s unreadable: %v", path, err)
+		}
+	}
+	return store
+}
+
+func (s *mfaStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := writeJSONFile(s.path, s.users); err != nil {
+		log.Printf("mfa store %s not saved: %v", s.path, err)
+	}
+}
+
+func mfaKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func (s *mfaStore) get(username string) (mfaEnrollment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.users[mfaKey(username)]
+	return e, ok
+}
+
+func (s *mfaStore) enrolled(username string) bool {
+	e, ok := s.get(username)
+	return ok && e.Confirmed
+}
+
+// begin returns the pending enrollment of username, creating a secret if
+// there is none yet. Reloading the setup page keeps the same secret.
+func (s *mfaStore) begin(username string, now time.Time) (mfaEnrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := mfaKey(username)
+	if e, ok := s.users[key]; ok {
+		if e.Confirmed {
+			return mfaEnrollment{}, errMFAEnrolled
+		}
+		return e, nil
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return mfaEnrollment{}, err
+	}
+	e := mfaEnrollment{Username: username, Secret: totpEncoding.EncodeToString(secret), CreatedAt: now.UTC()}
+	s.users[key] = e
+	s.saveLocked()
+	return e, nil
+}
+
+// confirm activates a pending enrollment with a code from the app and
+// returns the recovery codes, which are only shown this once.
+func (s *mfaStore) confirm(username, code string, now time.Time) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	key := mfaKey(username)
+	e, ok := s.users[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, errMFANotEnrolled
+	}
+	if e.Confirmed {
+		s.mu.Unlock()
+		return nil, errMFAEnrolled
+	}
+	step, ok := e.checkTOTP(code, now)
+	if !ok {
+		s.mu.Unlock()
+		return nil, errMFACode
+	}
+	confirmed := now.UTC()
+	e.Confirmed = true
+	e.ConfirmedAt = &confirmed
+	e.LastStep = step
+	e.RecoveryHashes = hashes
+	e.Failures, e.LockedUntil = 0, nil
+	s.users[key] = e
+	s.saveLocked()
+	s.mu.Unlock()
+
+	recordAudit(auditEvent{
+		Time:    now,
+		Actor:   username,
+		Action:  "mfa.enroll",
+		Subject: username,
+	})
+	return codes, nil
+}
+
+// verify checks a login code. A TOTP code works once; a recovery code is
+// used up.
+func (s *mfaStore) verify(username, code string, now time.Time) bool {
+	code = strings.TrimSpace(code)
+	s.mu.Lock()
+	key := mfaKey(username)
+	e, ok := s.users[key]
+	if !ok || !e.Confirmed {
+		s.mu.Unlock()
+		return false
+	}
+	if step, ok := e.checkTOTP(code, now); ok {
+		e.LastStep = step
+		e.Failures, e.LockedUntil = 0, nil
+		s.users[key] = e
+		s.saveLocked()
+		s.mu.Unlock()
+		return true
+	}
+	hash := hashSecret(normalizeRecoveryCode(code))
+	used := -1
+	for i, h := range e.RecoveryHashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			used = i
+		}
+	}
+	if used < 0 {
+		s.mu.Unlock()
+		return false
+	}
+	e.RecoveryHashes = append(e.RecoveryHashes[:used:used], e.RecoveryHashes[used+1:]...)
+	e.Failures, e.LockedUntil = 0, nil
+	s.users[key] = e
+	s.saveLocked()
+	s.mu.Unlock()
+
+	recordAudit(auditEvent{
+		Time:    now,
+		Actor:   username,
+		Action:  "mfa.recovery",
+		Subject: username,
+		Detail:  fmt.Sprintf("%d recovery codes left", len(e.RecoveryHashes)),
+	})
+	return true
+}
+
+// locked reports whether username is locked out of the code step after
+// too many wrong codes.
+func (s *mfaStore) locked(username string, now time.Time) bool {
+	e, ok := s.get(username)
+	return ok && e.LockedUntil != nil && now.Before(*e.LockedUntil)
+}
+
+// fail counts a wrong login code for username. After mfaMaxLoginAttempts
+// in a row the user is locked out for mfaLockout, and fail returns true.
+// The count lives in the store, so starting a new login does not reset it.
+func (s *mfaStore) fail(username string, now time.Time) bool {
+	s.mu.Lock()
+	key := mfaKey(username)
+	e, ok := s.users[key]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	e.Failures++
+	locked := e.Failures >= mfaMaxLoginAttempts
+	if locked {
+		until := now.Add(mfaLockout).UTC()
+		e.Failures = 0
+		e.LockedUntil = &until
+	}
+	s.users[key] = e
+	s.saveLocked()
+	s.mu.Unlock()
+
+	if locked {
+		recordAudit(auditEvent{
+			Time:    now,
+			Actor:   username,
+			Action:  "mfa.lockout",
+			Subject: username,
+			Detail:  fmt.Sprintf("%d invalid codes, locked for %s", mfaMaxLoginAttempts, mfaLockout),
+		})
+	}
+	return locked
+}
+
+// remove turns the second factor of username off.
+func (s *mfaStore) remove(username, actor string, now time.Time) error {
+	s.mu.Lock()
+	key := mfaKey(username)
+	e, ok := s.users[key]
+	if ok {
+		delete(s.users, key)
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+	if !ok || !e.Confirmed {
+		return errMFANotEnrolled
+	}
+
+	recordAudit(auditEvent{
+		Time:    now,
+		Actor:   actor,
+		Action:  "mfa.disable",
+		Subject: e.Username,
+	})
+	return nil
+}
+
+// checkTOTP accepts a code only for a time step after the last one used,
+// so an observed code cannot be replayed.
+func (e mfaEnrollment) checkTOTP(code string, now time.Time) (int64, bool) {
+	secret, err := totpEncoding.DecodeString(e.Secret)
+	if err != nil {
+		return 0, false
+	}
+	step, ok := totpStep(secret, code, now)
+	if !ok || step <= e.LastStep {
+		return 0, false
+	}
+	return step, true
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryKeys)
+	hashes := make([]string, 0, recoveryKeys)
+	for range recoveryKeys {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashSecret(code))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// mfaRequiredFor reports whether a password login of username needs a
+// second factor.
+func mfaRequiredFor(username string) bool {
+	switch mfaMode {
+	case mfaModeRequired:
+		return true
+	case mfaModeOptional:
+		return mfaEnrollments.enrolled(username)
+	default:
+		return false
+	}
+}
+
+var errMFAPassword = errors.New("directory password refused: two-factor authentication is enabled")
+
+const (
+	mfaLoginKey         = "mfa_login"
+	mfaLoginTimeout     = 5 * time.Minute
+	mfaMaxLoginAttempts = 5
+	mfaLockout          = 15 * time.Minute
+)
+
+// mfaLoginState is kept in the session between the password and the code
+// step of a login.
+type mfaLoginState struct {
+	User    *User
+	Access  []Access
+	Expires time.Time
+}
+
+// startMFALogin parks a password login until the second factor is checked.
+// A user without an enrollment under MFA_MODE=required enrolls right here.
+func startMFALogin(w http.ResponseWriter, r *http.Request, u *User, access []Access) {
+	sessionManager.Put(r.Context(), mfaLoginKey, mfaLoginState{
+		User:    u,
+		Access:  access,
+		Expires: time.Now().Add(mfaLoginTimeout),
+	})
+	serveMFALogin(w, u.Name, "")
+}
+
+func serveMFALogin(w http.ResponseWriter, username, message string) {
+	if mfaEnrollments.enrolled(username) {
+		serveMFAPage(w, http.StatusOK, mfaPrompt("/login/mfa", message))
+		return
+	}
+	content, err := mfaSetup(username, "/login/mfa", message)
+	if err != nil {
+		log.Printf("mfa setup failed for %s: %v", username, err)
+		serveLogin(w, "Login failed.")
+		return
+	}
+	serveMFAPage(w, http.StatusOK, content)
+}
+
+func pendingMFALogin(r *http.Request) (mfaLoginState, bool) {
+	login, ok := sessionManager.Get(r.Context(), mfaLoginKey).(mfaLoginState)
+	if !ok || login.User == nil || time.Now().After(login.Expires) {
+		return mfaLoginState{}, false
+	}
+	return login, true
+}
+
+func handleMFALoginGet(w http.ResponseWriter, r *http.Request) {
+	login, ok := pendingMFALogin(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	serveMFALogin(w, login.User.Name, "")
+}
+
+// handleMFALoginPost finishes a password login with a TOTP or recovery
+// code, or confirms the enrollment of a user who had to enroll first.
+func handleMFALoginPost(w http.ResponseWriter, r *http.Request) {
+	login, ok := pendingMFALogin(r)
+	if !ok {
+		sessionManager.Remove(r.Context(), mfaLoginKey)
+		serveLogin(w, "Sign-in expired. Please try again.")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		serveLogin(w, "Invalid form submission.")
+		return
+	}
+	code := strings.TrimSpace(r.FormValue("code"))
+	username := login.User.Name
+	now := time.Now()
+	if mfaEnrollments.locked(username, now) {
+		sessionManager.Remove(r.Context(), mfaLoginKey)
+		serveLogin(w, "Too many invalid codes. Please try again later.")
+		return
+	}
+
+	var recoveryCodes []string
+	if mfaEnrollments.enrolled(username) {
+		ok = mfaEnrollments.verify(username, code, now)
+	} else {
+		var err error
+		recoveryCodes, err = mfaEnrollments.confirm(username, code, now)
+		ok = err == nil
+	}
+	if !ok {
+		if mfaEnrollments.fail(username, now) {
+			sessionManager.Remove(r.Context(), mfaLoginKey)
+			log.Printf("mfa failed too often for %s", username)
+			serveLogin(w, "Too many invalid codes. Please try again later.")
+			return
+		}
+		serveMFALogin(w, username, "Invalid code.")
+		return
+	}
+
+	sessionManager.Remove(r.Context(), mfaLoginKey)
+	if err := createSession(r, loginSourcePassword, login.User, login.Access, nil); err != nil {
+		log.Printf("session create failed for %s: %v", username, err)
+		serveLogin(w, "Login failed.")
+		return
+	}
+	personalTokens.refresh(loginSourcePassword, login.User, login.Access, nil)
+	if recoveryCodes != nil {
+		serveMFAPage(w, http.StatusOK, mfaRecovery(recoveryCodes))
+		return
+	}
+	http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
+}
+
+// handleMFASettings shows the enrollment page of a signed-in user, or the
+// status of an existing enrollment.
+func handleMFASettings(w http.ResponseWriter, r *http.Request) {
+	sess, ok := getSession(r)
+	if !ok || sess.Anonymous {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	serveMFASettings(w, sess.User.Name, "")
+}
+
+func serveMFASettings(w http.ResponseWriter, username, message string) {
+	if e, ok := mfaEnrollments.get(username); ok && e.Confirmed {
+		serveMFAPage(w, http.StatusOK, mfaStatus(e, message))
+		return
+	}
+	content, err := mfaSetup(username, "/mfa", message)
+	if err != nil {
+		log.Printf("mfa setup failed for %s: %v", username, err)
+		http.Error(w, "mfa unavailable", http.StatusInternalServerError)
+		return
+	}
+	serveMFAPage(w, http.StatusOK, content)
+}
+
+func handleMFAEnroll(w http.ResponseWriter, r *http.Request) {
+	sess, ok := getSession(r)
+	if !ok || sess.Anonymous {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form submission", http.StatusBadRequest)
+		return
+	}
+	codes, err := mfaEnrollments.confirm(sess.User.Name, strings.TrimSpace(r.FormValue("code")), time.Now())
+	if err != nil {
+		serveMFASettings(w, sess.User.Name, "Invalid code.")
+		return
+	}
+	serveMFAPage(w, http.StatusOK, mfaRecovery(codes))
+}
+
+// handleMFADisable turns the second factor off after a final code check.
+// Under MFA_MODE=required only an admin reset can remove it.
+func handleMFADisable(w http.ResponseWriter, r *http.Request) {
+	sess, ok := getSession(r)
+	if !ok || sess.Anonymous {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if mfaMode == mfaModeRequired {
+		serveMFASettings(w, sess.User.Name, "Two-factor authentication is required and cannot be turned off.")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form submission", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if !mfaEnrollments.verify(sess.User.Name, r.FormValue("code"), now) {
+		serveMFASettings(w, sess.User.Name, "Invalid code.")
+		return
+	}
+	if err := mfaEnrollments.remove(sess.User.Name, sess.User.Name, now); err != nil {
+		serveMFASettings(w, sess.User.Name, "Two-factor authentication is not enabled.")
+		return
+	}
+	http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
+}
+
+func serveMFAPage(w http.ResponseWriter, status int, content string) {
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, strings.Replace(mfaHTML, "{{CONTENT}}", content, 1))
+}
+
+func mfaCodeForm(action, label, button string) string {
+	form := strings.Replace(mfaCodeFormHTML, "{{ACTION}}", action, 1)
+	form = strings.Replace(form, "{{LABEL}}", label, 1)
+	return strings.Replace(form, "{{BUTTON}}", button, 1)
+}
+
+func mfaErrorHTML(message string) string {
+	if message == "" {
+		return ""
+	}
+	return `<div class="error">` + html.EscapeString(message) + `</div>`
+}
+
+func mfaPrompt(action, message string) string {
+	content := strings.Replace(mfaPromptHTML, "{{ERROR}}", mfaErrorHTML(message), 1)
+	return strings.Replace(content, "{{FORM}}", mfaCodeForm(action, "Code", "Verify"), 1)
+}
+
+func mfaSetup(username, action, message string) (string, error) {
+	e, err := mfaEnrollments.begin(username, time.Now())
+	if err != nil {
+		return "", err
+	}
+	code, err := qr.Encode(e.provisioningURI(), qr.M)
+	if err != nil {
+		return "", err
+	}
+	content := strings.Replace(mfaSetupHTML, "{{QR}}", base64.StdEncoding.EncodeToString(code.PNG()), 1)
+	content = strings.Replace(content, "{{SECRET}}", html.EscapeString(e.Secret), 1)
+	content = strings.Replace(content, "{{ERROR}}", mfaErrorHTML(message), 1)
+	return strings.Replace(content, "{{FORM}}", mfaCodeForm(action, "Code", "Turn on"), 1), nil
+}
+
+func mfaRecovery(codes []string) string {
+	var items strings.Builder
+	for _, code := range codes {
+		items.WriteString("<li>" + html.EscapeString(code) + "</li>")
+	}
+	return strings.Replace(mfaRecoveryHTML, "{{CODES}}", items.String(), 1)
+}
+
+func mfaStatus(e mfaEnrollment, message string) string {
+	content := strings.Replace(mfaStatusHTML, "{{USERNAME}}", html.EscapeString(e.Username), 1)
+	content = strings.Replace(content, "{{RECOVERY}}", fmt.Sprint(len(e.RecoveryHashes)), 1)
+	content = strings.Replace(content, "{{ERROR}}", mfaErrorHTML(message), 1)
+	form := ""
+	if mfaMode != mfaModeRequired {
+		form = mfaCodeForm("/mfa/disable", "Code to turn it off", "Turn off")
+	}
+	return strings.Replace(content, "{{FORM}}", form, 1)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withMFA(t *testing.T, mode string) *mfaStore {
+	t.Helper()
+	prevMode, prevStore := mfaMode, mfaEnrollments
+	mfaMode = mode
+	mfaEnrollments = newMFAStore("")
+	t.Cleanup(func() {
+		mfaMode, mfaEnrollments = prevMode, prevStore
+	})
+	return mfaEnrollments
+}
+
+// currentTOTP returns the code an authenticator app would show for the
+// enrollment of username at now, shifted by offset time steps.
+func currentTOTP(t *testing.T, store *mfaStore, username string, now time.Time, offset int64) string {
+	t.Helper()
+	e, ok := store.get(username)
+	if !ok {
+		t.Fatalf("no enrollment for %s", username)
+	}
+	secret, err := totpEncoding.DecodeString(e.Secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	return totpCode(secret, now.Unix()/int64(totpPeriod/time.Second)+offset)
+}
+
+func enrollMFA(t *testing.T, store *mfaStore, username string, now time.Time) []string {
+	t.Helper()
+	if _, err := store.begin(username, now); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	codes, err := store.confirm(username, currentTOTP(t, store, username, now, 0), now)
+	if err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	return codes
+}
+
+// seedMFALogin stores a login that passed the password step and waits for
+// the second factor.
+func seedMFALogin(t *testing.T, username string) string {
+	t.Helper()
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	access := []Access{{Group: "team1_rw", Namespace: "team1"}}
+	sessionManager.Put(ctx, mfaLoginKey, mfaLoginState{
+		User:    &User{Name: username, Group: "team1_rw", Namespace: "team1"},
+		Access:  access,
+		Expires: time.Now().Add(mfaLoginTimeout),
+	})
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatalf("commit session: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = sessionManager.Store.Delete(token)
+	})
+	return token
+}
+
+func postMFACode(router http.Handler, path, token, code string) *httptest.ResponseRecorder {
+	body := url.Values{"code": {code}}
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func sessionCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "cv_session" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 at T=59s, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	if got := totpCode(secret, 1); got != "287082" {
+		t.Fatalf("expected 287082, got %s", got)
+	}
+	if _, ok := totpStep(secret, "287082", time.Unix(59+30, 0)); !ok {
+		t.Fatalf("expected one step of drift to be accepted")
+	}
+	if _, ok := totpStep(secret, "287082", time.Unix(59+90, 0)); ok {
+		t.Fatalf("expected an old code to be refused")
+	}
+}
+
+func TestMFAStoreEnrollment(t *testing.T) {
+	store := withMFA(t, mfaModeOptional)
+	now := time.Now()
+
+	first, err := store.begin("alice", now)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	again, _ := store.begin("Alice", now)
+	if again.Secret != first.Secret {
+		t.Fatalf("expected a pending enrollment to keep its secret")
+	}
+	if !strings.HasPrefix(first.provisioningURI(), "otpauth://totp/") || !strings.Contains(first.provisioningURI(), "secret="+first.Secret) {
+		t.Fatalf("unexpected provisioning URI %s", first.provisioningURI())
+	}
+	if _, err := store.confirm("alice", "000000", now); err == nil {
+		t.Fatalf("expected a wrong code to be refused")
+	}
+	if store.enrolled("alice") || mfaRequiredFor("alice") {
+		t.Fatalf("expected alice to be unenrolled before confirming")
+	}
+
+	codes := enrollMFA(t, store, "alice", now)
+	if len(codes) != recoveryKeys || !store.enrolled("alice") || !mfaRequiredFor("alice") {
+		t.Fatalf("expected alice to be enrolled with %d recovery codes, got %v", recoveryKeys, codes)
+	}
+	if _, err := store.begin("alice", now); err != errMFAEnrolled {
+		t.Fatalf("expected begin to refuse an enrolled user, got %v", err)
+	}
+	if store.verify("alice", currentTOTP(t, store, "alice", now, 0), now) {
+		t.Fatalf("expected the confirmation code not to be replayable")
+	}
+	if !store.verify("alice", currentTOTP(t, store, "alice", now, 1), now) {
+		t.Fatalf("expected the next code to be accepted")
+	}
+	if !store.verify("alice", strings.ToUpper(codes[0]), now) {
+		t.Fatalf("expected a recovery code to be accepted")
+	}
+	if store.verify("alice", codes[0], now) {
+		t.Fatalf("expected a recovery code to work only once")
+	}
+	if e, _ := store.get("alice"); len(e.RecoveryHashes) != recoveryKeys-1 {
+		t.Fatalf("expected one recovery code to be used up, got %d left", len(e.RecoveryHashes))
+	}
+
+	if err := store.remove("alice", "root", now); err != nil || store.enrolled("alice") {
+		t.Fatalf("expected the enrollment to be removed: %v", err)
+	}
+	if err := store.remove("alice", "root", now); err != errMFANotEnrolled {
+		t.Fatalf("expected a second remove to fail, got %v", err)
+	}
+}
+
+func TestMFALoginFlow(t *testing.T) {
+	store := withMFA(t, mfaModeOptional)
+	withPersonalTokenStore(t)
+	now := time.Now()
+	enrollMFA(t, store, "alice", now)
+	router := cvRouter()
+	token := seedMFALogin(t, "alice")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/login/mfa", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `action="/login/mfa"`) || strings.Contains(rec.Body.String(), "data:image/png") {
+		t.Fatalf("expected the code prompt, got %s", rec.Body.String())
+	}
+
+	rec = postMFACode(router, "/login/mfa", token, "000000")
+	if !strings.Contains(rec.Body.String(), "Invalid code.") {
+		t.Fatalf("expected a wrong code to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = postMFACode(router, "/login/mfa", token, currentTOTP(t, store, "alice", now, 1))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/api/dashboard" {
+		t.Fatalf("expected redirect to the dashboard, got %d %s", rec.Code, rec.Body.String())
+	}
+	cookie := sessionCookie(rec)
+	if cookie == nil {
+		t.Fatalf("expected a session cookie")
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/dashboard", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Welcome, alice.") || !strings.Contains(rec.Body.String(), `href="/mfa"`) {
+		t.Fatalf("expected the dashboard with the two-factor link, got %d", rec.Code)
+	}
+
+	// The pending login is gone once it completed.
+	rec = postMFACode(router, "/login/mfa", cookie.Value, currentTOTP(t, store, "alice", now, 1))
+	if !strings.Contains(rec.Body.String(), "Sign-in expired") {
+		t.Fatalf("expected the pending login to be used up, got %s", rec.Body.String())
+	}
+}
+
+func TestMFALoginEnrollsWhenRequired(t *testing.T) {
+	store := withMFA(t, mfaModeRequired)
+	withPersonalTokenStore(t)
+	router := cvRouter()
+	token := seedMFALogin(t, "bob")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/login/mfa", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), "data:image/png;base64,") {
+		t.Fatalf("expected the setup page with a QR code, got %s", rec.Body.String())
+	}
+
+	rec = postMFACode(router, "/login/mfa", token, currentTOTP(t, store, "bob", time.Now(), 0))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<li>") || sessionCookie(rec) == nil {
+		t.Fatalf("expected the recovery codes and a session, got %d %s", rec.Code, rec.Body.String())
+	}
+	if !store.enrolled("bob") {
+		t.Fatalf("expected bob to be enrolled")
+	}
+}
+
+func TestMFALoginAttemptLimit(t *testing.T) {
+	store := withMFA(t, mfaModeOptional)
+	enrollMFA(t, store, "alice", time.Now().Add(-time.Minute))
+	router := cvRouter()
+
+	// Starting a new login after each wrong code does not reset the count.
+	var rec *httptest.ResponseRecorder
+	for range mfaMaxLoginAttempts {
+		rec = postMFACode(router, "/login/mfa", seedMFALogin(t, "alice"), "000000")
+	}
+	if !strings.Contains(rec.Body.String(), "Too many invalid codes.") {
+		t.Fatalf("expected the login to be dropped, got %s", rec.Body.String())
+	}
+	rec = postMFACode(router, "/login/mfa", seedMFALogin(t, "alice"), currentTOTP(t, store, "alice", time.Now(), 0))
+	if rec.Code == http.StatusSeeOther || !strings.Contains(rec.Body.String(), "Too many invalid codes.") {
+		t.Fatalf("expected a valid code to be refused while locked out, got %d", rec.Code)
+	}
+	if !store.locked("alice", time.Now()) || store.locked("alice", time.Now().Add(mfaLockout)) {
+		t.Fatalf("expected alice to be locked out for %s", mfaLockout)
+	}
+}
+
+func TestMFAStoreResetsFailuresOnSuccess(t *testing.T) {
+	store := withMFA(t, mfaModeOptional)
+	now := time.Now()
+	enrollMFA(t, store, "alice", now.Add(-time.Minute))
+	for range mfaMaxLoginAttempts - 1 {
+		if store.fail("alice", now) {
+			t.Fatalf("expected no lockout before the limit")
+		}
+	}
+	if !store.verify("alice", currentTOTP(t, store, "alice", now, 0), now) {
+		t.Fatalf("expected the code to be accepted")
+	}
+	if store.fail("alice", now) {
+		t.Fatalf("expected a successful code to reset the count")
+	}
+}
+
+func TestMFASettingsEnrollAndDisable(t *testing.T) {
+	store := withMFA(t, mfaModeOptional)
+	router := cvRouter()
+	token := seedSessionWithAccess(t, "alice", []Access{{Group: "team1_rw", Namespace: "team1"}})
+	now := time.Now()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/mfa", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `action="/mfa"`) {
+		t.Fatalf("expected the setup page, got %s", rec.Body.String())
+	}
+	rec = postMFACode(router, "/mfa", token, currentTOTP(t, store, "alice", now, 0))
+	if !store.enrolled("alice") || !strings.Contains(rec.Body.String(), "<li>") {
+		t.Fatalf("expected alice to be enrolled, got %s", rec.Body.String())
+	}
+
+	rec = postMFACode(router, "/mfa/disable", token, "000000")
+	if !store.enrolled("alice") || !strings.Contains(rec.Body.String(), "Invalid code.") {
+		t.Fatalf("expected a wrong code not to turn two-factor off")
+	}
+	rec = postMFACode(router, "/mfa/disable", token, currentTOTP(t, store, "alice", now, 1))
+	if rec.Code != http.StatusSeeOther || store.enrolled("alice") {
+		t.Fatalf("expected two-factor to be off, got %d", rec.Code)
+	}
+}
+
+func TestMFARequiredCannotBeDisabled(t *testing.T) {
+	store := withMFA(t, mfaModeRequired)
+	now := time.Now()
+	enrollMFA(t, store, "alice", now)
+	token := seedSessionWithAccess(t, "alice", []Access{{Group: "team1_rw", Namespace: "team1"}})
+
+	rec := postMFACode(cvRouter(), "/mfa/disable", token, currentTOTP(t, store, "alice", now, 1))
+	if !store.enrolled("alice") || !strings.Contains(rec.Body.String(), "cannot be turned off") {
+		t.Fatalf("expected required two-factor to stay on, got %s", rec.Body.String())
+	}
+}
+
+func TestRegistryAuthRefusesPasswordWithMFA(t *testing.T) {
+	store := withMFA(t, mfaModeOptional)
+	withCachedAuth(t, 0, nil)
+
+	if _, _, err := registryAuth("alice", "secret"); err != nil {
+		t.Fatalf("expected a password to work without two-factor: %v", err)
+	}
+	enrollMFA(t, store, "alice", time.Now())
+	if _, _, err := registryAuth("alice", "secret"); err != errMFAPassword {
+		t.Fatalf("expected the password to be refused, got %v", err)
+	}
+
+	mfaMode = mfaModeRequired
+	if _, _, err := registryAuth("bob", "secret"); err != errMFAPassword {
+		t.Fatalf("expected passwords to be refused in required mode, got %v", err)
+	}
+	mfaMode = mfaModeOff
+	if _, _, err := registryAuth("alice", "secret"); err != nil {
+		t.Fatalf("expected passwords to work with two-factor off: %v", err)
+	}
+}
+
+func TestMFAResetRequiresAdmin(t *testing.T) {
+	store := withMFA(t, mfaModeOptional)
+	enrollMFA(t, store, "bob", time.Now())
+	router := cvRouter()
+	token := seedSessionWithAccess(t, "alice", []Access{{Group: "team1_rw", Namespace: "team1"}})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/api/admin/mfa/bob", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || !store.enrolled("bob") {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+
+	prevAdmins := adminUsers
+	adminUsers = []string{"alice"}
+	t.Cleanup(func() {
+		adminUsers = prevAdmins
+	})
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/admin/mfa/bob", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || store.enrolled("bob") {
+		t.Fatalf("expected the enrollment to be reset, got %d", rec.Code)
+	}
+}
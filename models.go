@@ -2,13 +2,23 @@ package main
 
 import "time"
 
-const sessionTTL = 30 * time.Minute
-
 type sessionData struct {
 	User       *User
 	Access     []Access
 	Namespaces []string
 	CreatedAt  time.Time
+	Anonymous  bool
+	// TokenID is set when the session comes from a personal access token.
+	TokenID string
+	// ID names the session in the session list, so the cookie token is
+	// never shown.
+	ID     string
+	Source string
+	// Groups are the groups an identity provider sent at single sign-on,
+	// mapped again whenever the session is revalidated.
+	Groups     []string
+	RemoteAddr string
+	UserAgent  string
 }
 
 type User struct {
@@ -24,10 +34,19 @@ type Access struct {
 	Namespace     string
 	PullOnly      bool
 	DeleteAllowed bool
+	Role          string
+	Directory     string
+	GrantID       string
+	ExpiresAt     time.Time
+	// Personal marks the owner's grant on their personal namespace.
+	Personal bool
 }
 
 type LDAPConfig struct {
+	Name            string
+	Domains         []string
 	URL             string
+	URLs            []string
 	BaseDN          string
 	UserFilter      string
 	GroupAttribute  string
@@ -35,6 +54,79 @@ type LDAPConfig struct {
 	UserMailDomain  string
 	StartTLS        bool
 	SkipTLSVerify   bool
+	BindDN          string
+	BindPassword    string
+	UserAttribute   string
+
+	GroupResolution       []string
+	GroupBaseDN           string
+	GroupMemberAttributes []string
+	GroupMappingFile      string
+
+	ServerSelection string
+	ServerBackoff   time.Duration
+	DialTimeout     time.Duration
+	PoolSize        int
+	PoolIdleTimeout time.Duration
+}
+
+type TokenConfig struct {
+	Enabled        bool
+	Realm          string
+	Service        string
+	Issuer         string
+	TTL            time.Duration
+	SigningKeyPath string
+}
+
+type OIDCConfig struct {
+	Issuer           string
+	ClientID         string
+	ClientSecret     string
+	RedirectURL      string
+	Scopes           []string
+	UsernameClaim    string
+	GroupsClaim      string
+	GroupPrefix      string
+	GroupMappingFile string
+	ProviderName     string
+}
+
+type SAMLConfig struct {
+	RootURL           string
+	EntityID          string
+	IDPMetadataURL    string
+	IDPMetadataFile   string
+	CertFile          string
+	KeyFile           string
+	UsernameAttribute string
+	GroupsAttribute   string
+	GroupPrefix       string
+	GroupMappingFile  string
+	ProviderName      string
+}
+
+type SessionConfig struct {
+	Store              string
+	Path               string
+	RedisURL           string
+	RedisPrefix        string
+	Lifetime           time.Duration
+	IdleTimeout        time.Duration
+	RevalidateInterval time.Duration
+}
+
+type FileAuthConfig struct {
+	HtpasswdFile     string
+	GroupsFile       string
+	GroupPrefix      string
+	GroupMappingFile string
+}
+
+type OfflineConfig struct {
+	GracePeriod time.Duration
+	Mode        string
+	StorePath   string
 }
 
 type repoInfo struct {
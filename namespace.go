@@ -0,0 +1,40 @@
+package main
+
+import "strings"
+
+// namespaceCovers reports whether path lies below namespace. Namespaces
+// may span several segments, so a grant on org/payments covers
+// org/payments/app and org/payments/batch/worker but not org/payroll.
+func namespaceCovers(namespace, path string) bool {
+	return namespace != "" && strings.HasPrefix(path, namespace+"/")
+}
+
+// mostSpecificNamespace picks the longest namespace that covers path. The
+// most specific grant wins, so org/payments decides for org/payments/app
+// even when org is also granted.
+func mostSpecificNamespace(namespaces []string, path string) (string, bool) {
+	best := ""
+	for _, ns := range namespaces {
+		if namespaceCovers(ns, path) && len(ns) > len(best) {
+			best = ns
+		}
+	}
+	return best, best != ""
+}
+
+// namespaceParent returns the closest other namespace that contains ns.
+func namespaceParent(namespaces []string, ns string) string {
+	parent, _ := mostSpecificNamespace(namespaces, ns)
+	return parent
+}
+
+// repoOwnedBy reports whether namespace is the most specific of namespaces
+// for repo, so listings under a parent leave out repositories that belong
+// to a nested namespace.
+func repoOwnedBy(namespaces []string, namespace, repo string) bool {
+	if !namespaceCovers(namespace, repo) {
+		return false
+	}
+	owner, ok := mostSpecificNamespace(namespaces, repo)
+	return !ok || owner == namespace
+}
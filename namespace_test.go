@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMostSpecificNamespace(t *testing.T) {
+	namespaces := []string{"org", "org/payments", "team1"}
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"org/payments/app", "org/payments", true},
+		{"org/payments/batch/worker", "org/payments", true},
+		{"org/payroll/app", "org", true},
+		{"org/payments", "org", true},
+		{"team1/app", "team1", true},
+		{"team2/app", "", false},
+		{"org", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := mostSpecificNamespace(namespaces, tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Fatalf("%s: expected %q %v, got %q %v", tt.path, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestAuthorizeNestedNamespaces(t *testing.T) {
+	access := []Access{
+		{Group: "org_rwd", Namespace: "org", DeleteAllowed: true},
+		{Group: "org_payments_r", Namespace: "org/payments", PullOnly: true},
+	}
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{http.MethodGet, "/v2/org/payments/app/manifests/v1", true},
+		{http.MethodPut, "/v2/org/payments/app/manifests/v1", false},
+		{http.MethodDelete, "/v2/org/payments/app/manifests/sha256:abc", false},
+		{http.MethodPost, "/v2/org/payments/app/blobs/uploads/", false},
+		{http.MethodPut, "/v2/org/payroll/app/manifests/v1", true},
+		{http.MethodDelete, "/v2/org/payroll/app/manifests/sha256:abc", true},
+		{http.MethodGet, "/v2/orgs/app/manifests/v1", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := authorize(access, req); got != tt.want {
+			t.Fatalf("%s %s: expected %v, got %v", tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestGrantScopesNestedNamespaces(t *testing.T) {
+	access := []Access{
+		{Namespace: "org", Role: roleDeveloper},
+		{Namespace: "org/payments", Role: roleReader},
+	}
+	got := grantScopes(access, []tokenAccess{
+		{Type: "repository", Name: "org/payments/app", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "org/web", Actions: []string{"pull", "push"}},
+	})
+	want := []tokenAccess{
+		{Type: "repository", Name: "org/payments/app", Actions: []string{"pull"}},
+		{Type: "repository", Name: "org/web", Actions: []string{"pull", "push"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestFetchReposSkipsNestedNamespaces(t *testing.T) {
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/_catalog" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]string{
+			"repositories": {"org/web", "org/payments/app", "org/payments/batch/worker", "org2/app"},
+		})
+	})
+	defer cleanup()
+
+	namespaces := []string{"org", "org/payments"}
+	repos, err := fetchRepos(context.Background(), "org", namespaces)
+	if err != nil {
+		t.Fatalf("fetch repos: %v", err)
+	}
+	if !reflect.DeepEqual(repos, []string{"org/web"}) {
+		t.Fatalf("unexpected org repos: %v", repos)
+	}
+	repos, err = fetchRepos(context.Background(), "org/payments", namespaces)
+	if err != nil {
+		t.Fatalf("fetch repos: %v", err)
+	}
+	if !reflect.DeepEqual(repos, []string{"org/payments/app", "org/payments/batch/worker"}) {
+		t.Fatalf("unexpected org/payments repos: %v", repos)
+	}
+}
+
+func TestBuildNamespacePermissionsParent(t *testing.T) {
+	access := []Access{
+		{Group: "org_r", Namespace: "org", PullOnly: true},
+		{Group: "org_payments_rw", Namespace: "org/payments"},
+		{Group: "org_payments_eu_r", Namespace: "org/payments/eu", PullOnly: true},
+	}
+	got := buildNamespacePermissions([]string{"org", "org/payments", "org/payments/eu"}, access)
+	parents := []string{got[0].Parent, got[1].Parent, got[2].Parent}
+	if !reflect.DeepEqual(parents, []string{"", "org", "org/payments"}) {
+		t.Fatalf("unexpected parents: %v", parents)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	offlineModeReadOnly = "read-only"
+	offlineModeFull     = "full"
+
+	offlineKDFIterations = 100_000
+)
+
+// offlineRecord is the last successful directory login for a user, kept so
+// registry access survives an LDAP outage.
+type offlineRecord struct {
+	Salt       []byte    `json:"salt"`
+	Verifier   []byte    `json:"verifier"`
+	Iterations int       `json:"iterations"`
+	User       User      `json:"user"`
+	Access     []Access  `json:"access"`
+	LastLogin  time.Time `json:"last_login"`
+}
+
+func (c OfflineConfig) Enabled() bool {
+	return c.GracePeriod > 0
+}
+
+type offlineStore struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]offlineRecord
+
+	// salt and seen let record recognize a repeated login without running
+	// the KDF. They live in memory only.
+	salt []byte
+	seen map[string][]byte
+}
+
+var offlineAuth = newOfflineStore(offlineCfg.StorePath)
+
+func newOfflineStore(path string) *offlineStore {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	store := &offlineStore{path: path, records: make(map[string]offlineRecord), salt: salt, seen: make(map[string][]byte)}
+	if path != "" {
+		if err := readJSONFile(path, &store.records); err != nil {
+			log.Printf("offline auth store %s unreadable: %v", path, err)
+		}
+	}
+	return store
+}
+
+func offlineKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func offlineVerifier(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, 32)
+}
+
+// offlineRefreshAfter is how old a record may get before an identical
+// login writes it again, so the grace period keeps counting from a recent
+// login.
+func offlineRefreshAfter() time.Duration {
+	return min(time.Hour, offlineCfg.GracePeriod/2)
+}
+
+func (s *offlineStore) loginMAC(username, password string) []byte {
+	mac := hmac.New(sha256.New, s.salt)
+	mac.Write([]byte(offlineKey(username)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// unchanged reports whether the stored record of username already matches
+// this login and is recent enough to keep.
+func (s *offlineStore) unchanged(username string, mac []byte, u *User, access []Access, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := offlineKey(username)
+	rec, ok := s.records[key]
+	return ok && hmac.Equal(s.seen[key], mac) && rec.User == *u && sameAccess(rec.Access, access) &&
+		now.Sub(rec.LastLogin) < offlineRefreshAfter()
+}
+
+// record stores the outcome of a successful directory login and prunes
+// records that are past the grace period. A login with the same password
+// and access as a recent record is not written again, so the KDF and the
+// store write do not run on every registry request.
+func (s *offlineStore) record(username, password string, u *User, access []Access, now time.Time) error {
+	mac := s.loginMAC(username, password)
+	if s.unchanged(username, mac, u, access, now) {
+		return nil
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	verifier, err := offlineVerifier(password, salt, offlineKDFIterations)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, rec := range s.records {
+		if now.Sub(rec.LastLogin) > offlineCfg.GracePeriod {
+			delete(s.records, k)
+		}
+	}
+	s.records[offlineKey(username)] = offlineRecord{
+		Salt:       salt,
+		Verifier:   verifier,
+		Iterations: offlineKDFIterations,
+		User:       *u,
+		Access:     append([]Access(nil), access...),
+		LastLogin:  now,
+	}
+	s.seen[offlineKey(username)] = mac
+	return s.saveLocked()
+}
+
+// verify checks password against the stored record. Records older than the
+// grace period are rejected.
+func (s *offlineStore) verify(username, password string, now time.Time) (*User, []Access, error) {
+	s.mu.Lock()
+	rec, ok := s.records[offlineKey(username)]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("no offline record for %s", username)
+	}
+	if now.Sub(rec.LastLogin) > offlineCfg.GracePeriod {
+		return nil, nil, fmt.Errorf("offline record for %s expired", username)
+	}
+	verifier, err := offlineVerifier(password, rec.Salt, rec.Iterations)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare(verifier, rec.Verifier) != 1 {
+		return nil, nil, fmt.Errorf("offline password mismatch for %s", username)
+	}
+
+	u := rec.User
+	access := append([]Access(nil), rec.Access...)
+	if offlineCfg.Mode != offlineModeFull {
+		for i := range access {
+			access[i].PullOnly = true
+			access[i].DeleteAllowed = false
+			access[i].Role = ""
+		}
+		u.PullOnly = true
+		u.DeleteAllowed = false
+	}
+	return &u, access, nil
+}
+
+// forget drops the record of username, so it can no longer log in while
+// the directory is down.
+func (s *offlineStore) forget(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := offlineKey(username)
+	if _, ok := s.records[key]; !ok {
+		return
+	}
+	delete(s.records, key)
+	delete(s.seen, key)
+	if err := s.saveLocked(); err != nil {
+		log.Printf("offline auth: unable to forget %s: %v", username, err)
+	}
+}
+
+func (s *offlineStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	return writeJSONFile(s.path, s.records)
+}
+
+// directoryAuth authenticates against LDAP. When the directory cannot be
+// reached (as opposed to rejecting the credentials) and offline mode is
+// enabled, it falls back to the user's last good login. degraded reports
+// whether the offline record was used.
+func directoryAuth(username, password string) (u *User, access []Access, degraded bool, err error) {
+	u, access, err = ldapAuth(username, password)
+	if !offlineCfg.Enabled() {
+		return u, access, false, err
+	}
+	if err == nil {
+		if recErr := offlineAuth.record(username, password, u, access, time.Now()); recErr != nil {
+			log.Printf("offline auth: unable to record login for %s: %v", username, recErr)
+		}
+		return u, access, false, nil
+	}
+	if !isLDAPNetworkError(err) {
+		return nil, nil, false, err
+	}
+
+	u, access, offlineErr := offlineAuth.verify(username, password, time.Now())
+	if offlineErr != nil {
+		log.Printf("offline auth: denied %s while directory unreachable: %v", username, offlineErr)
+		return nil, nil, false, err
+	}
+	log.Printf("offline auth: granted %s %s access to %v while directory unreachable: %v",
+		username, offlineCfg.Mode, namespacesFromAccess(access), err)
+	return u, access, true, nil
+}
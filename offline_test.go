@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestDirectoryAuthFallsBackWhenUnreachable(t *testing.T) {
+	ldapDown := withOfflineAuth(t, offlineModeReadOnly)
+
+	if _, _, degraded, err := directoryAuth("alice", "secret"); err != nil || degraded {
+		t.Fatalf("expected online login, got degraded=%v err=%v", degraded, err)
+	}
+
+	*ldapDown = true
+	u, access, degraded, err := directoryAuth("alice", "secret")
+	if err != nil || !degraded {
+		t.Fatalf("expected offline login, got degraded=%v err=%v", degraded, err)
+	}
+	if u.Name != "alice" || len(access) != 1 || !access[0].PullOnly || access[0].DeleteAllowed {
+		t.Fatalf("expected read-only access, got %+v %+v", u, access)
+	}
+
+	if _, _, _, err := directoryAuth("alice", "wrong"); err == nil {
+		t.Fatalf("expected wrong password to be rejected offline")
+	}
+	if _, _, _, err := directoryAuth("bob", "secret"); err == nil {
+		t.Fatalf("expected unknown user to be rejected offline")
+	}
+}
+
+func TestDirectoryAuthFullOfflineMode(t *testing.T) {
+	ldapDown := withOfflineAuth(t, offlineModeFull)
+	if _, _, _, err := directoryAuth("alice", "secret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	*ldapDown = true
+	_, access, _, err := directoryAuth("alice", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if access[0].PullOnly || !access[0].DeleteAllowed {
+		t.Fatalf("expected full access, got %+v", access)
+	}
+}
+
+func TestDirectoryAuthDoesNotFallBackOnBadCredentials(t *testing.T) {
+	withOfflineAuth(t, offlineModeFull)
+	if _, _, _, err := directoryAuth("alice", "secret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return nil, nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+	if _, _, _, err := directoryAuth("alice", "secret"); err == nil {
+		t.Fatalf("expected directory rejection to win over the offline record")
+	}
+}
+
+func TestOfflineStoreExpiryAndPersistence(t *testing.T) {
+	withOfflineAuth(t, offlineModeReadOnly)
+	path := filepath.Join(t.TempDir(), "offline.json")
+	store := newOfflineStore(path)
+	now := time.Now()
+	if err := store.record("Alice", "secret", &User{Name: "Alice"}, []Access{{Namespace: "team1"}}, now); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	reloaded := newOfflineStore(path)
+	if _, _, err := reloaded.verify("alice", "secret", now.Add(time.Minute)); err != nil {
+		t.Fatalf("expected persisted record to verify: %v", err)
+	}
+	if _, _, err := reloaded.verify("alice", "secret", now.Add(2*time.Hour)); err == nil {
+		t.Fatalf("expected record past the grace period to be rejected")
+	}
+}
+
+func withOfflineAuth(t *testing.T, mode string) *bool {
+	t.Helper()
+	down := false
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		if down {
+			return nil, nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused"))
+		}
+		if password != "secret" {
+			return nil, nil, errors.New("ldap bind failed")
+		}
+		return &User{Name: username}, []Access{{Namespace: "team1", DeleteAllowed: true}}, nil
+	}
+	prevCfg := offlineCfg
+	prevStore := offlineAuth
+	offlineCfg = OfflineConfig{GracePeriod: time.Hour, Mode: mode}
+	offlineAuth = newOfflineStore("")
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+		offlineCfg = prevCfg
+		offlineAuth = prevStore
+	})
+	return &down
+}
+
+func TestOfflineStoreSkipsUnchangedLogins(t *testing.T) {
+	withOfflineAuth(t, offlineModeReadOnly)
+	store := newOfflineStore("")
+	now := time.Now()
+	access := []Access{{Namespace: "team1"}}
+	if err := store.record("alice", "secret", &User{Name: "alice"}, access, now); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	first := store.records["alice"]
+
+	if err := store.record("Alice", "secret", &User{Name: "alice"}, access, now.Add(time.Minute)); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if !store.records["alice"].LastLogin.Equal(first.LastLogin) {
+		t.Fatalf("expected a repeated login to keep the record")
+	}
+
+	// A new password, new access or an old record are written again.
+	steps := []struct {
+		name     string
+		password string
+		access   []Access
+		at       time.Time
+	}{
+		{"password", "changed", access, now.Add(time.Minute)},
+		{"access", "changed", []Access{{Namespace: "team2"}}, now.Add(2 * time.Minute)},
+		{"stale", "changed", []Access{{Namespace: "team2"}}, now.Add(time.Hour)},
+	}
+	for _, step := range steps {
+		if err := store.record("alice", step.password, &User{Name: "alice"}, step.access, step.at); err != nil {
+			t.Fatalf("%s: record: %v", step.name, err)
+		}
+		if !store.records["alice"].LastLogin.Equal(step.at) {
+			t.Fatalf("%s: expected the record to be written again", step.name)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcLoginKey     = "oidc_login"
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcLoginState is kept in the session between the redirect to the
+// identity provider and the callback.
+type oidcLoginState struct {
+	State    string
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider is the discovered configuration of the identity provider.
+type oidcProvider struct {
+	discovery oidcDiscovery
+	keys      *jwksCache
+}
+
+var (
+	oidcProviderMu sync.Mutex
+	oidcProviders  = map[string]*oidcProvider{}
+)
+
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != "" && c.ClientID != ""
+}
+
+// oidcProviderFor fetches and caches the discovery document of issuer.
+// Failures are not cached, so a provider that was down at startup is
+// picked up on the next login.
+func oidcProviderFor(ctx context.Context, issuer string) (*oidcProvider, error) {
+	oidcProviderMu.Lock()
+	defer oidcProviderMu.Unlock()
+	if p, ok := oidcProviders[issuer]; ok {
+		return p, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery: status %d", resp.StatusCode)
+	}
+	var doc oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", doc.Issuer, issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: incomplete provider metadata")
+	}
+	p := &oidcProvider{discovery: doc, keys: newJWKSCache(doc.JWKSURI, oidcHTTPClient)}
+	oidcProviders[issuer] = p
+	return p, nil
+}
+
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge derives the S256 code challenge for verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// handleOIDCLogin starts an authorization-code flow with PKCE.
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := oidcProviderFor(r.Context(), oidcCfg.Issuer)
+	if err != nil {
+		log.Printf("oidc login: %v", err)
+		serveLogin(w, "Single sign-on is unavailable.")
+		return
+	}
+
+	var login oidcLoginState
+	for _, field := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *field, err = randomURLString(32); err != nil {
+			serveLogin(w, "Login failed.")
+			return
+		}
+	}
+	login.Expires = time.Now().Add(oidcLoginTimeout)
+	sessionManager.Put(r.Context(), oidcLoginKey, login)
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcCfg.ClientID},
+		"redirect_uri":          {oidcCfg.RedirectURL},
+		"scope":                 {strings.Join(oidcCfg.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {pkceChallenge(login.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	target := provider.discovery.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleOIDCCallback finishes the flow: it checks the state, redeems the
+// code, verifies the ID token and logs the user in with the namespaces
+// derived from the groups claim.
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	login, ok := sessionManager.Get(r.Context(), oidcLoginKey).(oidcLoginState)
+	sessionManager.Remove(r.Context(), oidcLoginKey)
+	query := r.URL.Query()
+	if !ok || time.Now().After(login.Expires) ||
+		subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+		serveLogin(w, "Single sign-on expired. Please try again.")
+		return
+	}
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("oidc callback: provider returned %s: %s", errCode, query.Get("error_description"))
+		serveLogin(w, "Single sign-on was denied.")
+		return
+	}
+
+	user, access, groups, err := oidcAuthenticate(r.Context(), query.Get("code"), login)
+	if err != nil {
+		log.Printf("oidc login failed: %v", err)
+		serveLogin(w, "Single sign-on failed.")
+		return
+	}
+	if err := createSession(r, loginSourceOIDC, user, access, groups); err != nil {
+		log.Printf("session create failed for %s: %v", user.Name, err)
+		serveLogin(w, "Login failed.")
+		return
+	}
+	personalTokens.refresh(loginSourceOIDC, user, access, groups)
+	http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
+}
+
+type oidcTokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+// oidcAuthenticate redeems code and turns the ID token into a user and
+// namespace access. It also returns the groups claim, which the session
+// keeps so it can be mapped again later.
+func oidcAuthenticate(ctx context.Context, code string, login oidcLoginState) (*User, []Access, []string, error) {
+	if code == "" {
+		return nil, nil, nil, errors.New("missing authorization code")
+	}
+	provider, err := oidcProviderFor(ctx, oidcCfg.Issuer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	idToken, err := provider.exchange(ctx, code, login.Verifier)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	claims, err := provider.verifyIDToken(ctx, idToken, login.Nonce, time.Now())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	username, _ := claimValue(claims, oidcCfg.UsernameClaim).(string)
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, nil, nil, fmt.Errorf("id token has no %s claim", oidcCfg.UsernameClaim)
+	}
+	groups := claimStrings(claims, oidcCfg.GroupsClaim)
+	user, access, err := oidcGroupAccess(username, groups)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return user, access, groups, nil
+}
+
+// oidcGroupAccess maps the groups the provider sent for username to
+// namespace access with the current mapping and grants.
+func oidcGroupAccess(username string, groups []string) (*User, []Access, error) {
+	mapper, err := groupMapperFor(oidcCfg.GroupMappingFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, user := accessFromGroups(username, groups, oidcCfg.GroupPrefix, mapper)
+	if user == nil {
+		return nil, nil, fmt.Errorf("%w for %s", errNoAccess, username)
+	}
+	return user, access, nil
+}
+
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcCfg.RedirectURL},
+		"client_id":     {oidcCfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if oidcCfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oidcCfg.ClientID), url.QueryEscape(oidcCfg.ClientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token exchange: status %d", resp.StatusCode)
+	}
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("oidc token exchange: no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, lifetime and nonce
+// of an ID token and returns its claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token, nonce string, now time.Time) (map[string]any, error) {
+	var claims map[string]any
+	if err := verifySignedJWT(token, p.keys.keyFor(ctx), &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != oidcCfg.Issuer {
+		return nil, fmt.Errorf("id token issuer %q", iss)
+	}
+	if !containsString(claimStrings(claims, "aud"), oidcCfg.ClientID) {
+		return nil, errors.New("id token audience mismatch")
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.Add(-tokenClockSkew).Unix() >= int64(exp) {
+		return nil, errors.New("id token expired")
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// claimValue looks up a claim by name. A dotted name such as
+// realm_access.roles walks into nested objects.
+func claimValue(claims map[string]any, name string) any {
+	var value any = claims
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = obj[part]
+	}
+	return value
+}
+
+// claimStrings returns a claim that holds a string or a list of strings.
+func claimStrings(claims map[string]any, name string) []string {
+	switch v := claimValue(claims, name).(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIdP is a minimal OpenID provider: it issues a code for whatever the
+// test asks it to authorize and checks PKCE when the code is redeemed.
+type fakeIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	codes  map[string]fakeAuthorization
+	claims map[string]any
+}
+
+type fakeAuthorization struct {
+	challenge string
+	nonce     string
+	redirect  string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	idp := &fakeIdP{key: key, codes: map[string]fakeAuthorization{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "vault" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		idp.mu.Lock()
+		idp.codes["code-1"] = fakeAuthorization{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), redirect: q.Get("redirect_uri")}
+		idp.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=code-1&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		idp.mu.Lock()
+		auth, ok := idp.codes[r.Form.Get("code")]
+		delete(idp.codes, r.Form.Get("code"))
+		claims := map[string]any{}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		idp.mu.Unlock()
+		id, secret, _ := r.BasicAuth()
+		if !ok || pkceChallenge(r.Form.Get("code_verifier")) != auth.challenge || r.Form.Get("redirect_uri") != auth.redirect || id != "vault" || secret != "s3cret" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		if _, set := claims["nonce"]; !set {
+			claims["nonce"] = auth.nonce
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idp.sign(t, claims)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	idp.claims = map[string]any{
+		"iss":                idp.server.URL,
+		"aud":                "vault",
+		"sub":                "1234",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"preferred_username": "alice",
+		"groups":             []string{"team1_rw", "other"},
+	}
+	return idp
+}
+
+func (idp *fakeIdP) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (idp *fakeIdP) setClaim(name string, value any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims[name] = value
+}
+
+func withOIDC(t *testing.T, idp *fakeIdP) {
+	t.Helper()
+	prevCfg := oidcCfg
+	oidcCfg = OIDCConfig{
+		Issuer:        idp.server.URL,
+		ClientID:      "vault",
+		ClientSecret:  "s3cret",
+		RedirectURL:   "https://vault.test/oidc/callback",
+		Scopes:        []string{"openid", "groups"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		GroupPrefix:   "team",
+		ProviderName:  "Corp SSO",
+	}
+	oidcProviderMu.Lock()
+	oidcProviders = map[string]*oidcProvider{}
+	oidcProviderMu.Unlock()
+	t.Cleanup(func() {
+		oidcCfg = prevCfg
+		oidcProviderMu.Lock()
+		oidcProviders = map[string]*oidcProvider{}
+		oidcProviderMu.Unlock()
+	})
+}
+
+// oidcLogin runs the browser side of the flow and returns the final
+// response from the callback together with the session cookie.
+func oidcLogin(t *testing.T, router http.Handler, idp *fakeIdP, tamperState bool) (*httptest.ResponseRecorder, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected redirect to the provider, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "cv_session" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("expected a session cookie for the login state")
+	}
+	authorize := rec.Header().Get("Location")
+	if !strings.HasPrefix(authorize, idp.server.URL+"/authorize?") {
+		t.Fatalf("unexpected authorize URL %q", authorize)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authorize)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	_ = resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || callback.Path != "/oidc/callback" {
+		t.Fatalf("unexpected callback %q", resp.Header.Get("Location"))
+	}
+	if tamperState {
+		q := callback.Query()
+		q.Set("state", "forged")
+		callback.RawQuery = q.Encode()
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "cv_session" {
+			cookie = c
+		}
+	}
+	return rec, cookie
+}
+
+func TestOIDCLoginCreatesSession(t *testing.T) {
+	idp := newFakeIdP(t)
+	withOIDC(t, idp)
+	router := cvRouter()
+
+	rec, cookie := oidcLogin(t, router, idp, false)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/api/dashboard" {
+		t.Fatalf("expected redirect to the dashboard, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/dashboard", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected dashboard, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "Welcome, alice.") || !strings.Contains(body, `"namespaces":["team1"]`) {
+		t.Fatalf("expected alice with team1 from the groups claim, got %s", body)
+	}
+}
+
+func TestOIDCLoginRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		claim  string
+		value  any
+		tamper bool
+	}{
+		{name: "forged state", tamper: true},
+		{name: "wrong audience", claim: "aud", value: "someone-else"},
+		{name: "wrong issuer", claim: "iss", value: "https://evil.test"},
+		{name: "expired", claim: "exp", value: time.Now().Add(-time.Hour).Unix()},
+		{name: "replayed nonce", claim: "nonce", value: "old-nonce"},
+		{name: "no groups", claim: "groups", value: []string{"other"}},
+		{name: "no username", claim: "preferred_username", value: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newFakeIdP(t)
+			withOIDC(t, idp)
+			if tt.claim != "" {
+				idp.setClaim(tt.claim, tt.value)
+			}
+			rec, _ := oidcLogin(t, cvRouter(), idp, tt.tamper)
+			if rec.Code == http.StatusSeeOther {
+				t.Fatalf("expected login to fail")
+			}
+			if !strings.Contains(rec.Body.String(), `class="error"`) {
+				t.Fatalf("expected the login page with an error, got %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestOIDCGroupsClaimPaths(t *testing.T) {
+	claims := map[string]any{
+		"groups":       "team1_r",
+		"realm_access": map[string]any{"roles": []any{"team2_rw", 7}},
+	}
+	if got := claimStrings(claims, "groups"); strings.Join(got, ",") != "team1_r" {
+		t.Fatalf("unexpected single group: %v", got)
+	}
+	if got := claimStrings(claims, "realm_access.roles"); strings.Join(got, ",") != "team2_rw" {
+		t.Fatalf("unexpected nested groups: %v", got)
+	}
+	if got := claimStrings(claims, "missing.path"); got != nil {
+		t.Fatalf("expected no groups, got %v", got)
+	}
+}
+
+func TestLoginPageShowsSSO(t *testing.T) {
+	idp := newFakeIdP(t)
+	withOIDC(t, idp)
+	rec := httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if !strings.Contains(rec.Body.String(), `href="/oidc/login">Sign in with Corp SSO`) {
+		t.Fatalf("expected SSO link on the login page")
+	}
+}
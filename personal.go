@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// personalNamespace returns the private namespace for username, or "" when
+// personal namespaces are disabled. The username is lowercased; a-z and 0-9
+// are kept and every other byte becomes a dash and two hex digits, so the
+// result is a valid repository path component and distinct users never
+// share a namespace, e.g. alice@corp.example -> u-alice-40corp-2eexample.
+func personalNamespace(username string) string {
+	if !personalNamespaces {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimSpace(username))
+	if name == "" {
+		return ""
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "-%02x", c)
+	}
+	return personalNamespacePrefix + b.String()
+}
+
+// isPersonalNamespace reports whether ns lies in the personal namespace
+// space. The prefix is reserved: group mappings, grants, robot accounts and
+// trust policies cannot target it, so only the owner and admins reach a
+// personal namespace.
+func isPersonalNamespace(ns string) bool {
+	return personalNamespaces && personalNamespacePrefix != "" &&
+		strings.HasPrefix(ns, personalNamespacePrefix)
+}
+
+// reservedNamespaceError refuses configured targets in the personal
+// namespace space.
+func reservedNamespaceError(ns string) error {
+	if !isPersonalNamespace(ns) {
+		return nil
+	}
+	return fmt.Errorf("namespace %s is reserved: %s* is the personal namespace space", ns, personalNamespacePrefix)
+}
+
+// namespaceIsPersonal reports whether access holds the owner's grant on ns.
+func namespaceIsPersonal(access []Access, ns string) bool {
+	for _, entry := range access {
+		if entry.Namespace == ns && entry.Personal {
+			return true
+		}
+	}
+	return false
+}
+
+// withPersonalNamespace adds the owner's own namespace with full rwd
+// rights. Every other entry in the personal namespace space is dropped, so
+// no group or grant can open a user's namespace to someone else. A user
+// without any other grant is given the personal namespace as their primary
+// one.
+func withPersonalNamespace(username string, access []Access, selected *User) ([]Access, *User) {
+	ns := personalNamespace(username)
+	if ns == "" {
+		return access, selected
+	}
+	kept := make([]Access, 0, len(access)+1)
+	for _, entry := range access {
+		if isPersonalNamespace(entry.Namespace) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	kept = append(kept, Access{Group: ns, Namespace: ns, DeleteAllowed: true, Personal: true})
+	if selected == nil || isPersonalNamespace(selected.Namespace) {
+		selected = &User{Name: username, Group: ns, Namespace: ns, DeleteAllowed: true}
+	}
+	return kept, selected
+}
+
+// adminPersonalAccess gives admins rwd access to the personal namespaces the
+// given repositories live in. Personal namespaces are not known up front,
+// so the grant is added per request.
+func adminPersonalAccess(username string, access []Access, repos ...string) []Access {
+	if !personalNamespaces || !isAdminUser(username) {
+		return access
+	}
+	for _, repo := range repos {
+		ns, _, ok := strings.Cut(repo, "/")
+		if !ok || !isPersonalNamespace(ns) {
+			continue
+		}
+		if _, granted := namespaceCapabilities(access, ns); granted {
+			continue
+		}
+		access = append(access, Access{Group: "admin", Namespace: ns, DeleteAllowed: true})
+	}
+	return access
+}
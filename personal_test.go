@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPersonalNamespaceName(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+	tests := map[string]string{
+		"alice":              "u-alice",
+		"Alice":              "u-alice",
+		"alice@corp.example": "u-alice-40corp-2eexample",
+		"john..doe_":         "u-john-2e-2edoe-5f",
+		"@@":                 "u--40-40",
+		" ":                  "",
+	}
+	for username, want := range tests {
+		if got := personalNamespace(username); got != want {
+			t.Fatalf("%q: expected %q, got %q", username, want, got)
+		}
+	}
+	seen := map[string]string{}
+	for _, username := range []string{"alice.b", "alice-b", "alice@b", "alice_b", "aliceb"} {
+		ns := personalNamespace(username)
+		if other, ok := seen[ns]; ok {
+			t.Fatalf("%q and %q share namespace %q", username, other, ns)
+		}
+		seen[ns] = username
+	}
+}
+
+func TestPersonalNamespaceDisabled(t *testing.T) {
+	access, user := accessFromGroups("alice", nil, "team", nil)
+	if user != nil || len(access) != 0 {
+		t.Fatalf("expected no access without personal namespaces, got %+v", access)
+	}
+}
+
+func TestAccessFromGroupsAddsPersonalNamespace(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+
+	access, user := accessFromGroups("alice", []string{"cn=team1_r,dc=corp"}, "team", nil)
+	if user == nil || user.Namespace != "team1" {
+		t.Fatalf("expected team1 to stay the primary namespace, got %+v", user)
+	}
+	if len(access) != 2 || access[1].Namespace != "u-alice" || !access[1].DeleteAllowed || access[1].PullOnly {
+		t.Fatalf("expected rwd personal namespace, got %+v", access)
+	}
+
+	// Users without any group still get somewhere to push.
+	access, user = accessFromGroups("bob", nil, "team", nil)
+	if user == nil || user.Namespace != "u-bob" || len(access) != 1 {
+		t.Fatalf("expected personal namespace for bob, got %+v %+v", user, access)
+	}
+}
+
+func TestAccessFromGroupsDropsGrantsIntoPersonalNamespaces(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+	mapper, err := newGroupMapper(groupMappingFile{
+		Rules: []groupMappingRule{{Match: `^ns-(.+)$`, Namespace: "$1", Permission: "rwd"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	access, user := accessFromGroups("bob", []string{"cn=ns-u-alice,dc=corp", "cn=ns-u-bob,dc=corp"}, "team", mapper)
+	if user == nil || user.Namespace != "u-bob" {
+		t.Fatalf("expected bob's own namespace, got %+v", user)
+	}
+	for _, entry := range access {
+		if entry.Namespace == "u-alice" || (entry.Namespace == "u-bob" && !entry.Personal) {
+			t.Fatalf("expected group grants into personal namespaces to be dropped: %+v", access)
+		}
+	}
+}
+
+func TestPersonalNamespacePrefixIsReserved(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+	files := []groupMappingFile{
+		{Groups: []groupMappingEntry{{Group: "team", Namespace: "U-Team", Permission: "rw"}}},
+		{Rules: []groupMappingRule{{Match: `^(.+)$`, Namespace: "u-$1", Permission: "r"}}},
+	}
+	for _, file := range files {
+		if _, err := newGroupMapper(file); err == nil {
+			t.Fatalf("expected %+v to be refused", file)
+		}
+	}
+	if _, err := newGroupMapper(groupMappingFile{
+		Groups: []groupMappingEntry{{Group: "team", Namespace: "team-u", Permission: "rw"}},
+	}); err != nil {
+		t.Fatalf("expected other namespaces to load: %v", err)
+	}
+}
+
+func TestAuthorizePersonalNamespace(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+	alice, _ := accessFromGroups("alice", nil, "team", nil)
+	bob, _ := accessFromGroups("bob", nil, "team", nil)
+
+	push := httptest.NewRequest(http.MethodPut, "/v2/u-alice/scratch/manifests/dev", nil)
+	if !authorize(alice, push) {
+		t.Fatalf("expected alice to push to her namespace")
+	}
+	del := httptest.NewRequest(http.MethodDelete, "/v2/u-alice/scratch/manifests/sha256:abc", nil)
+	if !authorize(alice, del) {
+		t.Fatalf("expected alice to delete in her namespace")
+	}
+	pull := httptest.NewRequest(http.MethodGet, "/v2/u-alice/scratch/manifests/dev", nil)
+	if authorize(bob, pull) {
+		t.Fatalf("expected bob to be denied")
+	}
+}
+
+func TestAdminPersonalAccess(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+	prevAdmins := adminUsers
+	adminUsers = []string{"root"}
+	t.Cleanup(func() {
+		adminUsers = prevAdmins
+	})
+
+	access := []Access{{Namespace: "team1"}}
+	if got := adminPersonalAccess("bob", access, "u-alice/scratch"); len(got) != 1 {
+		t.Fatalf("expected no extra access for non-admins, got %+v", got)
+	}
+	if got := adminPersonalAccess("root", access, "team2/app"); len(got) != 1 {
+		t.Fatalf("expected no extra access outside personal namespaces, got %+v", got)
+	}
+	got := adminPersonalAccess("root", access, "u-alice/scratch")
+	req := httptest.NewRequest(http.MethodDelete, "/v2/u-alice/scratch/manifests/sha256:abc", nil)
+	if !authorize(got, req) {
+		t.Fatalf("expected admin to manage personal namespaces, got %+v", got)
+	}
+}
+
+func TestCvRouterAdminReachesPersonalNamespace(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+	prevAdmins := adminUsers
+	adminUsers = []string{"root"}
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		access, user := accessFromGroups(username, nil, "team", nil)
+		return user, access, nil
+	}
+	originalUpstream := upstream
+	upstream = mustParse("http://registry.test")
+	originalTransport := proxyTransport
+	proxyTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Request:    r,
+		}, nil
+	})
+	t.Cleanup(func() {
+		adminUsers = prevAdmins
+		ldapAuth = originalAuth
+		upstream = originalUpstream
+		proxyTransport = originalTransport
+	})
+
+	router := cvRouter()
+	for _, tt := range []struct {
+		user string
+		want int
+	}{
+		{"alice", http.StatusOK},
+		{"bob", http.StatusForbidden},
+		{"root", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v2/u-alice/scratch/manifests/dev", nil)
+		req.SetBasicAuth(tt.user, "secret")
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s: expected %d, got %d", tt.user, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestBuildNamespacePermissionsPersonal(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+	access, _ := accessFromGroups("alice", []string{"cn=team1_r,dc=corp"}, "team", nil)
+	got := buildNamespacePermissions(namespacesFromAccess(access), access)
+	if len(got) != 2 || got[0].Personal || !got[1].Personal || got[1].Namespace != "u-alice" {
+		t.Fatalf("unexpected permissions: %+v", got)
+	}
+}
+
+func withPersonalNamespaces(t *testing.T, prefix string) {
+	t.Helper()
+	prevEnabled := personalNamespaces
+	prevPrefix := personalNamespacePrefix
+	personalNamespaces = true
+	personalNamespacePrefix = prefix
+	t.Cleanup(func() {
+		personalNamespaces = prevEnabled
+		personalNamespacePrefix = prevPrefix
+	})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// personalTokenPrefix marks a personal access token.
+const personalTokenPrefix = "cvp_"
+
+// Personal access token scopes.
+const (
+	scopeAPIRead      = "api-read"
+	scopeAPIWrite     = "api-write"
+	scopeRegistryPull = "registry-pull"
+	scopeRegistryPush = "registry-push"
+)
+
+var allTokenScopes = []string{scopeAPIRead, scopeAPIWrite, scopeRegistryPull, scopeRegistryPush}
+
+// personalToken lets scripts act as a user on the API and the registry.
+// Its access is resolved again when it is used, the way the user logged
+// in; the access it carries from the last login is only used while that
+// lookup cannot answer. Only a hash of its secret is kept.
+type personalToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Username   string     `json:"username"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsed   *time.Time `json:"last_used,omitempty"`
+	SecretHash string     `json:"secret_hash,omitempty"`
+	Account    *User      `json:"account,omitempty"`
+	Access     []Access   `json:"access,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	Groups     []string   `json:"groups,omitempty"`
+}
+
+var (
+	errPersonalTokenNotFound = errors.New("personal access token not found")
+	errPersonalTokenInvalid  = errors.New("invalid personal access token")
+)
+
+func isPersonalTokenCredential(value string) bool {
+	return strings.HasPrefix(value, personalTokenPrefix)
+}
+
+func (t personalToken) hasScope(scope string) bool {
+	return containsString(t.Scopes, scope)
+}
+
+// public returns a copy of the token that is safe to show.
+func (t personalToken) public() personalToken {
+	t.SecretHash = ""
+	t.Account = nil
+	t.Access = nil
+	t.Groups = nil
+	return t
+}
+
+type personalTokenStore struct {
+	jsonStore[personalToken]
+}
+
+var personalTokens = newPersonalTokenStore(personalTokenStorePath)
+
+func newPersonalTokenStore(path string) *personalTokenStore {
+	store := &personalTokenStore{}
+	store.load("personal token store", path)
+	return store
+}
+
+func (s *personalTokenStore) pruneLocked(now time.Time) bool {
+	changed := false
+	for id, t := range s.items {
+		if !now.Before(t.ExpiresAt) {
+			delete(s.items, id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// add stores t and returns it together with the token value to hand out.
+func (s *personalTokenStore) add(t personalToken) (personalToken, string, error) {
+	id, err := newGrantID()
+	if err != nil {
+		return personalToken{}, "", err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return personalToken{}, "", err
+	}
+	t.ID = id
+	t.SecretHash = hashSecret(secret)
+	t.Access = append([]Access(nil), t.Access...)
+
+	s.mu.Lock()
+	s.pruneLocked(t.CreatedAt)
+	s.items[id] = t
+	s.saveLocked()
+	s.mu.Unlock()
+
+	recordAudit(auditEvent{
+		Time:    t.CreatedAt,
+		Actor:   t.Username,
+		Action:  "token.create",
+		Subject: "user:" + t.Username,
+		Detail:  t.ID + " " + strings.Join(t.Scopes, ",") + " until " + t.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+	return t, personalTokenPrefix + id + "." + secret, nil
+}
+
+func (s *personalTokenStore) get(id string) (personalToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.items[id]
+	return t, ok
+}
+
+func (s *personalTokenStore) revoke(id, actor string, now time.Time) (personalToken, error) {
+	s.mu.Lock()
+	t, ok := s.items[id]
+	if ok {
+		delete(s.items, id)
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return personalToken{}, errPersonalTokenNotFound
+	}
+
+	recordAudit(auditEvent{
+		Time:    now,
+		Actor:   actor,
+		Action:  "token.revoke",
+		Subject: "user:" + t.Username,
+		Detail:  t.ID,
+	})
+	return t, nil
+}
+
+// revokeUser removes every token of username and reports how many there
+// were.
+func (s *personalTokenStore) revokeUser(username, actor string, now time.Time) int {
+	s.mu.Lock()
+	var revoked []personalToken
+	for id, t := range s.items {
+		if strings.EqualFold(t.Username, username) {
+			revoked = append(revoked, t)
+			delete(s.items, id)
+		}
+	}
+	if len(revoked) > 0 {
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+
+	for _, t := range revoked {
+		recordAudit(auditEvent{
+			Time:    now,
+			Actor:   actor,
+			Action:  "token.revoke",
+			Subject: "user:" + t.Username,
+			Detail:  t.ID,
+		})
+	}
+	return len(revoked)
+}
+
+// list returns the unexpired tokens of username, newest first.
+func (s *personalTokenStore) list(username string, now time.Time) []personalToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pruneLocked(now) {
+		s.saveLocked()
+	}
+	var out []personalToken
+	for _, t := range s.items {
+		if strings.EqualFold(t.Username, username) {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.After(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// refresh replaces the access carried by every token of the user with what
+// a fresh login resolved, and remembers how the user logged in. It reports
+// whether any token changed.
+func (s *personalTokenStore) refresh(source string, u *User, access []Access, groups []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for id, t := range s.items {
+		if !strings.EqualFold(t.Username, u.Name) {
+			continue
+		}
+		if t.Account != nil && *t.Account == *u && sameAccess(t.Access, access) &&
+			t.Source == source && slices.Equal(t.Groups, groups) {
+			continue
+		}
+		account := *u
+		t.Account = &account
+		t.Access = append([]Access(nil), access...)
+		t.Source = source
+		t.Groups = append([]string(nil), groups...)
+		s.items[id] = t
+		changed = true
+	}
+	if changed {
+		s.saveLocked()
+	}
+	return changed
+}
+
+// owners returns one unexpired token of every user that has any, so users
+// without a session can be looked up again.
+func (s *personalTokenStore) owners(now time.Time) []personalToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	var out []personalToken
+	for _, t := range s.items {
+		key := strings.ToLower(t.Username)
+		if seen[key] || !now.Before(t.ExpiresAt) {
+			continue
+		}
+		seen[key] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+// verify checks a token value and records its use.
+func (s *personalTokenStore) verify(value string, now time.Time) (personalToken, bool) {
+	rest, ok := strings.CutPrefix(value, personalTokenPrefix)
+	if !ok {
+		return personalToken{}, false
+	}
+	id, secret, ok := strings.Cut(rest, ".")
+	if !ok {
+		return personalToken{}, false
+	}
+	hash := hashSecret(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, found := s.items[id]
+	if !found || !now.Before(t.ExpiresAt) || subtle.ConstantTimeCompare([]byte(hash), []byte(t.SecretHash)) != 1 {
+		return personalToken{}, false
+	}
+	if t.LastUsed == nil || now.Sub(*t.LastUsed) >= lastUsedResolution {
+		used := now.UTC()
+		t.LastUsed = &used
+		s.items[id] = t
+		s.saveLocked()
+	}
+	return t, true
+}
+
+// account returns the user and current access behind a verified token.
+// The user is looked up again the way they last logged in; a user that is
+// gone or lost every group gets nothing. While the lookup cannot answer,
+// and for tokens from before logins were recorded, the access carried from
+// the last login is used without grants that have since ended.
+func (t personalToken) account(now time.Time) (*User, []Access, bool) {
+	if t.Source != "" {
+		u, access, err := accessLookups.resolve(t.Source, t.Username, t.Groups, now)
+		switch {
+		case err == nil:
+			return u, access, true
+		case accountGone(err):
+			return nil, nil, false
+		}
+	}
+	u := User{Name: t.Username}
+	if t.Account != nil {
+		u = *t.Account
+	}
+	access, _ := activeAccess(append([]Access(nil), t.Access...), now)
+	return &u, access, true
+}
+
+// registryAccess narrows access to what the registry scopes of the token
+// allow. registry-push adds pushes to namespaces the user can push to;
+// neither scope deletes tags or repositories.
+func (t personalToken) registryAccess(access []Access) []Access {
+	push := t.hasScope(scopeRegistryPush)
+	var scoped []Access
+	for _, a := range access {
+		caps := a.capabilities()
+		if !caps[capPull] {
+			continue
+		}
+		a.DeleteAllowed = false
+		if push && caps[capPush] {
+			a.PullOnly = false
+			a.Role = roleDeveloper
+		} else {
+			a.PullOnly = true
+			a.Role = roleReader
+		}
+		scoped = append(scoped, a)
+	}
+	return scoped
+}
+
+// personalTokenAuth authenticates a registry login that uses a personal
+// access token as its password.
+func personalTokenAuth(username, value string) (*User, []Access, error) {
+	now := time.Now()
+	t, ok := personalTokens.verify(value, now)
+	if !ok || !strings.EqualFold(t.Username, username) {
+		return nil, nil, errPersonalTokenInvalid
+	}
+	if !t.hasScope(scopeRegistryPull) && !t.hasScope(scopeRegistryPush) {
+		return nil, nil, errPersonalTokenInvalid
+	}
+	u, access, ok := t.account(now)
+	if !ok {
+		return nil, nil, errPersonalTokenInvalid
+	}
+	return u, t.registryAccess(access), nil
+}
+
+// personalTokenSession builds an API session from a bearer token. API
+// reads need api-read or api-write; anything else needs api-write.
+func personalTokenSession(r *http.Request) (sessionData, bool) {
+	value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return sessionData{}, false
+	}
+	now := time.Now()
+	t, ok := personalTokens.verify(strings.TrimSpace(value), now)
+	if !ok {
+		return sessionData{}, false
+	}
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if !t.hasScope(scopeAPIWrite) && !(read && t.hasScope(scopeAPIRead)) {
+		return sessionData{}, false
+	}
+	u, access, ok := t.account(now)
+	if !ok {
+		return sessionData{}, false
+	}
+	return sessionData{
+		User:       u,
+		Access:     access,
+		Namespaces: namespacesFromAccess(access),
+		CreatedAt:  t.CreatedAt,
+		TokenID:    t.ID,
+		Source:     t.Source,
+		Groups:     t.Groups,
+	}, true
+}
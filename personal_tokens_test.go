@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPersonalTokenVerify(t *testing.T) {
+	store := withPersonalTokenStore(t)
+	now := time.Now()
+	token, value, err := store.add(personalToken{Name: "ci", Username: "alice", Scopes: []string{scopeAPIRead}, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("add token: %v", err)
+	}
+	if !isPersonalTokenCredential(value) || strings.Contains(token.SecretHash, value) {
+		t.Fatalf("unexpected token value %q", value)
+	}
+	got, ok := store.verify(value, now)
+	if !ok || got.LastUsed == nil {
+		t.Fatalf("expected token to verify and record its use")
+	}
+	if _, ok := store.verify(value+"x", now); ok {
+		t.Fatalf("expected tampered token to fail")
+	}
+	if _, ok := store.verify(value, now.Add(time.Hour)); ok {
+		t.Fatalf("expected expired token to fail")
+	}
+	if _, err := store.revoke(token.ID, "alice", now); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, ok := store.verify(value, now); ok {
+		t.Fatalf("expected revoked token to fail")
+	}
+}
+
+func TestPersonalTokenRegistryAuth(t *testing.T) {
+	store := withPersonalTokenStore(t)
+	now := time.Now()
+	access := []Access{{Group: "team1_rwd", Namespace: "team1", DeleteAllowed: true}}
+	_, pullValue, _ := store.add(personalToken{Username: "alice", Scopes: []string{scopeRegistryPull}, CreatedAt: now, ExpiresAt: now.Add(time.Hour), Access: access})
+	_, pushValue, _ := store.add(personalToken{Username: "alice", Scopes: []string{scopeRegistryPush}, CreatedAt: now, ExpiresAt: now.Add(time.Hour), Access: access})
+	_, apiValue, _ := store.add(personalToken{Username: "alice", Scopes: []string{scopeAPIWrite}, CreatedAt: now, ExpiresAt: now.Add(time.Hour), Access: access})
+
+	_, got, err := registryAuth("alice", pullValue)
+	if err != nil || !namespaceCan(got, "team1", capPull) || namespaceCan(got, "team1", capPush) {
+		t.Fatalf("expected pull-only access, got %+v %v", got, err)
+	}
+	_, got, err = registryAuth("alice", pushValue)
+	if err != nil || !namespaceCan(got, "team1", capPush) || namespaceCan(got, "team1", capDeleteTag) {
+		t.Fatalf("expected push without delete, got %+v %v", got, err)
+	}
+	if _, _, err := registryAuth("alice", apiValue); err == nil {
+		t.Fatalf("expected api-only token to be refused by the registry")
+	}
+	if _, _, err := registryAuth("bob", pushValue); err == nil {
+		t.Fatalf("expected another username to be refused")
+	}
+}
+
+func TestCvRouterPersonalTokenBasicAuth(t *testing.T) {
+	store := withPersonalTokenStore(t)
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer cleanup()
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		t.Fatalf("personal access tokens must not reach the directory")
+		return nil, nil, nil
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+
+	now := time.Now()
+	_, value, _ := store.add(personalToken{
+		Username:  "alice",
+		Scopes:    []string{scopeRegistryPull},
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+		Access:    []Access{{Group: "team1_rw", Namespace: "team1"}},
+	})
+	router := cvRouter()
+	for _, tt := range []struct {
+		method string
+		want   int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodPut, http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, "/v2/team1/app/manifests/latest", nil)
+		req.SetBasicAuth("alice", value)
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s: expected %d, got %d", tt.method, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestPersonalTokenAPIBearer(t *testing.T) {
+	store := withPersonalTokenStore(t)
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"repositories":["team1/app"]}`))
+	})
+	defer cleanup()
+
+	now := time.Now()
+	access := []Access{{Group: "team1_rwd", Namespace: "team1", DeleteAllowed: true}}
+	_, readValue, _ := store.add(personalToken{Username: "alice", Scopes: []string{scopeAPIRead}, CreatedAt: now, ExpiresAt: now.Add(time.Hour), Access: access})
+	_, pullValue, _ := store.add(personalToken{Username: "alice", Scopes: []string{scopeRegistryPull}, CreatedAt: now, ExpiresAt: now.Add(time.Hour), Access: access})
+
+	router := cvRouter()
+	call := func(method, path, value string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+value)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := call(http.MethodGet, "/api/repos?namespace=team1", readValue); code != http.StatusOK {
+		t.Fatalf("expected api-read token to list repos, got %d", code)
+	}
+	if code := call(http.MethodGet, "/api/repos?namespace=team2", readValue); code != http.StatusForbidden {
+		t.Fatalf("expected the token to carry the user's namespaces, got %d", code)
+	}
+	if code := call(http.MethodDelete, "/api/tag?repo=team1/app&tag=v1", readValue); code != http.StatusUnauthorized {
+		t.Fatalf("expected api-read token to be refused a write, got %d", code)
+	}
+	if code := call(http.MethodGet, "/api/repos?namespace=team1", pullValue); code != http.StatusUnauthorized {
+		t.Fatalf("expected registry-only token to be refused by the API, got %d", code)
+	}
+	if code := call(http.MethodGet, "/api/repos?namespace=team1", "cvp_bogus.value"); code != http.StatusUnauthorized {
+		t.Fatalf("expected unknown token to be refused, got %d", code)
+	}
+}
+
+func TestPersonalTokenAPI(t *testing.T) {
+	withPersonalTokenStore(t)
+	router := cvRouter()
+	alice := seedSessionWithAccess(t, "alice", []Access{{Group: "team1_r", Namespace: "team1", PullOnly: true}})
+	bob := seedSessionWithAccess(t, "bob", []Access{{Group: "team2_r", Namespace: "team2", PullOnly: true}})
+
+	call := func(cookie, bearer, method, path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		var buf bytes.Buffer
+		if body != nil {
+			_ = json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "cv_session", Value: cookie})
+		}
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	body := map[string]any{"name": "laptop", "duration": "720h", "scopes": []string{"api-read", "api-write", "registry-pull"}}
+	rec := call(alice, "", http.MethodPost, "/api/tokens", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if raw := rec.Body.String(); strings.Contains(raw, "secret_hash") || strings.Contains(raw, `"access"`) {
+		t.Fatalf("expected the hash and access to stay private: %s", raw)
+	}
+	var created tokenCreatePayload
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("decode token: %v", err)
+	}
+	if created.ID == "" || created.Token == "" || created.Username != "alice" || len(created.Scopes) != 3 {
+		t.Fatalf("unexpected token: %+v", created)
+	}
+
+	for name, body := range map[string]map[string]any{
+		"no scopes":    {"name": "x", "duration": "1h", "scopes": []string{}},
+		"bad scope":    {"name": "x", "duration": "1h", "scopes": []string{"admin"}},
+		"too long":     {"name": "x", "duration": "9999h", "scopes": []string{"api-read"}},
+		"missing name": {"duration": "1h", "scopes": []string{"api-read"}},
+	} {
+		if rec := call(alice, "", http.MethodPost, "/api/tokens", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", name, rec.Code)
+		}
+	}
+	if rec := call("", created.Token, http.MethodPost, "/api/tokens", body); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a token to be refused minting tokens, got %d", rec.Code)
+	}
+
+	var listed tokenListPayload
+	_ = json.NewDecoder(call("", created.Token, http.MethodGet, "/api/tokens", nil).Body).Decode(&listed)
+	if len(listed.Tokens) != 1 || listed.Tokens[0].ID != created.ID || listed.Tokens[0].LastUsed == nil {
+		t.Fatalf("expected the used token in the list, got %+v", listed)
+	}
+	listed = tokenListPayload{}
+	_ = json.NewDecoder(call(bob, "", http.MethodGet, "/api/tokens", nil).Body).Decode(&listed)
+	if len(listed.Tokens) != 0 {
+		t.Fatalf("expected bob to see no tokens, got %+v", listed)
+	}
+
+	if rec := call(bob, "", http.MethodDelete, "/api/tokens/"+created.ID, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected bob revoke to be refused, got %d", rec.Code)
+	}
+	if rec := call(alice, "", http.MethodDelete, "/api/tokens/"+created.ID, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected revoke to succeed, got %d", rec.Code)
+	}
+	if rec := call("", created.Token, http.MethodGet, "/api/tokens", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked token to stop working, got %d", rec.Code)
+	}
+}
+
+func TestPersonalTokenRefreshOnLogin(t *testing.T) {
+	store := withPersonalTokenStore(t)
+	withLookupAccess(t, func(username string) (*User, []Access, error) {
+		return nil, nil, errors.New("ldap: connection refused")
+	})
+	now := time.Now()
+	token, _, _ := store.add(personalToken{Username: "alice", Scopes: []string{scopeAPIRead}, CreatedAt: now, ExpiresAt: now.Add(time.Hour), Access: []Access{{Namespace: "team1"}}})
+
+	store.refresh(loginSourcePassword, &User{Name: "Alice", Namespace: "team2"}, []Access{{Namespace: "team2"}}, nil)
+	got, _ := store.get(token.ID)
+	if _, access, ok := got.account(now); !ok || strings.Join(namespacesFromAccess(access), ",") != "team2" {
+		t.Fatalf("expected the token to pick up the new access, got %+v", access)
+	}
+}
+
+func TestPersonalTokenResolvesAccessWhenUsed(t *testing.T) {
+	store := withPersonalTokenStore(t)
+	calls := 0
+	var lookupErr error
+	withLookupAccess(t, func(username string) (*User, []Access, error) {
+		calls++
+		if lookupErr != nil {
+			return nil, nil, lookupErr
+		}
+		return &User{Name: username}, []Access{{Group: "team2_rw", Namespace: "team2"}}, nil
+	})
+	now := time.Now()
+	_, value, _ := store.add(personalToken{
+		Username:  "alice",
+		Scopes:    []string{scopeRegistryPush},
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+		Access:    []Access{{Group: "team1_rwd", Namespace: "team1", DeleteAllowed: true}},
+		Source:    loginSourcePassword,
+	})
+
+	for range 2 {
+		_, got, err := registryAuth("alice", value)
+		if err != nil || namespaceCan(got, "team1", capPull) || !namespaceCan(got, "team2", capPush) {
+			t.Fatalf("expected the current access instead of the snapshot, got %+v %v", got, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the lookup to be cached, got %d calls", calls)
+	}
+
+	accessLookups.flush("alice")
+	lookupErr = errUnknownUser
+	if _, _, err := registryAuth("alice", value); err == nil {
+		t.Fatalf("expected the token of a removed user to be refused")
+	}
+}
+
+func withPersonalTokenStore(t *testing.T) *personalTokenStore {
+	return withStore(t, &personalTokens, newPersonalTokenStore(""))
+}
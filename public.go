@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isPublicRepository reports whether repo lies in one of PUBLIC_NAMESPACES.
+func isPublicRepository(repo string) bool {
+	_, ok := mostSpecificNamespace(publicNamespaces, repo)
+	return ok
+}
+
+// publicPull reports whether r reads a manifest, blob or tag list in a
+// public namespace. Such requests need no credentials; pushes, deletes and
+// upload sessions always do.
+func publicPull(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if !isSafeRequestPath(r) || strings.Contains(r.URL.Path, "/blobs/uploads/") {
+		return false
+	}
+	repo, ok := repositoryFromPath(r.URL.Path)
+	return ok && isPublicRepository(repo)
+}
+
+// publicAccess grants pull on every public namespace.
+func publicAccess() []Access {
+	access := make([]Access, 0, len(publicNamespaces))
+	for _, ns := range publicNamespaces {
+		access = append(access, Access{Namespace: ns, PullOnly: true})
+	}
+	return access
+}
+
+// anonymousSession is used for UI reads without a login. It only sees the
+// public namespaces and can never do more than pull.
+func anonymousSession() sessionData {
+	access := publicAccess()
+	return sessionData{
+		User:       &User{},
+		Access:     access,
+		Namespaces: namespacesFromAccess(access),
+		Anonymous:  true,
+	}
+}
+
+// withPublicNamespaces lets a logged-in user browse the public namespaces
+// next to their own. A public namespace that one of the user's grants
+// already covers is left out: its pull-only entry would be the most
+// specific match there and take away the push or delete the grant allows.
+func withPublicNamespaces(sess sessionData) sessionData {
+	if len(publicNamespaces) == 0 || sess.Anonymous {
+		return sess
+	}
+	access := make([]Access, 0, len(sess.Access)+len(publicNamespaces))
+	access = append(access, sess.Access...)
+	for _, entry := range publicAccess() {
+		if !accessCovers(sess.Access, entry.Namespace) {
+			access = append(access, entry)
+		}
+	}
+	sess.Access = access
+	sess.Namespaces = namespacesFromAccess(access)
+	return sess
+}
+
+// accessCovers reports whether any entry in access is namespace or covers it.
+func accessCovers(access []Access, namespace string) bool {
+	for _, entry := range access {
+		if entry.Namespace == namespace || namespaceCovers(entry.Namespace, namespace) {
+			return true
+		}
+	}
+	return false
+}
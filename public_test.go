@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublicPull(t *testing.T) {
+	withPublicConfig(t, "base")
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{http.MethodGet, "/v2/base/alpine/manifests/3.20", true},
+		{http.MethodHead, "/v2/base/alpine/blobs/sha256:abc", true},
+		{http.MethodGet, "/v2/base/alpine/tags/list", true},
+		{http.MethodGet, "/v2/base/tools/go/manifests/1.24", true},
+		{http.MethodPut, "/v2/base/alpine/manifests/3.20", false},
+		{http.MethodDelete, "/v2/base/alpine/manifests/sha256:abc", false},
+		{http.MethodGet, "/v2/base/alpine/blobs/uploads/abc", false},
+		{http.MethodGet, "/v2/team1/app/manifests/latest", false},
+		{http.MethodGet, "/v2/basement/app/manifests/latest", false},
+		{http.MethodGet, "/v2/", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := publicPull(req); got != tt.want {
+			t.Fatalf("%s %s: expected %v, got %v", tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestCvRouterAnonymousPublicPull(t *testing.T) {
+	withPublicConfig(t, "base")
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team1", PullOnly: true}}, nil
+	}
+	originalUpstream := upstream
+	upstream = mustParse("http://registry.test")
+	originalTransport := proxyTransport
+	proxyTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Request:    r,
+		}, nil
+	})
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+		upstream = originalUpstream
+		proxyTransport = originalTransport
+	})
+
+	router := cvRouter()
+	tests := []struct {
+		method string
+		path   string
+		auth   bool
+		want   int
+	}{
+		{http.MethodGet, "/v2/base/alpine/manifests/3.20", false, http.StatusOK},
+		{http.MethodPut, "/v2/base/alpine/manifests/3.20", false, http.StatusUnauthorized},
+		{http.MethodGet, "/v2/team1/app/manifests/latest", false, http.StatusUnauthorized},
+		{http.MethodGet, "/v2/", false, http.StatusUnauthorized},
+		// Users without a grant on the public namespace can still pull.
+		{http.MethodGet, "/v2/base/alpine/manifests/3.20", true, http.StatusOK},
+		{http.MethodPut, "/v2/base/alpine/manifests/3.20", true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.auth {
+			req.SetBasicAuth("alice", "secret")
+		}
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s %s auth=%v: expected %d, got %d", tt.method, tt.path, tt.auth, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestTokenEndpointAnonymousPublicScopes(t *testing.T) {
+	withTokenAuth(t)
+	withPublicConfig(t, "base")
+
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/token?service=container-vault&scope=repository:base/alpine:pull,push&scope=repository:team1/app:pull", nil)
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp tokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	claims, err := parseTokenClaims(resp.Token, time.Now())
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if claims.Subject != "" || len(claims.Access) != 1 {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	if got := claims.Access[0]; got.Name != "base/alpine" || len(got.Actions) != 1 || got.Actions[0] != "pull" {
+		t.Fatalf("expected pull on base/alpine only, got %+v", got)
+	}
+}
+
+func TestGrantScopesAddsPublicPull(t *testing.T) {
+	withPublicConfig(t, "base")
+	access := []Access{{Namespace: "base", Role: roleDeveloper}}
+	got := grantScopes(access, []tokenAccess{{Type: "repository", Name: "base/alpine", Actions: []string{"pull", "push"}}})
+	if len(got) != 1 || len(got[0].Actions) != 2 {
+		t.Fatalf("expected developers to keep push on a public namespace, got %+v", got)
+	}
+	got = grantScopes(nil, []tokenAccess{{Type: "repository", Name: "base/alpine", Actions: []string{"push"}}})
+	if len(got) != 0 {
+		t.Fatalf("expected no push for anonymous, got %+v", got)
+	}
+}
+
+func TestAnonymousBrowsePublicNamespaces(t *testing.T) {
+	withPublicConfig(t, "base")
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/_catalog" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"repositories":["base/alpine","team1/app"]}`))
+	})
+	defer cleanup()
+
+	router := cvRouter()
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/api/repos?namespace=base", http.StatusOK},
+		{http.MethodGet, "/api/repos?namespace=team1", http.StatusForbidden},
+		{http.MethodDelete, "/api/tag?repo=base/alpine&tag=3.20", http.StatusUnauthorized},
+		{http.MethodDelete, "/api/admin/auth-cache", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Fatalf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/dashboard", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "Welcome, guest") || !strings.Contains(body, `href="/login"`) || strings.Contains(body, `action="/logout"`) {
+		t.Fatalf("expected guest dashboard, got %s", body)
+	}
+	if !strings.Contains(body, `"public":true`) {
+		t.Fatalf("expected public namespace in bootstrap, got %s", body)
+	}
+}
+
+func TestSessionSeesPublicNamespaces(t *testing.T) {
+	withPublicConfig(t, "base")
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"repositories":["base/alpine"]}`))
+	})
+	defer cleanup()
+
+	router := cvRouter()
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1", DeleteAllowed: true}})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/repos?namespace=base", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/tag?repo=base/alpine&tag=3.20", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestWithPublicNamespacesKeepsCoveringGrants(t *testing.T) {
+	withPublicConfig(t, "org/pub", "base")
+	sess := withPublicNamespaces(sessionData{
+		User:   &User{Name: "alice"},
+		Access: []Access{{Namespace: "org", DeleteAllowed: true}},
+	})
+	del := httptest.NewRequest(http.MethodDelete, "/v2/org/pub/app/manifests/sha256:abc", nil)
+	if !authorize(sess.Access, del) {
+		t.Fatalf("expected rwd on org to keep delete in public org/pub, got %+v", sess.Access)
+	}
+	pull := httptest.NewRequest(http.MethodGet, "/v2/base/alpine/manifests/3.20", nil)
+	if !authorize(sess.Access, pull) {
+		t.Fatalf("expected the uncovered public namespace to be added, got %+v", sess.Access)
+	}
+	push := httptest.NewRequest(http.MethodPut, "/v2/base/alpine/manifests/3.20", nil)
+	if authorize(sess.Access, push) {
+		t.Fatalf("expected public base to stay pull-only")
+	}
+}
+
+func TestLoginPageLinksPublicBrowse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveLogin(rec, "")
+	if strings.Contains(rec.Body.String(), "Browse public images") {
+		t.Fatalf("expected no public link without public namespaces")
+	}
+	withPublicConfig(t, "base")
+	rec = httptest.NewRecorder()
+	serveLogin(rec, "")
+	if !strings.Contains(rec.Body.String(), "Browse public images") {
+		t.Fatalf("expected public link")
+	}
+}
+
+func withPublicConfig(t *testing.T, namespaces ...string) {
+	t.Helper()
+	prev := publicNamespaces
+	publicNamespaces = namespaces
+	t.Cleanup(func() {
+		publicNamespaces = prev
+	})
+}
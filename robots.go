@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// robotPrefix starts every robot account username, which keeps robot
+// logins away from the directory.
+const robotPrefix = "robot$"
+
+// lastUsedResolution is how often the last-used time of a robot or a
+// personal access token is written back to its store.
+const lastUsedResolution = time.Minute
+
+// robotAccount is a namespace-scoped registry login for automation, such
+// as a CI pipeline. Only a hash of its secret is kept.
+type robotAccount struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Namespace   string     `json:"namespace"`
+	Permission  string     `json:"permission"`
+	Description string     `json:"description,omitempty"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+	SecretHash  string     `json:"secret_hash,omitempty"`
+}
+
+var robotNamePattern = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+
+var (
+	errRobotNotFound = errors.New("robot account not found")
+	errRobotExists   = errors.New("robot account already exists")
+)
+
+// robotUsername is the login of the robot called name in namespace.
+func robotUsername(namespace, name string) string {
+	return robotPrefix + namespace + "+" + name
+}
+
+func isRobotUsername(username string) bool {
+	return strings.HasPrefix(username, robotPrefix)
+}
+
+// Username is the registry login of the robot.
+func (a robotAccount) Username() string {
+	return robotUsername(a.Namespace, a.Name)
+}
+
+func (a robotAccount) expired(now time.Time) bool {
+	return a.ExpiresAt != nil && !now.Before(*a.ExpiresAt)
+}
+
+// public returns a copy of the account that is safe to show.
+func (a robotAccount) public() robotAccount {
+	a.SecretHash = ""
+	return a
+}
+
+func (a robotAccount) access() Access {
+	// The permission was validated when the robot was created.
+	grant, _ := grantFromPermission(a.Namespace, a.Permission)
+	return Access{
+		Group:         a.Username(),
+		Namespace:     a.Namespace,
+		PullOnly:      grant.pullOnly,
+		DeleteAllowed: grant.deleteAllowed,
+		Role:          grant.role,
+	}
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+type robotStore struct {
+	jsonStore[robotAccount]
+}
+
+var robotAccounts = newRobotStore(robotStorePath)
+
+func newRobotStore(path string) *robotStore {
+	store := &robotStore{}
+	store.load("robot account store", path)
+	return store
+}
+
+// add stores a and returns it together with its generated secret.
+func (s *robotStore) add(a robotAccount) (robotAccount, string, error) {
+	id, err := newGrantID()
+	if err != nil {
+		return robotAccount{}, "", err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return robotAccount{}, "", err
+	}
+	a.ID = id
+	a.SecretHash = hashSecret(secret)
+
+	s.mu.Lock()
+	for _, existing := range s.items {
+		if existing.Username() == a.Username() {
+			s.mu.Unlock()
+			return robotAccount{}, "", errRobotExists
+		}
+	}
+	s.items[id] = a
+	s.saveLocked()
+	s.mu.Unlock()
+
+	detail := a.Permission
+	if a.ExpiresAt != nil {
+		detail += " until " + a.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	recordAudit(auditEvent{
+		Time:      a.CreatedAt,
+		Actor:     a.CreatedBy,
+		Action:    "robot.create",
+		Namespace: a.Namespace,
+		Subject:   a.Username(),
+		Detail:    detail,
+	})
+	return a, secret, nil
+}
+
+func (s *robotStore) get(id string) (robotAccount, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.items[id]
+	return a, ok
+}
+
+// rotate replaces the secret of robot id; the old secret stops working
+// immediately.
+func (s *robotStore) rotate(id, actor string, now time.Time) (robotAccount, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return robotAccount{}, "", err
+	}
+	s.mu.Lock()
+	a, ok := s.items[id]
+	if ok {
+		a.SecretHash = hashSecret(secret)
+		s.items[id] = a
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return robotAccount{}, "", errRobotNotFound
+	}
+
+	recordAudit(auditEvent{
+		Time:      now,
+		Actor:     actor,
+		Action:    "robot.rotate",
+		Namespace: a.Namespace,
+		Subject:   a.Username(),
+	})
+	return a, secret, nil
+}
+
+func (s *robotStore) remove(id, actor string, now time.Time) (robotAccount, error) {
+	s.mu.Lock()
+	a, ok := s.items[id]
+	if ok {
+		delete(s.items, id)
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return robotAccount{}, errRobotNotFound
+	}
+
+	recordAudit(auditEvent{
+		Time:      now,
+		Actor:     actor,
+		Action:    "robot.delete",
+		Namespace: a.Namespace,
+		Subject:   a.Username(),
+	})
+	return a, nil
+}
+
+// list returns every robot account, expired ones included, sorted by
+// username.
+func (s *robotStore) list() []robotAccount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]robotAccount, 0, len(s.items))
+	for _, a := range s.items {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Username() < out[j].Username()
+	})
+	return out
+}
+
+// verify checks a robot login and records its use. Expired robots are
+// refused but kept, so their owners can see why a pipeline stopped.
+func (s *robotStore) verify(username, secret string, now time.Time) (robotAccount, bool) {
+	hash := hashSecret(secret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, a := range s.items {
+		if a.Username() != username {
+			continue
+		}
+		if a.expired(now) || subtle.ConstantTimeCompare([]byte(hash), []byte(a.SecretHash)) != 1 {
+			return robotAccount{}, false
+		}
+		if a.LastUsed == nil || now.Sub(*a.LastUsed) >= lastUsedResolution {
+			used := now.UTC()
+			a.LastUsed = &used
+			s.items[id] = a
+			s.saveLocked()
+		}
+		return a, true
+	}
+	return robotAccount{}, false
+}
+
+var errRobotCredentials = errors.New("invalid robot credentials")
+
+// robotAuth authenticates a robot account login.
+func robotAuth(username, secret string) (*User, []Access, error) {
+	a, ok := robotAccounts.verify(username, secret, time.Now())
+	if !ok {
+		return nil, nil, errRobotCredentials
+	}
+	access := a.access()
+	return &User{
+		Name:          a.Username(),
+		Group:         access.Group,
+		Namespace:     access.Namespace,
+		PullOnly:      access.PullOnly,
+		DeleteAllowed: access.DeleteAllowed,
+	}, []Access{access}, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRobotStoreVerify(t *testing.T) {
+	store := withRobotStore(t)
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	robot, secret, err := store.add(robotAccount{Name: "ci", Namespace: "team1", Permission: "rw", CreatedAt: now, ExpiresAt: &expires})
+	if err != nil {
+		t.Fatalf("add robot: %v", err)
+	}
+	if robot.Username() != "robot$team1+ci" || robot.SecretHash == secret {
+		t.Fatalf("unexpected robot: %+v", robot)
+	}
+	if _, _, err := store.add(robotAccount{Name: "ci", Namespace: "team1", Permission: "r", CreatedAt: now}); err != errRobotExists {
+		t.Fatalf("expected duplicate to be refused, got %v", err)
+	}
+
+	got, ok := store.verify("robot$team1+ci", secret, now)
+	if !ok || got.LastUsed == nil {
+		t.Fatalf("expected robot to verify and record its use, got %+v", got)
+	}
+	if _, ok := store.verify("robot$team1+ci", "wrong", now); ok {
+		t.Fatalf("expected wrong secret to fail")
+	}
+	if _, ok := store.verify("robot$team2+ci", secret, now); ok {
+		t.Fatalf("expected other robot name to fail")
+	}
+	if _, ok := store.verify("robot$team1+ci", secret, expires); ok {
+		t.Fatalf("expected expired robot to fail")
+	}
+
+	_, rotated, err := store.rotate(robot.ID, "root", now)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if _, ok := store.verify("robot$team1+ci", secret, now); ok {
+		t.Fatalf("expected old secret to stop working")
+	}
+	if _, ok := store.verify("robot$team1+ci", rotated, now); !ok {
+		t.Fatalf("expected new secret to work")
+	}
+}
+
+func TestRobotStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "robots.json")
+	now := time.Now()
+	_, secret, err := newRobotStore(path).add(robotAccount{Name: "ci", Namespace: "team1", Permission: "r", CreatedAt: now})
+	if err != nil {
+		t.Fatalf("add robot: %v", err)
+	}
+	if _, ok := newRobotStore(path).verify("robot$team1+ci", secret, now); !ok {
+		t.Fatalf("expected robot to survive a restart")
+	}
+}
+
+func TestCvRouterRobotLogin(t *testing.T) {
+	store := withRobotStore(t)
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer cleanup()
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		t.Fatalf("robot logins must not reach the directory")
+		return nil, nil, nil
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+
+	now := time.Now()
+	_, secret, _ := store.add(robotAccount{Name: "ci", Namespace: "team1", Permission: "r", CreatedAt: now})
+	router := cvRouter()
+	tests := []struct {
+		method string
+		path   string
+		secret string
+		want   int
+	}{
+		{http.MethodGet, "/v2/team1/app/manifests/latest", secret, http.StatusOK},
+		{http.MethodPut, "/v2/team1/app/manifests/latest", secret, http.StatusForbidden},
+		{http.MethodGet, "/v2/team2/app/manifests/latest", secret, http.StatusForbidden},
+		{http.MethodGet, "/v2/team1/app/manifests/latest", "wrong", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.SetBasicAuth("robot$team1+ci", tt.secret)
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestRobotTokenScopes(t *testing.T) {
+	withTokenAuth(t)
+	store := withRobotStore(t)
+	_, secret, _ := store.add(robotAccount{Name: "ci", Namespace: "team1", Permission: "rw", CreatedAt: time.Now()})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/token?service=container-vault&scope=repository:team1/app:pull,push,delete", nil)
+	req.SetBasicAuth("robot$team1+ci", secret)
+	cvRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp tokenResponse
+	_ = json.NewDecoder(rec.Body).Decode(&resp)
+	claims, err := parseTokenClaims(resp.Token, time.Now())
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if claims.Subject != "robot$team1+ci" || len(claims.Access) != 1 || len(claims.Access[0].Actions) != 2 {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestRobotAPI(t *testing.T) {
+	withRobotStore(t)
+	router := cvRouter()
+	nsAdmin := seedSessionWithAccess(t, "carol", []Access{{Namespace: "team2", Role: roleNamespaceAdmin}})
+	developer := seedSessionWithAccess(t, "dave", []Access{{Namespace: "team2", Role: roleDeveloper}})
+
+	call := func(token, method, path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		var buf bytes.Buffer
+		if body != nil {
+			_ = json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	robot := map[string]string{"namespace": "team2", "name": "ci", "permission": "rw", "duration": "720h"}
+	if rec := call(developer, http.MethodPost, "/api/robots", robot); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected developer to be refused, got %d", rec.Code)
+	}
+	rec := call(nsAdmin, http.MethodPost, "/api/robots", robot)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "secret_hash") {
+		t.Fatalf("expected the secret hash to stay private: %s", rec.Body.String())
+	}
+	var created robotSecretPayload
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("decode robot: %v", err)
+	}
+	if created.ID == "" || created.Username != "robot$team2+ci" || created.Secret == "" || created.ExpiresAt == nil {
+		t.Fatalf("unexpected robot: %+v", created)
+	}
+	if rec := call(nsAdmin, http.MethodPost, "/api/robots", robot); rec.Code != http.StatusConflict {
+		t.Fatalf("expected duplicate to conflict, got %d", rec.Code)
+	}
+	for name, body := range map[string]map[string]string{
+		"bad name":     {"namespace": "team2", "name": "CI Bot!", "permission": "r"},
+		"bad perm":     {"namespace": "team2", "name": "bot", "permission": "owner"},
+		"bad duration": {"namespace": "team2", "name": "bot", "permission": "r", "duration": "soon"},
+	} {
+		if rec := call(nsAdmin, http.MethodPost, "/api/robots", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", name, rec.Code)
+		}
+	}
+
+	if _, _, err := robotAuth(created.Username, created.Secret); err != nil {
+		t.Fatalf("expected the new secret to log in: %v", err)
+	}
+
+	rec = call(nsAdmin, http.MethodGet, "/api/robots", nil)
+	if strings.Contains(rec.Body.String(), "secret_hash") {
+		t.Fatalf("expected the list to hide secret hashes: %s", rec.Body.String())
+	}
+	var listed robotListPayload
+	_ = json.NewDecoder(rec.Body).Decode(&listed)
+	if len(listed.Robots) != 1 || listed.Robots[0].ID != created.ID || listed.Robots[0].LastUsed == nil {
+		t.Fatalf("expected one used robot, got %+v", listed)
+	}
+	listed = robotListPayload{}
+	_ = json.NewDecoder(call(developer, http.MethodGet, "/api/robots", nil).Body).Decode(&listed)
+	if len(listed.Robots) != 0 {
+		t.Fatalf("expected developer to see no robots, got %+v", listed)
+	}
+
+	rec = call(nsAdmin, http.MethodPost, "/api/robots/"+created.ID+"/secret", nil)
+	var rotated robotSecretPayload
+	_ = json.NewDecoder(rec.Body).Decode(&rotated)
+	if rec.Code != http.StatusOK || rotated.Secret == "" || rotated.Secret == created.Secret {
+		t.Fatalf("expected a new secret, got %d %+v", rec.Code, rotated)
+	}
+	if _, _, err := robotAuth(created.Username, created.Secret); err == nil {
+		t.Fatalf("expected the old secret to stop working")
+	}
+
+	if rec := call(developer, http.MethodDelete, "/api/robots/"+created.ID, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected developer delete to be refused, got %d", rec.Code)
+	}
+	if rec := call(nsAdmin, http.MethodDelete, "/api/robots/"+created.ID, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected delete to succeed, got %d", rec.Code)
+	}
+	if _, _, err := robotAuth(created.Username, rotated.Secret); err == nil {
+		t.Fatalf("expected deleted robot to stop working")
+	}
+}
+
+func withRobotStore(t *testing.T) *robotStore {
+	return withStore(t, &robotAccounts, newRobotStore(""))
+}
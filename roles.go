@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Capabilities a namespace grant can carry.
+const (
+	capPull            = "pull"
+	capPush            = "push"
+	capDeleteTag       = "delete-tag"
+	capDeleteRepo      = "delete-repo"
+	capManageRetention = "manage-retention"
+	capManageWebhooks  = "manage-webhooks"
+	capViewAudit       = "view-audit"
+	capManageAccess    = "manage-access"
+)
+
+// Built-in roles.
+const (
+	roleReader         = "reader"
+	roleDeveloper      = "developer"
+	roleMaintainer     = "maintainer"
+	roleNamespaceAdmin = "namespace-admin"
+)
+
+var allCapabilities = []string{
+	capPull, capPush, capDeleteTag, capDeleteRepo,
+	capManageRetention, capManageWebhooks, capViewAudit, capManageAccess,
+}
+
+var roleCapabilities = map[string][]string{
+	roleReader:         {capPull},
+	roleDeveloper:      {capPull, capPush},
+	roleMaintainer:     {capPull, capPush, capDeleteTag, capDeleteRepo, capViewAudit},
+	roleNamespaceAdmin: allCapabilities,
+}
+
+type capabilitySet map[string]bool
+
+func (s capabilitySet) has(capability string) bool {
+	return s[capability]
+}
+
+func (s capabilitySet) list() []string {
+	out := make([]string, 0, len(s))
+	for _, c := range allCapabilities {
+		if s[c] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func isRole(name string) bool {
+	_, ok := roleCapabilities[name]
+	return ok
+}
+
+// capabilities returns what a single grant allows. A named role wins;
+// grants without one keep the r/rw/rd/rwd meaning of PullOnly and
+// DeleteAllowed.
+func (a Access) capabilities() capabilitySet {
+	set := capabilitySet{}
+	if caps, ok := roleCapabilities[a.Role]; ok {
+		for _, c := range caps {
+			set[c] = true
+		}
+		return set
+	}
+	set[capPull] = true
+	if !a.PullOnly {
+		set[capPush] = true
+	}
+	if a.DeleteAllowed {
+		set[capDeleteTag] = true
+		set[capDeleteRepo] = true
+	}
+	return set
+}
+
+// legacyFlags reports the closest PullOnly/DeleteAllowed pair for a role,
+// so code and clients that only know the booleans keep working.
+func legacyFlags(role string) (pullOnly bool, deleteAllowed bool) {
+	caps := Access{Role: role}.capabilities()
+	return !caps.has(capPush), caps.has(capDeleteTag)
+}
+
+// namespaceCapabilities merges every grant for namespace. ok is false when
+// the user has no grant for it at all.
+func namespaceCapabilities(access []Access, namespace string) (capabilitySet, bool) {
+	set := capabilitySet{}
+	ok := false
+	for _, entry := range access {
+		if entry.Namespace == "" || entry.Namespace != namespace {
+			continue
+		}
+		ok = true
+		for c := range entry.capabilities() {
+			set[c] = true
+		}
+	}
+	return set, ok
+}
+
+func namespaceCan(access []Access, namespace, capability string) bool {
+	caps, ok := namespaceCapabilities(access, namespace)
+	return ok && caps.has(capability)
+}
+
+func namespaceRoles(access []Access, namespace string) []string {
+	seen := map[string]bool{}
+	var roles []string
+	for _, entry := range access {
+		if entry.Namespace != namespace || entry.Role == "" || seen[entry.Role] {
+			continue
+		}
+		seen[entry.Role] = true
+		roles = append(roles, entry.Role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// registryCapability maps a registry API request to the capability it
+// needs. Manifest deletes remove tags; blob deletes clean up repository
+// content and need delete-repo.
+func registryCapability(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return capPull
+	case http.MethodDelete:
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			return capDeleteRepo
+		}
+		return capDeleteTag
+	default:
+		return capPush
+	}
+}
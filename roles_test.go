@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAccessCapabilitiesFromLegacyFlags(t *testing.T) {
+	tests := []struct {
+		access Access
+		want   []string
+	}{
+		{Access{PullOnly: true}, []string{capPull}},
+		{Access{}, []string{capPull, capPush}},
+		{Access{PullOnly: true, DeleteAllowed: true}, []string{capPull, capDeleteTag, capDeleteRepo}},
+		{Access{DeleteAllowed: true}, []string{capPull, capPush, capDeleteTag, capDeleteRepo}},
+	}
+	for _, tt := range tests {
+		if got := tt.access.capabilities().list(); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%+v: expected %v, got %v", tt.access, tt.want, got)
+		}
+	}
+}
+
+func TestAccessCapabilitiesFromRole(t *testing.T) {
+	// The role wins over the legacy booleans.
+	access := Access{Role: roleNamespaceAdmin, PullOnly: true}
+	if got := access.capabilities().list(); !reflect.DeepEqual(got, allCapabilities) {
+		t.Fatalf("expected every capability, got %v", got)
+	}
+	if pullOnly, deleteAllowed := legacyFlags(roleDeveloper); pullOnly || deleteAllowed {
+		t.Fatalf("expected developer to map to rw, got pullOnly=%v deleteAllowed=%v", pullOnly, deleteAllowed)
+	}
+}
+
+func TestAuthorizeUsesRoleCapabilities(t *testing.T) {
+	tests := []struct {
+		role   string
+		method string
+		path   string
+		want   bool
+	}{
+		{roleReader, http.MethodGet, "/v2/team1/app/manifests/latest", true},
+		{roleReader, http.MethodPut, "/v2/team1/app/manifests/latest", false},
+		{roleDeveloper, http.MethodPut, "/v2/team1/app/manifests/latest", true},
+		{roleDeveloper, http.MethodDelete, "/v2/team1/app/manifests/sha256:abc", false},
+		{roleMaintainer, http.MethodDelete, "/v2/team1/app/manifests/sha256:abc", true},
+		{roleMaintainer, http.MethodDelete, "/v2/team1/app/blobs/sha256:abc", true},
+	}
+	for _, tt := range tests {
+		access := []Access{{Namespace: "team1", Role: tt.role}}
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := authorize(access, req); got != tt.want {
+			t.Fatalf("%s %s %s: expected %v, got %v", tt.role, tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestNamespaceActionsFromCapabilities(t *testing.T) {
+	access := []Access{{Namespace: "team1", Role: roleDeveloper}, {Namespace: "team2", Role: roleMaintainer}}
+	if got := namespaceActions(access, "team1"); !reflect.DeepEqual(got, []string{"pull", "push"}) {
+		t.Fatalf("unexpected team1 actions: %v", got)
+	}
+	if got := namespaceActions(access, "team2"); !reflect.DeepEqual(got, []string{"pull", "push", "delete"}) {
+		t.Fatalf("unexpected team2 actions: %v", got)
+	}
+	if got := namespaceActions(access, "team3"); got != nil {
+		t.Fatalf("expected no actions for team3, got %v", got)
+	}
+}
+
+func TestBuildNamespacePermissionsCapabilities(t *testing.T) {
+	access := []Access{
+		{Group: "GG-Payments-Admins", Namespace: "payments", Role: roleNamespaceAdmin},
+		{Group: "team1_r", Namespace: "team1", PullOnly: true},
+		{Group: "GG-Team1-Devs", Namespace: "team1", Role: roleDeveloper},
+	}
+	got := buildNamespacePermissions([]string{"payments", "team1"}, access)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 permissions, got %d", len(got))
+	}
+	if !reflect.DeepEqual(got[0].Capabilities, allCapabilities) || !reflect.DeepEqual(got[0].Roles, []string{roleNamespaceAdmin}) {
+		t.Fatalf("unexpected payments permission: %+v", got[0])
+	}
+	if got[0].PullOnly || !got[0].DeleteAllowed {
+		t.Fatalf("expected legacy flags to follow capabilities: %+v", got[0])
+	}
+	if !reflect.DeepEqual(got[1].Capabilities, []string{capPull, capPush}) || got[1].PullOnly || got[1].DeleteAllowed {
+		t.Fatalf("unexpected team1 permission: %+v", got[1])
+	}
+}
+
+func TestGroupMappingAcceptsRoles(t *testing.T) {
+	mapper, err := newGroupMapper(groupMappingFile{
+		Groups: []groupMappingEntry{{Group: "GG-Payments-Maintainers", Namespace: "payments", Permission: "Maintainer"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	access, user := accessFromGroups("alice", []string{"cn=GG-Payments-Maintainers,dc=corp"}, "team", mapper)
+	if user == nil || len(access) != 1 || access[0].Role != roleMaintainer {
+		t.Fatalf("expected maintainer role, got %+v", access)
+	}
+	if !namespaceCan(access, "payments", capViewAudit) || namespaceCan(access, "payments", capManageWebhooks) {
+		t.Fatalf("unexpected maintainer capabilities: %v", access[0].capabilities().list())
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+const (
+	samlRequestCookie = "cv_saml_request"
+	samlLoginTimeout  = 10 * time.Minute
+)
+
+var samlHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	samlProviderMu sync.Mutex
+	samlProvider   *saml.ServiceProvider
+)
+
+func (c SAMLConfig) Enabled() bool {
+	return c.RootURL != "" && (c.IDPMetadataURL != "" || c.IDPMetadataFile != "")
+}
+
+// samlServiceProvider builds the service provider on first use. Like OIDC
+// discovery, a failed metadata fetch is not cached.
+func samlServiceProvider(ctx context.Context) (*saml.ServiceProvider, error) {
+	samlProviderMu.Lock()
+	defer samlProviderMu.Unlock()
+	if samlProvider != nil {
+		return samlProvider, nil
+	}
+
+	key, cert, err := loadSAMLKeyPair(samlCfg.CertFile, samlCfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	idp, err := loadSAMLIDPMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root, err := url.Parse(samlCfg.RootURL)
+	if err != nil {
+		return nil, fmt.Errorf("saml root url: %w", err)
+	}
+	sp := &saml.ServiceProvider{
+		EntityID:          samlCfg.EntityID,
+		Key:               key,
+		Certificate:       cert,
+		HTTPClient:        samlHTTPClient,
+		MetadataURL:       *root.JoinPath("/saml/metadata"),
+		AcsURL:            *root.JoinPath("/saml/acs"),
+		IDPMetadata:       idp,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+	}
+	samlProvider = sp
+	return sp, nil
+}
+
+// loadSAMLKeyPair reads the RSA key the service provider uses to decrypt
+// assertions. Both files are required.
+func loadSAMLKeyPair(certFile, keyFile string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("SAML_CERT_FILE and SAML_KEY_FILE are required")
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("saml key pair: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("saml key pair: key must be RSA")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("saml key pair: %w", err)
+	}
+	return key, cert, nil
+}
+
+func loadSAMLIDPMetadata(ctx context.Context) (*saml.EntityDescriptor, error) {
+	var data []byte
+	if samlCfg.IDPMetadataFile != "" {
+		raw, err := os.ReadFile(samlCfg.IDPMetadataFile)
+		if err != nil {
+			return nil, fmt.Errorf("saml idp metadata: %w", err)
+		}
+		data = raw
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, samlCfg.IDPMetadataURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := samlHTTPClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("saml idp metadata: %w", err)
+		}
+		defer resp.Body.Close() //nolint:errcheck
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("saml idp metadata: status %d", resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, fmt.Errorf("saml idp metadata: %w", err)
+		}
+	}
+	return parseSAMLMetadata(data)
+}
+
+// parseSAMLMetadata accepts either a single EntityDescriptor or an
+// EntitiesDescriptor and returns the first identity provider in it.
+func parseSAMLMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	var entity saml.EntityDescriptor
+	if err := xml.Unmarshal(data, &entity); err == nil {
+		if len(entity.IDPSSODescriptors) == 0 {
+			return nil, errors.New("saml idp metadata: no IDPSSODescriptor")
+		}
+		return &entity, nil
+	}
+	var entities saml.EntitiesDescriptor
+	if err := xml.Unmarshal(data, &entities); err != nil {
+		return nil, fmt.Errorf("saml idp metadata: %w", err)
+	}
+	for i, e := range entities.EntityDescriptors {
+		if len(e.IDPSSODescriptors) > 0 {
+			return &entities.EntityDescriptors[i], nil
+		}
+	}
+	return nil, errors.New("saml idp metadata: no IDPSSODescriptor")
+}
+
+// handleSAMLMetadata serves the service provider metadata for registration
+// with the identity provider.
+func handleSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	sp, err := samlServiceProvider(r.Context())
+	if err != nil {
+		log.Printf("saml metadata: %v", err)
+		http.Error(w, "saml unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	buf, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		http.Error(w, "saml unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(buf)
+}
+
+// handleSAMLLogin sends the browser to the identity provider with an
+// AuthnRequest. The request ID goes into its own cookie because the
+// response comes back as a cross-site POST, which the Lax session cookie
+// does not survive.
+func handleSAMLLogin(w http.ResponseWriter, r *http.Request) {
+	sp, err := samlServiceProvider(r.Context())
+	if err != nil {
+		log.Printf("saml login: %v", err)
+		serveLogin(w, "Single sign-on is unavailable.")
+		return
+	}
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		log.Printf("saml login: %v", err)
+		serveLogin(w, "Single sign-on is unavailable.")
+		return
+	}
+	target, err := req.Redirect("", sp)
+	if err != nil {
+		log.Printf("saml login: %v", err)
+		serveLogin(w, "Login failed.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     samlRequestCookie,
+		Value:    req.ID,
+		Path:     "/saml/acs",
+		MaxAge:   int(samlLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// handleSAMLACS is the assertion consumer service. It only accepts a
+// response to the request this browser started, then logs the user in
+// with the namespaces derived from the groups attribute.
+func handleSAMLACS(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: samlRequestCookie, Path: "/saml/acs", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteNoneMode})
+	cookie, err := r.Cookie(samlRequestCookie)
+	if err != nil || cookie.Value == "" {
+		serveLogin(w, "Single sign-on expired. Please try again.")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		serveLogin(w, "Invalid form submission.")
+		return
+	}
+	sp, err := samlServiceProvider(r.Context())
+	if err != nil {
+		log.Printf("saml acs: %v", err)
+		serveLogin(w, "Single sign-on is unavailable.")
+		return
+	}
+	assertion, err := sp.ParseResponse(r, []string{cookie.Value})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		log.Printf("saml login failed: %v", err)
+		serveLogin(w, "Single sign-on failed.")
+		return
+	}
+
+	user, access, groups, err := samlAuthenticate(assertion)
+	if err != nil {
+		log.Printf("saml login failed: %v", err)
+		serveLogin(w, "Single sign-on failed.")
+		return
+	}
+	if err := createSession(r, loginSourceSAML, user, access, groups); err != nil {
+		log.Printf("session create failed for %s: %v", user.Name, err)
+		serveLogin(w, "Login failed.")
+		return
+	}
+	personalTokens.refresh(loginSourceSAML, user, access, groups)
+	http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
+}
+
+// samlAuthenticate turns a verified assertion into a user and namespace
+// access. Without SAML_USERNAME_ATTRIBUTE the subject NameID is the
+// username. It also returns the groups attribute, which the session keeps
+// so it can be mapped again later.
+func samlAuthenticate(assertion *saml.Assertion) (*User, []Access, []string, error) {
+	username := ""
+	if samlCfg.UsernameAttribute != "" {
+		if values := samlAttributeValues(assertion, samlCfg.UsernameAttribute); len(values) > 0 {
+			username = values[0]
+		}
+	} else if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		username = assertion.Subject.NameID.Value
+	}
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, nil, nil, errors.New("assertion has no username")
+	}
+	groups := samlAttributeValues(assertion, samlCfg.GroupsAttribute)
+	user, access, err := samlGroupAccess(username, groups)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return user, access, groups, nil
+}
+
+// samlGroupAccess maps the groups the identity provider sent for username
+// to namespace access with the current mapping and grants.
+func samlGroupAccess(username string, groups []string) (*User, []Access, error) {
+	mapper, err := groupMapperFor(samlCfg.GroupMappingFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, user := accessFromGroups(username, groups, samlCfg.GroupPrefix, mapper)
+	if user == nil {
+		return nil, nil, fmt.Errorf("%w for %s", errNoAccess, username)
+	}
+	return user, access, nil
+}
+
+// samlAttributeValues collects the values of every attribute whose Name or
+// FriendlyName is name.
+func samlAttributeValues(assertion *saml.Assertion, name string) []string {
+	var values []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+			for _, v := range attr.Values {
+				if v.Value != "" {
+					values = append(values, v.Value)
+				}
+			}
+		}
+	}
+	return values
+}
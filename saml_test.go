@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crewjam/saml"
+)
+
+// testSAMLIdP signs responses for whatever service provider metadata the
+// test hands it.
+type testSAMLIdP struct {
+	saml.IdentityProvider
+	sp *saml.EntityDescriptor
+}
+
+func (idp *testSAMLIdP) GetServiceProvider(_ *http.Request, id string) (*saml.EntityDescriptor, error) {
+	if idp.sp == nil || idp.sp.EntityID != id {
+		return nil, os.ErrNotExist
+	}
+	return idp.sp, nil
+}
+
+func newTestSAMLIdP(t *testing.T) *testSAMLIdP {
+	t.Helper()
+	dir := t.TempDir()
+	cert, key := writeTestCA(t, filepath.Join(dir, "idp.crt"), filepath.Join(dir, "idp.key"))
+	idp := &testSAMLIdP{}
+	idp.Key = key
+	idp.Certificate = cert
+	idp.MetadataURL = url.URL{Scheme: "https", Host: "idp.test", Path: "/metadata"}
+	idp.SSOURL = url.URL{Scheme: "https", Host: "idp.test", Path: "/sso"}
+	idp.ServiceProviderProvider = idp
+	return idp
+}
+
+func withSAML(t *testing.T, idp *testSAMLIdP) {
+	t.Helper()
+	dir := t.TempDir()
+	metadata, err := xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatalf("marshal idp metadata: %v", err)
+	}
+	metadataFile := filepath.Join(dir, "idp.xml")
+	if err := os.WriteFile(metadataFile, metadata, 0o600); err != nil {
+		t.Fatalf("write idp metadata: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "sp.crt"), filepath.Join(dir, "sp.key")
+	writeTestCA(t, certFile, keyFile)
+
+	prevCfg := samlCfg
+	samlCfg = SAMLConfig{
+		RootURL:           "https://vault.test",
+		IDPMetadataFile:   metadataFile,
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		UsernameAttribute: "uid",
+		GroupsAttribute:   "groups",
+		GroupPrefix:       "team",
+		ProviderName:      "Corp SAML",
+	}
+	samlProviderMu.Lock()
+	samlProvider = nil
+	samlProviderMu.Unlock()
+	t.Cleanup(func() {
+		samlCfg = prevCfg
+		samlProviderMu.Lock()
+		samlProvider = nil
+		samlProviderMu.Unlock()
+	})
+}
+
+// samlLogin runs the browser side of an SP-initiated login. requestID
+// replaces the tracking cookie when set, and the response is signed by
+// signer instead of idp when signer is not nil.
+func samlLogin(t *testing.T, router http.Handler, idp, signer *testSAMLIdP, session *saml.Session, requestID string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	var spMetadata saml.EntityDescriptor
+	if err := xml.Unmarshal(rec.Body.Bytes(), &spMetadata); err != nil {
+		t.Fatalf("parse sp metadata: %v", err)
+	}
+	if signer == nil {
+		signer = idp
+	}
+	signer.sp = &spMetadata
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/login", nil))
+	location := rec.Header().Get("Location")
+	if rec.Code != http.StatusFound || !strings.HasPrefix(location, "https://idp.test/sso?SAMLRequest=") {
+		t.Fatalf("expected redirect to the identity provider, got %d %q", rec.Code, location)
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == samlRequestCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.SameSite != http.SameSiteNoneMode {
+		t.Fatalf("expected a cross-site request cookie, got %+v", cookie)
+	}
+	if requestID != "" {
+		cookie.Value = requestID
+	}
+
+	authn, err := saml.NewIdpAuthnRequest(&signer.IdentityProvider, httptest.NewRequest(http.MethodGet, location, nil))
+	if err != nil {
+		t.Fatalf("read authn request: %v", err)
+	}
+	if err := authn.Validate(); err != nil {
+		t.Fatalf("validate authn request: %v", err)
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(authn, session); err != nil {
+		t.Fatalf("make assertion: %v", err)
+	}
+	form, err := authn.PostBinding()
+	if err != nil {
+		t.Fatalf("make response: %v", err)
+	}
+	if form.URL != "https://vault.test/saml/acs" {
+		t.Fatalf("unexpected ACS URL %q", form.URL)
+	}
+
+	body := url.Values{"SAMLResponse": {form.SAMLResponse}}
+	req := httptest.NewRequest(http.MethodPost, "/saml/acs", strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func samlSession(groups ...string) *saml.Session {
+	values := make([]saml.AttributeValue, 0, len(groups))
+	for _, g := range groups {
+		values = append(values, saml.AttributeValue{Type: "xs:string", Value: g})
+	}
+	return &saml.Session{
+		ID:               "s1",
+		NameID:           "alice@example.com",
+		UserName:         "alice",
+		CustomAttributes: []saml.Attribute{{Name: "groups", Values: values}},
+	}
+}
+
+func TestSAMLLoginCreatesSession(t *testing.T) {
+	idp := newTestSAMLIdP(t)
+	withSAML(t, idp)
+	router := cvRouter()
+
+	rec := samlLogin(t, router, idp, nil, samlSession("team1_rw", "other"), "")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/api/dashboard" {
+		t.Fatalf("expected redirect to the dashboard, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "cv_session" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("expected a session cookie")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/dashboard", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "Welcome, alice.") || !strings.Contains(body, `"namespaces":["team1"]`) {
+		t.Fatalf("expected alice with team1 from the groups attribute, got %d %s", rec.Code, body)
+	}
+}
+
+func TestSAMLLoginRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		session   *saml.Session
+		requestID string
+		otherIdP  bool
+	}{
+		{name: "unsolicited response", session: samlSession("team1_rw"), requestID: "id-forged"},
+		{name: "untrusted signer", session: samlSession("team1_rw"), otherIdP: true},
+		{name: "no groups", session: samlSession("other")},
+		{name: "no username", session: &saml.Session{ID: "s1", NameID: "alice@example.com", CustomAttributes: samlSession("team1_rw").CustomAttributes}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestSAMLIdP(t)
+			withSAML(t, idp)
+			var signer *testSAMLIdP
+			if tt.otherIdP {
+				signer = newTestSAMLIdP(t)
+			}
+			rec := samlLogin(t, cvRouter(), idp, signer, tt.session, tt.requestID)
+			if rec.Code == http.StatusSeeOther {
+				t.Fatalf("expected login to fail")
+			}
+			if !strings.Contains(rec.Body.String(), `class="error"`) {
+				t.Fatalf("expected the login page with an error, got %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSAMLACSRequiresRequestCookie(t *testing.T) {
+	idp := newTestSAMLIdP(t)
+	withSAML(t, idp)
+	req := httptest.NewRequest(http.MethodPost, "/saml/acs", strings.NewReader("SAMLResponse=x"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), "Single sign-on expired") {
+		t.Fatalf("expected IdP-initiated responses to be refused, got %s", rec.Body.String())
+	}
+}
+
+func TestSAMLUsernameFromNameID(t *testing.T) {
+	idp := newTestSAMLIdP(t)
+	withSAML(t, idp)
+	samlCfg.UsernameAttribute = ""
+	assertion := &saml.Assertion{
+		Subject:             &saml.Subject{NameID: &saml.NameID{Value: "bob"}},
+		AttributeStatements: []saml.AttributeStatement{{Attributes: []saml.Attribute{{FriendlyName: "groups", Values: []saml.AttributeValue{{Value: "team2_r"}}}}}},
+	}
+	user, access, _, err := samlAuthenticate(assertion)
+	if err != nil || user.Name != "bob" || strings.Join(namespacesFromAccess(access), ",") != "team2" {
+		t.Fatalf("expected bob with team2, got %+v %+v %v", user, access, err)
+	}
+}
+
+func TestParseSAMLMetadataEntities(t *testing.T) {
+	idp := newTestSAMLIdP(t)
+	inner, _ := xml.Marshal(idp.Metadata())
+	wrapped := `<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata"><EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.test"></EntityDescriptor>` +
+		strings.TrimPrefix(string(inner), xml.Header) + `</EntitiesDescriptor>`
+	got, err := parseSAMLMetadata([]byte(wrapped))
+	if err != nil || got.EntityID != "https://idp.test/metadata" {
+		t.Fatalf("expected the identity provider entity, got %+v %v", got, err)
+	}
+	if _, err := parseSAMLMetadata([]byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"/>`)); err == nil {
+		t.Fatalf("expected metadata without an identity provider to be refused")
+	}
+}
+
+func TestLoginPageShowsSAML(t *testing.T) {
+	idp := newTestSAMLIdP(t)
+	withSAML(t, idp)
+	rec := httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if !strings.Contains(rec.Body.String(), `href="/saml/login">Sign in with Corp SAML`) {
+		t.Fatalf("expected SAML link on the login page")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scimUser is a user pushed by the identity provider through SCIM. An
+// inactive user cannot log in.
+type scimUser struct {
+	ID           string      `json:"id"`
+	ExternalID   string      `json:"external_id,omitempty"`
+	UserName     string      `json:"user_name"`
+	DisplayName  string      `json:"display_name,omitempty"`
+	Active       bool        `json:"active"`
+	Emails       []scimEmail `json:"emails,omitempty"`
+	Created      time.Time   `json:"created"`
+	LastModified time.Time   `json:"last_modified"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// scimGroup is a group pushed through SCIM. Members are user IDs, and the
+// display name is matched like an LDAP group name.
+type scimGroup struct {
+	ID           string    `json:"id"`
+	ExternalID   string    `json:"external_id,omitempty"`
+	DisplayName  string    `json:"display_name"`
+	Members      []string  `json:"members,omitempty"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type scimStoreData struct {
+	Users  map[string]scimUser  `json:"users"`
+	Groups map[string]scimGroup `json:"groups"`
+}
+
+type scimStore struct {
+	mu   sync.Mutex
+	path string
+	data scimStoreData
+}
+
+var scimDirectory = newSCIMStore(scimStorePath)
+
+var (
+	errSCIMNotFound = errors.New("resource not found")
+	errSCIMConflict = errors.New("resource already exists")
+	errSCIMInvalid  = errors.New("invalid resource")
+)
+
+func newSCIMStore(path string) *scimStore {
+	store := &scimStore{path: path}
+	if path != "" {
+		if err := readJSONFile(path, &store.data); err != nil {
+			log.Printf("scim store %s unreadable: %v", path, err)
+		}
+	}
+	if store.data.Users == nil {
+		store.data.Users = make(map[string]scimUser)
+	}
+	if store.data.Groups == nil {
+		store.data.Groups = make(map[string]scimGroup)
+	}
+	return store
+}
+
+func (s *scimStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := writeJSONFile(s.path, s.data); err != nil {
+		log.Printf("scim store %s not saved: %v", s.path, err)
+	}
+}
+
+func (s *scimStore) userByNameLocked(username string) (scimUser, bool) {
+	for _, u := range s.data.Users {
+		if strings.EqualFold(u.UserName, username) {
+			return u, true
+		}
+	}
+	return scimUser{}, false
+}
+
+func (s *scimStore) checkUserLocked(u scimUser) error {
+	if strings.TrimSpace(u.UserName) == "" {
+		return fmt.Errorf("%w: userName is required", errSCIMInvalid)
+	}
+	if other, ok := s.userByNameLocked(u.UserName); ok && other.ID != u.ID {
+		return fmt.Errorf("%w: userName %s is taken", errSCIMConflict, u.UserName)
+	}
+	return nil
+}
+
+func (s *scimStore) createUser(u scimUser, now time.Time) (scimUser, error) {
+	id, err := newGrantID()
+	if err != nil {
+		return scimUser{}, err
+	}
+	u.ID = id
+	u.Created, u.LastModified = now.UTC(), now.UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkUserLocked(u); err != nil {
+		return scimUser{}, err
+	}
+	s.data.Users[id] = u
+	s.saveLocked()
+	return u, nil
+}
+
+func (s *scimStore) user(id string) (scimUser, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[id]
+	return u, ok
+}
+
+// updateUser applies change to the user with id and returns the user
+// before and after.
+func (s *scimStore) updateUser(id string, now time.Time, change func(*scimUser) error) (scimUser, scimUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.data.Users[id]
+	if !ok {
+		return scimUser{}, scimUser{}, errSCIMNotFound
+	}
+	u := old
+	u.Emails = append([]scimEmail(nil), old.Emails...)
+	if err := change(&u); err != nil {
+		return scimUser{}, scimUser{}, err
+	}
+	u.ID, u.Created, u.LastModified = old.ID, old.Created, now.UTC()
+	if err := s.checkUserLocked(u); err != nil {
+		return scimUser{}, scimUser{}, err
+	}
+	s.data.Users[id] = u
+	s.saveLocked()
+	return old, u, nil
+}
+
+// deleteUser removes a user and its group memberships.
+func (s *scimStore) deleteUser(id string) (scimUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[id]
+	if !ok {
+		return scimUser{}, errSCIMNotFound
+	}
+	delete(s.data.Users, id)
+	for gid, g := range s.data.Groups {
+		if containsString(g.Members, id) {
+			g.Members = removeString(g.Members, id)
+			s.data.Groups[gid] = g
+		}
+	}
+	s.saveLocked()
+	return u, nil
+}
+
+func (s *scimStore) users() []scimUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]scimUser, 0, len(s.data.Users))
+	for _, u := range s.data.Users {
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+func (s *scimStore) checkGroupLocked(g scimGroup) error {
+	if strings.TrimSpace(g.DisplayName) == "" {
+		return fmt.Errorf("%w: displayName is required", errSCIMInvalid)
+	}
+	for _, other := range s.data.Groups {
+		if other.ID != g.ID && strings.EqualFold(other.DisplayName, g.DisplayName) {
+			return fmt.Errorf("%w: displayName %s is taken", errSCIMConflict, g.DisplayName)
+		}
+	}
+	for _, member := range g.Members {
+		if _, ok := s.data.Users[member]; !ok {
+			return fmt.Errorf("%w: unknown member %s", errSCIMInvalid, member)
+		}
+	}
+	return nil
+}
+
+func (s *scimStore) createGroup(g scimGroup, now time.Time) (scimGroup, error) {
+	id, err := newGrantID()
+	if err != nil {
+		return scimGroup{}, err
+	}
+	g.ID = id
+	g.Created, g.LastModified = now.UTC(), now.UTC()
+	g.Members = uniqueStrings(g.Members)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkGroupLocked(g); err != nil {
+		return scimGroup{}, err
+	}
+	s.data.Groups[id] = g
+	s.saveLocked()
+	return g, nil
+}
+
+func (s *scimStore) group(id string) (scimGroup, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.data.Groups[id]
+	return g, ok
+}
+
+func (s *scimStore) updateGroup(id string, now time.Time, change func(*scimGroup) error) (scimGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.data.Groups[id]
+	if !ok {
+		return scimGroup{}, errSCIMNotFound
+	}
+	g := old
+	g.Members = append([]string(nil), old.Members...)
+	if err := change(&g); err != nil {
+		return scimGroup{}, err
+	}
+	g.ID, g.Created, g.LastModified = old.ID, old.Created, now.UTC()
+	g.Members = uniqueStrings(g.Members)
+	if err := s.checkGroupLocked(g); err != nil {
+		return scimGroup{}, err
+	}
+	s.data.Groups[id] = g
+	s.saveLocked()
+	return g, nil
+}
+
+func (s *scimStore) deleteGroup(id string) (scimGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.data.Groups[id]
+	if !ok {
+		return scimGroup{}, errSCIMNotFound
+	}
+	delete(s.data.Groups, id)
+	s.saveLocked()
+	return g, nil
+}
+
+func (s *scimStore) groups() []scimGroup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]scimGroup, 0, len(s.data.Groups))
+	for _, g := range s.data.Groups {
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// groupsOfLocked returns the display names of the groups userID belongs
+// to.
+func (s *scimStore) groupsOfLocked(userID string) []string {
+	var names []string
+	for _, g := range s.data.Groups {
+		if containsString(g.Members, userID) {
+			names = append(names, g.DisplayName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loginGroups returns the SCIM groups of username for a login. ok is false
+// when the identity provider deactivated the user.
+func (s *scimStore) loginGroups(username string) (groups []string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, found := s.userByNameLocked(username)
+	if !found {
+		return nil, true
+	}
+	if !u.Active {
+		return nil, false
+	}
+	return s.groupsOfLocked(u.ID), true
+}
+
+// deprovisionUser ends everything username can still use: browser
+// sessions, personal access tokens, the offline login record and cached
+// credentials.
+func deprovisionUser(username string, now time.Time) {
+	sessions := destroyUserSessions(username)
+	tokens := personalTokens.revokeUser(username, "scim", now)
+	shares := shareLinks.revokeUser(username, "scim", now)
+	offlineAuth.forget(username)
+	authCache.flush(username)
+	accessLookups.flush(username)
+	recordAudit(auditEvent{
+		Time:    now,
+		Actor:   "scim",
+		Action:  "scim.deprovision",
+		Subject: "user:" + username,
+		Detail:  fmt.Sprintf("%d sessions, %d tokens and %d share links revoked", sessions, tokens, shares),
+	})
+}
+
+func removeString(values []string, value string) []string {
+	var out []string
+	for _, v := range values {
+		if v != value {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func uniqueStrings(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if !containsString(out, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
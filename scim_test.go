@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withSCIM(t *testing.T) *scimStore {
+	t.Helper()
+	prevToken, prevStore := scimToken, scimDirectory
+	scimToken = "scim-secret"
+	scimDirectory = newSCIMStore("")
+	t.Cleanup(func() {
+		scimToken, scimDirectory = prevToken, prevStore
+	})
+	return scimDirectory
+}
+
+// scimCall sends a SCIM request with the provisioning token and decodes
+// the response into out when out is not nil.
+func scimCall(t *testing.T, router http.Handler, method, path, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer scim-secret")
+	req.Header.Set("Content-Type", "application/scim+json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if out != nil && rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %s: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func scimCreateUser(t *testing.T, router http.Handler, username string) scimUserResource {
+	t.Helper()
+	var user scimUserResource
+	body := `{"schemas":["` + scimUserSchema + `"],"userName":"` + username + `","name":{"givenName":"A"},"emails":[{"value":"` + username + `@example.com","primary":true}]}`
+	if code := scimCall(t, router, http.MethodPost, "/scim/v2/Users", body, &user); code != http.StatusCreated {
+		t.Fatalf("create user %s: %d", username, code)
+	}
+	return user
+}
+
+func scimCreateGroup(t *testing.T, router http.Handler, name string, members ...string) scimGroupResource {
+	t.Helper()
+	refs := make([]scimRef, 0, len(members))
+	for _, m := range members {
+		refs = append(refs, scimRef{Value: m})
+	}
+	body, _ := json.Marshal(scimGroupResource{Schemas: []string{scimGroupSchema}, DisplayName: name, Members: refs})
+	var group scimGroupResource
+	if code := scimCall(t, router, http.MethodPost, "/scim/v2/Groups", string(body), &group); code != http.StatusCreated {
+		t.Fatalf("create group %s: %d", name, code)
+	}
+	return group
+}
+
+func TestSCIMRequiresToken(t *testing.T) {
+	withSCIM(t)
+	router := cvRouter()
+	for _, auth := range []string{"", "Bearer wrong", "Basic c2NpbTpzY2ltLXNlY3JldA=="} {
+		req := httptest.NewRequest(http.MethodGet, "/scim/v2/Users", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), scimErrorSchema) {
+			t.Fatalf("%q: expected a SCIM 401, got %d %s", auth, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestSCIMUsersAndGroups(t *testing.T) {
+	withSCIM(t)
+	router := cvRouter()
+
+	alice := scimCreateUser(t, router, "alice")
+	if alice.ID == "" || alice.Active == nil || !*alice.Active || len(alice.Emails) != 1 {
+		t.Fatalf("unexpected user %+v", alice)
+	}
+	if code := scimCall(t, router, http.MethodPost, "/scim/v2/Users", `{"userName":"ALICE"}`, nil); code != http.StatusConflict {
+		t.Fatalf("expected a duplicate userName to conflict, got %d", code)
+	}
+	bob := scimCreateUser(t, router, "bob")
+
+	var list scimListResponse
+	filter := url.QueryEscape(`userName eq "Alice"`)
+	if code := scimCall(t, router, http.MethodGet, "/scim/v2/Users?filter="+filter, "", &list); code != http.StatusOK || list.TotalResults != 1 {
+		t.Fatalf("expected one user for the filter, got %d %+v", code, list)
+	}
+	if code := scimCall(t, router, http.MethodGet, "/scim/v2/Users?startIndex=2&count=5", "", &list); code != http.StatusOK || list.TotalResults != 2 || list.ItemsPerPage != 1 || list.StartIndex != 2 {
+		t.Fatalf("expected the second page to hold one user, got %+v", list)
+	}
+	if code := scimCall(t, router, http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(`userName co "a"`), "", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected an unsupported filter to be refused, got %d", code)
+	}
+
+	group := scimCreateGroup(t, router, "team1_rw", alice.ID)
+	if code := scimCall(t, router, http.MethodPost, "/scim/v2/Groups", `{"displayName":"team2_r","members":[{"value":"nobody"}]}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown member to be refused, got %d", code)
+	}
+	access, user := accessFromGroups("alice", nil, "team", nil)
+	if user == nil || !namespaceCan(access, "team1", capPush) {
+		t.Fatalf("expected SCIM groups to grant team1, got %+v", access)
+	}
+	var fetched scimUserResource
+	scimCall(t, router, http.MethodGet, "/scim/v2/Users/"+alice.ID, "", &fetched)
+	if len(fetched.Groups) != 1 || fetched.Groups[0].Display != "team1_rw" {
+		t.Fatalf("expected the user to list its group, got %+v", fetched.Groups)
+	}
+
+	// Identity providers move members with PATCH.
+	patch := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[
+		{"op":"add","path":"members","value":[{"value":"` + bob.ID + `"}]},
+		{"op":"remove","path":"members[value eq \"` + alice.ID + `\"]"},
+		{"op":"Replace","value":{"displayName":"team1_r"}}]}`
+	var patched scimGroupResource
+	if code := scimCall(t, router, http.MethodPatch, "/scim/v2/Groups/"+group.ID, patch, &patched); code != http.StatusOK {
+		t.Fatalf("patch group: %d", code)
+	}
+	if patched.DisplayName != "team1_r" || len(patched.Members) != 1 || patched.Members[0].Value != bob.ID || patched.Members[0].Display != "bob" {
+		t.Fatalf("unexpected group after patch %+v", patched)
+	}
+	if _, user := accessFromGroups("alice", nil, "team", nil); user != nil {
+		t.Fatalf("expected alice to lose team1")
+	}
+	access, _ = accessFromGroups("bob", []string{"cn=team3_rw,ou=groups,dc=example,dc=com"}, "team", nil)
+	if !namespaceCan(access, "team1", capPull) || namespaceCan(access, "team1", capPush) || !namespaceCan(access, "team3", capPush) {
+		t.Fatalf("expected SCIM and directory groups to combine, got %+v", access)
+	}
+
+	if code := scimCall(t, router, http.MethodDelete, "/scim/v2/Groups/"+group.ID, "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete group: %d", code)
+	}
+	if code := scimCall(t, router, http.MethodGet, "/scim/v2/Groups/"+group.ID, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected the group to be gone, got %d", code)
+	}
+}
+
+func TestSCIMDeprovisionRevokesEverything(t *testing.T) {
+	withSCIM(t)
+	tokens := withPersonalTokenStore(t)
+	shares := withShareStore(t)
+	withMFA(t, mfaModeOff)
+	router := cvRouter()
+
+	alice := scimCreateUser(t, router, "alice")
+	scimCreateGroup(t, router, "team1_rw", alice.ID)
+	cookie := seedSessionWithAccess(t, "alice", []Access{{Group: "team1_rw", Namespace: "team1"}})
+	other := seedSessionWithAccess(t, "bob", []Access{{Group: "team1_rw", Namespace: "team1"}})
+	now := time.Now()
+	_, value, err := tokens.add(personalToken{Username: "alice", Scopes: []string{scopeAPIRead}, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("add token: %v", err)
+	}
+	aliceLink, err := shares.add(shareLink{Repo: "team1/app", Namespace: "team1", CreatedBy: "Alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("add share link: %v", err)
+	}
+	bobLink, err := shares.add(shareLink{Repo: "team1/app", Namespace: "team1", CreatedBy: "bob", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("add share link: %v", err)
+	}
+
+	// Azure AD sends booleans as strings.
+	patch := `{"Operations":[{"op":"Replace","path":"active","value":"False"}]}`
+	var patched scimUserResource
+	if code := scimCall(t, router, http.MethodPatch, "/scim/v2/Users/"+alice.ID, patch, &patched); code != http.StatusOK || *patched.Active {
+		t.Fatalf("expected alice to be deactivated, got %d %+v", code, patched)
+	}
+
+	dashboard := func(cookie string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/dashboard", nil)
+		req.AddCookie(&http.Cookie{Name: "cv_session", Value: cookie})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := dashboard(cookie); code != http.StatusUnauthorized {
+		t.Fatalf("expected the session of alice to be gone, got %d", code)
+	}
+	if code := dashboard(other); code != http.StatusOK {
+		t.Fatalf("expected other sessions to survive, got %d", code)
+	}
+	if _, ok := tokens.verify(value, now); ok {
+		t.Fatalf("expected the token of alice to be revoked")
+	}
+	if _, ok := shares.get(aliceLink.ID); ok {
+		t.Fatalf("expected the share link of alice to be revoked")
+	}
+	if _, ok := shares.get(bobLink.ID); !ok {
+		t.Fatalf("expected other share links to survive")
+	}
+	if _, user := accessFromGroups("alice", []string{"team2_rw"}, "team", nil); user != nil {
+		t.Fatalf("expected a deactivated user to get no access")
+	}
+
+	patch = `{"Operations":[{"op":"replace","value":{"active":true}}]}`
+	if code := scimCall(t, router, http.MethodPatch, "/scim/v2/Users/"+alice.ID, patch, nil); code != http.StatusOK {
+		t.Fatalf("reactivate: %d", code)
+	}
+	if _, user := accessFromGroups("alice", nil, "team", nil); user == nil {
+		t.Fatalf("expected a reactivated user to get access again")
+	}
+}
+
+func TestSCIMDeleteUser(t *testing.T) {
+	store := withSCIM(t)
+	withPersonalTokenStore(t)
+	router := cvRouter()
+
+	alice := scimCreateUser(t, router, "alice")
+	group := scimCreateGroup(t, router, "team1_rw", alice.ID)
+	cookie := seedSessionWithAccess(t, "alice", []Access{{Group: "team1_rw", Namespace: "team1"}})
+
+	if code := scimCall(t, router, http.MethodDelete, "/scim/v2/Users/"+alice.ID, "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete user: %d", code)
+	}
+	if g, _ := store.group(group.ID); len(g.Members) != 0 {
+		t.Fatalf("expected the membership to be removed, got %v", g.Members)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/dashboard", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: cookie})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the session to end, got %d", rec.Code)
+	}
+	if code := scimCall(t, router, http.MethodDelete, "/scim/v2/Users/"+alice.ID, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected a second delete to 404, got %d", code)
+	}
+}
+
+func TestParseSCIMFilter(t *testing.T) {
+	attr, value, err := parseSCIMFilter(`userName Eq "a\"b"`)
+	if err != nil || attr != "username" || value != `a"b` {
+		t.Fatalf("unexpected parse %q %q %v", attr, value, err)
+	}
+	for _, filter := range []string{`userName sw "a"`, `userName eq a`, `userName eq "a" and active eq true`} {
+		if _, _, err := parseSCIMFilter(filter); err == nil {
+			t.Fatalf("%s: expected the filter to be refused", filter)
+		}
+	}
+}
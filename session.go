@@ -3,7 +3,13 @@ package main
 import (
 	"context"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
@@ -12,16 +18,31 @@ import (
 
 const sessionKey = "session"
 
+// sessionSeenKey holds when a logged in session last served a request, so
+// the revalidator can rewrite it without starting a new idle period.
+const sessionSeenKey = "seen"
+
+// Login sources recorded on a session.
+const (
+	loginSourcePassword = "password"
+	loginSourceOIDC     = "oidc"
+	loginSourceSAML     = "saml"
+)
+
 var sessionManager = newSessionManager()
 
 func init() {
 	gob.Register(sessionData{})
+	gob.Register(oidcLoginState{})
+	gob.Register(mfaLoginState{})
+	gob.Register(time.Time{})
 }
 
 func newSessionManager() *scs.SessionManager {
 	manager := scs.New()
 	manager.Store = memstore.New()
-	manager.Lifetime = sessionTTL
+	manager.Lifetime = sessionCfg.Lifetime
+	manager.IdleTimeout = sessionCfg.IdleTimeout
 	manager.Cookie.Name = "cv_session"
 	manager.Cookie.Path = "/"
 	manager.Cookie.HttpOnly = true
@@ -30,20 +51,77 @@ func newSessionManager() *scs.SessionManager {
 	return manager
 }
 
-func createSession(ctx context.Context, u *User, access []Access) error {
+// createSession logs u in on the session of r. source is how the user
+// logged in and groups what a single sign-on provider sent, if anything.
+func createSession(r *http.Request, source string, u *User, access []Access, groups []string) error {
 	namespaces := namespacesFromAccess(access)
-	if err := sessionManager.RenewToken(ctx); err != nil {
+	id, err := newGrantID()
+	if err != nil {
+		return err
+	}
+	if err := sessionManager.RenewToken(r.Context()); err != nil {
 		return err
 	}
-	sessionManager.Put(ctx, sessionKey, sessionData{
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	sessionManager.Put(r.Context(), sessionKey, sessionData{
 		User:       u,
 		Access:     access,
 		Namespaces: namespaces,
 		CreatedAt:  time.Now(),
+		ID:         id,
+		Source:     source,
+		Groups:     groups,
+		RemoteAddr: remote,
+		UserAgent:  r.UserAgent(),
 	})
+	if sessionManager.IdleTimeout > 0 {
+		sessionManager.Put(r.Context(), sessionSeenKey, time.Now())
+	}
 	return nil
 }
 
+// trackSessionActivity records when a logged in session last served a
+// request. It only matters with an idle timeout, and then scs writes the
+// session back on every request anyway.
+func trackSessionActivity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sessionManager.IdleTimeout > 0 && sessionManager.Exists(r.Context(), sessionKey) {
+			sessionManager.Put(r.Context(), sessionSeenKey, time.Now())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// saveSession writes the session in ctx back to the store without
+// extending it. Commit would start a new idle period; this keeps the
+// expiry the last request left, and the lifetime deadline.
+func saveSession(ctx context.Context) error {
+	values := make(map[string]any)
+	for _, key := range sessionManager.Keys(ctx) {
+		values[key] = sessionManager.Get(ctx, key)
+	}
+	deadline := sessionManager.Deadline(ctx)
+	b, err := sessionManager.Codec.Encode(deadline, values)
+	if err != nil {
+		return err
+	}
+	expiry := deadline
+	if idle := sessionManager.IdleTimeout; idle > 0 {
+		seen, ok := values[sessionSeenKey].(time.Time)
+		if !ok {
+			// Sessions from before the activity was recorded.
+			seen = time.Now()
+		}
+		if idleExpiry := seen.Add(idle); idleExpiry.Before(expiry) {
+			expiry = idleExpiry
+		}
+	}
+	return sessionManager.Store.Commit(sessionManager.Token(ctx), b, expiry)
+}
+
 func getSession(r *http.Request) (sessionData, bool) {
 	sess, ok := sessionManager.Get(r.Context(), sessionKey).(sessionData)
 	if !ok || sess.User == nil {
@@ -56,6 +134,229 @@ func destroySession(ctx context.Context) error {
 	return sessionManager.Destroy(ctx)
 }
 
+// destroyUserSessions ends every session of username, including a login
+// waiting for its second factor, and reports how many it ended.
+func destroyUserSessions(username string) int {
+	destroyed := 0
+	err := sessionManager.Iterate(context.Background(), func(ctx context.Context) error {
+		name := ""
+		if sess, ok := sessionManager.Get(ctx, sessionKey).(sessionData); ok && sess.User != nil {
+			name = sess.User.Name
+		} else if login, ok := sessionManager.Get(ctx, mfaLoginKey).(mfaLoginState); ok && login.User != nil {
+			name = login.User.Name
+		}
+		if name == "" || !strings.EqualFold(name, username) {
+			return nil
+		}
+		destroyed++
+		return sessionManager.Destroy(ctx)
+	})
+	if err != nil {
+		log.Printf("unable to end sessions of %s: %v", username, err)
+	}
+	return destroyed
+}
+
+// sessionInfo describes a session in the session list.
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Source     string    `json:"source,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Current    bool      `json:"current"`
+}
+
+// userSessions lists the sessions of username, oldest first.
+func userSessions(username string) ([]sessionInfo, error) {
+	sessions := []sessionInfo{}
+	err := sessionManager.Iterate(context.Background(), func(ctx context.Context) error {
+		sess, ok := sessionManager.Get(ctx, sessionKey).(sessionData)
+		if !ok || sess.User == nil || !strings.EqualFold(sess.User.Name, username) {
+			return nil
+		}
+		sessions = append(sessions, sessionInfo{
+			ID:         sess.ID,
+			Username:   sess.User.Name,
+			Source:     sess.Source,
+			CreatedAt:  sess.CreatedAt,
+			ExpiresAt:  sessionManager.Deadline(ctx),
+			RemoteAddr: sess.RemoteAddr,
+			UserAgent:  sess.UserAgent,
+		})
+		return nil
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, err
+}
+
+// destroySessionByID ends the session of username with id and reports
+// whether there was one.
+func destroySessionByID(username, id string) (bool, error) {
+	found := false
+	err := sessionManager.Iterate(context.Background(), func(ctx context.Context) error {
+		sess, ok := sessionManager.Get(ctx, sessionKey).(sessionData)
+		if found || !ok || sess.User == nil || sess.ID == "" || sess.ID != id || !strings.EqualFold(sess.User.Name, username) {
+			return nil
+		}
+		found = true
+		return sessionManager.Destroy(ctx)
+	})
+	return found, err
+}
+
+// sessionLookup is the result of looking a user up again.
+type sessionLookup struct {
+	user   *User
+	access []Access
+	err    error
+}
+
+// lookupAccess resolves the access of a logged in user without the
+// password. It runs the AUTH_BACKENDS chain.
+var lookupAccess = func(username string) (*User, []Access, error) {
+	return authenticators.Lookup(username)
+}
+
+// revalidateSessions looks the user of every session up again the way
+// they logged in and replaces the access the session holds with the
+// result: password users through the AUTH_BACKENDS chain, single sign-on
+// users by mapping the groups from their login again. Users that only
+// have personal access tokens are looked up as well. When every lookup of
+// a user finds them gone or without groups, their sessions end and their
+// tokens and share links are revoked. When a backend cannot answer,
+// nothing changes until the next round.
+func revalidateSessions(now time.Time) {
+	lookups := make(map[string]*sessionLookup)
+	changed := make(map[string]*sessionLookup)
+	alive := make(map[string]bool)
+	gone := make(map[string]string)
+	ended := make(map[string]int)
+	lookup := func(source, username string, groups []string) *sessionLookup {
+		key := accessLookups.key(source, username, groups)
+		if l := lookups[key]; l != nil {
+			return l
+		}
+		l := &sessionLookup{}
+		l.user, l.access, l.err = resolveLogin(source, username, groups)
+		lookups[key] = l
+		switch {
+		case l.err == nil:
+			alive[strings.ToLower(username)] = true
+		case accountGone(l.err):
+			gone[strings.ToLower(username)] = username
+		case !errors.Is(l.err, errLookupUnsupported):
+			// A backend without lookup support would log this for every
+			// user on every round.
+			log.Printf("session revalidation for %s skipped: %v", username, l.err)
+		}
+		return l
+	}
+	err := sessionManager.Iterate(context.Background(), func(ctx context.Context) error {
+		sess, ok := sessionManager.Get(ctx, sessionKey).(sessionData)
+		if !ok || sess.User == nil {
+			return nil
+		}
+		lookup := lookup(sess.Source, sess.User.Name, sess.Groups)
+		switch {
+		case lookup.err == nil:
+			if *sess.User == *lookup.user && sameAccess(sess.Access, lookup.access) {
+				return nil
+			}
+			sess.User = lookup.user
+			sess.Access = lookup.access
+			sess.Namespaces = namespacesFromAccess(lookup.access)
+			sessionManager.Put(ctx, sessionKey, sess)
+			if err := saveSession(ctx); err != nil {
+				log.Printf("session of %s not updated: %v", sess.User.Name, err)
+				return nil
+			}
+			changed[strings.ToLower(sess.User.Name)] = lookup
+		case accountGone(lookup.err):
+			if err := sessionManager.Destroy(ctx); err != nil {
+				log.Printf("session of %s not ended: %v", sess.User.Name, err)
+				return nil
+			}
+			ended[strings.ToLower(sess.User.Name)]++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("session revalidation failed: %v", err)
+	}
+	for _, t := range personalTokens.owners(now) {
+		lookup := lookup(t.Source, t.Username, t.Groups)
+		if lookup.err == nil && personalTokens.refresh(t.Source, lookup.user, lookup.access, t.Groups) {
+			changed[strings.ToLower(t.Username)] = lookup
+		}
+	}
+
+	for _, lookup := range changed {
+		recordAudit(auditEvent{
+			Time:    now,
+			Action:  "session.refresh",
+			Subject: "user:" + lookup.user.Name,
+			Detail:  "namespaces: " + strings.Join(namespacesFromAccess(lookup.access), ", "),
+		})
+	}
+	for key, username := range gone {
+		// A user who still resolves another way, for example through a
+		// newer single sign-on login, keeps their tokens and links.
+		tokens, shares := 0, 0
+		if !alive[key] {
+			tokens = personalTokens.revokeUser(username, "revalidation", now)
+			shares = shareLinks.revokeUser(username, "revalidation", now)
+		}
+		if ended[key] == 0 && tokens == 0 && shares == 0 {
+			continue
+		}
+		recordAudit(auditEvent{
+			Time:    now,
+			Action:  "session.end",
+			Subject: "user:" + username,
+			Detail:  fmt.Sprintf("%d sessions, %d tokens and %d share links revoked: no longer authorized", ended[key], tokens, shares),
+		})
+	}
+}
+
+// sameAccess compares access lists, treating equal expiry instants as
+// equal whatever their monotonic clock reading.
+func sameAccess(a, b []Access) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if !x.ExpiresAt.Equal(y.ExpiresAt) {
+			return false
+		}
+		x.ExpiresAt, y.ExpiresAt = time.Time{}, time.Time{}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// runSessionRevalidator revalidates sessions every interval until stop
+// closes.
+func runSessionRevalidator(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			revalidateSessions(now)
+		}
+	}
+}
+
 func namespacesFromAccess(access []Access) []string {
 	seen := make(map[string]struct{})
 	var namespaces []string
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	sessionStoreMemory = "memory"
+	sessionStoreBolt   = "bolt"
+	sessionStoreRedis  = "redis"
+)
+
+// newSessionStore returns the scs store selected by SESSION_STORE. The
+// memory store loses every session on restart; bolt keeps them in a local
+// file and redis shares them between replicas.
+func newSessionStore(cfg SessionConfig) (scs.Store, error) {
+	switch cfg.Store {
+	case sessionStoreMemory:
+		return memstore.New(), nil
+	case sessionStoreBolt:
+		return newBoltSessionStore(cfg.Path, time.Minute)
+	case sessionStoreRedis:
+		return newRedisSessionStore(cfg.RedisURL, cfg.RedisPrefix)
+	default:
+		return nil, fmt.Errorf("unknown session store %q: use memory, bolt or redis", cfg.Store)
+	}
+}
+
+var boltSessionBucket = []byte("sessions")
+
+// boltSessionStore keeps sessions in a bbolt file. Each value is the expiry
+// as big-endian Unix nanoseconds followed by the encoded session.
+type boltSessionStore struct {
+	db   *bolt.DB
+	stop chan struct{}
+}
+
+func newBoltSessionStore(path string, cleanupInterval time.Duration) (*boltSessionStore, error) {
+	if path == "" {
+		return nil, errors.New("bolt session store needs SESSION_STORE_PATH")
+	}
+	// The file is locked while open; fail instead of waiting forever when
+	// another process holds it.
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open session store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltSessionBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("open session store %s: %w", path, err)
+	}
+	s := &boltSessionStore{db: db, stop: make(chan struct{})}
+	if cleanupInterval > 0 {
+		go s.cleanup(cleanupInterval)
+	}
+	return s, nil
+}
+
+func decodeBoltSession(v []byte, now time.Time) ([]byte, bool) {
+	if len(v) < 8 {
+		return nil, false
+	}
+	expiry := int64(binary.BigEndian.Uint64(v[:8])) // #nosec G115 -- written by Commit from a Unix time
+	if now.UnixNano() >= expiry {
+		return nil, false
+	}
+	return append([]byte(nil), v[8:]...), true
+}
+
+func (s *boltSessionStore) Find(token string) ([]byte, bool, error) {
+	var data []byte
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data, found = decodeBoltSession(tx.Bucket(boltSessionBucket).Get([]byte(token)), time.Now())
+		return nil
+	})
+	return data, found, err
+}
+
+func (s *boltSessionStore) Commit(token string, b []byte, expiry time.Time) error {
+	v := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint64(v[:8], uint64(expiry.UnixNano())) // #nosec G115 -- session expiries are after 1970
+	copy(v[8:], b)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionBucket).Put([]byte(token), v)
+	})
+}
+
+func (s *boltSessionStore) Delete(token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionBucket).Delete([]byte(token))
+	})
+}
+
+// All returns every unexpired session, for scs.SessionManager.Iterate.
+func (s *boltSessionStore) All() (map[string][]byte, error) {
+	sessions := make(map[string][]byte)
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionBucket).ForEach(func(k, v []byte) error {
+			if data, ok := decodeBoltSession(v, now); ok {
+				sessions[string(k)] = data
+			}
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+// deleteExpired removes the sessions that expired before now.
+func (s *boltSessionStore) deleteExpired(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSessionBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if _, ok := decodeBoltSession(v, now); !ok {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltSessionStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.deleteExpired(time.Now()); err != nil {
+				log.Printf("session store cleanup failed: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the cleanup and closes the file.
+func (s *boltSessionStore) Close() error {
+	close(s.stop)
+	return s.db.Close()
+}
+
+// redisSessionStore keeps sessions in Redis or a compatible server under
+// prefix, and lets Redis expire them.
+type redisSessionStore struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+func newRedisSessionStore(rawURL, prefix string) (*redisSessionStore, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SESSION_REDIS_URL: %w", err)
+	}
+	s := &redisSessionStore{client: redis.NewClient(opts), prefix: prefix, timeout: 5 * time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		_ = s.client.Close()
+		return nil, fmt.Errorf("session store %s: %w", opts.Addr, err)
+	}
+	return s, nil
+}
+
+func (s *redisSessionStore) Find(token string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	data, err := s.client.Get(ctx, s.prefix+token).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *redisSessionStore) Commit(token string, b []byte, expiry time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	ttl := time.Until(expiry)
+	if ttl <= 0 {
+		return s.client.Del(ctx, s.prefix+token).Err()
+	}
+	return s.client.Set(ctx, s.prefix+token, b, ttl).Err()
+}
+
+func (s *redisSessionStore) Delete(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.client.Del(ctx, s.prefix+token).Err()
+}
+
+// All returns every session under the prefix, for
+// scs.SessionManager.Iterate. Each SCAN batch and its GETs get their own
+// timeout, so a large store is not cut off halfway.
+func (s *redisSessionStore) All() (map[string][]byte, error) {
+	sessions := make(map[string][]byte)
+	var cursor uint64
+	for {
+		next, err := s.scanBatch(cursor, sessions)
+		if err != nil {
+			return nil, err
+		}
+		if next == 0 {
+			return sessions, nil
+		}
+		cursor = next
+	}
+}
+
+// scanBatch reads one SCAN batch starting at cursor into sessions and
+// returns the cursor of the next batch.
+func (s *redisSessionStore) scanBatch(cursor uint64, sessions map[string][]byte) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	keys, next, err := s.client.Scan(ctx, cursor, s.prefix+"*", 100).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		data, err := s.client.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			// Expired between SCAN and GET.
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		sessions[strings.TrimPrefix(key, s.prefix)] = data
+	}
+	return next, nil
+}
+
+func (s *redisSessionStore) Close() error {
+	return s.client.Close()
+}
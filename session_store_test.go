@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alicebob/miniredis/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// useSessionStore swaps the store of sessionManager for the test.
+func useSessionStore(t *testing.T, store scs.Store) {
+	t.Helper()
+	resetSessions(t)
+	sessionManager.Store = store
+}
+
+// storeRoundTrip commits a session for alice through sessionManager and
+// returns its token.
+func storeRoundTrip(t *testing.T) string {
+	t.Helper()
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", nil).WithContext(ctx)
+	if err := createSession(req, loginSourcePassword, &User{Name: "alice"}, []Access{{Namespace: "team1"}}, nil); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatalf("commit session: %v", err)
+	}
+	return token
+}
+
+func sessionUser(t *testing.T, token string) string {
+	t.Helper()
+	ctx, err := sessionManager.Load(context.Background(), token)
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	sess, ok := sessionManager.Get(ctx, sessionKey).(sessionData)
+	if !ok || sess.User == nil {
+		return ""
+	}
+	return sess.User.Name
+}
+
+func TestBoltSessionStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	store, err := newBoltSessionStore(path, 0)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	useSessionStore(t, store)
+	token := storeRoundTrip(t)
+	if err := store.Close(); err != nil {
+		t.Fatalf("close store: %v", err)
+	}
+
+	store, err = newBoltSessionStore(path, 0)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	sessionManager.Store = store
+	if got := sessionUser(t, token); got != "alice" {
+		t.Fatalf("expected the session to survive a restart, got %q", got)
+	}
+	if n := destroyUserSessions("alice"); n != 1 {
+		t.Fatalf("expected Iterate to find one session, got %d", n)
+	}
+	if got := sessionUser(t, token); got != "" {
+		t.Fatalf("expected the session to be destroyed, got %q", got)
+	}
+}
+
+func TestBoltSessionStoreExpiry(t *testing.T) {
+	store, err := newBoltSessionStore(filepath.Join(t.TempDir(), "sessions.db"), 0)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	now := time.Now()
+	if err := store.Commit("old", []byte("a"), now.Add(-time.Second)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Commit("new", []byte("b"), now.Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if _, found, err := store.Find("old"); err != nil || found {
+		t.Fatalf("expected an expired session to be hidden, got %v %v", found, err)
+	}
+	all, err := store.All()
+	if err != nil || len(all) != 1 || string(all["new"]) != "b" {
+		t.Fatalf("expected only the live session, got %v %v", all, err)
+	}
+	if err := store.deleteExpired(now); err != nil {
+		t.Fatalf("delete expired: %v", err)
+	}
+	var keys int
+	_ = store.db.View(func(tx *bolt.Tx) error {
+		keys = tx.Bucket(boltSessionBucket).Stats().KeyN
+		return nil
+	})
+	if keys != 1 {
+		t.Fatalf("expected the expired session to be removed, %d keys left", keys)
+	}
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	store, err := newRedisSessionStore("redis://"+server.Addr()+"/0", "cv:session:")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	useSessionStore(t, store)
+
+	token := storeRoundTrip(t)
+	if !server.Exists("cv:session:" + token) {
+		t.Fatalf("expected the session under the prefix, got keys %v", server.Keys())
+	}
+	if ttl := server.TTL("cv:session:" + token); ttl <= 0 || ttl > sessionManager.Lifetime {
+		t.Fatalf("expected the key to expire with the session, got %v", ttl)
+	}
+	if err := server.Set("other:key", "x"); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	// A second replica sees the same session.
+	replica, err := newRedisSessionStore("redis://"+server.Addr()+"/0", "cv:session:")
+	if err != nil {
+		t.Fatalf("open replica: %v", err)
+	}
+	t.Cleanup(func() { _ = replica.Close() })
+	sessionManager.Store = replica
+	if got := sessionUser(t, token); got != "alice" {
+		t.Fatalf("expected the replica to load the session, got %q", got)
+	}
+	all, err := replica.All()
+	if err != nil || len(all) != 1 {
+		t.Fatalf("expected All to skip other keys, got %d %v", len(all), err)
+	}
+
+	server.FastForward(sessionManager.Lifetime + time.Second)
+	if got := sessionUser(t, token); got != "" {
+		t.Fatalf("expected Redis to expire the session, got %q", got)
+	}
+	if err := store.Commit("gone", []byte("x"), time.Now().Add(-time.Second)); err != nil || server.Exists("cv:session:gone") {
+		t.Fatalf("expected an expired commit to delete the key, got %v", err)
+	}
+}
+
+func TestNewSessionStore(t *testing.T) {
+	if _, err := newSessionStore(SessionConfig{Store: sessionStoreMemory}); err != nil {
+		t.Fatalf("memory store: %v", err)
+	}
+	tests := map[string]SessionConfig{
+		"unknown":       {Store: "sqlite"},
+		"bolt no path":  {Store: sessionStoreBolt},
+		"redis bad url": {Store: sessionStoreRedis, RedisURL: "http://localhost"},
+		"redis down":    {Store: sessionStoreRedis, RedisURL: "redis://127.0.0.1:1/0"},
+	}
+	for name, cfg := range tests {
+		if _, err := newSessionStore(cfg); err == nil {
+			t.Fatalf("%s: expected the session store to be refused", name)
+		}
+	}
+}
+
+func TestRedisSessionStoreAllPages(t *testing.T) {
+	server := miniredis.RunT(t)
+	store, err := newRedisSessionStore("redis://"+server.Addr()+"/0", "cv:session:")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	for i := range 250 {
+		if err := server.Set(fmt.Sprintf("cv:session:%03d", i), "x"); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	all, err := store.All()
+	if err != nil || len(all) != 250 || string(all["042"]) != "x" {
+		t.Fatalf("expected every session across SCAN batches, got %d %v", len(all), err)
+	}
+}
+
+func TestRevalidateSessionsKeepsIdleExpiry(t *testing.T) {
+	store, err := newBoltSessionStore(filepath.Join(t.TempDir(), "sessions.db"), 0)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	useSessionStore(t, store)
+	sessionManager.IdleTimeout = time.Hour
+	withPersonalTokenStore(t)
+	withLookupAccess(t, func(username string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Group: "team2_r", Namespace: "team2", PullOnly: true}}, nil
+	})
+
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", nil).WithContext(ctx)
+	if err := createSession(req, loginSourcePassword, &User{Name: "alice"}, []Access{{Namespace: "team1"}}, nil); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	now := time.Now()
+	sessionManager.Put(ctx, sessionSeenKey, now.Add(-50*time.Minute))
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatalf("commit session: %v", err)
+	}
+	deadline := sessionManager.Deadline(ctx)
+
+	revalidateSessions(now)
+
+	var expiry time.Time
+	_ = store.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltSessionBucket).Get([]byte(token))
+		expiry = time.Unix(0, int64(binary.BigEndian.Uint64(v[:8])))
+		return nil
+	})
+	if want := now.Add(10 * time.Minute); expiry.Sub(want).Abs() > time.Second {
+		t.Fatalf("expected the idle expiry to stay at %v, got %v", want, expiry)
+	}
+	ctx, err = sessionManager.Load(context.Background(), token)
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	sess, _ := sessionManager.Get(ctx, sessionKey).(sessionData)
+	if !reflect.DeepEqual(sess.Namespaces, []string{"team2"}) || !sessionManager.Deadline(ctx).Equal(deadline) {
+		t.Fatalf("expected new access with the same deadline, got %+v until %v", sess, sessionManager.Deadline(ctx))
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -34,8 +36,10 @@ func TestCreateSessionStoresData(t *testing.T) {
 	if err != nil {
 		t.Fatalf("load session: %v", err)
 	}
+	req := httptest.NewRequest(http.MethodPost, "/login", nil).WithContext(ctx)
+	req.Header.Set("User-Agent", "test-browser")
 	start := time.Now()
-	if err := createSession(ctx, user, access); err != nil {
+	if err := createSession(req, loginSourcePassword, user, access, nil); err != nil {
 		t.Fatalf("create session: %v", err)
 	}
 	token, _, err := sessionManager.Commit(ctx)
@@ -66,6 +70,9 @@ func TestCreateSessionStoresData(t *testing.T) {
 	if sess.CreatedAt.Before(start) || sess.CreatedAt.After(end) {
 		t.Fatalf("unexpected CreatedAt: %v", sess.CreatedAt)
 	}
+	if sess.ID == "" || sess.Source != loginSourcePassword || sess.RemoteAddr != "192.0.2.1" || sess.UserAgent != "test-browser" {
+		t.Fatalf("unexpected session details: %+v", sess)
+	}
 }
 
 func TestGetSessionValid(t *testing.T) {
@@ -131,3 +138,217 @@ func resetSessions(t *testing.T) {
 		sessionManager = newSessionManager()
 	})
 }
+
+// loginSession creates a session the way a login does and returns its
+// cookie and session ID.
+func loginSession(t *testing.T, username, source string, access []Access) (string, string) {
+	t.Helper()
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", nil).WithContext(ctx)
+	if err := createSession(req, source, &User{Name: username}, access, nil); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatalf("commit session: %v", err)
+	}
+	sess, _ := sessionManager.Get(ctx, sessionKey).(sessionData)
+	return token, sess.ID
+}
+
+// withLookupAccess replaces how users are looked up without a password
+// and forgets cached answers.
+func withLookupAccess(t *testing.T, lookup func(username string) (*User, []Access, error)) {
+	t.Helper()
+	prev := lookupAccess
+	lookupAccess = lookup
+	accessLookups.flush("")
+	t.Cleanup(func() {
+		lookupAccess = prev
+		accessLookups.flush("")
+	})
+}
+
+func loadSessionData(t *testing.T, token string) (sessionData, bool) {
+	t.Helper()
+	ctx, err := sessionManager.Load(context.Background(), token)
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	sess, ok := sessionManager.Get(ctx, sessionKey).(sessionData)
+	return sess, ok && sess.User != nil
+}
+
+func TestRevalidateSessions(t *testing.T) {
+	resetSessions(t)
+	tokens := withPersonalTokenStore(t)
+	shares := withShareStore(t)
+	rwd := []Access{{Group: "team1_rwd", Namespace: "team1", DeleteAllowed: true}, {Group: "team2_r", Namespace: "team2", PullOnly: true}}
+	calls := map[string]int{}
+	withLookupAccess(t, func(username string) (*User, []Access, error) {
+		calls[username]++
+		switch username {
+		case "alice":
+			access := []Access{{Group: "team2_r", Namespace: "team2", PullOnly: true}}
+			return &User{Name: "alice", Group: "team2_r", Namespace: "team2", PullOnly: true}, access, nil
+		case "bob", "erin":
+			return nil, nil, errUnknownUser
+		case "frank":
+			return &User{Name: "frank"}, []Access{{Group: "team2_r", Namespace: "team2", PullOnly: true}}, nil
+		case "carol":
+			return &User{Name: "carol"}, rwd, nil
+		default:
+			return nil, nil, errors.New("ldap: connection refused")
+		}
+	})
+
+	alice1, _ := loginSession(t, "alice", loginSourcePassword, rwd)
+	alice2, _ := loginSession(t, "alice", loginSourcePassword, rwd)
+	bob, _ := loginSession(t, "bob", loginSourcePassword, rwd)
+	carol, _ := loginSession(t, "carol", loginSourcePassword, rwd)
+	dave, _ := loginSession(t, "dave", loginSourcePassword, rwd)
+	now := time.Now()
+	addToken := func(username string) string {
+		token, _, _ := tokens.add(personalToken{Username: username, Scopes: []string{scopeRegistryPull}, CreatedAt: now, ExpiresAt: now.Add(time.Hour), Access: rwd, Source: loginSourcePassword})
+		return token.ID
+	}
+	bobToken := addToken("bob")
+	erinToken := addToken("erin")
+	frankToken := addToken("frank")
+	erinShare, _ := shares.add(shareLink{Repo: "team1/app", Namespace: "team1", CreatedBy: "erin", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+
+	revalidateSessions(now)
+
+	for _, token := range []string{alice1, alice2} {
+		sess, ok := loadSessionData(t, token)
+		if !ok || !reflect.DeepEqual(sess.Namespaces, []string{"team2"}) || namespaceCan(sess.Access, "team1", capDeleteTag) {
+			t.Fatalf("expected team1 to be dropped, got %+v", sess)
+		}
+	}
+	if calls["alice"] != 1 {
+		t.Fatalf("expected one lookup per user, got %d", calls["alice"])
+	}
+	if _, ok := loadSessionData(t, bob); ok {
+		t.Fatalf("expected the session of a removed user to end")
+	}
+	for _, id := range []string{bobToken, erinToken} {
+		if _, ok := tokens.get(id); ok {
+			t.Fatalf("expected the tokens of removed users to be revoked")
+		}
+	}
+	if _, ok := shares.get(erinShare.ID); ok {
+		t.Fatalf("expected the share links of removed users to be revoked")
+	}
+	if token, ok := tokens.get(frankToken); !ok || !reflect.DeepEqual(namespacesFromAccess(token.Access), []string{"team2"}) {
+		t.Fatalf("expected the token of a user without a session to be refreshed, got %+v", token)
+	}
+	for name, token := range map[string]string{"carol": carol, "dave": dave} {
+		if sess, ok := loadSessionData(t, token); !ok || !sameAccess(sess.Access, rwd) {
+			t.Fatalf("%s: expected the session to keep its access, got %+v", name, sess)
+		}
+	}
+}
+
+func TestRevalidateSingleSignOnSessions(t *testing.T) {
+	resetSessions(t)
+	withPersonalTokenStore(t)
+	withShareStore(t)
+	withLookupAccess(t, func(username string) (*User, []Access, error) {
+		t.Fatalf("single sign-on users must not be looked up in the directory")
+		return nil, nil, nil
+	})
+	prevCfg := oidcCfg
+	oidcCfg = OIDCConfig{GroupPrefix: "team"}
+	t.Cleanup(func() { oidcCfg = prevCfg })
+
+	login := func(username string, groups []string) string {
+		ctx, err := sessionManager.Load(context.Background(), "")
+		if err != nil {
+			t.Fatalf("load session: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/oidc/callback", nil).WithContext(ctx)
+		stale := []Access{{Group: "team1_rwd", Namespace: "team1", DeleteAllowed: true}}
+		if err := createSession(req, loginSourceOIDC, &User{Name: username}, stale, groups); err != nil {
+			t.Fatalf("create session: %v", err)
+		}
+		token, _, err := sessionManager.Commit(ctx)
+		if err != nil {
+			t.Fatalf("commit session: %v", err)
+		}
+		return token
+	}
+	alice := login("alice", []string{"team1_r"})
+	bob := login("bob", []string{"other"})
+
+	revalidateSessions(time.Now())
+
+	if sess, ok := loadSessionData(t, alice); !ok || !namespaceCan(sess.Access, "team1", capPull) || namespaceCan(sess.Access, "team1", capPush) {
+		t.Fatalf("expected the groups from the login to be mapped again, got %+v", sess)
+	}
+	if _, ok := loadSessionData(t, bob); ok {
+		t.Fatalf("expected a session whose groups no longer map to end")
+	}
+}
+
+func TestSessionAPI(t *testing.T) {
+	resetSessions(t)
+	prevAdmins := adminUsers
+	adminUsers = []string{"root"}
+	t.Cleanup(func() { adminUsers = prevAdmins })
+	access := []Access{{Group: "team1_rw", Namespace: "team1"}}
+	current, currentID := loginSession(t, "alice", loginSourcePassword, access)
+	laptop, laptopID := loginSession(t, "alice", loginSourcePassword, access)
+	other, otherID := loginSession(t, "bob", loginSourcePassword, access)
+	root, _ := loginSession(t, "root", loginSourcePassword, access)
+	router := cvRouter()
+
+	call := func(method, path, cookie string, out any) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(&http.Cookie{Name: "cv_session", Value: cookie})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if out != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+				t.Fatalf("%s %s: decode %s: %v", method, path, rec.Body.String(), err)
+			}
+		}
+		return rec.Code
+	}
+
+	var list sessionListPayload
+	if code := call(http.MethodGet, "/api/sessions", current, &list); code != http.StatusOK || len(list.Sessions) != 2 {
+		t.Fatalf("expected the two sessions of alice, got %d %+v", code, list)
+	}
+	for _, s := range list.Sessions {
+		if s.Current != (s.ID == currentID) || s.Username != "alice" || s.Source != loginSourcePassword || s.ExpiresAt.IsZero() {
+			t.Fatalf("unexpected session %+v", s)
+		}
+	}
+
+	if code := call(http.MethodDelete, "/api/sessions/"+otherID, current, nil); code != http.StatusNotFound {
+		t.Fatalf("expected the session of another user to be hidden, got %d", code)
+	}
+	if code := call(http.MethodDelete, "/api/sessions/"+laptopID, current, nil); code != http.StatusOK {
+		t.Fatalf("revoke session: %d", code)
+	}
+	if code := call(http.MethodGet, "/api/dashboard", laptop, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked session to end, got %d", code)
+	}
+
+	if code := call(http.MethodDelete, "/api/admin/sessions/bob", current, nil); code != http.StatusForbidden {
+		t.Fatalf("expected a non-admin to be refused, got %d", code)
+	}
+	var logout sessionLogoutPayload
+	if code := call(http.MethodDelete, "/api/admin/sessions/alice", root, &logout); code != http.StatusOK || logout.Ended != 1 {
+		t.Fatalf("expected one session to end, got %d %+v", code, logout)
+	}
+	if code := call(http.MethodGet, "/api/dashboard", current, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected alice to be logged out, got %d", code)
+	}
+	if code := call(http.MethodGet, "/api/dashboard", other, nil); code != http.StatusOK {
+		t.Fatalf("expected bob to stay logged in, got %d", code)
+	}
+}
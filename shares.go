@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sharePrefix marks a registry password as a share link credential.
+const sharePrefix = "cvs_"
+
+// shareLink lets anyone holding its credential pull one repository, or one
+// image in it, until it expires or its creator can no longer pull from the
+// namespace. Source and Groups record how the creator logged in.
+type shareLink struct {
+	ID        string    `json:"id"`
+	Repo      string    `json:"repo"`
+	Namespace string    `json:"namespace"`
+	Digest    string    `json:"digest,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Source    string    `json:"source,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+}
+
+// public returns a copy of the link that is safe to show.
+func (l shareLink) public() shareLink {
+	l.Groups = nil
+	return l
+}
+
+// creatorCanPull reports whether the creator of l can still pull from its
+// namespace, looking them up again the way they logged in. Links from
+// before logins were recorded, and lookups that cannot answer, keep
+// working.
+func (l shareLink) creatorCanPull(now time.Time) bool {
+	if l.Source == "" {
+		return true
+	}
+	_, access, err := accessLookups.resolve(l.Source, l.CreatedBy, l.Groups, now)
+	switch {
+	case err == nil:
+		return namespaceCan(access, l.Namespace, capPull)
+	case accountGone(err):
+		return false
+	}
+	return true
+}
+
+var digestPattern = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+var (
+	shareKeyOnce sync.Once
+	shareKey     []byte
+)
+
+// shareSigningKey returns SHARE_LINK_KEY, or a random key for the life of
+// the process when it is unset.
+func shareSigningKey() []byte {
+	shareKeyOnce.Do(func() {
+		if shareLinkKey != "" {
+			shareKey = []byte(shareLinkKey)
+			return
+		}
+		shareKey = make([]byte, 32)
+		if _, err := rand.Read(shareKey); err != nil {
+			panic(err)
+		}
+	})
+	return shareKey
+}
+
+func (l shareLink) signature() string {
+	mac := hmac.New(sha256.New, shareSigningKey())
+	mac.Write([]byte(strings.Join([]string{
+		l.ID, l.Repo, l.Digest, strconv.FormatInt(l.ExpiresAt.Unix(), 10),
+	}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// credential is the password handed out for the link.
+func (l shareLink) credential() string {
+	return sharePrefix + l.ID + "." + l.signature()
+}
+
+func isShareCredential(password string) bool {
+	return strings.HasPrefix(password, sharePrefix)
+}
+
+type shareStore struct {
+	jsonStore[shareLink]
+	// digests caches the content a digest-pinned link may fetch. Manifests
+	// are immutable by digest, so the set never goes stale.
+	digests map[string]map[string]bool
+}
+
+var shareLinks = newShareStore(shareStorePath)
+
+var errShareNotFound = errors.New("share link not found")
+
+func newShareStore(path string) *shareStore {
+	store := &shareStore{digests: make(map[string]map[string]bool)}
+	store.load("share link store", path)
+	return store
+}
+
+func (s *shareStore) add(l shareLink) (shareLink, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return shareLink{}, err
+	}
+	l.ID = hex.EncodeToString(id)
+
+	s.mu.Lock()
+	s.pruneLocked(l.CreatedAt)
+	s.items[l.ID] = l
+	s.saveLocked()
+	s.mu.Unlock()
+
+	recordAudit(auditEvent{
+		Time:      l.CreatedAt,
+		Actor:     l.CreatedBy,
+		Action:    "share.create",
+		Namespace: l.Namespace,
+		Subject:   l.target(),
+		Detail:    l.ID + " until " + l.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+	return l, nil
+}
+
+func (s *shareStore) get(id string) (shareLink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.items[id]
+	return l, ok
+}
+
+func (s *shareStore) revoke(id, actor string, now time.Time) (shareLink, error) {
+	s.mu.Lock()
+	l, ok := s.items[id]
+	if ok {
+		delete(s.items, id)
+		delete(s.digests, id)
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return shareLink{}, errShareNotFound
+	}
+	recordAudit(auditEvent{
+		Time:      now,
+		Actor:     actor,
+		Action:    "share.revoke",
+		Namespace: l.Namespace,
+		Subject:   l.target(),
+		Detail:    l.ID,
+	})
+	return l, nil
+}
+
+// revokeUser removes every link created by username and returns how many
+// there were.
+func (s *shareStore) revokeUser(username, actor string, now time.Time) int {
+	s.mu.Lock()
+	var revoked []shareLink
+	for id, l := range s.items {
+		if strings.EqualFold(l.CreatedBy, username) {
+			revoked = append(revoked, l)
+			delete(s.items, id)
+			delete(s.digests, id)
+		}
+	}
+	if len(revoked) > 0 {
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+
+	for _, l := range revoked {
+		recordAudit(auditEvent{
+			Time:      now,
+			Actor:     actor,
+			Action:    "share.revoke",
+			Namespace: l.Namespace,
+			Subject:   l.target(),
+			Detail:    l.ID,
+		})
+	}
+	return len(revoked)
+}
+
+// list returns the links that have not expired, newest first.
+func (s *shareStore) list(now time.Time) []shareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+	out := make([]shareLink, 0, len(s.items))
+	for _, l := range s.items {
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.After(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+func (s *shareStore) pruneLocked(now time.Time) {
+	changed := false
+	for id, l := range s.items {
+		if !now.Before(l.ExpiresAt) {
+			delete(s.items, id)
+			delete(s.digests, id)
+			changed = true
+		}
+	}
+	if changed {
+		s.saveLocked()
+	}
+}
+
+// verify returns the link behind a credential if it is genuine, still
+// stored, not expired and its creator can still pull.
+func (s *shareStore) verify(credential string, now time.Time) (shareLink, bool) {
+	rest, ok := strings.CutPrefix(credential, sharePrefix)
+	if !ok {
+		return shareLink{}, false
+	}
+	id, sig, ok := strings.Cut(rest, ".")
+	if !ok {
+		return shareLink{}, false
+	}
+	l, found := s.get(id)
+	if !found || !now.Before(l.ExpiresAt) {
+		return shareLink{}, false
+	}
+	if !hmac.Equal([]byte(sig), []byte(l.signature())) || !l.creatorCanPull(now) {
+		return shareLink{}, false
+	}
+	return l, true
+}
+
+// allowedDigests returns the manifests and blobs that make up a pinned
+// image: the pinned manifest, the platform manifests of an index, and the
+// config and layers of each image manifest.
+func (s *shareStore) allowedDigests(ctx context.Context, l shareLink) (map[string]bool, error) {
+	s.mu.Lock()
+	cached, ok := s.digests[l.ID]
+	s.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	allowed := map[string]bool{l.Digest: true}
+	body, contentType, _, err := fetchManifestPayload(ctx, client, l.Repo, l.Digest)
+	if err != nil {
+		return nil, err
+	}
+	images := [][]byte{body}
+	if isManifestListContentType(contentType) {
+		var list manifestList
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, err
+		}
+		images = images[:0]
+		for _, m := range list.Manifests {
+			allowed[m.Digest] = true
+			child, err := fetchManifestByDigest(ctx, client, l.Repo, m.Digest)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, child)
+		}
+	}
+	for _, image := range images {
+		var manifest manifestSchema2
+		if err := json.Unmarshal(image, &manifest); err != nil {
+			return nil, err
+		}
+		if manifest.Config.Digest != "" {
+			allowed[manifest.Config.Digest] = true
+		}
+		for _, layer := range manifest.Layers {
+			allowed[layer.Digest] = true
+		}
+	}
+
+	s.mu.Lock()
+	s.digests[l.ID] = allowed
+	s.mu.Unlock()
+	return allowed, nil
+}
+
+// shareAllows reports whether a share link permits r: GET or HEAD on the
+// link's repository manifests and blobs, limited to the pinned image when
+// the link has a digest.
+func shareAllows(l shareLink, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if !isSafeRequestPath(r) {
+		return false
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/"+l.Repo+"/")
+	if !ok {
+		return false
+	}
+	kind, ref, ok := strings.Cut(rest, "/")
+	if !ok || ref == "" || strings.Contains(ref, "/") || (kind != "manifests" && kind != "blobs") {
+		return false
+	}
+	if l.Digest == "" {
+		return true
+	}
+	if ref == l.Digest {
+		return true
+	}
+	allowed, err := shareLinks.allowedDigests(r.Context(), l)
+	if err != nil {
+		log.Printf("share link %s: resolve %s@%s: %v", l.ID, l.Repo, l.Digest, err)
+		return false
+	}
+	return allowed[ref]
+}
+
+func (l shareLink) target() string {
+	if l.Digest == "" {
+		return l.Repo
+	}
+	return l.Repo + "@" + l.Digest
+}
+
+// serveShareRequest proxies r for a share link credential sent as the Basic
+// Auth password.
+func serveShareRequest(w http.ResponseWriter, r *http.Request, proxy http.Handler, credential string) {
+	link, ok := shareLinks.verify(credential, time.Now())
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Registry"`)
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/v2/" && !shareAllows(link, r) {
+		http.Error(w, "forbidden by share link", http.StatusForbidden)
+		return
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// shareScopes grants pull on the link's repository to the scopes that ask
+// for it.
+func shareScopes(l shareLink, requested []tokenAccess) []tokenAccess {
+	var granted []tokenAccess
+	for _, scope := range requested {
+		if scope.Type != "repository" || scope.Name != l.Repo {
+			continue
+		}
+		if containsString(scope.Actions, "pull") || containsString(scope.Actions, "*") {
+			granted = append(granted, tokenAccess{Type: scope.Type, Name: scope.Name, Actions: []string{"pull"}})
+		}
+	}
+	return granted
+}
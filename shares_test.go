@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareLinkVerify(t *testing.T) {
+	store := withShareStore(t)
+	now := time.Now()
+	link, err := store.add(shareLink{Repo: "team1/app", Namespace: "team1", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("add link: %v", err)
+	}
+	credential := link.credential()
+	if !isShareCredential(credential) {
+		t.Fatalf("expected share prefix, got %q", credential)
+	}
+	if got, ok := store.verify(credential, now); !ok || got.ID != link.ID {
+		t.Fatalf("expected credential to verify")
+	}
+	if _, ok := store.verify(credential+"x", now); ok {
+		t.Fatalf("expected tampered credential to fail")
+	}
+	if _, ok := store.verify(credential, now.Add(2*time.Hour)); ok {
+		t.Fatalf("expected expired credential to fail")
+	}
+	if _, err := store.revoke(link.ID, "alice", now); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, ok := store.verify(credential, now); ok {
+		t.Fatalf("expected revoked credential to fail")
+	}
+}
+
+func TestShareLinkFollowsCreatorAccess(t *testing.T) {
+	store := withShareStore(t)
+	lookup := func(username string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Group: "team1_r", Namespace: "team1", PullOnly: true}}, nil
+	}
+	withLookupAccess(t, func(username string) (*User, []Access, error) {
+		return lookup(username)
+	})
+	now := time.Now()
+	link, _ := store.add(shareLink{Repo: "team1/app", Namespace: "team1", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour), Source: loginSourcePassword})
+	credential := link.credential()
+	if _, ok := store.verify(credential, now); !ok {
+		t.Fatalf("expected the link to work while its creator can pull")
+	}
+
+	for name, next := range map[string]func(string) (*User, []Access, error){
+		"lost the namespace": func(username string) (*User, []Access, error) {
+			return &User{Name: username}, []Access{{Group: "team2_r", Namespace: "team2", PullOnly: true}}, nil
+		},
+		"gone": func(string) (*User, []Access, error) {
+			return nil, nil, errUnknownUser
+		},
+	} {
+		lookup = next
+		accessLookups.flush("")
+		if _, ok := store.verify(credential, now); ok {
+			t.Fatalf("%s: expected the link to stop working", name)
+		}
+	}
+}
+
+func TestShareAllowsRepository(t *testing.T) {
+	link := shareLink{ID: "x", Repo: "team1/app"}
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{http.MethodGet, "/v2/team1/app/manifests/latest", true},
+		{http.MethodHead, "/v2/team1/app/blobs/sha256:abc", true},
+		{http.MethodGet, "/v2/team1/app/tags/list", false},
+		{http.MethodPut, "/v2/team1/app/manifests/latest", false},
+		{http.MethodDelete, "/v2/team1/app/manifests/sha256:abc", false},
+		{http.MethodGet, "/v2/team1/app/blobs/uploads/abc", false},
+		{http.MethodGet, "/v2/team1/other/manifests/latest", false},
+		{http.MethodGet, "/v2/team1/app/sub/manifests/latest", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := shareAllows(link, req); got != tt.want {
+			t.Fatalf("%s %s: expected %v, got %v", tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestShareAllowsPinnedIndex(t *testing.T) {
+	store := withShareStore(t)
+	index := "sha256:index"
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/team1/app/manifests/" + index:
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			_, _ = w.Write([]byte(`{"schemaVersion":2,"manifests":[{"digest":"sha256:amd64"}]}`))
+		case "/v2/team1/app/manifests/sha256:amd64":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			_, _ = w.Write([]byte(`{"schemaVersion":2,"config":{"digest":"sha256:config"},"layers":[{"digest":"sha256:layer"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer cleanup()
+
+	now := time.Now()
+	link, _ := store.add(shareLink{Repo: "team1/app", Namespace: "team1", Digest: index, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/v2/team1/app/manifests/" + index, true},
+		{"/v2/team1/app/manifests/sha256:amd64", true},
+		{"/v2/team1/app/blobs/sha256:config", true},
+		{"/v2/team1/app/blobs/sha256:layer", true},
+		{"/v2/team1/app/blobs/sha256:other", false},
+		{"/v2/team1/app/manifests/latest", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if got := shareAllows(link, req); got != tt.want {
+			t.Fatalf("%s: expected %v, got %v", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestCvRouterShareCredential(t *testing.T) {
+	store := withShareStore(t)
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer cleanup()
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		t.Fatalf("share credentials must not reach the directory")
+		return nil, nil, nil
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+
+	now := time.Now()
+	link, _ := store.add(shareLink{Repo: "team1/app", Namespace: "team1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	router := cvRouter()
+	tests := []struct {
+		method     string
+		path       string
+		credential string
+		want       int
+	}{
+		{http.MethodGet, "/v2/", link.credential(), http.StatusOK},
+		{http.MethodGet, "/v2/team1/app/manifests/latest", link.credential(), http.StatusOK},
+		{http.MethodPut, "/v2/team1/app/manifests/latest", link.credential(), http.StatusForbidden},
+		{http.MethodGet, "/v2/team1/other/manifests/latest", link.credential(), http.StatusForbidden},
+		{http.MethodGet, "/v2/team1/app/manifests/latest", sharePrefix + link.ID + ".forged", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.SetBasicAuth("share", tt.credential)
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestShareTokenFlow(t *testing.T) {
+	withTokenAuth(t)
+	store := withShareStore(t)
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer cleanup()
+
+	now := time.Now()
+	link, _ := store.add(shareLink{Repo: "team1/app", Namespace: "team1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	router := cvRouter()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/token?service=container-vault&scope=repository:team1/app:pull,push&scope=repository:team1/other:pull", nil)
+	req.SetBasicAuth("share", link.credential())
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp tokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	claims, err := parseTokenClaims(resp.Token, time.Now())
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if claims.Share != link.ID || len(claims.Access) != 1 || strings.Join(claims.Access[0].Actions, ",") != "pull" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	pull := func() int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v2/team1/app/manifests/latest", nil)
+		req.Header.Set("Authorization", "Bearer "+resp.Token)
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := pull(); code != http.StatusOK {
+		t.Fatalf("expected pull to work, got %d", code)
+	}
+	if _, err := store.revoke(link.ID, "alice", now); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if code := pull(); code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked link token to be refused, got %d", code)
+	}
+}
+
+func TestShareAPI(t *testing.T) {
+	withShareStore(t)
+	router := cvRouter()
+	alice := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1", PullOnly: true}})
+	bob := seedSessionWithAccess(t, "bob", []Access{{Namespace: "team2"}})
+
+	call := func(token, method, path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		var buf bytes.Buffer
+		if body != nil {
+			_ = json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := call(alice, http.MethodPost, "/api/shares", map[string]string{"repo": "team1/app", "digest": "sha256:abc", "duration": "24h", "note": "vendor"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created shareCreatePayload
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("decode link: %v", err)
+	}
+	if created.ID == "" || created.Repo != "team1/app" || created.Digest != "sha256:abc" || !isShareCredential(created.Credential) {
+		t.Fatalf("unexpected link: %+v", created)
+	}
+
+	if rec := call(bob, http.MethodPost, "/api/shares", map[string]string{"repo": "team1/app", "duration": "1h"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected bob to be refused, got %d", rec.Code)
+	}
+	if rec := call(alice, http.MethodPost, "/api/shares", map[string]string{"repo": "team1/app", "digest": "not a digest", "duration": "1h"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad digest, got %d", rec.Code)
+	}
+	if rec := call(alice, http.MethodPost, "/api/shares", map[string]string{"repo": "team1/app", "duration": "9999h"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for long duration, got %d", rec.Code)
+	}
+
+	var listed shareListPayload
+	_ = json.NewDecoder(call(alice, http.MethodGet, "/api/shares", nil).Body).Decode(&listed)
+	if len(listed.Links) != 1 || listed.Links[0].ID != created.ID {
+		t.Fatalf("expected alice to see the link, got %+v", listed)
+	}
+	listed = shareListPayload{}
+	_ = json.NewDecoder(call(bob, http.MethodGet, "/api/shares", nil).Body).Decode(&listed)
+	if len(listed.Links) != 0 {
+		t.Fatalf("expected bob to see no links, got %+v", listed)
+	}
+
+	if rec := call(bob, http.MethodDelete, "/api/shares/"+created.ID, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected bob revoke to be refused, got %d", rec.Code)
+	}
+	if rec := call(alice, http.MethodDelete, "/api/shares/"+created.ID, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected revoke to succeed, got %d", rec.Code)
+	}
+	if _, ok := shareLinks.verify(created.Credential, time.Now()); ok {
+		t.Fatalf("expected revoked credential to stop working")
+	}
+}
+
+func TestShareLinkCappedByTemporaryGrant(t *testing.T) {
+	withShareStore(t)
+	router := cvRouter()
+	access := []Access{{Namespace: "team2", PullOnly: true, GrantID: "g", ExpiresAt: time.Now().Add(time.Hour)}}
+	store := withGrantStore(t)
+	store.items["g"] = accessGrant{ID: "g", User: "alice", Namespace: "team2", Permission: "r", ExpiresAt: access[0].ExpiresAt}
+	token := seedSessionWithAccess(t, "alice", access)
+
+	body, _ := json.Marshal(map[string]string{"repo": "team2/app", "duration": "48h"})
+	req := httptest.NewRequest(http.MethodPost, "/api/shares", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected link to be capped by the grant, got %d", rec.Code)
+	}
+}
+
+func withShareStore(t *testing.T) *shareStore {
+	return withStore(t, &shareLinks, newShareStore(""))
+}
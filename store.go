@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// jsonStore holds records by ID in memory and, when path is set, in a JSON
+// file. Stores embed it and hold mu while they read or change items,
+// calling saveLocked after every change.
+type jsonStore[T any] struct {
+	mu    sync.Mutex
+	name  string
+	path  string
+	items map[string]T
+}
+
+// load names the store for log messages and reads path, if set. An
+// unreadable file is logged and the store starts empty.
+func (s *jsonStore[T]) load(name, path string) {
+	s.name, s.path, s.items = name, path, make(map[string]T)
+	if path == "" {
+		return
+	}
+	if err := readJSONFile(path, &s.items); err != nil {
+		log.Printf("%s %s unreadable: %v", name, path, err)
+	}
+}
+
+func (s *jsonStore[T]) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := writeJSONFile(s.path, s.items); err != nil {
+		log.Printf("%s %s not saved: %v", s.name, s.path, err)
+	}
+}
+
+// readJSONFile decodes the JSON document at path into v. A missing file is
+// not an error and leaves v untouched.
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile replaces path with the JSON encoding of v. The data is
+// written to a temporary file first so readers never see a partial file.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// withStore replaces the package store *global with fresh until the test
+// ends.
+func withStore[S any](t *testing.T, global **S, fresh *S) *S {
+	t.Helper()
+	prev := *global
+	*global = fresh
+	t.Cleanup(func() {
+		*global = prev
+	})
+	return fresh
+}
+
+func TestJSONStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	var store jsonStore[accessGrant]
+	store.load("test store", path)
+	store.mu.Lock()
+	store.items["g"] = accessGrant{ID: "g", Namespace: "team1"}
+	store.saveLocked()
+	store.mu.Unlock()
+
+	var reopened jsonStore[accessGrant]
+	reopened.load("test store", path)
+	if got := reopened.items["g"]; got.Namespace != "team1" {
+		t.Fatalf("expected the record to be read back, got %+v", reopened.items)
+	}
+
+	var memory jsonStore[accessGrant]
+	memory.load("test store", "")
+	memory.saveLocked()
+	if memory.items == nil {
+		t.Fatalf("expected an empty in-memory store")
+	}
+}
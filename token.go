@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenClockSkew = 30 * time.Second
+
+// tokenAccess is a single resource grant carried in a registry bearer token,
+// following the Docker distribution token specification.
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+type tokenClaims struct {
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub"`
+	Audience  string        `json:"aud"`
+	ExpiresAt int64         `json:"exp"`
+	NotBefore int64         `json:"nbf"`
+	IssuedAt  int64         `json:"iat"`
+	ID        string        `json:"jti"`
+	Access    []tokenAccess `json:"access"`
+	Groups    []string      `json:"groups,omitempty"`
+	Share     string        `json:"share,omitempty"`
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+var (
+	tokenKeyOnce sync.Once
+	tokenKey     *ecdsa.PrivateKey
+	tokenKeyErr  error
+)
+
+func tokenSigningKey() (*ecdsa.PrivateKey, error) {
+	tokenKeyOnce.Do(func() {
+		tokenKey, tokenKeyErr = loadOrCreateECKey(tokenCfg.SigningKeyPath)
+	})
+	return tokenKey, tokenKeyErr
+}
+
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	// Clients without credentials get an anonymous token that can only
+	// pull from public namespaces.
+	anonymous := !ok && len(publicNamespaces) > 0
+	if !anonymous && (!ok || password == "") {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Registry"`)
+		http.Error(w, "auth required", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	if service := query.Get("service"); service != "" && service != tokenCfg.Service {
+		http.Error(w, "unknown service", http.StatusBadRequest)
+		return
+	}
+
+	scopes := parseScopes(query["scope"])
+	var claims tokenClaims
+	switch {
+	case anonymous:
+		claims.Access = grantScopes(nil, scopes)
+	case isShareCredential(password):
+		link, ok := shareLinks.verify(password, time.Now())
+		if !ok {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		claims = tokenClaims{Subject: "share:" + link.ID, Access: shareScopes(link, scopes), Share: link.ID}
+	default:
+		user, access, err := registryAuth(username, password)
+		if err != nil {
+			log.Printf("token auth failed for %s: %v", username, err)
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		for _, scope := range scopes {
+			access = adminPersonalAccess(user.Name, access, scope.Name)
+		}
+		claims = tokenClaims{Subject: user.Name, Access: grantScopes(access, scopes), Groups: accessGroups(access)}
+	}
+	now := time.Now()
+	token, err := signTokenClaims(claims, now)
+	if err != nil {
+		log.Printf("token issue failed for %s: %v", username, err)
+		http.Error(w, "token unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(tokenCfg.TTL.Seconds()),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	})
+}
+
+func issueToken(subject string, access []tokenAccess, groups []string, now time.Time) (string, error) {
+	return signTokenClaims(tokenClaims{Subject: subject, Access: access, Groups: groups}, now)
+}
+
+// signTokenClaims fills in the issuer, audience, lifetime and ID of claims
+// and signs them.
+func signTokenClaims(claims tokenClaims, now time.Time) (string, error) {
+	key, err := tokenSigningKey()
+	if err != nil {
+		return "", err
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	if claims.Access == nil {
+		claims.Access = []tokenAccess{}
+	}
+	claims.Issuer = tokenCfg.Issuer
+	claims.Audience = tokenCfg.Service
+	claims.ExpiresAt = now.Add(tokenCfg.TTL).Unix()
+	claims.NotBefore = now.Add(-tokenClockSkew).Unix()
+	claims.IssuedAt = now.Unix()
+	claims.ID = hex.EncodeToString(jti)
+	return signJWT(key, claims)
+}
+
+func parseTokenClaims(token string, now time.Time) (*tokenClaims, error) {
+	key, err := tokenSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	var claims tokenClaims
+	if err := verifyJWT(token, &key.PublicKey, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != tokenCfg.Issuer || claims.Audience != tokenCfg.Service {
+		return nil, errInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt || now.Add(tokenClockSkew).Unix() < claims.NotBefore {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
+
+// parseScopes decodes scope query values of the form
+// "repository:team1/app:pull,push". Several scopes may share one value
+// separated by spaces.
+func parseScopes(values []string) []tokenAccess {
+	var scopes []tokenAccess
+	for _, value := range values {
+		for _, raw := range strings.Fields(value) {
+			first := strings.Index(raw, ":")
+			last := strings.LastIndex(raw, ":")
+			if first <= 0 || last == first {
+				continue
+			}
+			name := raw[first+1 : last]
+			if name == "" {
+				continue
+			}
+			scopes = append(scopes, tokenAccess{
+				Type:    raw[:first],
+				Name:    name,
+				Actions: splitCommaList(raw[last+1:]),
+			})
+		}
+	}
+	return scopes
+}
+
+// grantScopes intersects the requested scopes with the namespace permissions
+// derived from the user's groups. Pull on public namespaces is granted to
+// everyone.
+func grantScopes(access []Access, requested []tokenAccess) []tokenAccess {
+	var granted []tokenAccess
+	for _, scope := range requested {
+		if scope.Type != "repository" {
+			continue
+		}
+		var allowed []string
+		if namespace, ok := mostSpecificNamespace(namespacesFromAccess(access), scope.Name); ok {
+			allowed = namespaceActions(access, namespace)
+		}
+		if isPublicRepository(scope.Name) && !containsString(allowed, "pull") {
+			allowed = append([]string{"pull"}, allowed...)
+		}
+		var actions []string
+		for _, action := range allowed {
+			if containsString(scope.Actions, action) || containsString(scope.Actions, "*") {
+				actions = append(actions, action)
+			}
+		}
+		if len(actions) == 0 {
+			continue
+		}
+		granted = append(granted, tokenAccess{Type: scope.Type, Name: scope.Name, Actions: actions})
+	}
+	return granted
+}
+
+func namespaceActions(access []Access, namespace string) []string {
+	caps, ok := namespaceCapabilities(access, namespace)
+	if !ok {
+		return nil
+	}
+	var actions []string
+	if caps.has(capPull) {
+		actions = append(actions, "pull")
+	}
+	if caps.has(capPush) {
+		actions = append(actions, "push")
+	}
+	if caps.has(capDeleteTag) || caps.has(capDeleteRepo) {
+		actions = append(actions, "delete")
+	}
+	return actions
+}
+
+// authenticateBearer validates the bearer token on a registry request and
+// answers with a token challenge when it is missing or invalid.
+func authenticateBearer(w http.ResponseWriter, r *http.Request) (*tokenClaims, bool) {
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || strings.TrimSpace(token) == "" {
+		writeBearerChallenge(w, r, "")
+		http.Error(w, "auth required", http.StatusUnauthorized)
+		return nil, false
+	}
+	claims, err := parseTokenClaims(strings.TrimSpace(token), time.Now())
+	if err != nil {
+		writeBearerChallenge(w, r, "invalid_token")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
+
+func authorizeToken(claims *tokenClaims, r *http.Request) bool {
+	if !isSafeRequestPath(r) {
+		return false
+	}
+	if r.URL.Path == "/v2/" || publicPull(r) {
+		return true
+	}
+	if claims.Share != "" {
+		// Share tokens are re-checked against the link so a revocation
+		// takes effect before the token expires.
+		link, ok := shareLinks.get(claims.Share)
+		return ok && time.Now().Before(link.ExpiresAt) && shareAllows(link, r)
+	}
+	repo, ok := repositoryFromPath(r.URL.Path)
+	if !ok {
+		return false
+	}
+	action := registryAction(r.Method)
+	for _, entry := range claims.Access {
+		if entry.Type != "repository" || entry.Name != repo {
+			continue
+		}
+		if containsString(entry.Actions, action) || containsString(entry.Actions, "*") {
+			if manifestRepo, ref, aclAction, ok := manifestACLRequest(r); ok {
+				return aclAllows(repoACL, claims.Groups, manifestRepo, ref, aclAction)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func writeBearerChallenge(w http.ResponseWriter, r *http.Request, errCode string) {
+	challenge := fmt.Sprintf(`Bearer realm=%q,service=%q`, tokenCfg.Realm, tokenCfg.Service)
+	if repo, ok := repositoryFromPath(r.URL.Path); ok {
+		actions := registryAction(r.Method)
+		if actions == "push" {
+			actions = "pull,push"
+		}
+		challenge += fmt.Sprintf(`,scope="repository:%s:%s"`, repo, actions)
+	}
+	if errCode != "" {
+		challenge += fmt.Sprintf(`,error=%q`, errCode)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+}
+
+// repositoryFromPath extracts the repository name from a registry API path
+// such as /v2/team1/app/manifests/latest or /v2/team1/app/blobs/uploads/.
+func repositoryFromPath(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return "", false
+	}
+	parts := strings.Split(rest, "/")
+	n := len(parts)
+	switch {
+	case n >= 4 && parts[n-3] == "blobs" && parts[n-2] == "uploads":
+		parts = parts[:n-3]
+	case n >= 3 && (parts[n-2] == "manifests" || parts[n-2] == "blobs" || parts[n-2] == "tags"):
+		parts = parts[:n-2]
+	default:
+		return "", false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", false
+		}
+	}
+	return strings.Join(parts, "/"), true
+}
+
+func registryAction(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return "pull"
+	case http.MethodDelete:
+		return "delete"
+	default:
+		return "push"
+	}
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScopes(t *testing.T) {
+	got := parseScopes([]string{"repository:team1/app:pull,push repository:team2/x/y:pull", "bogus", "registry:catalog:*"})
+	want := []tokenAccess{
+		{Type: "repository", Name: "team1/app", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "team2/x/y", Actions: []string{"pull"}},
+		{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected scopes: %#v", got)
+	}
+}
+
+func TestGrantScopesIntersectsAccess(t *testing.T) {
+	access := []Access{
+		{Namespace: "team1", PullOnly: false, DeleteAllowed: false},
+		{Namespace: "team2", PullOnly: true, DeleteAllowed: true},
+	}
+	requested := []tokenAccess{
+		{Type: "repository", Name: "team1/app", Actions: []string{"pull", "push", "delete"}},
+		{Type: "repository", Name: "team2/app", Actions: []string{"*"}},
+		{Type: "repository", Name: "team3/app", Actions: []string{"pull"}},
+		{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+	}
+	got := grantScopes(access, requested)
+	want := []tokenAccess{
+		{Type: "repository", Name: "team1/app", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "team2/app", Actions: []string{"pull", "delete"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected grants: %#v", got)
+	}
+}
+
+func TestRepositoryFromPath(t *testing.T) {
+	tests := []struct {
+		path string
+		repo string
+		ok   bool
+	}{
+		{"/v2/team1/app/manifests/latest", "team1/app", true},
+		{"/v2/team1/a/b/tags/list", "team1/a/b", true},
+		{"/v2/team1/app/blobs/sha256:abc", "team1/app", true},
+		{"/v2/team1/app/blobs/uploads/", "team1/app", true},
+		{"/v2/team1/app/blobs/uploads/1234", "team1/app", true},
+		{"/v2/_catalog", "", false},
+		{"/v2/", "", false},
+	}
+	for _, tt := range tests {
+		repo, ok := repositoryFromPath(tt.path)
+		if ok != tt.ok || repo != tt.repo {
+			t.Fatalf("path %q: expected %q/%v, got %q/%v", tt.path, tt.repo, tt.ok, repo, ok)
+		}
+	}
+}
+
+func TestParseTokenClaimsRejectsExpired(t *testing.T) {
+	withTokenAuth(t)
+	token, err := issueToken("alice", nil, nil, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
+	if _, err := parseTokenClaims(token, time.Now()); err == nil {
+		t.Fatalf("expected expired token to be rejected")
+	}
+	if _, err := parseTokenClaims(token+"x", time.Now().Add(-time.Hour)); err == nil {
+		t.Fatalf("expected tampered token to be rejected")
+	}
+}
+
+func TestTokenEndpointRequiresCredentials(t *testing.T) {
+	withTokenAuth(t)
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/token?service=container-vault", nil)
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestProxyChallengesWithoutToken(t *testing.T) {
+	withTokenAuth(t)
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/v2/team1/app/manifests/v1", nil)
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+	want := `Bearer realm="https://localhost/token",service="container-vault",scope="repository:team1/app:pull,push"`
+	if got := rec.Header().Get("WWW-Authenticate"); got != want {
+		t.Fatalf("unexpected challenge: %q", got)
+	}
+}
+
+func TestTokenFlowAuthorizesProxy(t *testing.T) {
+	withTokenAuth(t)
+	calls := 0
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		calls++
+		return &User{Name: username}, []Access{{Namespace: "team1", PullOnly: true}}, nil
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+
+	originalTransport := proxyTransport
+	proxyTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Request:    r,
+		}, nil
+	})
+	t.Cleanup(func() {
+		proxyTransport = originalTransport
+	})
+
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/token?service=container-vault&scope=repository:team1/app:pull,push", nil)
+	req.SetBasicAuth("alice", "secret")
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp tokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	if resp.Token == "" || resp.ExpiresIn <= 0 {
+		t.Fatalf("unexpected token response: %#v", resp)
+	}
+
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/v2/team1/app/manifests/latest", nil)
+		req.Header.Set("Authorization", "Bearer "+resp.Token)
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single directory lookup, got %d", calls)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPut, "/v2/team1/app/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token)
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected push to be rejected, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+		t.Fatalf("expected insufficient_scope challenge, got %q", rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func withTokenAuth(t *testing.T) {
+	t.Helper()
+	prevCfg := tokenCfg
+	tokenCfg = loadTokenConfig()
+	tokenCfg.Enabled = true
+	t.Cleanup(func() {
+		tokenCfg = prevCfg
+	})
+}
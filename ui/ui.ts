@@ -7,7 +7,14 @@ type NamespacePermission = {
   namespace: string;
   pull_only: boolean;
   delete_allowed: boolean;
+  capabilities?: string[];
+  roles?: string[];
   groups?: string[];
+  directories?: string[];
+  parent?: string;
+  personal?: boolean;
+  public?: boolean;
+  expires_at?: string;
 };
 
 type PermissionKind = "r" | "rw" | "rd" | "rwd";
@@ -82,17 +89,41 @@ type HistoryEntry = {
   const namespaces = Array.isArray(bootstrap.namespaces) ? bootstrap.namespaces : [];
   const permissions = Array.isArray(bootstrap.permissions) ? bootstrap.permissions : [];
   const permissionByNamespace = new Map<string, PermissionKind>();
-  const deleteAllowedByNamespace = new Map<string, boolean>();
+  const capabilitiesByNamespace = new Map<string, string[]>();
+  const rolesByNamespace = new Map<string, string[]>();
   const groupsByNamespace = new Map<string, string[]>();
+  const directoriesByNamespace = new Map<string, string[]>();
+  const parentByNamespace = new Map<string, string>();
+  const personalNamespaces = new Set<string>();
+  const publicNamespaces = new Set<string>();
+  const expiryByNamespace = new Map<string, string>();
   permissions.forEach((perm) => {
     if (!perm || typeof perm.namespace !== "string") {
       return;
     }
     permissionByNamespace.set(perm.namespace, permissionKindFromFlags(perm));
-    deleteAllowedByNamespace.set(perm.namespace, Boolean(perm.delete_allowed));
+    capabilitiesByNamespace.set(perm.namespace, capabilitiesFromPermission(perm));
+    if (Array.isArray(perm.roles) && perm.roles.length > 0) {
+      rolesByNamespace.set(perm.namespace, perm.roles);
+    }
     if (Array.isArray(perm.groups) && perm.groups.length > 0) {
       groupsByNamespace.set(perm.namespace, perm.groups);
     }
+    if (Array.isArray(perm.directories) && perm.directories.length > 0) {
+      directoriesByNamespace.set(perm.namespace, perm.directories);
+    }
+    if (typeof perm.parent === "string" && perm.parent !== "") {
+      parentByNamespace.set(perm.namespace, perm.parent);
+    }
+    if (perm.personal) {
+      personalNamespaces.add(perm.namespace);
+    }
+    if (perm.public) {
+      publicNamespaces.add(perm.namespace);
+    }
+    if (typeof perm.expires_at === "string" && perm.expires_at !== "") {
+      expiryByNamespace.set(perm.namespace, perm.expires_at);
+    }
   });
 
   const state: State = {
@@ -142,9 +173,33 @@ type HistoryEntry = {
     return "r";
   }
 
+  function capabilitiesFromPermission(perm: NamespacePermission): string[] {
+    if (Array.isArray(perm.capabilities)) {
+      return perm.capabilities;
+    }
+    const caps = ["pull"];
+    if (!perm.pull_only) {
+      caps.push("push");
+    }
+    if (perm.delete_allowed) {
+      caps.push("delete-tag", "delete-repo");
+    }
+    return caps;
+  }
+
+  function namespaceCan(namespace: string, capability: string): boolean {
+    const caps = capabilitiesByNamespace.get(namespace);
+    return Array.isArray(caps) && caps.includes(capability);
+  }
+
   function permissionBadge(namespace: string): string {
     const kind = permissionByNamespace.get(namespace) || "rw";
-    const label = permissionLabels[kind];
+    const roles = rolesByNamespace.get(namespace);
+    const caps = capabilitiesByNamespace.get(namespace);
+    let label = roles && roles.length > 0 ? roles.join(", ") : permissionLabels[kind];
+    if (caps && caps.length > 0) {
+      label += " (" + caps.join(", ") + ")";
+    }
     return (
       '<span class="perm perm-' +
       escapeHTML(kind) +
@@ -173,6 +228,51 @@ type HistoryEntry = {
     );
   }
 
+  function directoryBadge(namespace: string): string {
+    const directories = directoriesByNamespace.get(namespace);
+    if (!directories || directories.length === 0) {
+      return "";
+    }
+    const label = directories.join(", ");
+    return (
+      '<span class="directory" title="' +
+      escapeHTML("Directory: " + label) +
+      '">' +
+      escapeHTML(label) +
+      "</span>"
+    );
+  }
+
+  function personalBadge(namespace: string): string {
+    if (!personalNamespaces.has(namespace)) {
+      return "";
+    }
+    return '<span class="personal" title="Only you and admins can access this namespace">personal</span>';
+  }
+
+  function publicBadge(namespace: string): string {
+    if (!publicNamespaces.has(namespace)) {
+      return "";
+    }
+    return '<span class="public" title="Anyone can pull from this namespace">public</span>';
+  }
+
+  function expiryBadge(namespace: string): string {
+    const expiresAt = expiryByNamespace.get(namespace);
+    if (!expiresAt) {
+      return "";
+    }
+    const when = new Date(expiresAt);
+    const label = Number.isNaN(when.getTime()) ? expiresAt : when.toLocaleString();
+    return (
+      '<span class="temporary" title="' +
+      escapeHTML("Temporary access until " + label) +
+      '">until ' +
+      escapeHTML(label) +
+      "</span>"
+    );
+  }
+
   function clearRepoCaches(repo: string): void {
     delete state.tagsByRepo[repo];
     const prefix = repo + ":";
@@ -204,8 +304,7 @@ type HistoryEntry = {
   }
 
   function canDeleteRepo(repo: string): boolean {
-    const namespace = namespaceFromRepo(repo);
-    return deleteAllowedByNamespace.get(namespace) === true;
+    return namespaceCan(namespaceFromRepo(repo), "delete-tag");
   }
 
   function renderTagActions(repo: string, tag: string, expanded: boolean): string {
@@ -233,7 +332,17 @@ type HistoryEntry = {
       treeEl.innerHTML = '<div class="mono">No namespaces assigned.</div>';
       return;
     }
-    treeEl.innerHTML = namespaces
+    treeEl.innerHTML = renderNamespaces(childNamespaces(""));
+  }
+
+  // childNamespaces lists the namespaces directly nested under parent; ""
+  // returns the top level.
+  function childNamespaces(parent: string): string[] {
+    return namespaces.filter((ns) => (parentByNamespace.get(ns) || "") === parent);
+  }
+
+  function renderNamespaces(list: string[]): string {
+    return list
       .map((ns) => {
         const expanded = state.expandedNamespace === ns;
         const caret = expanded ? "&#9662;" : "&#9656;";
@@ -242,6 +351,11 @@ type HistoryEntry = {
         const repoMarkup = expanded
           ? '<div class="branch">' + renderRepos(ns, repos, repoLoading) + "</div>"
           : "";
+        const children = childNamespaces(ns);
+        const childMarkup =
+          children.length > 0 ? '<div class="branch">' + renderNamespaces(children) + "</div>" : "";
+        const parent = parentByNamespace.get(ns);
+        const label = parent ? repoLabel(parent, ns) : ns;
         return (
           '<button class="node' +
           (expanded ? " active" : "") +
@@ -253,11 +367,16 @@ type HistoryEntry = {
           "</span>" +
           permissionBadge(ns) +
           groupInfoBadge(ns) +
+          directoryBadge(ns) +
+          personalBadge(ns) +
+          publicBadge(ns) +
+          expiryBadge(ns) +
           "<span>" +
-          escapeHTML(ns) +
+          escapeHTML(label) +
           "</span>" +
           "</button>" +
-          repoMarkup
+          repoMarkup +
+          childMarkup
         );
       })
       .join("");
@@ -967,3 +1086,138 @@ type HistoryEntry = {
 
   renderTree();
 })();
+
+type PersonalToken = {
+  id: string;
+  name: string;
+  scopes: string[];
+  created_at: string;
+  expires_at: string;
+  last_used?: string;
+};
+
+(function initTokens() {
+  const form = document.getElementById("tokenForm") as HTMLFormElement | null;
+  const list = document.getElementById("tokenList");
+  const secret = document.getElementById("tokenSecret");
+  if (!form || !list || !secret) {
+    return;
+  }
+  const formEl = form;
+  const listEl = list;
+  const secretEl = secret;
+
+  function escapeHTML(value: string): string {
+    return String(value).replace(/[&<>"']/g, (ch) => {
+      const map: Record<string, string> = {
+        "&": "&amp;",
+        "<": "&lt;",
+        ">": "&gt;",
+        '"': "&quot;",
+        "'": "&#39;",
+      };
+      return map[ch] ?? ch;
+    });
+  }
+
+  function formatDate(value: string | undefined): string {
+    if (!value) {
+      return "never";
+    }
+    const date = new Date(value);
+    return Number.isNaN(date.getTime()) ? value : date.toLocaleString();
+  }
+
+  function renderTokens(tokens: PersonalToken[]): void {
+    if (tokens.length === 0) {
+      listEl.innerHTML = '<div class="leaf">No tokens yet.</div>';
+      return;
+    }
+    listEl.innerHTML = tokens
+      .map(
+        (token) =>
+          '<div class="token-row">' +
+          "<span>" +
+          escapeHTML(token.name) +
+          " · " +
+          escapeHTML(token.scopes.join(", ")) +
+          "</span>" +
+          "<span>expires " +
+          escapeHTML(formatDate(token.expires_at)) +
+          " · last used " +
+          escapeHTML(formatDate(token.last_used)) +
+          "</span>" +
+          '<button class="tag-delete" type="button" data-token-id="' +
+          escapeHTML(token.id) +
+          '">Revoke</button>' +
+          "</div>",
+      )
+      .join("");
+  }
+
+  async function loadTokens(): Promise<void> {
+    try {
+      const res = await fetch("/api/tokens");
+      if (!res.ok) {
+        listEl.textContent = "Unable to load tokens.";
+        return;
+      }
+      const data = await res.json();
+      renderTokens(Array.isArray(data.tokens) ? data.tokens : []);
+    } catch (err) {
+      listEl.textContent = "Unable to load tokens.";
+    }
+  }
+
+  formEl.addEventListener("submit", async (event) => {
+    event.preventDefault();
+    const data = new FormData(formEl);
+    const body = {
+      name: String(data.get("name") || ""),
+      duration: String(data.get("duration") || ""),
+      scopes: data.getAll("scope").map(String),
+    };
+    try {
+      const res = await fetch("/api/tokens", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(body),
+      });
+      const created = await res.json();
+      if (!res.ok) {
+        secretEl.textContent = created.detail || "Unable to create token.";
+        return;
+      }
+      secretEl.innerHTML =
+        '<div class="token-secret">Copy this token now, it is not shown again: ' +
+        escapeHTML(created.token) +
+        "</div>";
+      formEl.reset();
+      loadTokens();
+    } catch (err) {
+      secretEl.textContent = "Unable to create token.";
+    }
+  });
+
+  listEl.addEventListener("click", async (event) => {
+    const target = event.target as HTMLElement | null;
+    const button = target?.closest("[data-token-id]") as HTMLButtonElement | null;
+    if (!button) {
+      return;
+    }
+    const id = button.getAttribute("data-token-id") || "";
+    if (!id || !window.confirm("Revoke this token?")) {
+      return;
+    }
+    button.disabled = true;
+    const res = await fetch("/api/tokens/" + encodeURIComponent(id), { method: "DELETE" });
+    if (!res.ok) {
+      button.disabled = false;
+      button.textContent = "Failed";
+      return;
+    }
+    loadTokens();
+  });
+
+  loadTokens();
+})();
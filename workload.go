@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var workloadHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// workloadTrustFile is the on-disk format of WORKLOAD_IDENTITY_FILE.
+type workloadTrustFile struct {
+	Issuers  []workloadIssuer `json:"issuers"`
+	Policies []trustPolicy    `json:"policies"`
+}
+
+// workloadIssuer is a CI system whose job tokens are accepted. Its keys
+// come either from a JWKS URL or from a JWKS file.
+type workloadIssuer struct {
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	JWKSURL  string `json:"jwks_url"`
+	JWKSFile string `json:"jwks_file"`
+
+	keys *jwksCache
+}
+
+// trustPolicy grants a namespace to job tokens of one issuer whose claims
+// all match. Claim values are globs: * stays within a path segment and **
+// crosses them.
+type trustPolicy struct {
+	Name       string            `json:"name"`
+	Issuer     string            `json:"issuer"`
+	Claims     map[string]string `json:"claims"`
+	Namespace  string            `json:"namespace"`
+	Permission string            `json:"permission"`
+
+	claims map[string]*regexp.Regexp
+	grant  groupGrant
+}
+
+type workloadTrust struct {
+	issuers  map[string]*workloadIssuer
+	policies []trustPolicy
+}
+
+var workloadIdentity *workloadTrust
+
+func loadWorkloadTrust(path string) (*workloadTrust, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		return nil, fmt.Errorf("workload identity: %w", err)
+	}
+	var file workloadTrustFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("workload identity %s: %w", path, err)
+	}
+	trust, err := compileWorkloadTrust(file)
+	if err != nil {
+		return nil, fmt.Errorf("workload identity %s: %w", path, err)
+	}
+	return trust, nil
+}
+
+func compileWorkloadTrust(file workloadTrustFile) (*workloadTrust, error) {
+	trust := &workloadTrust{issuers: map[string]*workloadIssuer{}}
+	for i := range file.Issuers {
+		iss := file.Issuers[i]
+		iss.Issuer = strings.TrimSuffix(strings.TrimSpace(iss.Issuer), "/")
+		if iss.Issuer == "" || iss.Audience == "" {
+			return nil, fmt.Errorf("issuer %d needs an issuer and an audience", i)
+		}
+		if _, dup := trust.issuers[iss.Issuer]; dup {
+			return nil, fmt.Errorf("issuer %s is listed twice", iss.Issuer)
+		}
+		switch {
+		case iss.JWKSFile != "" && iss.JWKSURL != "":
+			return nil, fmt.Errorf("issuer %s: set jwks_url or jwks_file, not both", iss.Issuer)
+		case iss.JWKSFile != "":
+			keys, err := loadJWKSFile(iss.JWKSFile)
+			if err != nil {
+				return nil, err
+			}
+			iss.keys = keys
+		case iss.JWKSURL != "":
+			iss.keys = newJWKSCache(iss.JWKSURL, workloadHTTPClient)
+		default:
+			return nil, fmt.Errorf("issuer %s needs jwks_url or jwks_file", iss.Issuer)
+		}
+		trust.issuers[iss.Issuer] = &iss
+	}
+
+	for i, policy := range file.Policies {
+		policy.Issuer = strings.TrimSuffix(strings.TrimSpace(policy.Issuer), "/")
+		if _, ok := trust.issuers[policy.Issuer]; !ok {
+			return nil, fmt.Errorf("policy %d: unknown issuer %q", i, policy.Issuer)
+		}
+		if strings.TrimSpace(policy.Name) == "" {
+			return nil, fmt.Errorf("policy %d needs a name", i)
+		}
+		if len(policy.Claims) == 0 {
+			return nil, fmt.Errorf("policy %s needs at least one claim condition", policy.Name)
+		}
+		if strings.TrimSpace(policy.Namespace) == "" {
+			return nil, fmt.Errorf("policy %s needs a namespace", policy.Name)
+		}
+		grant, err := grantFromPermission(policy.Namespace, policy.Permission)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", policy.Name, err)
+		}
+		if err := reservedNamespaceError(grant.namespace); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", policy.Name, err)
+		}
+		policy.grant = grant
+		policy.claims = make(map[string]*regexp.Regexp, len(policy.Claims))
+		for name, glob := range policy.Claims {
+			policy.claims[name] = globRegexp(glob)
+		}
+		trust.policies = append(trust.policies, policy)
+	}
+	return trust, nil
+}
+
+// isWorkloadCredential reports whether a registry password looks like a
+// signed JWT rather than a directory password.
+func isWorkloadCredential(password string) bool {
+	return workloadIdentity != nil && strings.HasPrefix(password, "eyJ") && strings.Count(password, ".") == 2
+}
+
+var errWorkloadToken = errors.New("invalid workload identity token")
+
+// workloadUserPrefix starts the user name of every CI job, so a job can
+// never pass for a directory user of the same name.
+const workloadUserPrefix = "workload:"
+
+// workloadAuth authenticates a CI job by its identity token. The username
+// is not checked; the user name is workload:<issuer>:<subject>.
+func workloadAuth(ctx context.Context, token string) (*User, []Access, error) {
+	trust := workloadIdentity
+	if trust == nil {
+		return nil, nil, errWorkloadToken
+	}
+	claims, iss, err := trust.verify(ctx, token, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	access := trust.access(iss, claims)
+	if len(access) == 0 {
+		return nil, nil, fmt.Errorf("%w: no trust policy matches", errWorkloadToken)
+	}
+	name := workloadUserPrefix + iss.Issuer
+	if subject, _ := claims["sub"].(string); subject != "" {
+		name += ":" + subject
+	}
+	first := access[0]
+	return &User{
+		Name:          name,
+		Group:         first.Group,
+		Namespace:     first.Namespace,
+		PullOnly:      first.PullOnly,
+		DeleteAllowed: first.DeleteAllowed,
+	}, access, nil
+}
+
+// verify checks the signature, issuer, audience and lifetime of a job
+// token and returns its claims.
+func (w *workloadTrust) verify(ctx context.Context, token string, now time.Time) (map[string]any, *workloadIssuer, error) {
+	var unverified struct {
+		Issuer string `json:"iss"`
+	}
+	if err := decodeJWTPayload(token, &unverified); err != nil {
+		return nil, nil, errWorkloadToken
+	}
+	iss, ok := w.issuers[strings.TrimSuffix(unverified.Issuer, "/")]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unknown issuer %q", errWorkloadToken, unverified.Issuer)
+	}
+
+	var claims map[string]any
+	if err := verifySignedJWT(token, iss.keys.keyFor(ctx), &claims); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errWorkloadToken, err)
+	}
+	if got, _ := claims["iss"].(string); strings.TrimSuffix(got, "/") != iss.Issuer {
+		return nil, nil, errWorkloadToken
+	}
+	if !containsString(claimStrings(claims, "aud"), iss.Audience) {
+		return nil, nil, fmt.Errorf("%w: audience mismatch", errWorkloadToken)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Unix() >= int64(exp) {
+		return nil, nil, fmt.Errorf("%w: expired", errWorkloadToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(tokenClockSkew).Unix() < int64(nbf) {
+		return nil, nil, fmt.Errorf("%w: not valid yet", errWorkloadToken)
+	}
+	return claims, iss, nil
+}
+
+// access returns one grant per trust policy of iss that the claims
+// satisfy.
+func (w *workloadTrust) access(iss *workloadIssuer, claims map[string]any) []Access {
+	var access []Access
+	for _, policy := range w.policies {
+		if policy.Issuer != iss.Issuer || !policy.matches(claims) {
+			continue
+		}
+		access = append(access, Access{
+			Group:         "workload:" + policy.Name,
+			Namespace:     policy.grant.namespace,
+			PullOnly:      policy.grant.pullOnly,
+			DeleteAllowed: policy.grant.deleteAllowed,
+			Role:          policy.grant.role,
+		})
+	}
+	return access
+}
+
+// matches requires every claim condition to hold. Only string, number and
+// boolean claims can match.
+func (p trustPolicy) matches(claims map[string]any) bool {
+	for name, re := range p.claims {
+		var value string
+		switch v := claimValue(claims, name).(type) {
+		case string:
+			value = v
+		case float64, bool:
+			value = fmt.Sprint(v)
+		default:
+			return false
+		}
+		if !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
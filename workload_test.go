@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withWorkloadIdentity(t *testing.T, file workloadTrustFile) {
+	t.Helper()
+	trust, err := compileWorkloadTrust(file)
+	if err != nil {
+		t.Fatalf("compile trust: %v", err)
+	}
+	prev := workloadIdentity
+	workloadIdentity = trust
+	t.Cleanup(func() {
+		workloadIdentity = prev
+	})
+}
+
+func ciTrust(issuer string) workloadTrustFile {
+	return workloadTrustFile{
+		Issuers: []workloadIssuer{{Issuer: issuer, Audience: "container-vault", JWKSURL: issuer + "/jwks"}},
+		Policies: []trustPolicy{
+			{Name: "app-main", Issuer: issuer, Claims: map[string]string{"repository": "team1/app", "ref": "refs/heads/main"}, Namespace: "team1", Permission: "rw"},
+			{Name: "app-any", Issuer: issuer, Claims: map[string]string{"repository": "team1/*"}, Namespace: "team1", Permission: "r"},
+			{Name: "prod", Issuer: issuer, Claims: map[string]string{"environment": "production", "repository": "team1/**"}, Namespace: "team1-prod", Permission: "rw"},
+		},
+	}
+}
+
+func ciClaims(idp *fakeIdP, extra map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":        idp.server.URL,
+		"aud":        "container-vault",
+		"sub":        "repo:team1/app:ref:refs/heads/main",
+		"exp":        time.Now().Add(5 * time.Minute).Unix(),
+		"repository": "team1/app",
+		"ref":        "refs/heads/main",
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestWorkloadAuthPolicies(t *testing.T) {
+	idp := newFakeIdP(t)
+	withWorkloadIdentity(t, ciTrust(idp.server.URL))
+
+	user, access, err := workloadAuth(context.Background(), idp.sign(t, ciClaims(idp, nil)))
+	if err != nil {
+		t.Fatalf("workload auth: %v", err)
+	}
+	if user.Name != "workload:"+idp.server.URL+":repo:team1/app:ref:refs/heads/main" || !namespaceCan(access, "team1", capPush) || namespaceCan(access, "team1-prod", capPull) {
+		t.Fatalf("expected push to team1 only, got %+v %+v", user, access)
+	}
+
+	_, access, err = workloadAuth(context.Background(), idp.sign(t, ciClaims(idp, map[string]any{"ref": "refs/heads/feature"})))
+	if err != nil || !namespaceCan(access, "team1", capPull) || namespaceCan(access, "team1", capPush) {
+		t.Fatalf("expected a feature branch to pull only, got %+v %v", access, err)
+	}
+
+	_, access, err = workloadAuth(context.Background(), idp.sign(t, ciClaims(idp, map[string]any{"repository": "team1/sub/app", "ref": "refs/tags/v1", "environment": "production"})))
+	if err != nil || strings.Join(namespacesFromAccess(access), ",") != "team1-prod" {
+		t.Fatalf("expected the production policy only, got %+v %v", access, err)
+	}
+}
+
+func TestWorkloadAuthRejects(t *testing.T) {
+	idp := newFakeIdP(t)
+	other := newFakeIdP(t)
+	withWorkloadIdentity(t, ciTrust(idp.server.URL))
+
+	tests := map[string]string{
+		"no matching policy": idp.sign(t, ciClaims(idp, map[string]any{"repository": "team2/app"})),
+		"wrong audience":     idp.sign(t, ciClaims(idp, map[string]any{"aud": "someone-else"})),
+		"expired":            idp.sign(t, ciClaims(idp, map[string]any{"exp": time.Now().Add(-time.Minute).Unix()})),
+		"not yet valid":      idp.sign(t, ciClaims(idp, map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"unknown issuer":     other.sign(t, ciClaims(other, nil)),
+		"forged signature":   other.sign(t, ciClaims(idp, nil)),
+		"list claim":         idp.sign(t, ciClaims(idp, map[string]any{"repository": []string{"team1/app"}})),
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := workloadAuth(context.Background(), token); err == nil {
+				t.Fatalf("expected the token to be refused")
+			}
+		})
+	}
+}
+
+func TestCvRouterWorkloadIdentity(t *testing.T) {
+	idp := newFakeIdP(t)
+	withWorkloadIdentity(t, ciTrust(idp.server.URL))
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer cleanup()
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		t.Fatalf("job tokens must not reach the directory")
+		return nil, nil, nil
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+
+	mainToken := idp.sign(t, ciClaims(idp, nil))
+	feature := idp.sign(t, ciClaims(idp, map[string]any{"ref": "refs/heads/feature"}))
+	router := cvRouter()
+	tests := []struct {
+		method string
+		token  string
+		want   int
+	}{
+		{http.MethodPut, mainToken, http.StatusOK},
+		{http.MethodGet, feature, http.StatusOK},
+		{http.MethodPut, feature, http.StatusForbidden},
+		{http.MethodGet, mainToken[:len(mainToken)-4] + "AAAA", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, "/v2/team1/app/manifests/latest", nil)
+		req.SetBasicAuth("ci", tt.token)
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s: expected %d, got %d", tt.method, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestWorkloadJWKSFile(t *testing.T) {
+	idp := newFakeIdP(t)
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "test",
+		"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatalf("write jwks: %v", err)
+	}
+	idp.server.Close()
+
+	file := ciTrust(idp.server.URL)
+	file.Issuers[0].JWKSURL = ""
+	file.Issuers[0].JWKSFile = path
+	withWorkloadIdentity(t, file)
+	if _, _, err := workloadAuth(context.Background(), idp.sign(t, ciClaims(idp, nil))); err != nil {
+		t.Fatalf("expected the file key set to verify the token: %v", err)
+	}
+}
+
+func TestLoadWorkloadTrustRejects(t *testing.T) {
+	withPersonalNamespaces(t, "u-")
+	issuer := workloadIssuer{Issuer: "https://ci.test", Audience: "container-vault", JWKSURL: "https://ci.test/jwks"}
+	policy := trustPolicy{Name: "p", Issuer: "https://ci.test", Claims: map[string]string{"repository": "team1/app"}, Namespace: "team1", Permission: "rw"}
+	tests := map[string]workloadTrustFile{
+		"no audience":       {Issuers: []workloadIssuer{{Issuer: "https://ci.test", JWKSURL: "https://ci.test/jwks"}}},
+		"no keys":           {Issuers: []workloadIssuer{{Issuer: "https://ci.test", Audience: "cv"}}},
+		"duplicate":         {Issuers: []workloadIssuer{issuer, issuer}},
+		"unknown issuer":    {Issuers: []workloadIssuer{issuer}, Policies: []trustPolicy{{Name: "p", Issuer: "https://other.test", Claims: policy.Claims, Namespace: "team1", Permission: "r"}}},
+		"no claims":         {Issuers: []workloadIssuer{issuer}, Policies: []trustPolicy{{Name: "p", Issuer: "https://ci.test", Namespace: "team1", Permission: "r"}}},
+		"bad permission":    {Issuers: []workloadIssuer{issuer}, Policies: []trustPolicy{{Name: "p", Issuer: "https://ci.test", Claims: policy.Claims, Namespace: "team1", Permission: "owner"}}},
+		"missing jwks":      {Issuers: []workloadIssuer{{Issuer: "https://ci.test", Audience: "cv", JWKSFile: "/does/not/exist"}}},
+		"missing namespace": {Issuers: []workloadIssuer{issuer}, Policies: []trustPolicy{{Name: "p", Issuer: "https://ci.test", Claims: policy.Claims, Permission: "r"}}},
+		"personal space":    {Issuers: []workloadIssuer{issuer}, Policies: []trustPolicy{{Name: "p", Issuer: "https://ci.test", Claims: policy.Claims, Namespace: "u-alice", Permission: "r"}}},
+	}
+	for name, file := range tests {
+		if _, err := compileWorkloadTrust(file); err == nil {
+			t.Fatalf("%s: expected the configuration to be refused", name)
+		}
+	}
+	if _, err := compileWorkloadTrust(workloadTrustFile{Issuers: []workloadIssuer{issuer}, Policies: []trustPolicy{policy}}); err != nil {
+		t.Fatalf("expected a valid configuration: %v", err)
+	}
+	if trust, err := loadWorkloadTrust(""); err != nil || trust != nil {
+		t.Fatalf("expected workload identity to be off without a file")
+	}
+}